@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/slim-bean/leafbus/pkg/store"
+)
+
+func main() {
+	parquetDir := flag.String("parquet-dir", "", "Base directory of the parquet archive (required)")
+	duckdbPath := flag.String("duckdb-path", "", "DuckDB file checked for rows which were never exported, defaults to leafbus.duckdb in parquet-dir")
+	tables := flag.String("tables", "status,runtime", "Comma separated archive directories to check")
+	minGap := flag.Duration("min-gap", 2*time.Hour, "Report gaps between partitions at least this long, 0 disables gap reports")
+	rebuildManifests := flag.Bool("rebuild-manifests", false, "Rewrite every manifest from the files on disk")
+	dedupe := flag.Bool("dedupe", false, "Merge the files of partitions with duplicate rows, keeping each row once")
+	exportOrphans := flag.Bool("export-orphans", false, "Export the hours still in the DuckDB file to parquet")
+	flag.Parse()
+
+	if *parquetDir == "" {
+		log.Fatal("parquet-dir is required")
+	}
+	if *duckdbPath == "" {
+		*duckdbPath = filepath.Join(*parquetDir, "leafbus.duckdb")
+	}
+	var dirNames []string
+	for _, name := range strings.Split(*tables, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			dirNames = append(dirNames, name)
+		}
+	}
+
+	// Repairs which change the archive must not run while leafbus is writing to it
+	if *exportOrphans {
+		writer, err := store.NewWriter(*parquetDir, *duckdbPath)
+		if err != nil {
+			log.Fatal("Failed to open duckdb, is leafbus still running? ", err)
+		}
+		writer.Close()
+		log.Println("Exported the hours left in", *duckdbPath)
+	}
+
+	archive, err := store.OpenArchive(*parquetDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer archive.Close()
+	if *dedupe {
+		removed, err := archive.Dedupe(dirNames)
+		if err != nil {
+			log.Fatal("Failed to dedupe: ", err)
+		}
+		log.Printf("Removed %d duplicate rows\n", removed)
+	}
+	if *rebuildManifests {
+		rebuilt, err := archive.RebuildManifests(dirNames)
+		if err != nil {
+			log.Fatal("Failed to rebuild manifests: ", err)
+		}
+		log.Printf("Rebuilt %d manifests\n", rebuilt)
+	}
+
+	ctx := context.Background()
+	report, err := archive.Check(ctx, dirNames, *minGap)
+	if err != nil {
+		log.Fatal(err)
+	}
+	problems := report.Problems
+	if _, err := os.Stat(*duckdbPath); err == nil {
+		orphans, err := store.CheckOrphans(ctx, *duckdbPath, dirNames)
+		if err != nil {
+			log.Println("Skipping the orphan row check, the duckdb file can't be opened while leafbus is running:", err)
+		}
+		problems = append(problems, orphans...)
+	}
+
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	fmt.Printf("%d partitions, %d files, %d rows, %d problems\n", report.Partitions, report.Files, report.Rows, len(problems))
+	for _, p := range problems {
+		// Gaps are only informational, the car is not always running
+		if p.Kind != store.ProblemGap {
+			os.Exit(1)
+		}
+	}
+}
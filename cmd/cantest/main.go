@@ -8,11 +8,13 @@ import (
 	"os"
 	"os/signal"
 	"strconv"
-	"unsafe"
+	"strings"
 
 	"github.com/brutella/can"
 	"github.com/gdamore/tcell"
 	"github.com/rivo/tview"
+
+	"github.com/slim-bean/leafbus/pkg/decode"
 )
 
 const (
@@ -112,18 +114,20 @@ func main() {
 }
 
 type Handler struct {
-	app   *tview.Application
-	table *tview.Table
-	text  *tview.TextView
-	id    uint32
+	app     *tview.Application
+	table   *tview.Table
+	text    *tview.TextView
+	id      uint32
+	signals []*decode.Signal
 }
 
 func NewHandler(app *tview.Application, table *tview.Table, text *tview.TextView, id uint32) *Handler {
 	return &Handler{
-		app:   app,
-		table: table,
-		text:  text,
-		id:    id,
+		app:     app,
+		table:   table,
+		text:    text,
+		id:      id,
+		signals: decode.NewDecoder(decode.Leaf).Signals(id),
 	}
 }
 
@@ -148,118 +152,11 @@ func (h *Handler) Handle(frame can.Frame) {
 			}
 
 			//Calcs
-
-			//  Target Brake Pedal can1 0x1CB
-			//brake := (uint16(frame.Data[2]) << 2) | (uint16(frame.Data[3]) >> 6)
-			//h.text.SetText(fmt.Sprintf("Brake Pedal: %v", brake))
-
-			//  Steering can1 0x002
-			//steering := int16(uint16(frame.Data[1]) << 8 | uint16(frame.Data[0]))
-			//h.text.SetText(fmt.Sprintf("Steering: %v", steering))
-
-			//  Throttle pos, motor amps can1 0x180
-			// throttle max == 800, motoramps always positive
-			//motorAmps := (uint16(frame.Data[2]) << 4) | (uint16(frame.Data[3]) >> 4)
-			//throttle := (uint16(frame.Data[5]) << 2) | (uint16(frame.Data[6]) >> 6)
-			//h.text.SetText(fmt.Sprintf("Gas Pedal: %v\nMotorA: %v", throttle, motorAmps))
-
-			//  Vehicle Speed can1 0x280
-			//speed := float64(uint16(frame.Data[4]) << 8 | uint16(frame.Data[5]))
-			//speed = speed * 0.0062
-			//h.text.SetText(fmt.Sprintf("Speed: %v", speed))
-
-			//  friction Brake pressure Pedal can1 0x292
-			//brake := frame.Data[6]
-			//h.text.SetText(fmt.Sprintf("Brake: %v", brake))
-
-			//  turn signal can1 358
-			//turnL := frame.Data[2] & 0b00000010 == 0b00000010
-			//turnR := frame.Data[2] & 0b00000100 == 0b00000100
-			//h.text.SetText(fmt.Sprintf("TurnR: %v\nTurnL: %v",turnR, turnL))
-
-			//  Climate Control Power can1 510
-			//ccPower := float64(frame.Data[3] >> 1 & 0b00111111)
-			//ccPower = ccPower * 0.25
-			//h.text.SetText(fmt.Sprintf("Clim P: %v", ccPower))
-
-			//  GIDS can1 5B3
-			//gid := uint16(frame.Data[4] & 0b00000001) << 8 | uint16(frame.Data[5])
-			//h.text.SetText(fmt.Sprintf("GID: %v", gid))
-
-			//  Odometer can1 5C5
-			//odo := uint32(frame.Data[1]) << 16 | uint32(frame.Data[2]) << 8 | uint32(frame.Data[3])
-			//h.text.SetText(fmt.Sprintf("Odo: %v", odo))
-
-			// Headlights can1 625
-			//parkL := frame.Data[1] & 0b01000000 == 0b01000000
-			//lowBeam := frame.Data[1] & 0b00100000 == 0b00100000
-			//highBeam := frame.Data[1] & 0b00010000 == 0b00010000
-			//h.text.SetText(fmt.Sprintf("Park: %v\nLow: %v\nHigh: %v", parkL, lowBeam, highBeam))
-
-			//  battery voltage can0 1DB
-			//currVoltage := float64((uint16(frame.Data[2]) << 2) | (uint16(frame.Data[3]&0b11000000) >> 6))
-			//currVoltage = currVoltage * 0.5
-			//h.text.SetText(fmt.Sprintf("Battery V: %v", currVoltage))
-
-			// Even though the doc says the LSB for current is 0.5 it seems to reflect the actual charger current
-			// more accurately when I don't ignore the last bit
-			//var battCurrent int16
-			//if frame.Data[0]&0b10000000 == 0b10000000 {
-			//	battCurrent = int16((uint16(frame.Data[0]) << 3) | 0b1111100000000000 | uint16(frame.Data[1]>>6))
-			//} else {
-			//	battCurrent = int16((uint16(frame.Data[0])<<3)&0b0000011111111111 | uint16(frame.Data[1]>>6))
-			//}
-			//h.text.SetText(fmt.Sprintf("Battery Amps: %v", battCurrent))
-			//var motorAmps int16
-			//if frame.Data[2]&0b00000100 == 0b00000100 {
-			//	motorAmps = int16(((uint16(frame.Data[2]&0b00000111) << 8) | 0b1111100000000000) | uint16(frame.Data[3]))
-			//} else {
-			//	motorAmps = int16(((uint16(frame.Data[2]&0b00000111) << 8) & 0b0000011111111111) | uint16(frame.Data[3]))
-			//}
-			//motorSpeed := int16(uint16(frame.Data[4])<<8 | uint16(frame.Data[5]))
-			//h.text.SetText(fmt.Sprintf("Motor Amps: %v\nMotor Speed: %v\nA: %v", motorAmps, motorSpeed, strconv.FormatInt(int64(motorAmps), 2)))
+			var calcs strings.Builder
+			for _, sig := range h.signals {
+				fmt.Fprintf(&calcs, "%s: %v %s\n", sig.Name, sig.Value(frame.Data), sig.Unit)
+			}
+			h.text.SetText(calcs.String())
 		})
 	}
-	//switch frame.ID {
-	//case 0x55B:
-	//
-	//	//currCharge := (uint16(frame.Data[0]) << 2) | (uint16(frame.Data[1]) >> 6)
-	//
-	//case 0x1DA:
-	//	//var motorAmps, motorSpd int16
-	//	//if frame.Data[2] & 0b00001000 == 0b00001000 {
-	//	//	motorAmps = int16((uint16(frame.Data[2]&0b00001111) << 8)|0b1111000000000000 | (uint16(frame.Data[3])))
-	//	//} else {
-	//	//	motorAmps = int16((uint16(frame.Data[2]&0b00001111) << 8)&0b0000111111111111 | (uint16(frame.Data[3])))
-	//	//}
-	//	//
-	//	////
-	//	//motorSpd = int16((uint16(frame.Data[4]) << 8) | (uint16(frame.Data[5])))
-	//	////
-	//	//fmt.Println("Amps", motorAmps, "Speed", motorSpd)
-	//
-	//case 0x1DB:
-	//
-	//	var battCurrent int16
-	//	if frame.Data[0]&0b10000000 == 0b10000000 {
-	//		battCurrent = int16((uint16(frame.Data[0]) << 3) | 0b1111100000000000 | uint16(frame.Data[1]>>6))
-	//	} else {
-	//		battCurrent = int16((uint16(frame.Data[0])<<3)&0b0000011111111111 | uint16(frame.Data[1]>>6))
-	//	}
-	//	currVoltage := (uint16(frame.Data[2]) << 1) | (uint16(frame.Data[3]&0b11000000) >> 7)
-	//	//
-	//	fmt.Println("0", strconv.FormatUint(uint64(frame.Data[0]), 2), "1", strconv.FormatUint(uint64(frame.Data[1]), 2), "BattAmps", float64(battCurrent), "0", strconv.FormatUint(uint64(frame.Data[2]), 2), "1", strconv.FormatUint(uint64(frame.Data[3]), 2), "BattVolts", float64(currVoltage))
-	//
-	//	//fmt.Println("0", strconv.FormatUint(uint64(frame.Data[0]), 2),"1", strconv.FormatUint(uint64(frame.Data[1]), 2))
-	//
-	//	//fmt.Println("0", frame.Data[0], "1", frame.Data[1])
-	//	//v := (uint16(frame.Data[0]) << 3) | (uint16(frame.Data[1]&0b11100000) >> 5)
-	//	////signed := *(*int16)(unsafe.Pointer(&v))
-	//	//fmt.Println(strconv.FormatInt(int64(int16convert(v)), 2), int16convert(v))
-	//
-	//}
-}
-
-func int16convert(f uint16) int16 {
-	return *(*int16)(unsafe.Pointer(&f))
 }
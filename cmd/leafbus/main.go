@@ -2,36 +2,54 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"log"
-	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/brutella/can"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"github.com/slim-bean/leafbus/pkg/canbus"
+	"github.com/slim-bean/leafbus/pkg/canlog"
 	"github.com/slim-bean/leafbus/pkg/charge"
+	"github.com/slim-bean/leafbus/pkg/decode"
+	"github.com/slim-bean/leafbus/pkg/events"
+	"github.com/slim-bean/leafbus/pkg/export"
 	"github.com/slim-bean/leafbus/pkg/gps"
+	"github.com/slim-bean/leafbus/pkg/grafana"
 	"github.com/slim-bean/leafbus/pkg/heater"
 	"github.com/slim-bean/leafbus/pkg/hydra"
+	"github.com/slim-bean/leafbus/pkg/leafdiag"
+	"github.com/slim-bean/leafbus/pkg/lokiapi"
 	"github.com/slim-bean/leafbus/pkg/ms4525"
+	"github.com/slim-bean/leafbus/pkg/promapi"
 	"github.com/slim-bean/leafbus/pkg/push"
+	"github.com/slim-bean/leafbus/pkg/s3"
+	"github.com/slim-bean/leafbus/pkg/savedquery"
 	"github.com/slim-bean/leafbus/pkg/statusui"
 	"github.com/slim-bean/leafbus/pkg/store"
 	"github.com/slim-bean/leafbus/pkg/stream"
+	"github.com/slim-bean/leafbus/pkg/trip"
 	"github.com/slim-bean/leafbus/pkg/wattcycle"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrate(os.Args[2:])
+		return
+	}
 	parquetDir := flag.String("parquet-dir", "", "Base directory for parquet output (required)")
 	duckdbPath := flag.String("duckdb-path", "", "Optional path to the duckdb database file")
 	wattcycleAddress := flag.String("wattcycle-address", wattcycle.DefaultAddress, "BLE address for the WattCycle 12V battery")
@@ -40,27 +58,61 @@ func main() {
 	heaterOnBelow := flag.Float64("heater-on-below", 35.0, "Heater ON when min temp <= value (F)")
 	heaterOffAbove := flag.Float64("heater-off-above", 37.0, "Heater OFF when min temp >= value (F)")
 	heaterActiveHigh := flag.Bool("heater-active-high", true, "Set GPIO high to turn heater on")
+	dbcPath := flag.String("dbc", "", "Optional DBC file with additional CAN signal definitions")
+	dbcReplace := flag.Bool("dbc-replace", false, "Decode frames only with the DBC file instead of alongside the built-in Leaf signals")
+	rawFrames := flag.Bool("raw-frames", false, "Store raw CAN frames in the can_frames table")
+	rawFrameIDs := flag.String("raw-frame-ids", "", "Comma separated hex frame IDs to store when raw-frames is enabled, all frames if empty")
+	canBuses := flag.String("can-buses", "can0,can1", "Comma separated CAN interfaces (e.g. vcan0), the charge monitor uses the first one")
+	diagEnabled := flag.Bool("diag", false, "Poll the LBC and VCM over ISO-TP/UDS while the key is on")
+	diagBus := flag.String("diag-bus", "", "CAN bus the LBC and VCM are polled on, defaults to the first of can-buses")
+	diagInterval := flag.Duration("diag-interval", leafdiag.DefaultInterval, "Interval between diagnostic polls")
+	backfillTrips := flag.Bool("backfill-trips", false, "Rebuild trips from the key on/off history in runtime_metrics at startup")
+	candumpDir := flag.String("candump-dir", "", "Record frames from all buses to rotating candump -l files in this directory")
+	candumpMaxMB := flag.Int("candump-max-mb", 64, "Rotate to a new candump file after this many megabytes")
+	candumpMaxFiles := flag.Int("candump-max-files", 0, "Remove the oldest candump files beyond this count, 0 keeps all files")
+	replayPath := flag.String("replay", "", "Replay a candump or Vector ASC (.asc) log instead of reading the CAN interfaces")
+	replaySpeed := flag.Float64("replay-speed", 1.0, "Replay speed factor, 0 replays as fast as possible")
+	compactInterval := flag.Duration("compact-interval", time.Hour, "Interval between parquet compactions, 0 disables compaction and retention")
+	compactDailyAfter := flag.Duration("compact-daily-after", 0, "Roll the hour partitions of a day into one daily file once the day is this old, 0 keeps hourly files")
+	retentionAge := flag.String("retention", "", "Comma separated table=age limits for the parquet archive, e.g. frames=720h,runtime=8760h")
+	retentionMB := flag.String("retention-mb", "", "Comma separated table=megabytes size limits for the parquet archive, e.g. frames=2048")
+	s3Endpoint := flag.String("s3-endpoint", "", "Upload finished parquet partitions to this S3-compatible endpoint, e.g. http://nas.local:9000")
+	s3Bucket := flag.String("s3-bucket", "", "Bucket the parquet archive is uploaded to")
+	s3Region := flag.String("s3-region", "us-east-1", "Region of the S3 bucket")
+	s3Prefix := flag.String("s3-prefix", "", "Prefix of the uploaded object keys")
+	s3SSID := flag.String("s3-ssid", "", "Only upload while connected to this Wi-Fi network")
+	s3Interval := flag.Duration("s3-interval", 15*time.Minute, "Interval between parquet uploads")
+	s3DeleteAfter := flag.String("s3-delete-after", "", "Comma separated table=age limits after which uploaded partitions are removed locally, e.g. frames=24h")
+	exportTimeout := flag.Duration("query-export-timeout", 5*time.Minute, "Timeout of /query requests streaming CSV, NDJSON or Arrow results")
+	queryThreads := flag.Int("query-threads", 2, "Threads used by /query and the other query APIs")
+	queryMemory := flag.String("query-memory", "512MB", "Memory limit of /query and the other query APIs, larger results spill to disk")
+	queryTempSize := flag.String("query-temp-size", "2GB", "Size limit of the spill files of /query and the other query APIs, queries which need more fail")
+	savedQueryDir := flag.String("saved-query-dir", "", "Directory of .sql files served as /query/{name}")
+	savedQueryTTL := flag.Duration("saved-query-cache-ttl", 30*time.Second, "How long saved query results are cached per parameters, 0 disables the cache")
 	flag.Parse()
 
-	log.Println("Finding interface can0")
-	iface0, err := net.InterfaceByName("can0")
-	if err != nil {
-		log.Fatalf("Could not find network interface %s (%v)", "can0", err)
-	}
-	log.Println("Opening interface can0")
-	conn0, err := can.NewReadWriteCloserForInterface(iface0)
+	rawIDs, err := parseFrameIDs(*rawFrameIDs)
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Println("Finding interface can1")
-	iface1, err := net.InterfaceByName("can1")
-	if err != nil {
-		log.Fatalf("Could not find network interface %s (%v)", "can1", err)
-	}
-	log.Println("Opening interface can1")
-	conn1, err := can.NewReadWriteCloserForInterface(iface1)
-	if err != nil {
-		log.Fatal(err)
+
+	busNames := splitList(*canBuses)
+	var sources []canbus.Source
+	if *replayPath != "" {
+		log.Println("Replaying CAN log", *replayPath)
+		sources, err = canbus.OpenReplay(*replayPath, *replaySpeed, busNames)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		for _, name := range busNames {
+			log.Println("Opening interface", name)
+			source, err := canbus.NewSocketCAN(name)
+			if err != nil {
+				log.Fatal(err)
+			}
+			sources = append(sources, source)
+		}
 	}
 
 	log.Println("Creating new Charge Monitor")
@@ -78,12 +130,80 @@ func main() {
 		log.Fatal(err)
 	}
 	defer writer.Close()
+	writer.SetQueryLimits(store.QueryLimits{Threads: *queryThreads, MemoryLimit: *queryMemory, MaxTempSize: *queryTempSize})
+	if *compactInterval > 0 {
+		retention, err := parseRetention(*retentionAge, *retentionMB)
+		if err != nil {
+			log.Fatal(err)
+		}
+		compactor := store.NewCompactor(writer, store.CompactConfig{
+			Interval:   *compactInterval,
+			DailyAfter: *compactDailyAfter,
+			Retention:  retention,
+		})
+		defer compactor.Close()
+	}
+	if *s3Endpoint != "" {
+		deleteAfter, err := parseRetention(*s3DeleteAfter, "")
+		if err != nil {
+			log.Fatal(err)
+		}
+		client, err := s3.NewClient(s3.Config{
+			Endpoint:  *s3Endpoint,
+			Region:    *s3Region,
+			Bucket:    *s3Bucket,
+			AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg := store.UploadConfig{
+			Interval:    *s3Interval,
+			Prefix:      *s3Prefix,
+			SSID:        *s3SSID,
+			DeleteAfter: make(map[string]time.Duration),
+		}
+		for table, r := range deleteAfter {
+			cfg.DeleteAfter[table] = r.MaxAge
+		}
+		uploader := store.NewUploader(writer, client, cfg)
+		defer uploader.Close()
+	}
 
 	handler, err := push.NewHandler(writer)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if *backfillTrips {
+		go func() {
+			log.Println("Backfilling trips from key history")
+			count, err := writer.BackfillTrips(context.Background())
+			if err != nil {
+				log.Println("Failed to backfill trips:", err)
+				return
+			}
+			log.Printf("Backfilled %d trips\n", count)
+		}()
+	}
 	chargeMonitor.SetHandler(handler)
+	if *dbcPath != "" {
+		log.Println("Loading DBC file", *dbcPath)
+		signals, err := decode.LoadDBC(*dbcPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *dbcReplace {
+			handler.SetDecoder(decode.NewDecoder(signals))
+		} else {
+			decoder := decode.NewDecoder(decode.Leaf)
+			decoder.Add(signals...)
+			handler.SetDecoder(decoder)
+		}
+		log.Printf("Loaded %d signals from DBC file\n", len(signals))
+	} else if *dbcReplace {
+		log.Fatal("dbc-replace requires dbc")
+	}
 
 	log.Println("Creating GPS")
 	gps, err := gps.NewGPS(handler, "/dev/ttyAMA3")
@@ -99,6 +219,7 @@ func main() {
 
 	log.Println("Creating streamer")
 	strm := stream.NewStreamer(handler)
+	strm.SetHistory(writer)
 
 	log.Println("Creating Hydra monitor")
 	hyd, err := hydra.NewHydra(handler, "/dev/ttyUSB0")
@@ -161,19 +282,56 @@ func main() {
 
 	handler.RegisterRunListener(ms)
 	handler.RegisterRunListener(gps)
+	if *diagEnabled {
+		var diagSource canbus.Source
+		for _, source := range sources {
+			if *diagBus == "" || source.Name() == *diagBus {
+				diagSource = source
+				break
+			}
+		}
+		if diagSource == nil {
+			log.Fatalf("diag-bus %s is not one of can-buses", *diagBus)
+		}
+		log.Println("Creating diagnostic poller on", diagSource.Name())
+		handler.RegisterRunListener(leafdiag.NewPoller(handler, diagSource, *diagInterval))
+	}
 	//handler.RegisterRunListener(cam)
 
-	log.Println("Creating new Bus and subscribing")
-	bus0 := can.NewBus(conn0)
-	bus0.SubscribeFunc(chargeMonitor.Handle)
-	bus0.SubscribeFunc(handler.Handle)
-	bus1 := can.NewBus(conn1)
-	bus1.SubscribeFunc(handler.Handle)
+	var recorder *canlog.Recorder
+	if *candumpDir != "" {
+		recorder, err = canlog.NewRecorder(canlog.Config{
+			Dir:      *candumpDir,
+			MaxBytes: int64(*candumpMaxMB) * 1024 * 1024,
+			MaxFiles: *candumpMaxFiles,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *rawFrames {
+		log.Println("Recording raw CAN frames")
+	}
+	log.Println("Subscribing to CAN buses")
+	for i, source := range sources {
+		if i == 0 {
+			source.SubscribeFunc(chargeMonitor.Handle)
+		}
+		// Subscribed directly so replayed frames keep their recorded time through HandleAt
+		source.Subscribe(handler)
+		if *rawFrames {
+			source.Subscribe(push.NewFrameRecorder(writer, source.Name(), rawIDs))
+		}
+		if recorder != nil {
+			source.Subscribe(recorder.Handler(source.Name()))
+		}
+	}
 
 	log.Println("Starting web server")
 	http.HandleFunc("/stream", strm.Handler)
+	http.HandleFunc("/stream/ws", strm.WebSocketHandler)
 	http.HandleFunc("/query", func(response http.ResponseWriter, request *http.Request) {
-		sqlQuery, limit, err := parseQueryRequest(request)
+		sqlQuery, limit, values, err := parseQueryRequest(request)
 		if err != nil {
 			writeQueryError(response, http.StatusBadRequest, err.Error(), sqlQuery)
 			return
@@ -183,14 +341,21 @@ func main() {
 			writeQueryError(response, http.StatusBadRequest, "sql is required", sqlQuery)
 			return
 		}
-		if !isQueryAllowed(sqlQuery) {
-			writeQueryError(response, http.StatusBadRequest, "only SELECT/WITH queries are allowed", sqlQuery)
+		params, err := savedquery.ParseParams(values, time.Now().UTC())
+		if err != nil {
+			writeQueryError(response, http.StatusBadRequest, err.Error(), sqlQuery)
 			return
 		}
 		sqlQuery = applyLimit(sqlQuery, limit)
+		if format, ok := export.Negotiate(request.Header.Get("Accept")); ok {
+			ctx, cancel := context.WithTimeout(request.Context(), *exportTimeout)
+			defer cancel()
+			streamQuery(ctx, response, writer, sqlQuery, params.Args(), format)
+			return
+		}
 		ctx, cancel := context.WithTimeout(request.Context(), 5*time.Second)
 		defer cancel()
-		result, err := writer.Query(ctx, sqlQuery)
+		result, err := writer.Query(ctx, sqlQuery, params.Args()...)
 		if err != nil {
 			writeQueryError(response, http.StatusBadRequest, fmt.Sprintf("query failed: %v", err), sqlQuery)
 			return
@@ -206,6 +371,19 @@ func main() {
 		}
 		return nil, heaterCtrlErr
 	})
+	statusui.RegisterCells(http.DefaultServeMux, handler, writer)
+	events.Register(http.DefaultServeMux, handler.Events())
+	trip.Register(http.DefaultServeMux, writer)
+	grafana.Register(http.DefaultServeMux, writer)
+	if *savedQueryDir != "" {
+		registry, err := savedquery.NewRegistry(savedquery.Config{Dir: *savedQueryDir, CacheTTL: *savedQueryTTL})
+		if err != nil {
+			log.Fatal(err)
+		}
+		savedquery.Register(http.DefaultServeMux, writer, registry)
+	}
+	promapi.Register(http.DefaultServeMux, writer)
+	lokiapi.Register(http.DefaultServeMux, writer)
 	http.HandleFunc("/control", func(writer http.ResponseWriter, request *http.Request) {
 		run := request.URL.Query().Get("run")
 		if strings.ToLower(run) == "true" {
@@ -240,28 +418,29 @@ func main() {
 	}()
 
 	log.Println("Listen on Can Buses")
-	go func() {
-		err = bus0.ConnectAndPublish()
-		if err != nil {
-			log.Println(err)
-		}
-	}()
-	go func() {
-		err = bus1.ConnectAndPublish()
-		if err != nil {
-			log.Println(err)
-		}
-	}()
+	for _, source := range sources {
+		go func(source canbus.Source) {
+			if err := source.Run(); err != nil {
+				log.Println(source.Name(), err)
+			}
+		}(source)
+	}
 
-	log.Println("Wait for sigint or kill")
-	c := make(chan os.Signal)
-	signal.Notify(c, os.Interrupt)
-	signal.Notify(c, os.Kill)
+	log.Println("Wait for sigint or sigterm")
+	c := make(chan os.Signal, 1)
+	// systemd stops the service with SIGTERM, SIGKILL can't be caught
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
 	select {
 	case <-c:
-		bus0.Disconnect()
-		bus1.Disconnect()
+		for _, source := range sources {
+			source.Close()
+		}
+		if recorder != nil {
+			if err := recorder.Close(); err != nil {
+				log.Println("Failed to close candump recorder:", err)
+			}
+		}
 		if wattMonitor != nil {
 			wattMonitor.Stop()
 		}
@@ -273,8 +452,9 @@ func main() {
 }
 
 type queryRequest struct {
-	SQL   string `json:"sql"`
-	Limit int    `json:"limit"`
+	SQL    string                 `json:"sql"`
+	Limit  int                    `json:"limit"`
+	Params map[string]interface{} `json:"params"`
 }
 
 type queryErrorResponse struct {
@@ -291,35 +471,69 @@ func writeQueryError(response http.ResponseWriter, status int, message string, s
 	})
 }
 
-func parseQueryRequest(request *http.Request) (string, int, error) {
-	sqlQuery := strings.TrimSpace(request.URL.Query().Get("sql"))
+// streamQuery writes the result of sqlQuery in format as the rows are read. Errors before the encoder is set up are
+// returned as the usual JSON error, later ones abort the response so the client can tell it is incomplete.
+func streamQuery(ctx context.Context, response http.ResponseWriter, writer *store.Writer, sqlQuery string, args []interface{}, format export.Format) {
+	enc := export.NewEncoder(format, response)
+	started := false
+	err := writer.QueryRows(ctx, sqlQuery, func(cols []*sql.ColumnType) error {
+		started = true
+		response.Header().Set("Content-Type", string(format))
+		return enc.Columns(cols)
+	}, enc.Row, args...)
+	if err == nil {
+		err = enc.Close()
+	}
+	if err == nil {
+		return
+	}
+	if !started {
+		writeQueryError(response, http.StatusBadRequest, fmt.Sprintf("query failed: %v", err), sqlQuery)
+		return
+	}
+	log.Printf("query export failed: %v (query=%q)", err, sqlQuery)
+	panic(http.ErrAbortHandler)
+}
+
+// parseQueryRequest returns the SQL, limit and parameter values of a /query request. Parameters are taken from the
+// URL and, for JSON bodies, the params object.
+func parseQueryRequest(request *http.Request) (string, int, url.Values, error) {
+	values := request.URL.Query()
+	sqlQuery := strings.TrimSpace(values.Get("sql"))
 	limit, err := parseQueryLimit(request)
 	if err != nil {
-		return sqlQuery, 0, err
+		return sqlQuery, 0, nil, err
 	}
 	if sqlQuery != "" {
-		return sqlQuery, limit, nil
+		return sqlQuery, limit, values, nil
 	}
 	if request.Method != http.MethodPost {
-		return "", 0, fmt.Errorf("use POST with JSON or text body, or provide ?sql=")
+		return "", 0, nil, fmt.Errorf("use POST with JSON or text body, or provide ?sql=")
 	}
 	contentType := request.Header.Get("Content-Type")
 	if strings.Contains(contentType, "application/json") {
 		var payload queryRequest
-		if err := json.NewDecoder(request.Body).Decode(&payload); err != nil {
-			return "", 0, fmt.Errorf("invalid JSON body")
+		decoder := json.NewDecoder(request.Body)
+		decoder.UseNumber()
+		if err := decoder.Decode(&payload); err != nil {
+			return "", 0, nil, fmt.Errorf("invalid JSON body")
 		}
 		payload.SQL = strings.TrimSpace(payload.SQL)
 		if limit <= 0 {
 			limit = payload.Limit
 		}
-		return payload.SQL, limit, nil
+		for name, value := range payload.Params {
+			if values.Get(name) == "" {
+				values.Set(name, fmt.Sprint(value))
+			}
+		}
+		return payload.SQL, limit, values, nil
 	}
 	body, err := io.ReadAll(request.Body)
 	if err != nil {
-		return "", 0, fmt.Errorf("failed to read request body")
+		return "", 0, nil, fmt.Errorf("failed to read request body")
 	}
-	return strings.TrimSpace(string(body)), limit, nil
+	return strings.TrimSpace(string(body)), limit, values, nil
 }
 
 func parseQueryLimit(request *http.Request) (int, error) {
@@ -337,25 +551,6 @@ func parseQueryLimit(request *http.Request) (int, error) {
 	return limit, nil
 }
 
-func isQueryAllowed(sql string) bool {
-	normalized := strings.TrimSpace(strings.ToLower(sql))
-	if strings.Contains(normalized, ";") {
-		return false
-	}
-	return hasSQLPrefix(normalized, "select") || hasSQLPrefix(normalized, "with")
-}
-
-func hasSQLPrefix(sql string, keyword string) bool {
-	if !strings.HasPrefix(sql, keyword) {
-		return false
-	}
-	if len(sql) == len(keyword) {
-		return true
-	}
-	next := sql[len(keyword)]
-	return next == ' ' || next == '\n' || next == '\t' || next == '\r'
-}
-
 func applyLimit(sql string, limit int) string {
 	if limit <= 0 {
 		return sql
@@ -367,6 +562,65 @@ func applyLimit(sql string, limit int) string {
 	return fmt.Sprintf("%s limit %d", strings.TrimSpace(sql), limit)
 }
 
+func parseFrameIDs(raw string) ([]uint32, error) {
+	var ids []uint32
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(part)), "0x")
+		if part == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(part, 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid frame id %q: %w", part, err)
+		}
+		ids = append(ids, uint32(id))
+	}
+	return ids, nil
+}
+
+// splitList splits a comma separated flag value, ignoring empty items.
+func splitList(raw string) []string {
+	var items []string
+	for _, part := range strings.Split(raw, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			items = append(items, part)
+		}
+	}
+	return items
+}
+
+// parseRetention combines the table=age and table=megabytes lists into the retention of each table.
+func parseRetention(ages string, sizes string) (map[string]store.Retention, error) {
+	retention := make(map[string]store.Retention)
+	for _, part := range splitList(ages) {
+		table, raw, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid retention %q, expected table=age", part)
+		}
+		age, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid retention %q: %w", part, err)
+		}
+		r := retention[table]
+		r.MaxAge = age
+		retention[table] = r
+	}
+	for _, part := range splitList(sizes) {
+		table, raw, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid retention size %q, expected table=megabytes", part)
+		}
+		mb, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid retention size %q: %w", part, err)
+		}
+		r := retention[table]
+		r.MaxBytes = mb * 1024 * 1024
+		retention[table] = r
+	}
+	return retention, nil
+}
+
 func fToC(tempF float64) float64 {
 	return (tempF - 32.0) * 5.0 / 9.0
 }
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/slim-bean/leafbus/pkg/store"
+)
+
+// runMigrate implements `leafbus migrate`, it applies the schema migrations to the DuckDB file and rewrites the
+// parquet files written with an older schema version, then writes the runtime rollups missing from the archive.
+// leafbus must not be running while it does.
+func runMigrate(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	parquetDir := flags.String("parquet-dir", "", "Base directory for parquet output (required)")
+	duckdbPath := flags.String("duckdb-path", "", "Optional path to the duckdb database file")
+	dryRun := flags.Bool("dry-run", false, "Only list the parquet files which would be rewritten and the missing rollups")
+	_ = flags.Parse(args)
+	if *parquetDir == "" {
+		log.Fatal("parquet-dir is required")
+	}
+	writer, err := store.NewWriter(*parquetDir, *duckdbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer writer.Close()
+	count, err := writer.MigrateArchive(*dryRun)
+	if err != nil {
+		log.Println("Failed to migrate parquet files:", err)
+		return
+	}
+	if *dryRun {
+		log.Printf("%d parquet files are older than the schema version of their directory\n", count)
+		if count, err = writer.BackfillRollups(true); err == nil {
+			log.Printf("%d runtime rollups are missing\n", count)
+		}
+		return
+	}
+	log.Printf("Rewrote %d parquet files to the schema version of their directory\n", count)
+	count, err = writer.BackfillRollups(false)
+	if err != nil {
+		log.Println("Failed to backfill runtime rollups:", err)
+		return
+	}
+	log.Printf("Wrote %d missing runtime rollups\n", count)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/brutella/can"
+
+	"github.com/slim-bean/leafbus/pkg/decode"
+	"github.com/slim-bean/leafbus/pkg/push"
+	"github.com/slim-bean/leafbus/pkg/store"
+)
+
+func main() {
+	archiveDir := flag.String("archive", "", "Parquet directory containing the captured raw frames (required)")
+	outDir := flag.String("out", "", "Directory for the re-decoded status/runtime parquet tree (required)")
+	startFlag := flag.String("start", "", "Start of the time range, RFC3339 (required)")
+	endFlag := flag.String("end", "", "End of the time range, RFC3339 (required)")
+	dbcPath := flag.String("dbc", "", "Optional DBC file with additional CAN signal definitions")
+	dbcReplace := flag.Bool("dbc-replace", false, "Decode frames only with the DBC file instead of alongside the built-in Leaf signals")
+	assumeKeyOn := flag.Bool("assume-key-on", false, "Store metrics even if the capture does not contain a key on frame (0x11A)")
+	flag.Parse()
+
+	if *archiveDir == "" || *outDir == "" {
+		log.Fatal("archive and out are required")
+	}
+	if filepath.Clean(*archiveDir) == filepath.Clean(*outDir) {
+		log.Fatal("out must be a different directory than archive")
+	}
+	start, err := time.Parse(time.RFC3339, *startFlag)
+	if err != nil {
+		log.Fatal("Failed to parse start:", err)
+	}
+	end, err := time.Parse(time.RFC3339, *endFlag)
+	if err != nil {
+		log.Fatal("Failed to parse end:", err)
+	}
+	if !end.After(start) {
+		log.Fatal("end must be after start")
+	}
+
+	writer, err := store.NewWriter(*outDir, "")
+	if err != nil {
+		log.Fatal(err)
+	}
+	writer.SetBlocking(true)
+
+	handler, err := push.NewHandler(writer)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *dbcPath != "" {
+		signals, err := decode.LoadDBC(*dbcPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *dbcReplace {
+			handler.SetDecoder(decode.NewDecoder(signals))
+		} else {
+			decoder := decode.NewDecoder(decode.Leaf)
+			decoder.Add(signals...)
+			handler.SetDecoder(decoder)
+		}
+	}
+	if *assumeKeyOn {
+		handler.SetRunning(true)
+	}
+
+	log.Printf("Re-decoding frames from %s to %s\n", start.Format(time.RFC3339), end.Format(time.RFC3339))
+	count := 0
+	err = store.ReadFrames(context.Background(), *archiveDir, start, end, func(row store.FrameRow) error {
+		frame := can.Frame{
+			ID:     row.ID,
+			Length: row.DLC,
+		}
+		copy(frame.Data[:], row.Data)
+		handler.HandleAt(frame, row.Timestamp)
+		count++
+		if count%1000000 == 0 {
+			log.Printf("Decoded %d frames, at %s\n", count, row.Timestamp.Format(time.RFC3339))
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Decoded %d frames, writing parquet to %s\n", count, *outDir)
+	writer.Flush()
+	writer.Close()
+	log.Println("Exiting")
+}
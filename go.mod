@@ -4,12 +4,14 @@ go 1.24.0
 
 require (
 	github.com/adrianmo/go-nmea v1.1.0
+	github.com/apache/arrow-go/v18 v18.4.1
 	github.com/brutella/can v0.0.1
 	github.com/buger/jsonparser v1.1.1
 	github.com/d2r2/go-i2c v0.0.0-20191123181816-73a8a799d6bc
 	github.com/d2r2/go-logger v0.0.0-20181221090742-9998a510495e
 	github.com/duckdb/duckdb-go/v2 v2.5.4
 	github.com/gdamore/tcell v1.3.0
+	github.com/gorilla/websocket v1.5.3
 	github.com/grafana/loki v1.3.0
 	github.com/json-iterator/go v1.1.12
 	github.com/modern-go/reflect2 v1.0.2
@@ -23,7 +25,6 @@ require (
 
 require (
 	github.com/alecthomas/units v0.0.0-20190717042225-c3de453c63f4 // indirect
-	github.com/apache/arrow-go/v18 v18.4.1 // indirect
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/blang/semver v3.5.1+incompatible // indirect
 	github.com/cespare/xxhash v1.1.0 // indirect
@@ -0,0 +1,78 @@
+package canbus
+
+import (
+	"sync"
+
+	"github.com/brutella/can"
+)
+
+// Fake is an in-memory Source, frames passed to Inject are delivered to the subscribers.
+type Fake struct {
+	name string
+
+	mu        sync.Mutex
+	handler   []can.Handler
+	published []can.Frame
+
+	closeOnce sync.Once
+	closeCh   chan struct{}
+}
+
+func NewFake(name string) *Fake {
+	return &Fake{
+		name:    name,
+		closeCh: make(chan struct{}),
+	}
+}
+
+func (f *Fake) Name() string {
+	return f.name
+}
+
+func (f *Fake) Subscribe(handler can.Handler) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.handler = append(f.handler, handler)
+}
+
+func (f *Fake) SubscribeFunc(fn can.HandlerFunc) {
+	f.Subscribe(can.NewHandler(fn))
+}
+
+// Publish records the frame, see Published.
+func (f *Fake) Publish(frame can.Frame) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.published = append(f.published, frame)
+	return nil
+}
+
+// Published returns the frames passed to Publish.
+func (f *Fake) Published() []can.Frame {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]can.Frame(nil), f.published...)
+}
+
+// Inject delivers a frame to the subscribers as if it was received on the bus.
+func (f *Fake) Inject(frame can.Frame) {
+	f.mu.Lock()
+	handlers := append([]can.Handler(nil), f.handler...)
+	f.mu.Unlock()
+	for _, h := range handlers {
+		h.Handle(frame)
+	}
+}
+
+// Run blocks until Close is called.
+func (f *Fake) Run() error {
+	<-f.closeCh
+	return nil
+}
+
+func (f *Fake) Close() error {
+	f.closeOnce.Do(func() {
+		close(f.closeCh)
+	})
+	return nil
+}
@@ -0,0 +1,138 @@
+package canbus
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brutella/can"
+)
+
+// collector records the frames handed to it.
+type collector struct {
+	mu     sync.Mutex
+	frames []can.Frame
+}
+
+func (c *collector) Handle(frame can.Frame) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.frames = append(c.frames, frame)
+}
+
+func (c *collector) got() []can.Frame {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]can.Frame(nil), c.frames...)
+}
+
+func TestFake(t *testing.T) {
+	var _ Source = (*Fake)(nil)
+	bus := NewFake("can1")
+	if bus.Name() != "can1" {
+		t.Errorf("Name() = %q, want can1", bus.Name())
+	}
+	var handler collector
+	var fn collector
+	bus.Subscribe(&handler)
+	bus.SubscribeFunc(fn.Handle)
+
+	injected := can.Frame{ID: 0x1DB, Length: 2, Data: [8]uint8{0x12, 0x34}}
+	bus.Inject(injected)
+	published := can.Frame{ID: 0x79B, Length: 8, Data: [8]uint8{0x02, 0x10, 0xC0}}
+	if err := bus.Publish(published); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+
+	for name, c := range map[string]*collector{"Subscribe": &handler, "SubscribeFunc": &fn} {
+		if got := c.got(); !reflect.DeepEqual(got, []can.Frame{injected}) {
+			t.Errorf("%s handler got %x, want only the injected frame", name, got)
+		}
+	}
+	if got := bus.Published(); !reflect.DeepEqual(got, []can.Frame{published}) {
+		t.Errorf("Published() = %x, want %x", got, published)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- bus.Run()
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Run() returned %v before Close", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	if err := bus.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if err := bus.Close(); err != nil {
+		t.Fatalf("second Close() error = %v", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run() error = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Run() did not return after Close")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "drive.log")
+	log := `(1436509052.000000) can0 1DB#00AA
+(1436509052.010000) can1 5BC#01
+(1436509052.020000) can0 55B#0203
+(1436509052.030000) can2 7BB#04
+`
+	if err := os.WriteFile(path, []byte(log), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sources, err := OpenReplay(path, 0, []string{"can0", "can1"})
+	if err != nil {
+		t.Fatalf("OpenReplay() error = %v", err)
+	}
+	collectors := make([]*collector, len(sources))
+	for i, source := range sources {
+		collectors[i] = &collector{}
+		source.Subscribe(collectors[i])
+	}
+	if err := sources[0].Publish(can.Frame{ID: 0x79B}); err != ErrReadOnly {
+		t.Errorf("Publish() error = %v, want %v", err, ErrReadOnly)
+	}
+	// Every source waits for the whole log
+	var wg sync.WaitGroup
+	for _, source := range sources {
+		wg.Add(1)
+		go func(s Source) {
+			defer wg.Done()
+			if err := s.Run(); err != nil {
+				t.Errorf("%s Run() error = %v", s.Name(), err)
+			}
+		}(source)
+	}
+	wg.Wait()
+
+	want := [][]can.Frame{
+		{
+			{ID: 0x1DB, Length: 2, Data: [8]uint8{0x00, 0xAA}},
+			{ID: 0x55B, Length: 2, Data: [8]uint8{0x02, 0x03}},
+		},
+		{
+			{ID: 0x5BC, Length: 1, Data: [8]uint8{0x01}},
+		},
+	}
+	for i, c := range collectors {
+		if got := c.got(); !reflect.DeepEqual(got, want[i]) {
+			t.Errorf("%s got %x, want %x", sources[i].Name(), got, want[i])
+		}
+	}
+	for _, source := range sources {
+		if err := source.Close(); err != nil {
+			t.Errorf("%s Close() error = %v", source.Name(), err)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package canbus
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/brutella/can"
+
+	"github.com/slim-bean/leafbus/pkg/canlog"
+)
+
+var ErrReadOnly = errors.New("replayed CAN bus is read only")
+
+// replay shares a single log file between the sources for each bus in it.
+type replay struct {
+	reader *canlog.Reader
+	player *canlog.Player
+
+	once   sync.Once
+	done   chan struct{}
+	err    error
+	closed sync.Once
+}
+
+// ReplayBus is a Source publishing the frames recorded on one bus of a candump or ASC log.
+type ReplayBus struct {
+	name   string
+	bus    *canlog.PlayerBus
+	replay *replay
+}
+
+// OpenReplay opens a candump or Vector ASC log and returns a Source for each named bus,
+// frames are matched to sources by the bus name in the log. Running any of the sources
+// starts the playback, speed scales the rate and 0 replays as fast as possible.
+func OpenReplay(path string, speed float64, names []string) ([]Source, error) {
+	reader, err := canlog.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &replay{
+		reader: reader,
+		player: canlog.NewPlayer(reader, speed),
+		done:   make(chan struct{}),
+	}
+	sources := make([]Source, 0, len(names))
+	for _, name := range names {
+		sources = append(sources, &ReplayBus{
+			name:   name,
+			bus:    r.player.Bus(name),
+			replay: r,
+		})
+	}
+	return sources, nil
+}
+
+func (b *ReplayBus) Name() string {
+	return b.name
+}
+
+func (b *ReplayBus) Subscribe(handler can.Handler) {
+	b.bus.Subscribe(handler)
+}
+
+func (b *ReplayBus) SubscribeFunc(fn can.HandlerFunc) {
+	b.bus.SubscribeFunc(fn)
+}
+
+func (b *ReplayBus) Publish(frame can.Frame) error {
+	return ErrReadOnly
+}
+
+// Run blocks until the whole log has been replayed.
+func (b *ReplayBus) Run() error {
+	b.replay.once.Do(func() {
+		go func() {
+			b.replay.err = b.replay.player.Run()
+			close(b.replay.done)
+		}()
+	})
+	<-b.replay.done
+	return b.replay.err
+}
+
+func (b *ReplayBus) Close() error {
+	var err error
+	b.replay.closed.Do(func() {
+		b.replay.player.Close()
+		// Wait for a running playback to stop reading before closing the file
+		b.replay.once.Do(func() {
+			close(b.replay.done)
+		})
+		<-b.replay.done
+		err = b.replay.reader.Close()
+	})
+	return err
+}
@@ -0,0 +1,60 @@
+package canbus
+
+import (
+	"fmt"
+
+	"github.com/brutella/can"
+)
+
+// Source is a named CAN bus which publishes received frames to its subscribers.
+type Source interface {
+	Name() string
+	Subscribe(handler can.Handler)
+	SubscribeFunc(fn can.HandlerFunc)
+	// Publish sends a frame on the bus, subscribers do not receive it.
+	Publish(frame can.Frame) error
+	// Run receives frames until the source is closed or runs out of frames.
+	Run() error
+	Close() error
+}
+
+// SocketCAN is a Source reading a SocketCAN interface such as can0 or vcan0.
+type SocketCAN struct {
+	name string
+	bus  *can.Bus
+}
+
+func NewSocketCAN(name string) (*SocketCAN, error) {
+	bus, err := can.NewBusForInterfaceWithName(name)
+	if err != nil {
+		return nil, fmt.Errorf("could not open CAN interface %s: %w", name, err)
+	}
+	return &SocketCAN{
+		name: name,
+		bus:  bus,
+	}, nil
+}
+
+func (s *SocketCAN) Name() string {
+	return s.name
+}
+
+func (s *SocketCAN) Subscribe(handler can.Handler) {
+	s.bus.Subscribe(handler)
+}
+
+func (s *SocketCAN) SubscribeFunc(fn can.HandlerFunc) {
+	s.bus.SubscribeFunc(fn)
+}
+
+func (s *SocketCAN) Publish(frame can.Frame) error {
+	return s.bus.Publish(frame)
+}
+
+func (s *SocketCAN) Run() error {
+	return s.bus.ConnectAndPublish()
+}
+
+func (s *SocketCAN) Close() error {
+	return s.bus.Disconnect()
+}
@@ -0,0 +1,144 @@
+package canlog
+
+import (
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/brutella/can"
+)
+
+// Player publishes the frames of a log to the handlers subscribed to each bus, keeping the original timing.
+type Player struct {
+	reader *Reader
+	speed  float64
+
+	mu    sync.Mutex
+	buses map[string]*PlayerBus
+
+	closeCh   chan struct{}
+	closeOnce sync.Once
+}
+
+// TimedHandler is implemented by handlers which take the recorded time of a frame instead of using the time it is
+// replayed.
+type TimedHandler interface {
+	HandleAt(frame can.Frame, ts time.Time)
+}
+
+// PlayerBus publishes the frames recorded on a single bus, it can be subscribed to like a can.Bus.
+type PlayerBus struct {
+	mu      sync.RWMutex
+	handler []can.Handler
+}
+
+// NewPlayer replays the reader, speed scales the playback rate and 0 replays as fast as possible.
+func NewPlayer(reader *Reader, speed float64) *Player {
+	return &Player{
+		reader:  reader,
+		speed:   speed,
+		buses:   map[string]*PlayerBus{},
+		closeCh: make(chan struct{}),
+	}
+}
+
+// Bus returns the named bus, e.g. can0, frames for buses without subscribers are skipped.
+func (p *Player) Bus(name string) *PlayerBus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b, ok := p.buses[name]
+	if !ok {
+		b = &PlayerBus{}
+		p.buses[name] = b
+	}
+	return b
+}
+
+// Run plays the log until the end or until Close is called.
+func (p *Player) Run() error {
+	var (
+		first   time.Time
+		started time.Time
+		count   int
+		skipped int
+	)
+	for {
+		rec, err := p.reader.Next()
+		if err == io.EOF {
+			break
+		}
+		var perr *ParseError
+		if errors.As(err, &perr) {
+			skipped++
+			if skipped <= 10 {
+				log.Println("Skipping CAN log", perr)
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if first.IsZero() {
+			first = rec.Timestamp
+			started = time.Now()
+		}
+		if p.speed > 0 {
+			target := started.Add(time.Duration(float64(rec.Timestamp.Sub(first)) / p.speed))
+			if wait := time.Until(target); wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-timer.C:
+				case <-p.closeCh:
+					timer.Stop()
+					return nil
+				}
+			}
+		}
+		select {
+		case <-p.closeCh:
+			return nil
+		default:
+		}
+		p.mu.Lock()
+		b := p.buses[rec.Bus]
+		p.mu.Unlock()
+		if b != nil {
+			b.publish(rec)
+		}
+		count++
+	}
+	log.Printf("Finished replaying %d CAN frames (%d lines skipped)\n", count, skipped)
+	return nil
+}
+
+func (p *Player) Close() {
+	p.closeOnce.Do(func() {
+		close(p.closeCh)
+	})
+}
+
+// Subscribe adds a handler to the bus.
+func (b *PlayerBus) Subscribe(handler can.Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handler = append(b.handler, handler)
+}
+
+// SubscribeFunc adds a function as handler.
+func (b *PlayerBus) SubscribeFunc(fn can.HandlerFunc) {
+	b.Subscribe(can.NewHandler(fn))
+}
+
+func (b *PlayerBus) publish(rec Record) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, h := range b.handler {
+		if th, ok := h.(TimedHandler); ok {
+			th.HandleAt(rec.Frame, rec.Timestamp)
+		} else {
+			h.Handle(rec.Frame)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package canlog
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brutella/can"
+)
+
+// Format is a CAN log file format. Vector's binary BLF logs are not supported, they can be converted to ASC.
+type Format int
+
+const (
+	// Candump is the `candump -l` log format from can-utils.
+	Candump Format = iota
+	// ASC is the Vector ASCII log format.
+	ASC
+)
+
+var ascDateLayouts = []string{
+	"Mon Jan 2 03:04:05.000 pm 2006",
+	"Mon Jan 2 03:04:05.000 PM 2006",
+	"Mon Jan 2 03:04:05 pm 2006",
+	"Mon Jan 2 03:04:05 PM 2006",
+	"Mon Jan 2 15:04:05.000 2006",
+	"Mon Jan 2 15:04:05 2006",
+}
+
+// ParseError is returned by Reader.Next for a line which could not be parsed, reading can continue after it.
+type ParseError struct {
+	Line int
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+// Reader reads frames from a candump or Vector ASC log.
+type Reader struct {
+	scanner *bufio.Scanner
+	closer  io.Closer
+	format  Format
+	lineNum int
+
+	// ASC header state
+	start    time.Time
+	decimal  bool
+	relative bool
+	last     time.Duration
+}
+
+// Open opens a log file, files with an .asc extension are read as Vector ASC and everything else as candump.
+func Open(path string) (*Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	format := Candump
+	if strings.EqualFold(filepath.Ext(path), ".asc") {
+		format = ASC
+	}
+	r := NewReader(f, format)
+	r.closer = f
+	return r, nil
+}
+
+func NewReader(r io.Reader, format Format) *Reader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	return &Reader{
+		scanner: scanner,
+		format:  format,
+		start:   time.Unix(0, 0),
+	}
+}
+
+func (r *Reader) Close() error {
+	if r.closer == nil {
+		return nil
+	}
+	return r.closer.Close()
+}
+
+// Next returns the next frame in the log, io.EOF at the end of the log or a *ParseError for a malformed line.
+func (r *Reader) Next() (Record, error) {
+	for r.scanner.Scan() {
+		r.lineNum++
+		line := strings.TrimSpace(r.scanner.Text())
+		if line == "" || strings.HasPrefix(line, "//") || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var (
+			rec Record
+			ok  bool
+			err error
+		)
+		if r.format == ASC {
+			rec, ok, err = r.parseASC(line)
+		} else {
+			rec, err = ParseCandump(line)
+			ok = true
+		}
+		if err != nil {
+			return Record{}, &ParseError{Line: r.lineNum, Err: err}
+		}
+		if ok {
+			return rec, nil
+		}
+	}
+	if err := r.scanner.Err(); err != nil {
+		return Record{}, err
+	}
+	return Record{}, io.EOF
+}
+
+// parseASC returns ok=false for header and event lines which do not contain a frame.
+func (r *Reader) parseASC(line string) (Record, bool, error) {
+	fields := strings.Fields(line)
+	switch strings.ToLower(fields[0]) {
+	case "date":
+		raw := strings.TrimSpace(line[len(fields[0]):])
+		for _, layout := range ascDateLayouts {
+			if ts, err := time.ParseInLocation(layout, raw, time.Local); err == nil {
+				r.start = ts
+				break
+			}
+		}
+		return Record{}, false, nil
+	case "base":
+		r.decimal = len(fields) > 1 && strings.EqualFold(fields[1], "dec")
+		r.relative = len(fields) > 3 && strings.EqualFold(fields[3], "relative")
+		return Record{}, false, nil
+	}
+	offset, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		// internal events, Begin/End Triggerblock and other statements
+		return Record{}, false, nil
+	}
+	// <time> <channel> <id>[x] <Rx|Tx> <d|r> <dlc> <data...>
+	if len(fields) < 5 {
+		return Record{}, false, nil
+	}
+	channel, err := strconv.Atoi(fields[1])
+	if err != nil {
+		// CANFD, error frames and statistics events
+		return Record{}, false, nil
+	}
+	elapsed := time.Duration(offset * float64(time.Second))
+	if r.relative {
+		elapsed += r.last
+	}
+	r.last = elapsed
+
+	idRaw := fields[2]
+	extended := strings.HasSuffix(strings.ToLower(idRaw), "x")
+	idRaw = strings.TrimRight(idRaw, "xX")
+	base := 16
+	if r.decimal {
+		base = 10
+	}
+	id, err := strconv.ParseUint(idRaw, base, 32)
+	if err != nil {
+		// Not a CAN frame line, e.g. ErrorFrame
+		return Record{}, false, nil
+	}
+	frame := can.Frame{ID: uint32(id)}
+	if extended {
+		frame.ID |= idEFF
+	}
+	rec := Record{
+		Timestamp: r.start.Add(elapsed),
+		Bus:       fmt.Sprintf("can%d", channel-1),
+		Frame:     frame,
+	}
+	kind := strings.ToLower(fields[4])
+	if kind == "r" {
+		rec.Frame.ID |= idRTR
+		return rec, true, nil
+	}
+	if kind != "d" || len(fields) < 6 {
+		return Record{}, false, fmt.Errorf("invalid ASC frame %q", line)
+	}
+	dlc, err := strconv.ParseUint(fields[5], 16, 8)
+	if err != nil || dlc > can.MaxFrameDataLength {
+		return Record{}, false, fmt.Errorf("invalid ASC dlc %q", fields[5])
+	}
+	if len(fields) < 6+int(dlc) {
+		return Record{}, false, fmt.Errorf("ASC frame has fewer than %d data bytes", dlc)
+	}
+	for i := 0; i < int(dlc); i++ {
+		v, err := strconv.ParseUint(fields[6+i], base, 8)
+		if err != nil {
+			return Record{}, false, fmt.Errorf("invalid ASC data byte %q: %w", fields[6+i], err)
+		}
+		rec.Frame.Data[i] = uint8(v)
+	}
+	rec.Frame.Length = uint8(dlc)
+	return rec, true, nil
+}
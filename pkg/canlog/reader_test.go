@@ -0,0 +1,186 @@
+package canlog
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brutella/can"
+)
+
+func TestParseCandump(t *testing.T) {
+	ts := time.Unix(1436509052, 249713000)
+	tests := []struct {
+		name    string
+		line    string
+		want    Record
+		wantErr bool
+	}{
+		{
+			name: "standard frame",
+			line: "(1436509052.249713) can0 1DB#00AA11BB",
+			want: Record{Timestamp: ts, Bus: "can0", Frame: can.Frame{ID: 0x1DB, Length: 4, Data: [8]uint8{0x00, 0xAA, 0x11, 0xBB}}},
+		},
+		{
+			name: "extended frame",
+			line: "(1436509052.249713) can1 18DAF1DB#0102030405060708",
+			want: Record{Timestamp: ts, Bus: "can1", Frame: can.Frame{ID: 0x18DAF1DB | idEFF, Length: 8, Data: [8]uint8{1, 2, 3, 4, 5, 6, 7, 8}}},
+		},
+		{
+			name: "remote frame",
+			line: "(1436509052.249713) can0 7BB#R",
+			want: Record{Timestamp: ts, Bus: "can0", Frame: can.Frame{ID: 0x7BB | idRTR}},
+		},
+		{
+			name: "empty data",
+			line: "(1436509052.249713) can0 5C5#",
+			want: Record{Timestamp: ts, Bus: "can0", Frame: can.Frame{ID: 0x5C5}},
+		},
+		{
+			name: "dotted data",
+			line: "(1436509052.249713) can0 1DB#00.AA.11",
+			want: Record{Timestamp: ts, Bus: "can0", Frame: can.Frame{ID: 0x1DB, Length: 3, Data: [8]uint8{0x00, 0xAA, 0x11}}},
+		},
+		{
+			name: "extra fields are ignored",
+			line: "(1436509052.249713) can0 1DB#01 R",
+			want: Record{Timestamp: ts, Bus: "can0", Frame: can.Frame{ID: 0x1DB, Length: 1, Data: [8]uint8{0x01}}},
+		},
+		{name: "missing timestamp", line: "can0 1DB#00", wantErr: true},
+		{name: "bad timestamp", line: "(abc) can0 1DB#00", wantErr: true},
+		{name: "missing separator", line: "(1436509052.249713) can0 1DB00", wantErr: true},
+		{name: "CAN FD", line: "(1436509052.249713) can0 1DB##100", wantErr: true},
+		{name: "bad id", line: "(1436509052.249713) can0 XYZ#00", wantErr: true},
+		{name: "odd data", line: "(1436509052.249713) can0 1DB#001", wantErr: true},
+		{name: "too much data", line: "(1436509052.249713) can0 1DB#000102030405060708", wantErr: true},
+		{name: "bad data", line: "(1436509052.249713) can0 1DB#0G", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseCandump(tt.line)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseCandump(%q) = %+v, want an error", tt.line, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseCandump(%q) error = %v", tt.line, err)
+			}
+			if !got.Timestamp.Equal(tt.want.Timestamp) || got.Bus != tt.want.Bus || got.Frame != tt.want.Frame {
+				t.Errorf("ParseCandump(%q) = %+v, want %+v", tt.line, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCandumpRoundTrip(t *testing.T) {
+	for _, line := range []string{
+		"(1436509052.249713) can0 1DB#00AA11BB",
+		"(1436509052.000001) can1 18DAF1DB#0102030405060708",
+		"(1436509052.249713) can0 7BB#R",
+		"(1436509052.249713) can0 5C5#",
+	} {
+		rec, err := ParseCandump(line)
+		if err != nil {
+			t.Fatalf("ParseCandump(%q) error = %v", line, err)
+		}
+		if got := FormatCandump(rec); got != line {
+			t.Errorf("FormatCandump(ParseCandump(%q)) = %q", line, got)
+		}
+	}
+}
+
+func TestReaderASC(t *testing.T) {
+	start := time.Date(2024, time.March, 5, 14, 30, 15, 0, time.Local)
+	tests := []struct {
+		name string
+		log  string
+		want []Record
+		// errLines are the lines reported with a *ParseError
+		errLines []int
+	}{
+		{
+			name: "absolute hex",
+			log: `date Tue Mar 5 02:30:15.000 pm 2024
+base hex  timestamps absolute
+internal events logged
+// version 9.0.0
+Begin Triggerblock Tue Mar 5 02:30:15.000 pm 2024
+   0.500000 1  1DB             Rx   d 4 00 AA 11 BB
+   1.250000 2  18DAF1DBx       Rx   d 2 01 02
+   1.500000 1  7BB             Rx   r
+   2.000000 1  ErrorFrame
+   2.125000 CANFD   1 Rx 1DB 1 0 8 8 00 00 00 00 00 00 00 00
+End TriggerBlock
+`,
+			want: []Record{
+				{Timestamp: start.Add(500 * time.Millisecond), Bus: "can0", Frame: can.Frame{ID: 0x1DB, Length: 4, Data: [8]uint8{0x00, 0xAA, 0x11, 0xBB}}},
+				{Timestamp: start.Add(1250 * time.Millisecond), Bus: "can1", Frame: can.Frame{ID: 0x18DAF1DB | idEFF, Length: 2, Data: [8]uint8{1, 2}}},
+				{Timestamp: start.Add(1500 * time.Millisecond), Bus: "can0", Frame: can.Frame{ID: 0x7BB | idRTR}},
+			},
+		},
+		{
+			name: "relative decimal",
+			log: `date Tue Mar 5 14:30:15 2024
+base dec  timestamps relative
+   0.500000 1  475             Rx   d 2 0 170
+   0.250000 1  475             Rx   d 1 255
+`,
+			want: []Record{
+				{Timestamp: start.Add(500 * time.Millisecond), Bus: "can0", Frame: can.Frame{ID: 475, Length: 2, Data: [8]uint8{0, 170}}},
+				{Timestamp: start.Add(750 * time.Millisecond), Bus: "can0", Frame: can.Frame{ID: 475, Length: 1, Data: [8]uint8{255}}},
+			},
+		},
+		{
+			name: "malformed frames",
+			log: `date Tue Mar 5 02:30:15 pm 2024
+base hex  timestamps absolute
+   0.500000 1  1DB             Rx   d 4 00 AA
+   0.750000 1  1DB             Rx   d Z 00
+   1.000000 1  1DB             Rx   d 1 GG
+   1.500000 1  1DB             Rx   d 1 01
+`,
+			want: []Record{
+				{Timestamp: start.Add(1500 * time.Millisecond), Bus: "can0", Frame: can.Frame{ID: 0x1DB, Length: 1, Data: [8]uint8{0x01}}},
+			},
+			errLines: []int{3, 4, 5},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReader(strings.NewReader(tt.log), ASC)
+			var got []Record
+			var errLines []int
+			for {
+				rec, err := r.Next()
+				if err == io.EOF {
+					break
+				}
+				var parseErr *ParseError
+				if errors.As(err, &parseErr) {
+					errLines = append(errLines, parseErr.Line)
+					continue
+				}
+				if err != nil {
+					t.Fatalf("Next() error = %v", err)
+				}
+				got = append(got, rec)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("read %d records %+v, want %d", len(got), got, len(tt.want))
+			}
+			for i := range got {
+				if !got[i].Timestamp.Equal(tt.want[i].Timestamp) || got[i].Bus != tt.want[i].Bus || got[i].Frame != tt.want[i].Frame {
+					t.Errorf("record %d = %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+			if !reflect.DeepEqual(errLines, tt.errLines) {
+				t.Errorf("parse errors on lines %v, want %v", errLines, tt.errLines)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package canlog
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brutella/can"
+)
+
+const (
+	// idEFF is the extended frame format flag in can.Frame.ID, the same bit SocketCAN uses.
+	idEFF  = 0x80000000
+	idRTR  = 0x40000000
+	idMask = 0x1FFFFFFF
+)
+
+// Record is a frame read from or written to a log file.
+type Record struct {
+	Timestamp time.Time
+	Bus       string
+	Frame     can.Frame
+}
+
+// FormatCandump formats a frame like `candump -l`, e.g. (1436509052.249713) can0 1DB#00AA11BB
+func FormatCandump(rec Record) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "(%d.%06d) %s ", rec.Timestamp.Unix(), rec.Timestamp.Nanosecond()/1000, rec.Bus)
+	if rec.Frame.ID&idEFF != 0 {
+		fmt.Fprintf(&b, "%08X#", rec.Frame.ID&idMask)
+	} else {
+		fmt.Fprintf(&b, "%03X#", rec.Frame.ID&idMask)
+	}
+	if rec.Frame.ID&idRTR != 0 {
+		b.WriteString("R")
+		return b.String()
+	}
+	length := rec.Frame.Length
+	if length > can.MaxFrameDataLength {
+		length = can.MaxFrameDataLength
+	}
+	for _, d := range rec.Frame.Data[:length] {
+		fmt.Fprintf(&b, "%02X", d)
+	}
+	return b.String()
+}
+
+// ParseCandump parses a line written by `candump -l` or FormatCandump.
+func ParseCandump(line string) (Record, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 || !strings.HasPrefix(fields[0], "(") || !strings.HasSuffix(fields[0], ")") {
+		return Record{}, fmt.Errorf("invalid candump line %q", line)
+	}
+	ts, err := parseEpoch(strings.Trim(fields[0], "()"))
+	if err != nil {
+		return Record{}, fmt.Errorf("invalid candump timestamp %q: %w", fields[0], err)
+	}
+	idPart, dataPart, ok := strings.Cut(fields[2], "#")
+	if !ok {
+		return Record{}, fmt.Errorf("invalid candump frame %q", fields[2])
+	}
+	if strings.HasPrefix(dataPart, "#") {
+		return Record{}, fmt.Errorf("CAN FD frames are not supported")
+	}
+	id, err := strconv.ParseUint(idPart, 16, 32)
+	if err != nil {
+		return Record{}, fmt.Errorf("invalid candump id %q: %w", idPart, err)
+	}
+	frame := can.Frame{ID: uint32(id)}
+	if len(idPart) > 3 {
+		frame.ID |= idEFF
+	}
+	if strings.HasPrefix(dataPart, "R") {
+		// Remote frames carry no data
+		frame.ID |= idRTR
+		return Record{Timestamp: ts, Bus: fields[1], Frame: frame}, nil
+	}
+	dataPart = strings.ReplaceAll(dataPart, ".", "")
+	if len(dataPart)%2 != 0 || len(dataPart)/2 > can.MaxFrameDataLength {
+		return Record{}, fmt.Errorf("invalid candump data %q", dataPart)
+	}
+	for i := 0; i < len(dataPart); i += 2 {
+		v, err := strconv.ParseUint(dataPart[i:i+2], 16, 8)
+		if err != nil {
+			return Record{}, fmt.Errorf("invalid candump data %q: %w", dataPart, err)
+		}
+		frame.Data[i/2] = uint8(v)
+	}
+	frame.Length = uint8(len(dataPart) / 2)
+	return Record{Timestamp: ts, Bus: fields[1], Frame: frame}, nil
+}
+
+func parseEpoch(raw string) (time.Time, error) {
+	secPart, fracPart, _ := strings.Cut(raw, ".")
+	sec, err := strconv.ParseInt(secPart, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var nanos int64
+	if fracPart != "" {
+		if len(fracPart) > 9 {
+			fracPart = fracPart[:9]
+		}
+		nanos, err = strconv.ParseInt(fracPart+strings.Repeat("0", 9-len(fracPart)), 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+	return time.Unix(sec, nanos), nil
+}
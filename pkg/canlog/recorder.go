@@ -0,0 +1,217 @@
+package canlog
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brutella/can"
+)
+
+const (
+	defaultMaxBytes = 64 * 1024 * 1024
+	flushInterval   = time.Second
+)
+
+type Config struct {
+	// Dir is the directory the candump files are written to.
+	Dir string
+	// MaxBytes rotates to a new file once the current one reaches this size, defaults to 64MB.
+	MaxBytes int64
+	// MaxFiles removes the oldest files once there are more than this many, 0 keeps everything.
+	MaxFiles int
+}
+
+// Recorder writes frames from one or more buses to rotating `candump -l` files.
+type Recorder struct {
+	cfg Config
+
+	mu      sync.Mutex
+	file    *os.File
+	buf     *bufio.Writer
+	written int64
+	closed  bool
+	path    string
+	base    string
+	seq     int
+
+	closeCh chan struct{}
+	doneCh  chan struct{}
+}
+
+func NewRecorder(cfg Config) (*Recorder, error) {
+	if cfg.Dir == "" {
+		return nil, fmt.Errorf("candump directory is required")
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = defaultMaxBytes
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	r := &Recorder{
+		cfg:     cfg,
+		closeCh: make(chan struct{}),
+		doneCh:  make(chan struct{}),
+	}
+	if err := r.rotate(); err != nil {
+		return nil, err
+	}
+	go r.run()
+	return r, nil
+}
+
+// Handler returns a can.Handler which records the frames it receives as coming from the named bus.
+func (r *Recorder) Handler(bus string) can.Handler {
+	return can.NewHandler(func(frame can.Frame) {
+		r.Write(Record{
+			Timestamp: time.Now(),
+			Bus:       bus,
+			Frame:     frame,
+		})
+	})
+}
+
+func (r *Recorder) Write(rec Record) {
+	line := FormatCandump(rec) + "\n"
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	if r.written+int64(len(line)) > r.cfg.MaxBytes {
+		if err := r.rotate(); err != nil {
+			log.Println("Failed to rotate candump file:", err)
+			return
+		}
+	}
+	n, err := r.buf.WriteString(line)
+	r.written += int64(n)
+	if err != nil {
+		log.Println("Failed to write candump file:", err)
+	}
+}
+
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	r.mu.Unlock()
+	close(r.closeCh)
+	<-r.doneCh
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closeFile()
+}
+
+func (r *Recorder) run() {
+	defer close(r.doneCh)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.mu.Lock()
+			if err := r.buf.Flush(); err != nil {
+				log.Println("Failed to flush candump file:", err)
+			}
+			r.mu.Unlock()
+		case <-r.closeCh:
+			return
+		}
+	}
+}
+
+// rotate must be called with mu held.
+func (r *Recorder) rotate() error {
+	if err := r.closeFile(); err != nil {
+		log.Println("Failed to close candump file:", err)
+	}
+	base := "candump-" + time.Now().Format("2006-01-02_150405")
+	if base == r.base {
+		r.seq++
+	} else {
+		r.base = base
+		r.seq = 0
+	}
+	path := filepath.Join(r.cfg.Dir, base+".log")
+	if r.seq > 0 {
+		// Rotating more than once a second needs a suffix to not overwrite the previous file
+		path = filepath.Join(r.cfg.Dir, fmt.Sprintf("%s-%d.log", base, r.seq))
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	log.Println("Recording CAN frames to", path)
+	r.file = f
+	r.path = path
+	r.buf = bufio.NewWriterSize(f, 64*1024)
+	r.written = 0
+	r.prune()
+	return nil
+}
+
+func (r *Recorder) closeFile() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.buf.Flush()
+	if cerr := r.file.Close(); err == nil {
+		err = cerr
+	}
+	r.file = nil
+	r.buf = nil
+	return err
+}
+
+// prune removes the oldest candump files beyond MaxFiles, in the order they were created.
+func (r *Recorder) prune() {
+	if r.cfg.MaxFiles <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(filepath.Join(r.cfg.Dir, "candump-*.log"))
+	if err != nil {
+		log.Println("Failed to list candump files:", err)
+		return
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		baseI, seqI := rotation(matches[i])
+		baseJ, seqJ := rotation(matches[j])
+		if baseI != baseJ {
+			return baseI < baseJ
+		}
+		return seqI < seqJ
+	})
+	for i := 0; len(matches)-i > r.cfg.MaxFiles; i++ {
+		if matches[i] == r.path {
+			continue
+		}
+		if err := os.Remove(matches[i]); err != nil {
+			log.Println("Failed to remove candump file:", err)
+		}
+	}
+}
+
+// rotation splits a candump file name into the time it was created, which sorts as text, and the sequence number of
+// files rotated within the same second, which doesn't.
+func rotation(path string) (string, int) {
+	name := strings.TrimSuffix(filepath.Base(path), ".log")
+	if i := strings.LastIndex(name, "-"); i > strings.LastIndex(name, "_") {
+		if seq, err := strconv.Atoi(name[i+1:]); err == nil {
+			return name[:i], seq
+		}
+	}
+	return name, 0
+}
@@ -0,0 +1,43 @@
+package canlog
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestRecorderPrune(t *testing.T) {
+	dir := t.TempDir()
+	// Oldest first
+	names := []string{
+		"candump-2024-03-05_143014.log",
+		"candump-2024-03-05_143015.log",
+		"candump-2024-03-05_143015-2.log",
+		"candump-2024-03-05_143015-10.log",
+		"candump-2024-03-05_143015-11.log",
+		"candump-2024-03-05_143016.log",
+	}
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := &Recorder{cfg: Config{Dir: dir, MaxFiles: 3}, path: filepath.Join(dir, names[len(names)-1])}
+	r.prune()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Name())
+	}
+	want := append([]string(nil), names[3:]...)
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("kept %v, want %v", got, want)
+	}
+}
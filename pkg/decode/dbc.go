@@ -0,0 +1,301 @@
+package decode
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var (
+	messageRe = regexp.MustCompile(`^BO_\s+(\d+)\s+(\w+)\s*:`)
+	signalRe  = regexp.MustCompile(`^SG_\s+(\w+)\s*(M|m\d+M?)?\s*:\s*(\d+)\|(\d+)@([01])([+-])\s*\(\s*([^,\s]+)\s*,\s*([^)\s]+)\s*\)\s*\[[^\]]*\]\s*"([^"]*)"`)
+)
+
+// LoadDBC reads the messages, signals, multiplexers and value tables from a DBC file.
+func LoadDBC(path string) ([]Signal, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseDBC(f)
+}
+
+// ParseDBC parses DBC content, statements other than BO_, SG_, VAL_TABLE_ and VAL_ are ignored.
+func ParseDBC(r io.Reader) ([]Signal, error) {
+	signals := []Signal{}
+	index := map[string]int{}
+	tables := map[string]map[int64]string{}
+	// VAL_ may reference a table defined later in the file so they are resolved at the end
+	type valueRef struct {
+		key    string
+		values map[int64]string
+		table  string
+	}
+	var refs []valueRef
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	var (
+		currID   uint32
+		inMsg    bool
+		lineNum  int
+		pending  strings.Builder
+		inStmt   bool
+		stmtLine int
+	)
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if inStmt {
+			pending.WriteString("\n")
+			pending.WriteString(line)
+			if !statementComplete(pending.String()) {
+				continue
+			}
+			line = pending.String()
+			pending.Reset()
+			inStmt = false
+		} else if isTerminatedStatement(line) && !statementComplete(line) {
+			pending.WriteString(line)
+			inStmt = true
+			stmtLine = lineNum
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(line, "BO_ "):
+			m := messageRe.FindStringSubmatch(line)
+			if m == nil {
+				return nil, fmt.Errorf("dbc line %d: invalid message definition", lineNum)
+			}
+			id, err := strconv.ParseUint(m[1], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("dbc line %d: invalid message id: %w", lineNum, err)
+			}
+			currID = uint32(id)
+			inMsg = true
+		case strings.HasPrefix(line, "SG_ "):
+			if !inMsg {
+				return nil, fmt.Errorf("dbc line %d: signal outside of a message", lineNum)
+			}
+			sig, err := parseSignal(line)
+			if err != nil {
+				return nil, fmt.Errorf("dbc line %d: %w", lineNum, err)
+			}
+			sig.ID = currID
+			index[signalKey(currID, sig.Name)] = len(signals)
+			signals = append(signals, sig)
+		case strings.HasPrefix(line, "VAL_TABLE_ "):
+			fields := tokenize(strings.TrimSuffix(line, ";"))
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("dbc line %d: invalid value table", stmtLineOr(stmtLine, lineNum))
+			}
+			values, err := parseValues(fields[2:])
+			if err != nil {
+				return nil, fmt.Errorf("dbc line %d: %w", stmtLineOr(stmtLine, lineNum), err)
+			}
+			tables[fields[1]] = values
+		case strings.HasPrefix(line, "VAL_ "):
+			fields := tokenize(strings.TrimSuffix(line, ";"))
+			if len(fields) < 3 {
+				return nil, fmt.Errorf("dbc line %d: invalid value description", stmtLineOr(stmtLine, lineNum))
+			}
+			id, err := strconv.ParseUint(fields[1], 10, 32)
+			if err != nil {
+				// Value descriptions for environment variables have no message id
+				continue
+			}
+			ref := valueRef{key: signalKey(uint32(id), fields[2])}
+			if len(fields) == 4 {
+				ref.table = fields[3]
+			} else {
+				ref.values, err = parseValues(fields[3:])
+				if err != nil {
+					return nil, fmt.Errorf("dbc line %d: %w", stmtLineOr(stmtLine, lineNum), err)
+				}
+			}
+			refs = append(refs, ref)
+		}
+		stmtLine = 0
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if inStmt {
+		return nil, fmt.Errorf("dbc line %d: unterminated statement", stmtLine)
+	}
+	for _, ref := range refs {
+		i, ok := index[ref.key]
+		if !ok {
+			continue
+		}
+		if ref.table != "" {
+			signals[i].Values = tables[ref.table]
+		} else {
+			signals[i].Values = ref.values
+		}
+	}
+	return signals, nil
+}
+
+func parseSignal(line string) (Signal, error) {
+	m := signalRe.FindStringSubmatch(line)
+	if m == nil {
+		return Signal{}, fmt.Errorf("invalid signal definition")
+	}
+	start, err := strconv.ParseUint(m[3], 10, 8)
+	if err != nil {
+		return Signal{}, fmt.Errorf("invalid start bit: %w", err)
+	}
+	length, err := strconv.ParseUint(m[4], 10, 8)
+	if err != nil {
+		return Signal{}, fmt.Errorf("invalid length: %w", err)
+	}
+	scale, err := strconv.ParseFloat(m[7], 64)
+	if err != nil {
+		return Signal{}, fmt.Errorf("invalid scale: %w", err)
+	}
+	offset, err := strconv.ParseFloat(m[8], 64)
+	if err != nil {
+		return Signal{}, fmt.Errorf("invalid offset: %w", err)
+	}
+	sig := Signal{
+		Name:     m[1],
+		StartBit: uint8(start),
+		Length:   uint8(length),
+		Signed:   m[6] == "-",
+		Scale:    scale,
+		Offset:   offset,
+		Unit:     m[9],
+		Metric:   MetricName(m[1]),
+	}
+	if m[5] == "0" {
+		sig.ByteOrder = BigEndian
+	}
+	switch mux := m[2]; {
+	case mux == "M":
+		sig.Multiplexor = true
+	case strings.HasPrefix(mux, "m"):
+		// Extended multiplexing (m1M) is treated as a plain multiplexed signal
+		val, err := strconv.ParseInt(strings.TrimSuffix(mux[1:], "M"), 10, 64)
+		if err != nil {
+			return Signal{}, fmt.Errorf("invalid multiplexer value: %w", err)
+		}
+		sig.Multiplexed = true
+		sig.MuxValue = val
+	}
+	return sig, nil
+}
+
+func parseValues(fields []string) (map[int64]string, error) {
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("value descriptions must be value/description pairs")
+	}
+	values := make(map[int64]string, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		val, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q: %w", fields[i], err)
+		}
+		values[int64(val)] = fields[i+1]
+	}
+	return values, nil
+}
+
+// MetricName converts a DBC signal name like BatteryCurrent or LB_Current into battery_current or lb_current.
+func MetricName(name string) string {
+	var b strings.Builder
+	runes := []rune(name)
+	for i, r := range runes {
+		if unicode.IsUpper(r) && i > 0 && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]) ||
+			(i+1 < len(runes) && unicode.IsUpper(runes[i-1]) && unicode.IsLower(runes[i+1]))) {
+			b.WriteRune('_')
+		}
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(unicode.ToLower(r))
+		} else {
+			b.WriteRune('_')
+		}
+	}
+	return strings.Trim(strings.ReplaceAll(b.String(), "__", "_"), "_")
+}
+
+func signalKey(id uint32, name string) string {
+	return strconv.FormatUint(uint64(id), 10) + "/" + name
+}
+
+// isTerminatedStatement reports whether the line starts a statement which ends with a semicolon and may span lines.
+func isTerminatedStatement(line string) bool {
+	for _, prefix := range []string{"CM_ ", "VAL_ ", "VAL_TABLE_ ", "BA_ ", "BA_DEF_ ", "BA_DEF_DEF_ ", "SIG_VALTYPE_ ", "SIG_GROUP_ "} {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// statementComplete reports whether the statement ends with a semicolon outside of a quoted string.
+func statementComplete(stmt string) bool {
+	inQuote := false
+	complete := false
+	for i := 0; i < len(stmt); i++ {
+		switch c := stmt[i]; {
+		case c == '\\' && inQuote:
+			i++
+		case c == '"':
+			inQuote = !inQuote
+		case c == ';' && !inQuote:
+			complete = true
+		case !inQuote && !unicode.IsSpace(rune(c)):
+			complete = false
+		}
+	}
+	return complete
+}
+
+// tokenize splits a statement on whitespace keeping quoted strings together without their quotes.
+func tokenize(stmt string) []string {
+	var (
+		tokens  []string
+		current strings.Builder
+		inQuote bool
+		quoted  bool
+	)
+	flush := func() {
+		if current.Len() > 0 || quoted {
+			tokens = append(tokens, current.String())
+		}
+		current.Reset()
+		quoted = false
+	}
+	for i := 0; i < len(stmt); i++ {
+		c := stmt[i]
+		switch {
+		case c == '\\' && inQuote && i+1 < len(stmt):
+			i++
+			current.WriteByte(stmt[i])
+		case c == '"':
+			inQuote = !inQuote
+			quoted = true
+		case !inQuote && unicode.IsSpace(rune(c)):
+			flush()
+		default:
+			current.WriteByte(c)
+		}
+	}
+	flush()
+	return tokens
+}
+
+func stmtLineOr(stmtLine int, lineNum int) int {
+	if stmtLine > 0 {
+		return stmtLine
+	}
+	return lineNum
+}
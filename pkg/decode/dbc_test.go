@@ -0,0 +1,111 @@
+package decode
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDBC(t *testing.T) {
+	tests := []struct {
+		name    string
+		dbc     string
+		want    []Signal
+		wantErr string
+	}{
+		{
+			name: "message and signals",
+			dbc: `VERSION ""
+
+BO_ 475 VCM_1DB: 8 VCM
+ SG_ LB_Current : 7|11@0- (-0.5,0) [-1000|1000] "A" Vector__XXX
+ SG_ LB_Voltage : 23|10@0+ (0.5,0) [0|500] "V" Vector__XXX
+BO_ 2 STEER: 2 XXX
+ SG_ SteeringPosition : 0|16@1- (1,0) [0|0] "" Vector__XXX
+`,
+			want: []Signal{
+				{ID: 475, Name: "LB_Current", StartBit: 7, Length: 11, ByteOrder: BigEndian, Signed: true, Scale: -0.5, Unit: "A", Metric: "lb_current"},
+				{ID: 475, Name: "LB_Voltage", StartBit: 23, Length: 10, ByteOrder: BigEndian, Scale: 0.5, Unit: "V", Metric: "lb_voltage"},
+				{ID: 2, Name: "SteeringPosition", StartBit: 0, Length: 16, Signed: true, Scale: 1, Metric: "steering_position"},
+			},
+		},
+		{
+			name: "multiplexed signals",
+			dbc: `BO_ 1979 LBC_7BB: 8 LBC
+ SG_ Group M : 0|8@1+ (1,0) [0|255] "" Vector__XXX
+ SG_ CellVolts m2 : 8|16@1+ (0.001,0) [0|5] "V" Vector__XXX
+ SG_ Ext m3M : 24|8@1+ (1,0) [0|255] "" Vector__XXX
+`,
+			want: []Signal{
+				{ID: 1979, Name: "Group", Length: 8, Scale: 1, Metric: "group", Multiplexor: true},
+				{ID: 1979, Name: "CellVolts", StartBit: 8, Length: 16, Scale: 0.001, Unit: "V", Metric: "cell_volts", Multiplexed: true, MuxValue: 2},
+				{ID: 1979, Name: "Ext", StartBit: 24, Length: 8, Scale: 1, Metric: "ext", Multiplexed: true, MuxValue: 3},
+			},
+		},
+		{
+			name: "value descriptions and tables",
+			dbc: `VAL_TABLE_ OnOff 1 "On" 0 "Off" ;
+BO_ 282 VCM_11A: 8 VCM
+ SG_ KeyState : 15|3@0+ (1,0) [0|7] "" Vector__XXX
+ SG_ Lights : 16|1@1+ (1,0) [0|1] "" Vector__XXX
+VAL_ 282 KeyState 4 "Off"
+ 2 "On" ;
+VAL_ 282 Lights OnOff ;
+VAL_ Unknown 1 "ignored" ;
+`,
+			want: []Signal{
+				{ID: 282, Name: "KeyState", StartBit: 15, Length: 3, ByteOrder: BigEndian, Scale: 1, Metric: "key_state", Values: map[int64]string{4: "Off", 2: "On"}},
+				{ID: 282, Name: "Lights", StartBit: 16, Length: 1, Scale: 1, Metric: "lights", Values: map[int64]string{1: "On", 0: "Off"}},
+			},
+		},
+		{
+			name:    "signal outside of a message",
+			dbc:     ` SG_ Orphan : 0|8@1+ (1,0) [0|255] "" Vector__XXX`,
+			wantErr: "dbc line 1: signal outside of a message",
+		},
+		{
+			name: "invalid signal",
+			dbc: `BO_ 1 M: 8 X
+ SG_ Broken : 0|8 (1,0) [0|255] "" Vector__XXX`,
+			wantErr: "dbc line 2: invalid signal definition",
+		},
+		{
+			name:    "unterminated value description",
+			dbc:     `VAL_ 1 Sig 1 "One"`,
+			wantErr: "dbc line 1: unterminated statement",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseDBC(strings.NewReader(tt.dbc))
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("ParseDBC() error = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseDBC() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseDBC() =\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetricName(t *testing.T) {
+	tests := map[string]string{
+		"BatteryCurrent": "battery_current",
+		"LB_Current":     "lb_current",
+		"VCMState2":      "vcm_state2",
+		"HVBatSOC":       "hv_bat_soc",
+		"speed_mph":      "speed_mph",
+		"Cell-Volts":     "cell_volts",
+	}
+	for name, want := range tests {
+		if got := MetricName(name); got != want {
+			t.Errorf("MetricName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package decode
+
+// Leaf holds the signals leafbus decodes from the Nissan Leaf car and EV CAN buses.
+var Leaf = []Signal{
+	// Steering Position
+	{ID: 0x002, Name: "steering_position", StartBit: 0, Length: 16, ByteOrder: LittleEndian, Signed: true, Scale: 1, Metric: "steering_position"},
+
+	// Gear and Key/Off/On, 0b100 is off and 0b010 is on
+	{ID: 0x11A, Name: "key_state", StartBit: 15, Length: 3, ByteOrder: BigEndian, Scale: 1},
+
+	// Throttle Position and Motor Amps, throttle max is 800 and motor amps is always positive
+	{ID: 0x180, Name: "motor_amps", StartBit: 23, Length: 12, ByteOrder: BigEndian, Scale: 1, Unit: "A", Metric: "motor_amps"},
+	{ID: 0x180, Name: "throttle_percent", StartBit: 47, Length: 10, ByteOrder: BigEndian, Scale: 100.0 / 800.0, Unit: "%", Metric: "throttle_percent"},
+
+	// Target brake position
+	{ID: 0x1CB, Name: "target_brake", StartBit: 23, Length: 10, ByteOrder: BigEndian, Scale: 1, Metric: "target_brake"},
+
+	// Motor Torque and Speed
+	{ID: 0x1DA, Name: "effective_torque", StartBit: 18, Length: 11, ByteOrder: BigEndian, Signed: true, Scale: 1, Unit: "Nm", Metric: "effective_torque"},
+	{ID: 0x1DA, Name: "motor_rpm", StartBit: 39, Length: 16, ByteOrder: BigEndian, Signed: true, Scale: 1, Unit: "rpm", Metric: "motor_rpm"},
+
+	// Battery Current and Voltage
+	// Even though the doc says the LSB for current is 0.5 it seems to reflect the actual charger current
+	// more accurately when I don't ignore the last bit. The reading is inverted because I prefer it this way.
+	// batteryAmpsRaw reproduces the layout of the original decoder, D0<<3 | D1>>6 as it always has been stored, rather
+	// than the 11 bit DBC layout which would read a third bit of D1, so the signal has no bit position of its own.
+	{ID: 0x1DB, Name: "battery_amps", Signed: true, Scale: -1, Unit: "A", Metric: "battery_amps", RawFunc: batteryAmpsRaw},
+	{ID: 0x1DB, Name: "battery_volts", StartBit: 23, Length: 10, ByteOrder: BigEndian, Scale: 0.5, Unit: "V", Metric: "battery_volts"},
+
+	// Speed
+	{ID: 0x280, Name: "speed_mph", StartBit: 39, Length: 16, ByteOrder: BigEndian, Scale: 0.0062, Unit: "mph", Metric: "speed_mph"},
+
+	// Friction Brake Pressure
+	{ID: 0x292, Name: "friction_brake_pressure", StartBit: 55, Length: 8, ByteOrder: BigEndian, Scale: 1, Metric: "friction_brake_pressure"},
+
+	// Turn Signal
+	{ID: 0x358, Name: "turn_left", StartBit: 17, Length: 1, ByteOrder: BigEndian, Scale: 1},
+	{ID: 0x358, Name: "turn_right", StartBit: 18, Length: 1, ByteOrder: BigEndian, Scale: 1},
+
+	// Climate control power
+	{ID: 0x510, Name: "climate_control_kw", StartBit: 30, Length: 6, ByteOrder: BigEndian, Scale: 0.25, Unit: "kW", Metric: "climate_control_kw"},
+
+	// SOC
+	{ID: 0x55B, Name: "soc", StartBit: 7, Length: 10, ByteOrder: BigEndian, Scale: 0.1, Unit: "%", Metric: "soc"},
+
+	// GID
+	{ID: 0x5B3, Name: "gids", StartBit: 32, Length: 9, ByteOrder: BigEndian, Scale: 1, Metric: "gids"},
+
+	// Odometer
+	{ID: 0x5C5, Name: "odometer", StartBit: 15, Length: 24, ByteOrder: BigEndian, Scale: 1, Metric: "odometer"},
+
+	// Headlights
+	{ID: 0x625, Name: "parking_lights", StartBit: 14, Length: 1, ByteOrder: BigEndian, Scale: 1},
+	{ID: 0x625, Name: "low_beams", StartBit: 13, Length: 1, ByteOrder: BigEndian, Scale: 1},
+	{ID: 0x625, Name: "high_beams", StartBit: 12, Length: 1, ByteOrder: BigEndian, Scale: 1},
+}
+
+func batteryAmpsRaw(data [8]uint8) int64 {
+	return int64(int8(data[0]))<<3 | int64(data[1]>>6)
+}
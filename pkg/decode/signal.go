@@ -0,0 +1,161 @@
+package decode
+
+import (
+	"encoding/binary"
+	"math"
+	"time"
+
+	"github.com/brutella/can"
+)
+
+type ByteOrder int
+
+const (
+	// LittleEndian is the Intel layout, StartBit is the least significant bit of the signal.
+	LittleEndian ByteOrder = iota
+	// BigEndian is the Motorola layout, StartBit is the most significant bit of the signal
+	// using the DBC sawtooth bit numbering (byte*8 + bit, bit 7 is the MSB of the byte).
+	BigEndian
+)
+
+// Signal describes where a value lives inside a CAN frame and how to scale it.
+type Signal struct {
+	ID        uint32
+	Name      string
+	StartBit  uint8
+	Length    uint8
+	ByteOrder ByteOrder
+	Signed    bool
+	Scale     float64
+	Offset    float64
+	Unit      string
+	// Metric is the name passed to SendMetric, signals without a metric name are decoded
+	// and handed to the Sink but are not stored as metrics.
+	Metric string
+	// Multiplexor marks the signal selecting which multiplexed signals are present in the frame.
+	Multiplexor bool
+	// Multiplexed signals are only decoded when the multiplexor raw value equals MuxValue.
+	Multiplexed bool
+	MuxValue    int64
+	// Values maps raw values to their description, from DBC value tables.
+	Values map[int64]string
+	// RawFunc replaces the bit extraction for signals whose existing data wasn't decoded with a DBC layout.
+	RawFunc func(data [8]uint8) int64
+}
+
+// Raw extracts the unscaled value of the signal from the frame data, sign extended if the signal is signed.
+func (s *Signal) Raw(data [8]uint8) int64 {
+	if s.RawFunc != nil {
+		return s.RawFunc(data)
+	}
+	if s.Length == 0 || s.Length > 64 {
+		return 0
+	}
+	var raw uint64
+	if s.ByteOrder == BigEndian {
+		word := binary.BigEndian.Uint64(data[:])
+		pos := uint(s.StartBit/8)*8 + uint(7-s.StartBit%8)
+		if pos+uint(s.Length) > 64 {
+			return 0
+		}
+		raw = word >> (64 - pos - uint(s.Length))
+	} else {
+		word := binary.LittleEndian.Uint64(data[:])
+		if uint(s.StartBit)+uint(s.Length) > 64 {
+			return 0
+		}
+		raw = word >> s.StartBit
+	}
+	if s.Length < 64 {
+		raw &= (1 << s.Length) - 1
+	}
+	if s.Signed && s.Length < 64 && raw&(1<<(s.Length-1)) != 0 {
+		raw |= ^uint64(0) << s.Length
+	}
+	return int64(raw)
+}
+
+// Value returns the scaled value of the signal.
+func (s *Signal) Value(data [8]uint8) float64 {
+	raw := s.Raw(data)
+	if s.Signed {
+		return float64(raw)*s.Scale + s.Offset
+	}
+	return float64(uint64(raw))*s.Scale + s.Offset
+}
+
+// Description looks up the value table entry for a scaled value.
+func (s *Signal) Description(val float64) (string, bool) {
+	if len(s.Values) == 0 || s.Scale == 0 {
+		return "", false
+	}
+	desc, ok := s.Values[int64(math.Round((val-s.Offset)/s.Scale))]
+	return desc, ok
+}
+
+// Sink receives every signal decoded from a frame.
+type Sink interface {
+	HandleSignal(sig *Signal, ts time.Time, val float64)
+}
+
+// Decoder maps frame IDs to the signals carried in them.
+type Decoder struct {
+	messages map[uint32]*message
+}
+
+type message struct {
+	mux     *Signal
+	signals []*Signal
+}
+
+func NewDecoder(signals []Signal) *Decoder {
+	d := &Decoder{
+		messages: map[uint32]*message{},
+	}
+	d.Add(signals...)
+	return d
+}
+
+// Add registers additional signal definitions, signals sharing a frame ID are decoded in the order they were added.
+func (d *Decoder) Add(signals ...Signal) {
+	for i := range signals {
+		sig := signals[i]
+		m, ok := d.messages[sig.ID]
+		if !ok {
+			m = &message{}
+			d.messages[sig.ID] = m
+		}
+		if sig.Multiplexor && m.mux == nil {
+			m.mux = &sig
+		}
+		m.signals = append(m.signals, &sig)
+	}
+}
+
+// Signals returns the definitions registered for a frame ID.
+func (d *Decoder) Signals(id uint32) []*Signal {
+	m, ok := d.messages[id]
+	if !ok {
+		return nil
+	}
+	return m.signals
+}
+
+// Decode hands every signal present in the frame to the sink, it returns false if the ID is unknown.
+func (d *Decoder) Decode(frame can.Frame, ts time.Time, sink Sink) bool {
+	m, ok := d.messages[frame.ID]
+	if !ok {
+		return false
+	}
+	var muxVal int64
+	if m.mux != nil {
+		muxVal = m.mux.Raw(frame.Data)
+	}
+	for _, sig := range m.signals {
+		if sig.Multiplexed && (m.mux == nil || sig.MuxValue != muxVal) {
+			continue
+		}
+		sink.HandleSignal(sig, ts, sig.Value(frame.Data))
+	}
+	return true
+}
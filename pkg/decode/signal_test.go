@@ -0,0 +1,186 @@
+package decode
+
+import (
+	"math"
+	"testing"
+)
+
+// legacyLeaf is how the hand written decoder in push.Handler computed each Leaf signal before the signals were
+// described as DBC layouts, stored data must keep decoding to the same values.
+var legacyLeaf = map[string]func(d [8]uint8) float64{
+	"steering_position": func(d [8]uint8) float64 {
+		return float64(int16(uint16(d[1])<<8 | uint16(d[0])))
+	},
+	"key_state": func(d [8]uint8) float64 {
+		return float64(d[1] >> 5)
+	},
+	"motor_amps": func(d [8]uint8) float64 {
+		return float64((uint16(d[2]) << 4) | (uint16(d[3]) >> 4))
+	},
+	"throttle_percent": func(d [8]uint8) float64 {
+		return float64((uint16(d[5])<<2)|(uint16(d[6])>>6)) / 800 * 100
+	},
+	"target_brake": func(d [8]uint8) float64 {
+		return float64((uint16(d[2]) << 2) | (uint16(d[3]) >> 6))
+	},
+	"effective_torque": func(d [8]uint8) float64 {
+		var torque int16
+		if d[2]&0b00000100 == 0b00000100 {
+			torque = int16(((uint16(d[2]&0b00000111) << 8) | 0b1111100000000000) | uint16(d[3]))
+		} else {
+			torque = int16(((uint16(d[2]&0b00000111) << 8) & 0b0000011111111111) | uint16(d[3]))
+		}
+		return float64(torque)
+	},
+	"motor_rpm": func(d [8]uint8) float64 {
+		return float64(int16(uint16(d[4])<<8 | uint16(d[5])))
+	},
+	"battery_amps": func(d [8]uint8) float64 {
+		var current int16
+		if d[0]&0b10000000 == 0b10000000 {
+			current = int16((uint16(d[0]) << 3) | 0b1111100000000000 | uint16(d[1]>>6))
+		} else {
+			current = int16((uint16(d[0])<<3)&0b0000011111111111 | uint16(d[1]>>6))
+		}
+		return float64(-current)
+	},
+	"battery_volts": func(d [8]uint8) float64 {
+		return float64((uint16(d[2])<<2)|(uint16(d[3]&0b11000000)>>6)) * 0.5
+	},
+	"speed_mph": func(d [8]uint8) float64 {
+		return float64(uint16(d[4])<<8|uint16(d[5])) * 0.0062
+	},
+	"friction_brake_pressure": func(d [8]uint8) float64 {
+		return float64(d[6])
+	},
+	"turn_left": func(d [8]uint8) float64 {
+		return float64(d[2] >> 1 & 1)
+	},
+	"turn_right": func(d [8]uint8) float64 {
+		return float64(d[2] >> 2 & 1)
+	},
+	"climate_control_kw": func(d [8]uint8) float64 {
+		return float64(d[3]>>1&0b00111111) * 0.25
+	},
+	"soc": func(d [8]uint8) float64 {
+		return float64((uint16(d[0])<<2)|(uint16(d[1])>>6)) / 10
+	},
+	"gids": func(d [8]uint8) float64 {
+		return float64(uint16(d[4]&0b00000001)<<8 | uint16(d[5]))
+	},
+	"odometer": func(d [8]uint8) float64 {
+		return float64(uint32(d[1])<<16 | uint32(d[2])<<8 | uint32(d[3]))
+	},
+	"parking_lights": func(d [8]uint8) float64 {
+		return float64(d[1] >> 6 & 1)
+	},
+	"low_beams": func(d [8]uint8) float64 {
+		return float64(d[1] >> 5 & 1)
+	},
+	"high_beams": func(d [8]uint8) float64 {
+		return float64(d[1] >> 4 & 1)
+	},
+}
+
+func TestLeafMatchesLegacyDecoder(t *testing.T) {
+	frames := map[string][8]uint8{
+		"zero":        {},
+		"ones":        {0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF},
+		"alternating": {0xAA, 0x55, 0xAA, 0x55, 0xAA, 0x55, 0xAA, 0x55},
+		"inverse":     {0x55, 0xAA, 0x55, 0xAA, 0x55, 0xAA, 0x55, 0xAA},
+		"charging":    {0x03, 0x40, 0x2E, 0xC0, 0x01, 0x23, 0x00, 0x00},
+		"driving":     {0xF8, 0xC0, 0x2D, 0x80, 0x1A, 0x2B, 0x3C, 0x4D},
+		"counting":    {0x01, 0x23, 0x45, 0x67, 0x89, 0xAB, 0xCD, 0xEF},
+	}
+	for i := range Leaf {
+		sig := &Leaf[i]
+		legacy, ok := legacyLeaf[sig.Name]
+		if !ok {
+			t.Errorf("no legacy decoding for %s", sig.Name)
+			continue
+		}
+		for name, data := range frames {
+			// Scales like 0.1 instead of dividing by 10 round differently in the last bit
+			if got, want := sig.Value(data), legacy(data); math.Abs(got-want) > 1e-9 {
+				t.Errorf("%s of %s frame %x = %v, want %v", sig.Name, name, data, got, want)
+			}
+		}
+	}
+}
+
+func TestSignalRaw(t *testing.T) {
+	tests := []struct {
+		name string
+		sig  Signal
+		data [8]uint8
+		want int64
+	}{
+		{
+			name: "little endian byte",
+			sig:  Signal{StartBit: 8, Length: 8},
+			data: [8]uint8{0x00, 0x7F},
+			want: 0x7F,
+		},
+		{
+			name: "little endian across bytes",
+			sig:  Signal{StartBit: 4, Length: 12},
+			data: [8]uint8{0x30, 0x12},
+			want: 0x123,
+		},
+		{
+			name: "little endian signed",
+			sig:  Signal{StartBit: 0, Length: 16, Signed: true},
+			data: [8]uint8{0xFE, 0xFF},
+			want: -2,
+		},
+		{
+			name: "big endian across bytes",
+			sig:  Signal{StartBit: 7, Length: 12, ByteOrder: BigEndian},
+			data: [8]uint8{0x12, 0x30},
+			want: 0x123,
+		},
+		{
+			name: "big endian inside a byte",
+			sig:  Signal{StartBit: 13, Length: 3, ByteOrder: BigEndian},
+			data: [8]uint8{0x00, 0b00111000},
+			want: 0b111,
+		},
+		{
+			name: "big endian signed",
+			sig:  Signal{StartBit: 7, Length: 8, ByteOrder: BigEndian, Signed: true},
+			data: [8]uint8{0x80},
+			want: -128,
+		},
+		{
+			name: "whole frame",
+			sig:  Signal{StartBit: 0, Length: 64},
+			data: [8]uint8{1, 2, 3, 4, 5, 6, 7, 8},
+			want: 0x0807060504030201,
+		},
+		{
+			name: "past the end of the frame",
+			sig:  Signal{StartBit: 60, Length: 8},
+			data: [8]uint8{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF},
+			want: 0,
+		},
+		{
+			name: "no length",
+			sig:  Signal{StartBit: 0},
+			data: [8]uint8{0xFF},
+			want: 0,
+		},
+		{
+			name: "raw func",
+			sig:  Signal{StartBit: 0, Length: 8, RawFunc: func(d [8]uint8) int64 { return int64(d[7]) }},
+			data: [8]uint8{1, 0, 0, 0, 0, 0, 0, 9},
+			want: 9,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.sig.Raw(tt.data); got != tt.want {
+				t.Errorf("Raw(%x) = %d, want %d", tt.data, got, tt.want)
+			}
+		})
+	}
+}
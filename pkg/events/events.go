@@ -0,0 +1,177 @@
+package events
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// subscriberSize is the number of events buffered for each client before it is disconnected.
+	subscriberSize = 256
+	keepAlive      = 15 * time.Second
+)
+
+// Event is one server-sent event, Data is sent as JSON.
+type Event struct {
+	Type string
+	// Job is the job label of log events, used to filter them.
+	Job  string
+	Data interface{}
+}
+
+// Broker passes events to the connected clients. A client which falls behind is disconnected instead of missing
+// events, EventSource reconnects and starts again from a new snapshot.
+type Broker struct {
+	snapshot func() []Event
+
+	mu sync.Mutex
+	// subs maps each client's channel to the filter of the events it wants
+	subs map[chan Event]func(Event) bool
+}
+
+// NewBroker returns a broker which sends the events returned by snapshot to each client when it connects.
+func NewBroker(snapshot func() []Event) *Broker {
+	return &Broker{
+		snapshot: snapshot,
+		subs:     make(map[chan Event]func(Event) bool),
+	}
+}
+
+// Publish sends e to every client which wants it without blocking.
+func (b *Broker) Publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch, want := range b.subs {
+		// Filtered here so events a client doesn't want, such as camera frames, don't fill its buffer
+		if !want(e) {
+			continue
+		}
+		select {
+		case ch <- e:
+		default:
+			log.Println("events: client is too slow, disconnecting it")
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+func (b *Broker) subscribe(want func(Event) bool) chan Event {
+	ch := make(chan Event, subscriberSize)
+	b.mu.Lock()
+	b.subs[ch] = want
+	b.mu.Unlock()
+	return ch
+}
+
+func (b *Broker) unsubscribe(ch chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[ch]; ok {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// Register serves the events of broker as Server-Sent Events on /events. ?types= limits them to a comma separated
+// list of types and ?jobs= the log events to a list of jobs. Camera frames are only sent if jobs asks for them.
+func Register(mux *http.ServeMux, broker *Broker) {
+	if mux == nil {
+		mux = http.DefaultServeMux
+	}
+	mux.HandleFunc("GET /events", broker.handler)
+}
+
+func (b *Broker) handler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	query := r.URL.Query()
+	want := filter(splitSet(query.Get("types")), splitSet(query.Get("jobs")))
+
+	// Subscribe before the snapshot so nothing between the two is missed
+	ch := b.subscribe(want)
+	defer b.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if b.snapshot != nil {
+		for _, e := range b.snapshot() {
+			if want(e) {
+				if err := writeEvent(w, e); err != nil {
+					return
+				}
+			}
+		}
+	}
+	flusher.Flush()
+
+	ping := time.NewTicker(keepAlive)
+	defer ping.Stop()
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err := writeEvent(w, e); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-ping.C:
+			if _, err := w.Write([]byte(": ping\n\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// filter returns whether a client wants an event, types and jobs are the sets it asked for or nil for all of them.
+// Camera frames are left out unless jobs lists them.
+func filter(types map[string]bool, jobs map[string]bool) func(Event) bool {
+	return func(e Event) bool {
+		if types != nil && !types[e.Type] {
+			return false
+		}
+		if e.Job == "" {
+			return true
+		}
+		if jobs != nil {
+			return jobs[e.Job]
+		}
+		return e.Job != "camera"
+	}
+}
+
+func writeEvent(w http.ResponseWriter, e Event) error {
+	data, err := json.Marshal(e.Data)
+	if err != nil {
+		log.Printf("events: failed to marshal %s event: %v", e.Type, err)
+		return nil
+	}
+	_, err = w.Write([]byte("event: " + e.Type + "\ndata: " + string(data) + "\n\n"))
+	return err
+}
+
+func splitSet(raw string) map[string]bool {
+	if raw == "" {
+		return nil
+	}
+	set := make(map[string]bool)
+	for _, part := range strings.Split(raw, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			set[part] = true
+		}
+	}
+	return set
+}
@@ -0,0 +1,28 @@
+package events
+
+import "testing"
+
+func TestPublishFilters(t *testing.T) {
+	b := NewBroker(nil)
+	ch := b.subscribe(filter(nil, nil))
+	camera := b.subscribe(filter(nil, splitSet("camera")))
+	// More camera frames than a client buffers, the client which doesn't want them must stay connected
+	for i := 0; i < 2*subscriberSize; i++ {
+		b.Publish(Event{Type: "log", Job: "camera"})
+	}
+	b.Publish(Event{Type: "status"})
+
+	b.mu.Lock()
+	_, connected := b.subs[ch]
+	_, cameraConnected := b.subs[camera]
+	b.mu.Unlock()
+	if !connected || len(ch) != 1 {
+		t.Errorf("client without camera frames connected = %v with %d events, want connected with the status event", connected, len(ch))
+	}
+	if e := <-ch; e.Type != "status" {
+		t.Errorf("got %s event, want status", e.Type)
+	}
+	if cameraConnected {
+		t.Errorf("client reading no camera frames is still connected, want it disconnected once its buffer is full")
+	}
+}
@@ -0,0 +1,185 @@
+package export
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+)
+
+// batchRows is the number of rows in each Arrow record batch.
+const batchRows = 4096
+
+// arrowEncoder writes an Arrow IPC stream. Integers become int64, except UBIGINT which stays uint64, floats and
+// decimals float64, timestamps microseconds in UTC and anything else, such as lists or intervals, strings.
+type arrowEncoder struct {
+	w       io.Writer
+	builder *array.RecordBuilder
+	writer  *ipc.Writer
+	rows    int
+}
+
+func arrowType(col *sql.ColumnType) arrow.DataType {
+	name := col.DatabaseTypeName()
+	switch {
+	case name == "BOOLEAN":
+		return arrow.FixedWidthTypes.Boolean
+	case name == "TINYINT", name == "SMALLINT", name == "INTEGER", name == "BIGINT",
+		name == "UTINYINT", name == "USMALLINT", name == "UINTEGER":
+		return arrow.PrimitiveTypes.Int64
+	case name == "UBIGINT":
+		return arrow.PrimitiveTypes.Uint64
+	case name == "FLOAT", name == "DOUBLE", strings.HasPrefix(name, "DECIMAL"):
+		return arrow.PrimitiveTypes.Float64
+	case strings.HasPrefix(name, "TIMESTAMP"):
+		return &arrow.TimestampType{Unit: arrow.Microsecond, TimeZone: "UTC"}
+	case name == "DATE":
+		return arrow.FixedWidthTypes.Date32
+	}
+	return arrow.BinaryTypes.String
+}
+
+func (e *arrowEncoder) Columns(cols []*sql.ColumnType) error {
+	fields := make([]arrow.Field, len(cols))
+	for i, col := range cols {
+		fields[i] = arrow.Field{Name: col.Name(), Type: arrowType(col), Nullable: true}
+	}
+	schema := arrow.NewSchema(fields, nil)
+	e.builder = array.NewRecordBuilder(memory.DefaultAllocator, schema)
+	e.writer = ipc.NewWriter(e.w, ipc.WithSchema(schema))
+	return nil
+}
+
+func (e *arrowEncoder) Row(values []interface{}) error {
+	for i, v := range values {
+		if err := appendValue(e.builder.Field(i), v); err != nil {
+			return fmt.Errorf("column %s: %w", e.builder.Schema().Field(i).Name, err)
+		}
+	}
+	e.rows++
+	if e.rows >= batchRows {
+		return e.flush()
+	}
+	return nil
+}
+
+func (e *arrowEncoder) flush() error {
+	if e.rows == 0 {
+		return nil
+	}
+	e.rows = 0
+	rec := e.builder.NewRecordBatch()
+	defer rec.Release()
+	return e.writer.Write(rec)
+}
+
+func (e *arrowEncoder) Close() error {
+	if e.writer == nil {
+		return nil
+	}
+	defer e.builder.Release()
+	if err := e.flush(); err != nil {
+		return err
+	}
+	return e.writer.Close()
+}
+
+func appendValue(b array.Builder, v interface{}) error {
+	if v == nil {
+		b.AppendNull()
+		return nil
+	}
+	switch b := b.(type) {
+	case *array.BooleanBuilder:
+		value, ok := v.(bool)
+		if !ok {
+			return fmt.Errorf("unexpected %T for BOOLEAN", v)
+		}
+		b.Append(value)
+	case *array.Int64Builder:
+		value, ok := toInt64(v)
+		if !ok {
+			return fmt.Errorf("unexpected %T for an integer", v)
+		}
+		b.Append(value)
+	case *array.Uint64Builder:
+		value, ok := v.(uint64)
+		if !ok {
+			return fmt.Errorf("unexpected %T for UBIGINT", v)
+		}
+		b.Append(value)
+	case *array.Float64Builder:
+		value, ok := toFloat64(v)
+		if !ok {
+			return fmt.Errorf("unexpected %T for a float", v)
+		}
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			b.AppendNull()
+			return nil
+		}
+		b.Append(value)
+	case *array.TimestampBuilder:
+		value, ok := v.(time.Time)
+		if !ok {
+			return fmt.Errorf("unexpected %T for a timestamp", v)
+		}
+		b.Append(arrow.Timestamp(value.UnixMicro()))
+	case *array.Date32Builder:
+		value, ok := v.(time.Time)
+		if !ok {
+			return fmt.Errorf("unexpected %T for DATE", v)
+		}
+		b.Append(arrow.Date32FromTime(value))
+	case *array.StringBuilder:
+		switch value := normalize(v).(type) {
+		case string:
+			b.Append(value)
+		case fmt.Stringer:
+			b.Append(value.String())
+		default:
+			b.Append(jsonString(value))
+		}
+	default:
+		return fmt.Errorf("unsupported builder %T", b)
+	}
+	return nil
+}
+
+func toInt64(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+func toFloat64(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	case interface{ Float64() float64 }:
+		return v.Float64(), true
+	}
+	return 0, false
+}
@@ -0,0 +1,169 @@
+package export
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format is a streaming output format for query results, named by its media type.
+type Format string
+
+const (
+	CSV    Format = "text/csv"
+	NDJSON Format = "application/x-ndjson"
+	Arrow  Format = "application/vnd.apache.arrow.stream"
+)
+
+var formats = []Format{CSV, NDJSON, Arrow}
+
+// Negotiate returns the first streaming format listed in an Accept header, false if it asks for none of them
+// and the regular JSON response should be used.
+func Negotiate(accept string) (Format, bool) {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		for _, f := range formats {
+			if mediaType == string(f) {
+				return f, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Encoder writes query results row by row, as passed by store.Writer.QueryRows.
+type Encoder interface {
+	Columns(cols []*sql.ColumnType) error
+	Row(values []interface{}) error
+	// Close writes anything still buffered and ends the stream.
+	Close() error
+}
+
+// NewEncoder returns an encoder writing f to w.
+func NewEncoder(f Format, w io.Writer) Encoder {
+	switch f {
+	case CSV:
+		return &csvEncoder{w: csv.NewWriter(w)}
+	case Arrow:
+		return &arrowEncoder{w: w}
+	default:
+		return &ndjsonEncoder{w: w}
+	}
+}
+
+type csvEncoder struct {
+	w      *csv.Writer
+	record []string
+}
+
+func (e *csvEncoder) Columns(cols []*sql.ColumnType) error {
+	header := make([]string, len(cols))
+	for i, col := range cols {
+		header[i] = col.Name()
+	}
+	e.record = make([]string, len(cols))
+	return e.w.Write(header)
+}
+
+func (e *csvEncoder) Row(values []interface{}) error {
+	for i, v := range values {
+		switch v := normalize(v).(type) {
+		case nil:
+			e.record[i] = ""
+		case string:
+			e.record[i] = v
+		case float64:
+			e.record[i] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool, int8, int16, int32, int64, uint8, uint16, uint32, uint64:
+			e.record[i] = fmt.Sprint(v)
+		default:
+			e.record[i] = jsonString(v)
+		}
+	}
+	return e.w.Write(e.record)
+}
+
+func (e *csvEncoder) Close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type ndjsonEncoder struct {
+	w     io.Writer
+	names [][]byte
+	line  []byte
+}
+
+func (e *ndjsonEncoder) Columns(cols []*sql.ColumnType) error {
+	e.names = make([][]byte, len(cols))
+	for i, col := range cols {
+		name, err := json.Marshal(col.Name())
+		if err != nil {
+			return err
+		}
+		e.names[i] = name
+	}
+	return nil
+}
+
+// Row writes the values as one JSON object with the keys in column order.
+func (e *ndjsonEncoder) Row(values []interface{}) error {
+	e.line = append(e.line[:0], '{')
+	for i, v := range values {
+		if i > 0 {
+			e.line = append(e.line, ',')
+		}
+		e.line = append(e.line, e.names[i]...)
+		e.line = append(e.line, ':')
+		value, err := json.Marshal(normalize(v))
+		if err != nil {
+			return err
+		}
+		e.line = append(e.line, value...)
+	}
+	e.line = append(e.line, '}', '\n')
+	_, err := e.w.Write(e.line)
+	return err
+}
+
+func (e *ndjsonEncoder) Close() error {
+	return nil
+}
+
+// normalize converts a scanned value to the form used by the text formats, like the JSON /query response:
+// timestamps as RFC3339 strings and NaN or infinite floats as null.
+func normalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	case float32:
+		return normalize(float64(v))
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil
+		}
+		return v
+	case interface{ Float64() float64 }:
+		// DECIMAL columns
+		return normalize(v.Float64())
+	}
+	return v
+}
+
+func jsonString(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
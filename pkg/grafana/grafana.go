@@ -0,0 +1,408 @@
+package grafana
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/slim-bean/leafbus/pkg/store"
+)
+
+const (
+	defaultMaxPoints = 1000
+	queryTimeout     = 10 * time.Second
+)
+
+type timeRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+type target struct {
+	Target  string          `json:"target"`
+	RefID   string          `json:"refId"`
+	Type    string          `json:"type"`
+	Hide    bool            `json:"hide"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+type queryRequest struct {
+	Range         timeRange `json:"range"`
+	IntervalMs    int64     `json:"intervalMs"`
+	MaxDataPoints int       `json:"maxDataPoints"`
+	Targets       []target  `json:"targets"`
+}
+
+type searchRequest struct {
+	Target string `json:"target"`
+}
+
+type annotationQuery struct {
+	Name   string `json:"name"`
+	Query  string `json:"query"`
+	Enable bool   `json:"enable"`
+}
+
+type annotationRequest struct {
+	Range      timeRange       `json:"range"`
+	Annotation annotationQuery `json:"annotation"`
+}
+
+type timeSeries struct {
+	Target     string           `json:"target"`
+	RefID      string           `json:"refId,omitempty"`
+	Datapoints [][2]interface{} `json:"datapoints"`
+}
+
+type tableColumn struct {
+	Text string `json:"text"`
+	Type string `json:"type"`
+}
+
+type table struct {
+	Type    string          `json:"type"`
+	RefID   string          `json:"refId,omitempty"`
+	Columns []tableColumn   `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+type annotation struct {
+	Annotation annotationQuery `json:"annotation"`
+	Time       int64           `json:"time"`
+	Title      string          `json:"title"`
+	Text       string          `json:"text"`
+	Tags       []string        `json:"tags"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// Register adds a SimpleJSON/Infinity datasource under /grafana: /grafana/search lists the runtime metrics,
+// /grafana/query returns metrics or SQL with time macros as time series or tables and /grafana/annotations
+// returns log events such as key and headlight changes.
+func Register(mux *http.ServeMux, writer *store.Writer) {
+	if mux == nil {
+		mux = http.DefaultServeMux
+	}
+	// The datasource tests the connection with a GET of the base URL
+	mux.HandleFunc("/grafana/", func(response http.ResponseWriter, request *http.Request) {
+		if request.URL.Path != "/grafana/" {
+			http.NotFound(response, request)
+			return
+		}
+		response.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("POST /grafana/search", func(response http.ResponseWriter, request *http.Request) {
+		var req searchRequest
+		if err := decode(request, &req); err != nil {
+			writeJSON(response, http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+		ctx, cancel := context.WithTimeout(request.Context(), queryTimeout)
+		defer cancel()
+		names, err := writer.MetricNames(ctx)
+		if err != nil {
+			log.Println("grafana: failed to list metrics:", err)
+			writeJSON(response, http.StatusInternalServerError, errorResponse{Error: "failed to list metrics"})
+			return
+		}
+		filter := strings.ToLower(strings.TrimSpace(req.Target))
+		matches := []string{}
+		for _, name := range names {
+			if filter == "" || strings.Contains(strings.ToLower(name), filter) {
+				matches = append(matches, name)
+			}
+		}
+		writeJSON(response, http.StatusOK, matches)
+	})
+	mux.HandleFunc("POST /grafana/query", func(response http.ResponseWriter, request *http.Request) {
+		var req queryRequest
+		if err := decode(request, &req); err != nil {
+			writeJSON(response, http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+		if req.MaxDataPoints <= 0 {
+			req.MaxDataPoints = defaultMaxPoints
+		}
+		ctx, cancel := context.WithTimeout(request.Context(), queryTimeout)
+		defer cancel()
+		results := []interface{}{}
+		for _, t := range req.Targets {
+			if t.Hide || strings.TrimSpace(t.Target) == "" {
+				continue
+			}
+			var err error
+			if isSQL(t.Target) {
+				results, err = appendSQL(ctx, results, writer, req, t)
+			} else {
+				results, err = appendMetric(ctx, results, writer, req, t)
+			}
+			if err != nil {
+				writeJSON(response, http.StatusBadRequest, errorResponse{Error: fmt.Sprintf("target %s: %v", t.RefID, err)})
+				return
+			}
+		}
+		writeJSON(response, http.StatusOK, results)
+	})
+	mux.HandleFunc("POST /grafana/annotations", func(response http.ResponseWriter, request *http.Request) {
+		var req annotationRequest
+		if err := decode(request, &req); err != nil {
+			writeJSON(response, http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+		ctx, cancel := context.WithTimeout(request.Context(), queryTimeout)
+		defer cancel()
+		// The annotation query is a comma separated list of log names, e.g. key,headlights, optionally followed by
+		// a line filter like Loki's: turn_signal |= "On"
+		query, contains, _ := strings.Cut(req.Annotation.Query, "|=")
+		contains = strings.Trim(strings.TrimSpace(contains), `"`)
+		var names []string
+		for _, name := range strings.Split(query, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+		entries, err := writer.LogEntries(ctx, req.Range.From, req.Range.To, names, 1000)
+		if err != nil {
+			log.Println("grafana: failed to read annotations:", err)
+			writeJSON(response, http.StatusInternalServerError, errorResponse{Error: "failed to read annotations"})
+			return
+		}
+		annotations := make([]annotation, 0, len(entries))
+		for _, entry := range entries {
+			if contains != "" && !strings.Contains(entry.Text, contains) {
+				continue
+			}
+			annotations = append(annotations, annotation{
+				Annotation: req.Annotation,
+				Time:       entry.Timestamp.UnixMilli(),
+				Title:      entry.Name,
+				Text:       entry.Text,
+				Tags:       []string{entry.Name},
+			})
+		}
+		writeJSON(response, http.StatusOK, annotations)
+	})
+}
+
+// appendMetric adds a metric target as a time series of one of min, max, avg or last, picked with the target
+// payload {"agg": "max"}, avg by default.
+func appendMetric(ctx context.Context, results []interface{}, writer *store.Writer, req queryRequest, t target) ([]interface{}, error) {
+	var payload struct {
+		Agg string `json:"agg"`
+	}
+	if len(t.Payload) > 0 && string(t.Payload) != `""` {
+		if err := json.Unmarshal(t.Payload, &payload); err != nil {
+			return results, fmt.Errorf("invalid payload: %w", err)
+		}
+	}
+	value := func(p store.MetricPoint) float64 { return p.Avg }
+	switch payload.Agg {
+	case "", "avg":
+	case "min":
+		value = func(p store.MetricPoint) float64 { return p.Min }
+	case "max":
+		value = func(p store.MetricPoint) float64 { return p.Max }
+	case "last":
+		value = func(p store.MetricPoint) float64 { return p.Last }
+	default:
+		return results, fmt.Errorf("unknown agg %q, expected min, max, avg or last", payload.Agg)
+	}
+	_, points, err := writer.MetricRange(ctx, t.Target, req.Range.From, req.Range.To, req.MaxDataPoints)
+	if err != nil {
+		return results, err
+	}
+	series := timeSeries{Target: t.Target, RefID: t.RefID, Datapoints: make([][2]interface{}, 0, len(points))}
+	for _, p := range points {
+		series.Datapoints = append(series.Datapoints, [2]interface{}{value(p), p.Timestamp.UnixMilli()})
+	}
+	return append(results, series), nil
+}
+
+// appendSQL runs a SQL target after expanding the time macros. Tables are returned as they are, time series need
+// a timestamp column and one series is returned per numeric column, or per value of a metric column if there is one.
+func appendSQL(ctx context.Context, results []interface{}, writer *store.Writer, req queryRequest, t target) ([]interface{}, error) {
+	query := expandMacros(t.Target, req.Range, req.IntervalMs)
+	result, err := writer.Query(ctx, query)
+	if err != nil {
+		return results, err
+	}
+	if t.Type == "table" {
+		return append(results, toTable(result, t.RefID)), nil
+	}
+	series, err := toTimeSeries(result, t.RefID)
+	if err != nil {
+		return results, err
+	}
+	for _, s := range series {
+		results = append(results, s)
+	}
+	return results, nil
+}
+
+var (
+	timeFilterMacro = regexp.MustCompile(`\$__timeFilter\(\s*([^)]+?)\s*\)`)
+	timeGroupMacro  = regexp.MustCompile(`\$__timeGroup\(\s*([^)]+?)\s*\)`)
+)
+
+// expandMacros replaces $__timeFilter(col), $__timeGroup(col), $__timeFrom, $__timeTo, $__interval_ms and $__interval.
+func expandMacros(query string, r timeRange, intervalMs int64) string {
+	if intervalMs <= 0 {
+		intervalMs = 1000
+	}
+	interval := fmt.Sprintf("INTERVAL '%d milliseconds'", intervalMs)
+	from, to := timestamp(r.From), timestamp(r.To)
+	query = timeFilterMacro.ReplaceAllString(query, fmt.Sprintf("$1 >= %s AND $1 < %s", from, to))
+	query = timeGroupMacro.ReplaceAllString(query, fmt.Sprintf("time_bucket(%s, $1)", interval))
+	return strings.NewReplacer(
+		"$__timeFrom", from,
+		"$__timeTo", to,
+		"$__interval_ms", fmt.Sprint(intervalMs),
+		"$__interval", interval,
+	).Replace(query)
+}
+
+func timestamp(ts time.Time) string {
+	return fmt.Sprintf("TIMESTAMP '%s'", ts.UTC().Format("2006-01-02 15:04:05.000"))
+}
+
+func toTable(result *store.QueryResult, refID string) table {
+	t := table{Type: "table", RefID: refID, Columns: make([]tableColumn, len(result.Columns)), Rows: result.Rows}
+	for i, name := range result.Columns {
+		t.Columns[i] = tableColumn{Text: name, Type: "string"}
+		for _, row := range result.Rows {
+			if row[i] == nil {
+				continue
+			}
+			switch v := row[i].(type) {
+			case float64, float32, int, int8, int16, int32, int64, uint8, uint16, uint32, uint64:
+				t.Columns[i].Type = "number"
+			case bool:
+				t.Columns[i].Type = "boolean"
+			case string:
+				if _, ok := parseTime(v); ok {
+					t.Columns[i].Type = "time"
+				}
+			}
+			break
+		}
+	}
+	return t
+}
+
+func toTimeSeries(result *store.QueryResult, refID string) ([]timeSeries, error) {
+	timeCol, metricCol := -1, -1
+	for i, name := range result.Columns {
+		switch strings.ToLower(name) {
+		case "ts", "time":
+			if timeCol < 0 {
+				timeCol = i
+			}
+		case "metric":
+			metricCol = i
+		}
+	}
+	if timeCol < 0 {
+		return nil, fmt.Errorf("time series need a ts or time column")
+	}
+	var order []string
+	byName := make(map[string]*timeSeries)
+	for _, row := range result.Rows {
+		ts, ok := parseTime(row[timeCol])
+		if !ok {
+			continue
+		}
+		for i, name := range result.Columns {
+			if i == timeCol || i == metricCol {
+				continue
+			}
+			value, ok := number(row[i])
+			if !ok {
+				continue
+			}
+			if metricCol >= 0 {
+				name = fmt.Sprint(row[metricCol])
+			}
+			s, ok := byName[name]
+			if !ok {
+				s = &timeSeries{Target: name, RefID: refID, Datapoints: [][2]interface{}{}}
+				byName[name] = s
+				order = append(order, name)
+			}
+			s.Datapoints = append(s.Datapoints, [2]interface{}{value, ts.UnixMilli()})
+		}
+	}
+	series := make([]timeSeries, 0, len(order))
+	for _, name := range order {
+		series = append(series, *byName[name])
+	}
+	return series, nil
+}
+
+func parseTime(v interface{}) (time.Time, bool) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, true
+	case string:
+		parsed, err := time.Parse(time.RFC3339Nano, t)
+		return parsed, err == nil
+	}
+	return time.Time{}, false
+}
+
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// isSQL reports whether a target is a query rather than a metric name, metric names never contain spaces.
+func isSQL(target string) bool {
+	return strings.ContainsAny(strings.TrimSpace(target), " \t\n")
+}
+
+func decode(request *http.Request, v interface{}) error {
+	if request.Body == nil || request.ContentLength == 0 {
+		return nil
+	}
+	if err := json.NewDecoder(request.Body).Decode(v); err != nil {
+		return fmt.Errorf("invalid JSON body")
+	}
+	return nil
+}
+
+func writeJSON(response http.ResponseWriter, status int, payload interface{}) {
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(status)
+	if err := json.NewEncoder(response).Encode(payload); err != nil {
+		log.Println("grafana: failed to write response:", err)
+	}
+}
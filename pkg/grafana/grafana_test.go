@@ -0,0 +1,203 @@
+package grafana
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/slim-bean/leafbus/pkg/store"
+)
+
+func TestHandlers(t *testing.T) {
+	writer, err := store.NewWriter(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	writer.SetBlocking(true)
+	t0 := time.Date(2024, time.March, 5, 12, 0, 0, 0, time.UTC)
+	metric := func(seconds int, name string, value float64) {
+		writer.EnqueueRuntime(store.RuntimeRow{Timestamp: t0.Add(time.Duration(seconds) * time.Second), Name: name, Value: sql.NullFloat64{Float64: value, Valid: true}, Kind: sql.NullString{String: "metric", Valid: true}})
+	}
+	logLine := func(seconds int, name string, text string) {
+		writer.EnqueueRuntime(store.RuntimeRow{Timestamp: t0.Add(time.Duration(seconds) * time.Second), Name: name, Text: sql.NullString{String: text, Valid: true}, Kind: sql.NullString{String: "log", Valid: true}})
+	}
+	metric(0, "speed", 10)
+	metric(1, "speed", 20)
+	metric(2, "speed", 30)
+	metric(0, "soc", 80)
+	logLine(0, "key", "Key Turned On")
+	logLine(2, "headlights", "On")
+	logLine(5, "key", "Key Turned Off")
+	// The hour is archived so the queries read parquet and its rollups
+	writer.Flush()
+
+	mux := http.NewServeMux()
+	Register(mux, writer)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	ms := t0.UnixMilli()
+	rangeJSON := fmt.Sprintf(`"range": {"from": %q, "to": %q}`, t0.Format(time.RFC3339), t0.Add(10*time.Second).Format(time.RFC3339))
+	tests := []struct {
+		name       string
+		path       string
+		body       string
+		wantStatus int
+		want       string
+	}{
+		{
+			name:       "search everything",
+			path:       "/grafana/search",
+			body:       `{"target": ""}`,
+			wantStatus: http.StatusOK,
+			want:       `["soc", "speed"]`,
+		},
+		{
+			name:       "search is case insensitive",
+			path:       "/grafana/search",
+			body:       `{"target": "SPE"}`,
+			wantStatus: http.StatusOK,
+			want:       `["speed"]`,
+		},
+		{
+			name:       "metric at raw resolution",
+			path:       "/grafana/query",
+			body:       `{` + rangeJSON + `, "targets": [{"target": "speed", "refId": "A"}]}`,
+			wantStatus: http.StatusOK,
+			want:       fmt.Sprintf(`[{"target": "speed", "refId": "A", "datapoints": [[10, %d], [20, %d], [30, %d]]}]`, ms, ms+1000, ms+2000),
+		},
+		{
+			name:       "metric from a rollup",
+			path:       "/grafana/query",
+			body:       `{` + rangeJSON + `, "maxDataPoints": 2, "targets": [{"target": "speed", "refId": "A", "payload": {"agg": "max"}}, {"target": "soc", "refId": "B", "hide": true}]}`,
+			wantStatus: http.StatusOK,
+			want:       fmt.Sprintf(`[{"target": "speed", "refId": "A", "datapoints": [[30, %d]]}]`, ms),
+		},
+		{
+			name:       "unknown aggregation",
+			path:       "/grafana/query",
+			body:       `{` + rangeJSON + `, "targets": [{"target": "speed", "refId": "A", "payload": {"agg": "median"}}]}`,
+			wantStatus: http.StatusBadRequest,
+			want:       `{"error": "target A: unknown agg \"median\", expected min, max, avg or last"}`,
+		},
+		{
+			name:       "sql time series per metric",
+			path:       "/grafana/query",
+			body:       `{` + rangeJSON + `, "intervalMs": 2000, "targets": [{"target": "SELECT $__timeGroup(ts) AS time, name AS metric, max(value) AS value FROM runtime_metrics WHERE kind = 'metric' AND $__timeFilter(ts) GROUP BY ALL ORDER BY ALL", "refId": "A"}]}`,
+			wantStatus: http.StatusOK,
+			want:       fmt.Sprintf(`[{"target": "soc", "refId": "A", "datapoints": [[80, %d]]}, {"target": "speed", "refId": "A", "datapoints": [[20, %d], [30, %d]]}]`, ms, ms, ms+2000),
+		},
+		{
+			name:       "sql table",
+			path:       "/grafana/query",
+			body:       `{` + rangeJSON + `, "targets": [{"target": "SELECT name, count(*) AS n FROM runtime_metrics WHERE kind = 'log' GROUP BY name ORDER BY name", "refId": "A", "type": "table"}]}`,
+			wantStatus: http.StatusOK,
+			want:       `[{"type": "table", "refId": "A", "columns": [{"text": "name", "type": "string"}, {"text": "n", "type": "number"}], "rows": [["headlights", 1], ["key", 2]]}]`,
+		},
+		{
+			name:       "sql time series without a time column",
+			path:       "/grafana/query",
+			body:       `{` + rangeJSON + `, "targets": [{"target": "SELECT 1 AS value", "refId": "A"}]}`,
+			wantStatus: http.StatusBadRequest,
+			want:       `{"error": "target A: time series need a ts or time column"}`,
+		},
+		{
+			name:       "invalid body",
+			path:       "/grafana/query",
+			body:       `{"targets": [`,
+			wantStatus: http.StatusBadRequest,
+			want:       `{"error": "invalid JSON body"}`,
+		},
+		{
+			name:       "annotations of named logs",
+			path:       "/grafana/annotations",
+			body:       `{` + rangeJSON + `, "annotation": {"name": "drives", "query": "key", "enable": true}}`,
+			wantStatus: http.StatusOK,
+			want: fmt.Sprintf(`[
+				{"annotation": {"name": "drives", "query": "key", "enable": true}, "time": %d, "title": "key", "text": "Key Turned On", "tags": ["key"]},
+				{"annotation": {"name": "drives", "query": "key", "enable": true}, "time": %d, "title": "key", "text": "Key Turned Off", "tags": ["key"]}
+			]`, ms, ms+5000),
+		},
+		{
+			name:       "annotations with a line filter",
+			path:       "/grafana/annotations",
+			body:       `{` + rangeJSON + `, "annotation": {"name": "on", "query": "key, headlights |= \"On\""}}`,
+			wantStatus: http.StatusOK,
+			want: fmt.Sprintf(`[
+				{"annotation": {"name": "on", "query": "key, headlights |= \"On\"", "enable": false}, "time": %d, "title": "key", "text": "Key Turned On", "tags": ["key"]},
+				{"annotation": {"name": "on", "query": "key, headlights |= \"On\"", "enable": false}, "time": %d, "title": "headlights", "text": "On", "tags": ["headlights"]}
+			]`, ms, ms+2000),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Post(server.URL+tt.path, "application/json", strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			var got, want interface{}
+			if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(tt.want), &want); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				gotJSON, _ := json.Marshal(got)
+				t.Errorf("got %s, want %s", gotJSON, tt.want)
+			}
+		})
+	}
+
+	resp, err := http.Get(server.URL + "/grafana/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /grafana/ status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestExpandMacros(t *testing.T) {
+	r := timeRange{
+		From: time.Date(2024, time.March, 5, 12, 0, 0, 0, time.UTC),
+		To:   time.Date(2024, time.March, 5, 13, 0, 0, 500000000, time.FixedZone("CET", 3600)),
+	}
+	tests := []struct {
+		query      string
+		intervalMs int64
+		want       string
+	}{
+		{
+			query:      "SELECT * FROM t WHERE $__timeFilter( ts )",
+			intervalMs: 1000,
+			want:       "SELECT * FROM t WHERE ts >= TIMESTAMP '2024-03-05 12:00:00.000' AND ts < TIMESTAMP '2024-03-05 12:00:00.500'",
+		},
+		{
+			query:      "SELECT $__timeGroup(ts) AS time, avg(value) FROM t GROUP BY 1",
+			intervalMs: 15000,
+			want:       "SELECT time_bucket(INTERVAL '15000 milliseconds', ts) AS time, avg(value) FROM t GROUP BY 1",
+		},
+		{
+			query: "SELECT $__interval_ms, $__interval, $__timeFrom, $__timeTo",
+			want:  "SELECT 1000, INTERVAL '1000 milliseconds', TIMESTAMP '2024-03-05 12:00:00.000', TIMESTAMP '2024-03-05 12:00:00.500'",
+		},
+	}
+	for _, tt := range tests {
+		if got := expandMacros(tt.query, r, tt.intervalMs); got != tt.want {
+			t.Errorf("expandMacros(%q, %d) = %q, want %q", tt.query, tt.intervalMs, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package isotp
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/brutella/can"
+)
+
+const (
+	singleFrame      = 0x00
+	firstFrame       = 0x10
+	consecutiveFrame = 0x20
+	flowControl      = 0x30
+
+	flowContinue = 0x00
+	flowWait     = 0x01
+	flowOverflow = 0x02
+
+	padding = 0xFF
+	// MaxPayload is the largest message which fits the 12 bit first frame length.
+	MaxPayload = 4095
+
+	defaultTimeout = time.Second
+)
+
+var ErrTimeout = errors.New("isotp: timeout waiting for frame")
+
+// Bus is the part of a CAN bus needed to exchange ISO-TP messages, canbus.Source satisfies it.
+type Bus interface {
+	Subscribe(handler can.Handler)
+	Publish(frame can.Frame) error
+}
+
+// Conn exchanges ISO 15765-2 messages between a transmit and receive ID using normal addressing.
+type Conn struct {
+	bus  Bus
+	txID uint32
+	rxID uint32
+
+	frames chan can.Frame
+
+	// Timeout is how long to wait for each frame from the ECU.
+	Timeout time.Duration
+}
+
+// NewConn subscribes to the bus for frames from rxID, requests are sent to txID.
+func NewConn(bus Bus, txID uint32, rxID uint32) *Conn {
+	c := &Conn{
+		bus:     bus,
+		txID:    txID,
+		rxID:    rxID,
+		frames:  make(chan can.Frame, 64),
+		Timeout: defaultTimeout,
+	}
+	bus.Subscribe(c)
+	return c
+}
+
+func (c *Conn) Handle(frame can.Frame) {
+	if frame.ID != c.rxID {
+		return
+	}
+	select {
+	case c.frames <- frame:
+	default:
+		// Nobody is reading, the frame belongs to a request which already timed out
+	}
+}
+
+// Send transmits a message, segmenting it into a first frame and consecutive frames when it does not fit a single frame.
+func (c *Conn) Send(payload []byte) error {
+	if len(payload) == 0 || len(payload) > MaxPayload {
+		return fmt.Errorf("isotp: invalid payload length %d", len(payload))
+	}
+	c.drain()
+	if len(payload) <= 7 {
+		data := []byte{singleFrame | byte(len(payload))}
+		return c.publish(append(data, payload...))
+	}
+
+	data := []byte{firstFrame | byte(len(payload)>>8), byte(len(payload))}
+	if err := c.publish(append(data, payload[:6]...)); err != nil {
+		return err
+	}
+	remaining := payload[6:]
+	seq := byte(1)
+	for len(remaining) > 0 {
+		blockSize, stMin, err := c.waitFlowControl()
+		if err != nil {
+			return err
+		}
+		for sent := 0; len(remaining) > 0 && (blockSize == 0 || sent < blockSize); sent++ {
+			n := len(remaining)
+			if n > 7 {
+				n = 7
+			}
+			if err := c.publish(append([]byte{consecutiveFrame | seq}, remaining[:n]...)); err != nil {
+				return err
+			}
+			remaining = remaining[n:]
+			seq = (seq + 1) & 0x0F
+			if len(remaining) > 0 && stMin > 0 {
+				time.Sleep(stMin)
+			}
+		}
+	}
+	return nil
+}
+
+// Receive waits for the next message, sending a flow control frame if it is segmented.
+func (c *Conn) Receive() ([]byte, error) {
+	for {
+		frame, err := c.next()
+		if err != nil {
+			return nil, err
+		}
+		data := frame.Data[:frameLength(frame)]
+		if len(data) == 0 {
+			continue
+		}
+		switch data[0] & 0xF0 {
+		case singleFrame:
+			n := int(data[0] & 0x0F)
+			if n == 0 || n > len(data)-1 {
+				return nil, fmt.Errorf("isotp: invalid single frame length %d", n)
+			}
+			return append([]byte(nil), data[1:1+n]...), nil
+		case firstFrame:
+			return c.receiveSegmented(data)
+		default:
+			// Stray consecutive or flow control frame from an earlier exchange
+			continue
+		}
+	}
+}
+
+func (c *Conn) receiveSegmented(first []byte) ([]byte, error) {
+	if len(first) < 2 {
+		return nil, fmt.Errorf("isotp: short first frame")
+	}
+	size := int(first[0]&0x0F)<<8 | int(first[1])
+	if size < 8 {
+		return nil, fmt.Errorf("isotp: invalid first frame length %d", size)
+	}
+	payload := make([]byte, 0, size)
+	payload = append(payload, first[2:]...)
+	if err := c.publish([]byte{flowControl | flowContinue, 0, 0}); err != nil {
+		return nil, err
+	}
+	seq := byte(1)
+	for len(payload) < size {
+		frame, err := c.next()
+		if err != nil {
+			return nil, err
+		}
+		data := frame.Data[:frameLength(frame)]
+		if len(data) == 0 || data[0]&0xF0 != consecutiveFrame {
+			return nil, fmt.Errorf("isotp: expected consecutive frame, got %#02x", data)
+		}
+		if data[0]&0x0F != seq {
+			return nil, fmt.Errorf("isotp: consecutive frame out of sequence, expected %d got %d", seq, data[0]&0x0F)
+		}
+		n := size - len(payload)
+		if n > len(data)-1 {
+			n = len(data) - 1
+		}
+		payload = append(payload, data[1:1+n]...)
+		seq = (seq + 1) & 0x0F
+	}
+	return payload, nil
+}
+
+func (c *Conn) waitFlowControl() (int, time.Duration, error) {
+	for {
+		frame, err := c.next()
+		if err != nil {
+			return 0, 0, err
+		}
+		data := frame.Data[:frameLength(frame)]
+		if len(data) < 3 || data[0]&0xF0 != flowControl {
+			continue
+		}
+		switch data[0] & 0x0F {
+		case flowContinue:
+			return int(data[1]), separationTime(data[2]), nil
+		case flowWait:
+			continue
+		case flowOverflow:
+			return 0, 0, fmt.Errorf("isotp: receiver reported overflow")
+		default:
+			return 0, 0, fmt.Errorf("isotp: invalid flow status %#02x", data[0])
+		}
+	}
+}
+
+func (c *Conn) next() (can.Frame, error) {
+	timer := time.NewTimer(c.Timeout)
+	defer timer.Stop()
+	select {
+	case frame := <-c.frames:
+		return frame, nil
+	case <-timer.C:
+		return can.Frame{}, ErrTimeout
+	}
+}
+
+func (c *Conn) drain() {
+	for {
+		select {
+		case <-c.frames:
+		default:
+			return
+		}
+	}
+}
+
+func (c *Conn) publish(data []byte) error {
+	frame := can.Frame{
+		ID:     c.txID,
+		Length: can.MaxFrameDataLength,
+	}
+	n := copy(frame.Data[:], data)
+	for i := n; i < can.MaxFrameDataLength; i++ {
+		frame.Data[i] = padding
+	}
+	return c.bus.Publish(frame)
+}
+
+func frameLength(frame can.Frame) uint8 {
+	if frame.Length > can.MaxFrameDataLength {
+		return can.MaxFrameDataLength
+	}
+	return frame.Length
+}
+
+// separationTime decodes the STmin byte of a flow control frame.
+func separationTime(b byte) time.Duration {
+	switch {
+	case b <= 0x7F:
+		return time.Duration(b) * time.Millisecond
+	case b >= 0xF1 && b <= 0xF9:
+		return time.Duration(b-0xF0) * 100 * time.Microsecond
+	default:
+		return 127 * time.Millisecond
+	}
+}
@@ -0,0 +1,218 @@
+package isotp
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/brutella/can"
+
+	"github.com/slim-bean/leafbus/pkg/canbus"
+)
+
+const (
+	testTx = 0x79B
+	testRx = 0x7BB
+)
+
+func frame(id uint32, data ...byte) can.Frame {
+	f := can.Frame{ID: id, Length: uint8(len(data))}
+	copy(f.Data[:], data)
+	return f
+}
+
+// sequence returns n bytes counting up from 1.
+func sequence(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i + 1)
+	}
+	return b
+}
+
+// segment splits payload into the first and consecutive frames an ECU sends.
+func segment(payload []byte) []can.Frame {
+	frames := []can.Frame{frame(testRx, append([]byte{firstFrame | byte(len(payload)>>8), byte(len(payload))}, payload[:6]...)...)}
+	seq := byte(1)
+	for rest := payload[6:]; len(rest) > 0; {
+		n := len(rest)
+		if n > 7 {
+			n = 7
+		}
+		frames = append(frames, frame(testRx, append([]byte{consecutiveFrame | seq}, rest[:n]...)...))
+		rest = rest[n:]
+		seq = (seq + 1) & 0x0F
+	}
+	return frames
+}
+
+func TestReceive(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames []can.Frame
+		want   []byte
+		// flowControl is whether the receiver has to ask for the consecutive frames
+		flowControl bool
+		wantErr     error
+	}{
+		{
+			name:   "single frame",
+			frames: []can.Frame{frame(testRx, 0x03, 0x62, 0xF1, 0x90)},
+			want:   []byte{0x62, 0xF1, 0x90},
+		},
+		{
+			name:   "padded single frame",
+			frames: []can.Frame{frame(testRx, 0x02, 0x7E, 0x00, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF)},
+			want:   []byte{0x7E, 0x00},
+		},
+		{
+			name:   "other ids are ignored",
+			frames: []can.Frame{frame(0x7BC, 0x01, 0xAA), frame(testRx, 0x01, 0xBB)},
+			want:   []byte{0xBB},
+		},
+		{
+			name:   "stray consecutive frame is skipped",
+			frames: []can.Frame{frame(testRx, 0x21, 1, 2, 3), frame(testRx, 0x01, 0xCC)},
+			want:   []byte{0xCC},
+		},
+		{
+			name:        "segmented",
+			frames:      segment(sequence(20)),
+			want:        sequence(20),
+			flowControl: true,
+		},
+		{
+			name:        "sequence number wraps",
+			frames:      segment(sequence(130)),
+			want:        sequence(130),
+			flowControl: true,
+		},
+		{
+			name:        "out of sequence",
+			frames:      []can.Frame{frame(testRx, 0x10, 0x0A, 1, 2, 3, 4, 5, 6), frame(testRx, 0x22, 7, 8, 9, 10)},
+			flowControl: true,
+			wantErr:     errors.New("isotp: consecutive frame out of sequence, expected 1 got 2"),
+		},
+		{
+			name:        "missing consecutive frame",
+			frames:      segment(sequence(20))[:2],
+			flowControl: true,
+			wantErr:     ErrTimeout,
+		},
+		{
+			name:    "invalid single frame length",
+			frames:  []can.Frame{frame(testRx, 0x00)},
+			wantErr: errors.New("isotp: invalid single frame length 0"),
+		},
+		{
+			name:    "invalid first frame length",
+			frames:  []can.Frame{frame(testRx, 0x10, 0x05, 1, 2, 3, 4, 5, 6)},
+			wantErr: errors.New("isotp: invalid first frame length 5"),
+		},
+		{
+			name:    "nothing received",
+			wantErr: ErrTimeout,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bus := canbus.NewFake("can0")
+			conn := NewConn(bus, testTx, testRx)
+			conn.Timeout = 20 * time.Millisecond
+			for _, f := range tt.frames {
+				bus.Inject(f)
+			}
+			got, err := conn.Receive()
+			if tt.wantErr != nil {
+				if err == nil || (err != tt.wantErr && err.Error() != tt.wantErr.Error()) {
+					t.Fatalf("Receive() = %x, %v, want error %v", got, err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("Receive() error = %v", err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("Receive() = %x, want %x", got, tt.want)
+			}
+			var want []can.Frame
+			if tt.flowControl {
+				want = []can.Frame{frame(testTx, flowControl|flowContinue, 0, 0, padding, padding, padding, padding, padding)}
+			}
+			if published := bus.Published(); len(published) != len(want) || (len(want) > 0 && published[0] != want[0]) {
+				t.Errorf("published %x, want %x", published, want)
+			}
+		})
+	}
+}
+
+func TestSend(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		// flowControl is answered to the first frame, nil for a single frame
+		flowControl []byte
+		want        []can.Frame
+		wantErr     bool
+	}{
+		{
+			name:    "single frame",
+			payload: []byte{0x22, 0xF1, 0x90},
+			want:    []can.Frame{frame(testTx, 0x03, 0x22, 0xF1, 0x90, padding, padding, padding, padding)},
+		},
+		{
+			name:        "segmented",
+			payload:     sequence(15),
+			flowControl: []byte{0x30, 0x00, 0x00},
+			want: []can.Frame{
+				frame(testTx, 0x10, 0x0F, 1, 2, 3, 4, 5, 6),
+				frame(testTx, 0x21, 7, 8, 9, 10, 11, 12, 13),
+				frame(testTx, 0x22, 14, 15, padding, padding, padding, padding, padding),
+			},
+		},
+		{
+			name:        "receiver overflow",
+			payload:     sequence(15),
+			flowControl: []byte{0x32, 0x00, 0x00},
+			want:        []can.Frame{frame(testTx, 0x10, 0x0F, 1, 2, 3, 4, 5, 6)},
+			wantErr:     true,
+		},
+		{
+			name:    "empty payload",
+			payload: nil,
+			wantErr: true,
+		},
+		{
+			name:    "payload too large",
+			payload: make([]byte, MaxPayload+1),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bus := canbus.NewFake("can0")
+			conn := NewConn(bus, testTx, testRx)
+			conn.Timeout = time.Second
+			if tt.flowControl != nil {
+				// Answer the first frame like an ECU, Send drains frames received before it
+				go func() {
+					for len(bus.Published()) == 0 {
+						time.Sleep(time.Millisecond)
+					}
+					bus.Inject(frame(testRx, tt.flowControl...))
+				}()
+			}
+			err := conn.Send(tt.payload)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Send() error = %v, want error %v", err, tt.wantErr)
+			}
+			published := bus.Published()
+			if len(published) != len(tt.want) {
+				t.Fatalf("published %x, want %x", published, tt.want)
+			}
+			for i := range published {
+				if published[i] != tt.want[i] {
+					t.Errorf("frame %d = %x, want %x", i, published[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
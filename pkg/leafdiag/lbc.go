@@ -0,0 +1,73 @@
+package leafdiag
+
+import (
+	"fmt"
+)
+
+// Offsets into the LBC responses after the service and group bytes, as used by LeafSpy and OVMS for the 2011-2017 packs.
+const (
+	hxOffset  = 26
+	sohOffset = 28
+	ahOffset  = 33
+
+	cellCount       = 96
+	temperatureSize = 3
+	temperatureMax  = 4
+	shuntBytes      = 24
+)
+
+// parseBattery returns state of health in percent, Hx in percent and capacity in amp hours from group 0x01.
+func parseBattery(data []byte) (float64, float64, float64, error) {
+	if len(data) < ahOffset+3 {
+		return 0, 0, 0, fmt.Errorf("battery group too short: %d bytes", len(data))
+	}
+	hx := float64(uint16(data[hxOffset])<<8|uint16(data[hxOffset+1])) / 102.4
+	soh := float64(uint16(data[sohOffset])<<8|uint16(data[sohOffset+1])) / 100
+	ah := float64(uint32(data[ahOffset])<<16|uint32(data[ahOffset+1])<<8|uint32(data[ahOffset+2])) / 10000
+	return soh, hx, ah, nil
+}
+
+// parseCellVoltages returns the 96 cell voltages in volts from group 0x02, each cell is a big endian millivolt value.
+func parseCellVoltages(data []byte) ([]float64, error) {
+	if len(data) < cellCount*2 {
+		return nil, fmt.Errorf("cell voltage group too short: %d bytes", len(data))
+	}
+	cells := make([]float64, cellCount)
+	for i := range cells {
+		cells[i] = float64(uint16(data[i*2])<<8|uint16(data[i*2+1])) / 1000
+	}
+	return cells, nil
+}
+
+// parseTemperatures returns the pack temperature sensors in C from group 0x04, sensors which are not fitted are nil.
+func parseTemperatures(data []byte) ([]*float64, error) {
+	if len(data) < temperatureSize {
+		return nil, fmt.Errorf("temperature group too short: %d bytes", len(data))
+	}
+	var temps []*float64
+	for i := 0; i < temperatureMax && (i+1)*temperatureSize <= len(data); i++ {
+		sensor := data[i*temperatureSize : (i+1)*temperatureSize]
+		// The first two bytes are the raw thermistor reading, 0xFFFF when the sensor is missing
+		if sensor[0] == 0xFF && sensor[1] == 0xFF {
+			temps = append(temps, nil)
+			continue
+		}
+		t := float64(int8(sensor[2]))
+		temps = append(temps, &t)
+	}
+	return temps, nil
+}
+
+// parseShunts returns whether the balancing shunt of each cell is active from group 0x06, four cells per byte in the low nibble.
+func parseShunts(data []byte) ([]bool, error) {
+	if len(data) < shuntBytes {
+		return nil, fmt.Errorf("shunt group too short: %d bytes", len(data))
+	}
+	shunts := make([]bool, 0, cellCount)
+	for _, b := range data[:shuntBytes] {
+		for bit := 3; bit >= 0; bit-- {
+			shunts = append(shunts, b&(1<<bit) != 0)
+		}
+	}
+	return shunts, nil
+}
@@ -0,0 +1,235 @@
+package leafdiag
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/slim-bean/leafbus/pkg/isotp"
+	"github.com/slim-bean/leafbus/pkg/push"
+	"github.com/slim-bean/leafbus/pkg/store"
+	"github.com/slim-bean/leafbus/pkg/uds"
+)
+
+const (
+	// Li-ion Battery Controller
+	lbcRequestID  = 0x79B
+	lbcResponseID = 0x7BB
+	// Vehicle Control Module
+	vcmRequestID  = 0x797
+	vcmResponseID = 0x79A
+
+	groupBattery      = 0x01
+	groupCellVoltages = 0x02
+	groupTemperatures = 0x04
+	groupShunts       = 0x06
+
+	didQCCount   = 0x1203
+	didL1L2Count = 0x1205
+
+	DefaultInterval = 30 * time.Second
+)
+
+var (
+	diagLabel = labels.Labels{
+		labels.Label{
+			Name:  "job",
+			Value: "diag",
+		},
+	}
+)
+
+// Poller queries the LBC and VCM over ISO-TP while the car is on, it is registered as a model.RunListener.
+type Poller struct {
+	handler   *push.Handler
+	lbc       *uds.Client
+	vcm       *uds.Client
+	interval  time.Duration
+	runChan   chan bool
+	shouldRun bool
+	failing   map[string]bool
+	// dropped counts the run state changes which replaced an unread one because a poll was in progress.
+	dropped atomic.Uint64
+}
+
+func NewPoller(handler *push.Handler, bus isotp.Bus, interval time.Duration) *Poller {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	p := &Poller{
+		handler:  handler,
+		lbc:      uds.NewClient(isotp.NewConn(bus, lbcRequestID, lbcResponseID)),
+		vcm:      uds.NewClient(isotp.NewConn(bus, vcmRequestID, vcmResponseID)),
+		interval: interval,
+		// Buffered so the CAN handler is not blocked while a poll is in progress
+		runChan: make(chan bool, 4),
+		failing: map[string]bool{},
+	}
+	go p.run()
+	return p
+}
+
+func (p *Poller) Start() {
+	p.setRun(true)
+}
+
+func (p *Poller) Stop() {
+	p.setRun(false)
+}
+
+// setRun never blocks the CAN handler calling Start and Stop. When the channel is full the oldest state is dropped,
+// it is superseded by the newer ones anyway.
+func (p *Poller) setRun(r bool) {
+	for {
+		select {
+		case p.runChan <- r:
+			return
+		default:
+		}
+		select {
+		case <-p.runChan:
+			if n := p.dropped.Add(1); n == 1 || n%100 == 0 {
+				log.Printf("Diagnostic Poller is busy, dropped %d run state changes\n", n)
+			}
+		default:
+		}
+	}
+}
+
+func (p *Poller) run() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !p.shouldRun {
+				continue
+			}
+			p.poll()
+		case r := <-p.runChan:
+			p.shouldRun = r
+			if r {
+				log.Println("Diagnostic Poller Running")
+			} else {
+				log.Println("Diagnostic Poller Stopped")
+			}
+		}
+	}
+}
+
+func (p *Poller) poll() {
+	p.pollBattery()
+	p.pollCells()
+	p.pollTemperatures()
+	p.pollChargeCounts()
+}
+
+func (p *Poller) pollBattery() {
+	data, err := p.lbc.ReadDataByLocalIdentifier(groupBattery)
+	if !p.check("lbc battery", err) {
+		return
+	}
+	soh, hx, ah, err := parseBattery(data)
+	if !p.check("lbc battery", err) {
+		return
+	}
+	ts := time.Now()
+	p.handler.SendMetric("battery_soh", nil, ts, soh)
+	p.handler.SendMetric("battery_hx", nil, ts, hx)
+	p.handler.SendMetric("battery_ah", nil, ts, ah)
+	p.handler.UpdateBatteryHealth(ts, soh, hx, ah)
+}
+
+// pollCells reads the cell voltages and balancing shunts, the shunts are optional.
+func (p *Poller) pollCells() {
+	data, err := p.lbc.ReadDataByLocalIdentifier(groupCellVoltages)
+	if !p.check("lbc cell voltages", err) {
+		return
+	}
+	cells, err := parseCellVoltages(data)
+	if !p.check("lbc cell voltages", err) {
+		return
+	}
+	var shunts []bool
+	data, err = p.lbc.ReadDataByLocalIdentifier(groupShunts)
+	if p.check("lbc shunts", err) {
+		shunts, err = parseShunts(data)
+		p.check("lbc shunts", err)
+	}
+	ts := time.Now()
+	summary := store.SummarizeCells(store.CellRow{Voltages: cells, Shunts: shunts})
+	p.handler.SendMetric("cell_voltage_min", nil, ts, summary.MinVolts)
+	p.handler.SendMetric("cell_voltage_max", nil, ts, summary.MaxVolts)
+	p.handler.SendMetric("cell_voltage_avg", nil, ts, summary.AvgVolts)
+	p.handler.SendMetric("cell_voltage_delta_mv", nil, ts, summary.DeltaMV)
+	if shunts != nil {
+		p.handler.SendMetric("balancing_shunts", nil, ts, float64(summary.ActiveShunts))
+	}
+	p.handler.UpdateCells(ts, cells, shunts)
+}
+
+func (p *Poller) pollTemperatures() {
+	data, err := p.lbc.ReadDataByLocalIdentifier(groupTemperatures)
+	if !p.check("lbc temperatures", err) {
+		return
+	}
+	temps, err := parseTemperatures(data)
+	if !p.check("lbc temperatures", err) {
+		return
+	}
+	ts := time.Now()
+	sum := 0.0
+	count := 0
+	for i, t := range temps {
+		if t == nil {
+			continue
+		}
+		p.handler.SendMetric(fmt.Sprintf("battery_temp_%d", i+1), nil, ts, *t)
+		sum += *t
+		count++
+	}
+	if count > 0 {
+		p.handler.UpdateTractionTemp(ts, sum/float64(count))
+	}
+}
+
+func (p *Poller) pollChargeCounts() {
+	qcData, err := p.vcm.ReadDataByIdentifier(didQCCount)
+	if !p.check("vcm qc count", err) {
+		return
+	}
+	l1l2Data, err := p.vcm.ReadDataByIdentifier(didL1L2Count)
+	if !p.check("vcm l1/l2 count", err) {
+		return
+	}
+	if len(qcData) < 2 || len(l1l2Data) < 2 {
+		p.check("vcm charge counts", fmt.Errorf("short response"))
+		return
+	}
+	qc := int64(qcData[0])<<8 | int64(qcData[1])
+	l1l2 := int64(l1l2Data[0])<<8 | int64(l1l2Data[1])
+	ts := time.Now()
+	p.handler.SendMetric("qc_count", nil, ts, float64(qc))
+	p.handler.SendMetric("l1l2_count", nil, ts, float64(l1l2))
+	p.handler.UpdateChargeCounts(ts, qc, l1l2)
+}
+
+// check logs the first failure and the recovery of each request instead of every poll.
+func (p *Poller) check(request string, err error) bool {
+	if err != nil {
+		if !p.failing[request] {
+			p.failing[request] = true
+			log.Printf("Diagnostic request %s failed: %v\n", request, err)
+			p.handler.SendLog(diagLabel, time.Now(), fmt.Sprintf("%s failed: %v", request, err))
+		}
+		return false
+	}
+	if p.failing[request] {
+		delete(p.failing, request)
+		log.Printf("Diagnostic request %s recovered\n", request)
+	}
+	return true
+}
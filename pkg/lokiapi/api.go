@@ -0,0 +1,235 @@
+package lokiapi
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/prometheus/prometheus/promql"
+
+	"github.com/slim-bean/leafbus/pkg/loghttp"
+	"github.com/slim-bean/leafbus/pkg/store"
+)
+
+const (
+	queryTimeout = 30 * time.Second
+	defaultLimit = 100
+	// maxLimit is the Loki default max_entries_limit_per_query.
+	maxLimit = 5000
+	// defaultRange is searched when a request has no start, Loki uses the last hour as well.
+	defaultRange = time.Hour
+)
+
+// Register adds the Loki HTTP API endpoints query_range, labels and label values under /loki/api/v1, answered from
+// the runtime_metrics rows with kind 'log' such as key events and camera frames.
+func Register(mux *http.ServeMux, writer *store.Writer) {
+	if mux == nil {
+		mux = http.DefaultServeMux
+	}
+	a := &api{writer: writer}
+	mux.HandleFunc("/loki/api/v1/query_range", a.queryRange)
+	mux.HandleFunc("/loki/api/v1/labels", a.labels)
+	mux.HandleFunc("/loki/api/v1/label/{name}/values", a.labelValues)
+}
+
+type api struct {
+	writer *store.Writer
+}
+
+func (a *api) queryRange(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q, err := parseQuery(r.Form.Get("query"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	start, end, err := timeRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := defaultLimit
+	if raw := r.Form.Get("limit"); raw != "" {
+		if limit, err = strconv.Atoi(raw); err != nil || limit <= 0 {
+			http.Error(w, fmt.Sprintf("invalid limit %q", raw), http.StatusBadRequest)
+			return
+		}
+		if limit > maxLimit {
+			http.Error(w, fmt.Sprintf("limit %d is over the maximum of %d", limit, maxLimit), http.StatusBadRequest)
+			return
+		}
+	}
+	var forward bool
+	switch strings.ToLower(r.Form.Get("direction")) {
+	case "", "backward":
+	case "forward":
+		forward = true
+	default:
+		http.Error(w, fmt.Sprintf("invalid direction %q", r.Form.Get("direction")), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+	result, err := a.writer.Query(ctx, q.sql(start, end, forward, limit))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Rows are already in the requested direction, so the entries of each stream are too
+	streams := loghttp.Streams{}
+	index := make(map[string]int)
+	for _, row := range result.Rows {
+		ts, _ := row[0].(int64)
+		key, _ := row[1].(string)
+		line, _ := row[2].(string)
+		i, ok := index[key]
+		if !ok {
+			ls, err := streamLabels(key)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			i = len(streams)
+			index[key] = i
+			streams = append(streams, loghttp.Stream{Labels: ls})
+		}
+		streams[i].Entries = append(streams[i].Entries, loghttp.Entry{Timestamp: time.Unix(0, ts), Line: line})
+	}
+	writeJSON(w, loghttp.QueryResponse{
+		Status: loghttp.QueryStatusSuccess,
+		Data:   loghttp.QueryResponseData{ResultType: loghttp.ResultTypeStream, Result: streams},
+	})
+}
+
+func (a *api) labels(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	start, end, err := timeRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	a.distinct(w, r.Context(), fmt.Sprintf(
+		`SELECT DISTINCT unnest(regexp_extract_all(labels, '[{ ]([a-zA-Z_][a-zA-Z0-9_]*)="', 1)) AS value FROM runtime_metrics WHERE kind = 'log' AND ts >= %s AND ts < %s ORDER BY value`,
+		sqlTime(start), sqlTime(end),
+	))
+}
+
+func (a *api) labelValues(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := r.PathValue("name")
+	if !labelName(name) {
+		http.Error(w, fmt.Sprintf("invalid label name %q", name), http.StatusBadRequest)
+		return
+	}
+	start, end, err := timeRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	a.distinct(w, r.Context(), fmt.Sprintf(
+		"SELECT DISTINCT %[1]s AS value FROM runtime_metrics WHERE kind = 'log' AND ts >= %[2]s AND ts < %[3]s AND %[1]s <> '' ORDER BY value",
+		labelValue("labels", name), sqlTime(start), sqlTime(end),
+	))
+}
+
+// distinct writes the strings in the first column of query as a label response.
+func (a *api) distinct(w http.ResponseWriter, ctx context.Context, query string) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	result, err := a.writer.Query(ctx, query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	values := make([]string, 0, len(result.Rows))
+	for _, row := range result.Rows {
+		if value, ok := row[0].(string); ok {
+			values = append(values, value)
+		}
+	}
+	writeJSON(w, loghttp.LabelResponse{Status: loghttp.QueryStatusSuccess, Data: values})
+}
+
+// streamLabels parses a labels column such as {job="camera"} into a label set.
+func streamLabels(raw string) (loghttp.LabelSet, error) {
+	ls := loghttp.LabelSet{}
+	if raw == "" || raw == "{}" {
+		return ls, nil
+	}
+	parsed, err := promql.ParseMetric(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid labels %s: %w", raw, err)
+	}
+	for _, l := range parsed {
+		ls[l.Name] = l.Value
+	}
+	return ls, nil
+}
+
+func timeRange(r *http.Request) (time.Time, time.Time, error) {
+	end := time.Now()
+	if raw := r.Form.Get("end"); raw != "" {
+		var err error
+		if end, err = parseTime(raw); err != nil {
+			return end, end, fmt.Errorf("invalid end: %w", err)
+		}
+	}
+	start := end.Add(-defaultRange)
+	if raw := r.Form.Get("start"); raw != "" {
+		var err error
+		if start, err = parseTime(raw); err != nil {
+			return start, end, fmt.Errorf("invalid start: %w", err)
+		}
+	}
+	if !end.After(start) {
+		return start, end, fmt.Errorf("end timestamp must be after start time")
+	}
+	return start, end, nil
+}
+
+// parseTime accepts unix nanoseconds, unix seconds with a fraction or RFC3339, like Loki.
+func parseTime(raw string) (time.Time, error) {
+	if ns, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return time.Unix(0, ns).UTC(), nil
+	}
+	if seconds, err := strconv.ParseFloat(raw, 64); err == nil {
+		whole, frac := math.Modf(seconds)
+		return time.Unix(int64(whole), int64(math.Round(frac*1e9))).UTC(), nil
+	}
+	return time.Parse(time.RFC3339Nano, raw)
+}
+
+func labelName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, ch := range name {
+		if !(ch == '_' || ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || i > 0 && ch >= '0' && ch <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// writeJSON encodes with jsoniter, loghttp registers the encoder writing entries as Loki's [timestamp, line] pairs.
+func writeJSON(w http.ResponseWriter, payload interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := jsoniter.ConfigCompatibleWithStandardLibrary.NewEncoder(w).Encode(payload); err != nil {
+		log.Println("lokiapi: failed to write response:", err)
+	}
+}
@@ -0,0 +1,140 @@
+package lokiapi
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+)
+
+// lineFilter is a LogQL line filter such as |= "key" or !~ "error.*".
+type lineFilter struct {
+	op    string
+	value string
+}
+
+// logQuery is a LogQL log query, a stream selector followed by line filters. Metric queries such as
+// count_over_time are not supported.
+type logQuery struct {
+	matchers []*labels.Matcher
+	filters  []lineFilter
+}
+
+func parseQuery(raw string) (logQuery, error) {
+	raw = strings.TrimSpace(raw)
+	if !strings.HasPrefix(raw, "{") {
+		return logQuery{}, fmt.Errorf("only log queries starting with a stream selector are supported: %s", raw)
+	}
+	end := selectorEnd(raw)
+	if end < 0 {
+		return logQuery{}, fmt.Errorf("unclosed stream selector: %s", raw)
+	}
+	matchers, err := promql.ParseMetricSelector(raw[:end+1])
+	if err != nil {
+		return logQuery{}, err
+	}
+	q := logQuery{matchers: matchers}
+	rest := strings.TrimSpace(raw[end+1:])
+	for rest != "" {
+		if len(rest) < 2 {
+			return q, fmt.Errorf("invalid line filter %q", rest)
+		}
+		op := rest[:2]
+		switch op {
+		case "|=", "!=", "|~", "!~":
+		default:
+			return q, fmt.Errorf("invalid line filter %q, expected |=, !=, |~ or !~", rest)
+		}
+		rest = strings.TrimSpace(rest[2:])
+		quoted, err := strconv.QuotedPrefix(rest)
+		if err != nil {
+			return q, fmt.Errorf("line filter %s needs a quoted string: %q", op, rest)
+		}
+		value, err := strconv.Unquote(quoted)
+		if err != nil {
+			return q, err
+		}
+		q.filters = append(q.filters, lineFilter{op: op, value: value})
+		rest = strings.TrimSpace(rest[len(quoted):])
+	}
+	return q, nil
+}
+
+// selectorEnd returns the index of the brace closing the stream selector, skipping quoted label values.
+func selectorEnd(raw string) int {
+	var quote rune
+	escaped := false
+	for i, ch := range raw {
+		switch {
+		case escaped:
+			escaped = false
+		case quote != 0 && ch == '\\' && quote != '`':
+			escaped = true
+		case quote != 0 && ch == quote:
+			quote = 0
+		case quote != 0:
+		case ch == '"' || ch == '`':
+			quote = ch
+		case ch == '}':
+			return i
+		}
+	}
+	return -1
+}
+
+// sql returns the log rows matching the query between start, inclusive, and end, exclusive, as the columns ts in
+// unix nanoseconds, labels and text.
+func (q logQuery) sql(start time.Time, end time.Time, forward bool, limit int) string {
+	conds := []string{
+		"kind = 'log'",
+		"ts >= " + sqlTime(start),
+		"ts < " + sqlTime(end),
+	}
+	for _, m := range q.matchers {
+		col := labelValue("labels", m.Name)
+		switch m.Type {
+		case labels.MatchEqual:
+			conds = append(conds, fmt.Sprintf("%s = %s", col, sqlString(m.Value)))
+		case labels.MatchNotEqual:
+			conds = append(conds, fmt.Sprintf("%s <> %s", col, sqlString(m.Value)))
+		case labels.MatchRegexp:
+			conds = append(conds, fmt.Sprintf("regexp_full_match(%s, %s)", col, sqlString(m.Value)))
+		case labels.MatchNotRegexp:
+			conds = append(conds, fmt.Sprintf("NOT regexp_full_match(%s, %s)", col, sqlString(m.Value)))
+		}
+	}
+	for _, f := range q.filters {
+		switch f.op {
+		case "|=":
+			conds = append(conds, fmt.Sprintf("contains(coalesce(text, ''), %s)", sqlString(f.value)))
+		case "!=":
+			conds = append(conds, fmt.Sprintf("NOT contains(coalesce(text, ''), %s)", sqlString(f.value)))
+		case "|~":
+			conds = append(conds, fmt.Sprintf("regexp_matches(coalesce(text, ''), %s)", sqlString(f.value)))
+		case "!~":
+			conds = append(conds, fmt.Sprintf("NOT regexp_matches(coalesce(text, ''), %s)", sqlString(f.value)))
+		}
+	}
+	order := "DESC"
+	if forward {
+		order = "ASC"
+	}
+	return fmt.Sprintf("SELECT epoch_ns(ts) AS ts, coalesce(labels, '{}') AS labels, coalesce(text, '') AS text FROM runtime_metrics WHERE %s ORDER BY ts %s LIMIT %d",
+		strings.Join(conds, " AND "), order, limit)
+}
+
+// labelValue extracts a label from a labels column such as {job="camera"}, empty if it is missing.
+func labelValue(column string, name string) string {
+	return fmt.Sprintf(`coalesce(regexp_extract(%s, '[{ ]%s="((?:[^"\\]|\\.)*)"', 1), '')`, column, name)
+}
+
+func sqlTime(ts time.Time) string {
+	return fmt.Sprintf("TIMESTAMP '%s'", ts.UTC().Format("2006-01-02 15:04:05.000000"))
+}
+
+func sqlString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -0,0 +1,179 @@
+package lokiapi
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/duckdb/duckdb-go/v2"
+)
+
+func TestSelectorEnd(t *testing.T) {
+	tests := map[string]int{
+		`{job="camera"}`:                13,
+		`{job="a}b"} |= "x"`:            10,
+		`{job="a\"}"}`:                  11,
+		"{job=`a\\`} != \"}\"":          9,
+		`{job="camera"`:                 -1,
+		`{job="camera}`:                 -1,
+		`{job="camera", level!="info"}`: 28,
+	}
+	for raw, want := range tests {
+		if got := selectorEnd(raw); got != want {
+			t.Errorf("selectorEnd(%q) = %d, want %d", raw, got, want)
+		}
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		query       string
+		wantFilters []lineFilter
+		wantErr     bool
+	}{
+		{query: `{job="camera"}`},
+		{
+			query:       ` {job="camera"} |= "frame" != "dropped" |~ "err.*" !~ ` + "`^debug`",
+			wantFilters: []lineFilter{{"|=", "frame"}, {"!=", "dropped"}, {"|~", "err.*"}, {"!~", "^debug"}},
+		},
+		{
+			query:       `{job="a}b"}|="quote \" inside"`,
+			wantFilters: []lineFilter{{"|=", `quote " inside`}},
+		},
+		{query: `count_over_time({job="camera"}[1m])`, wantErr: true},
+		{query: `{job="camera"`, wantErr: true},
+		{query: `{job=camera}`, wantErr: true},
+		{query: `{job="camera"} |`, wantErr: true},
+		{query: `{job="camera"} | json`, wantErr: true},
+		{query: `{job="camera"} |= frame`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			q, err := parseQuery(tt.query)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseQuery() = %+v, want an error", q)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseQuery() error = %v", err)
+			}
+			if !reflect.DeepEqual(q.filters, tt.wantFilters) {
+				t.Errorf("filters = %+v, want %+v", q.filters, tt.wantFilters)
+			}
+		})
+	}
+}
+
+func TestQuerySQL(t *testing.T) {
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("CREATE TABLE runtime_metrics (ts TIMESTAMP, name VARCHAR, value DOUBLE, text VARCHAR, labels VARCHAR, kind VARCHAR)"); err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Date(2024, time.March, 5, 12, 0, 0, 0, time.UTC)
+	logs := []struct {
+		offset int
+		labels string
+		text   string
+	}{
+		{0, `{job="camera", level="info"}`, "frame 1 saved"},
+		{1, `{job="camera", level="error"}`, "frame 2 dropped"},
+		{2, `{job="gps", level="info"}`, "fix acquired"},
+		{3, `{job="camera", level="info"}`, "it's frame 3"},
+		{4, `{job="camera", level="debug"}`, "frame 4 saved"},
+	}
+	for _, l := range logs {
+		if _, err := db.Exec("INSERT INTO runtime_metrics VALUES (?, 'log', NULL, ?, ?, 'log')", t0.Add(time.Duration(l.offset)*time.Second), l.text, l.labels); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec("INSERT INTO runtime_metrics VALUES (?, 'speed', 10, 'frame', '{job=\"camera\"}', 'metric')", t0); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query   string
+		forward bool
+		limit   int
+		want    []string
+	}{
+		{
+			query:   `{job="camera"}`,
+			forward: true,
+			limit:   100,
+			want:    []string{"frame 1 saved", "frame 2 dropped", "it's frame 3"},
+		},
+		{
+			query: `{job="camera"}`,
+			limit: 2,
+			want:  []string{"it's frame 3", "frame 2 dropped"},
+		},
+		{
+			query:   `{job=~"cam.*", level!="error"}`,
+			forward: true,
+			limit:   100,
+			want:    []string{"frame 1 saved", "it's frame 3"},
+		},
+		{
+			query:   `{level=~".+", job!~"cam.*"}`,
+			forward: true,
+			limit:   100,
+			want:    []string{"fix acquired"},
+		},
+		{
+			query:   `{job="camera"} |= "frame" != "dropped"`,
+			forward: true,
+			limit:   100,
+			want:    []string{"frame 1 saved", "it's frame 3"},
+		},
+		{
+			query:   `{job="camera"} |= "it's"`,
+			forward: true,
+			limit:   100,
+			want:    []string{"it's frame 3"},
+		},
+		{
+			query:   `{job="camera"} |~ "frame [12]" !~ "drop"`,
+			forward: true,
+			limit:   100,
+			want:    []string{"frame 1 saved"},
+		},
+	}
+	// The end is exclusive, the log at t0+4s is left out
+	start, end := t0, t0.Add(4*time.Second)
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			q, err := parseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			query := q.sql(start, end, tt.forward, tt.limit)
+			rows, err := db.Query(query)
+			if err != nil {
+				t.Fatalf("query failed: %v\n%s", err, query)
+			}
+			defer rows.Close()
+			var got []string
+			for rows.Next() {
+				var ts int64
+				var labels, text string
+				if err := rows.Scan(&ts, &labels, &text); err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, text)
+			}
+			if err := rows.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -154,7 +154,7 @@ func (s *imageServer) imageLoader(c chan *loghttp.Entry, done chan struct{}, sta
 			}
 			u := url.URL{
 				Scheme: "http",
-				Host:   "localhost:8003",
+				Host:   "localhost:7777",
 				Path:   "loki/api/v1/query_range",
 				RawQuery: fmt.Sprintf("start=%d&end=%d&direction=FORWARD", start.UnixNano(), end.UnixNano()) +
 					"&query=" + url.QueryEscape(fmt.Sprintf("{job=\"camera\"}")) +
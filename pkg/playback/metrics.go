@@ -131,7 +131,7 @@ func (s *metricServer) metricLoader(c chan *stream.Data, done chan struct{}, sta
 	}()
 	lastSent := time.Unix(0, 0)
 	client, err := api.NewClient(api.Config{
-		Address: "http://localhost:8002/api/prom",
+		Address: "http://localhost:7777",
 	})
 	if err != nil {
 		fmt.Printf("Error creating client: %v\n", err)
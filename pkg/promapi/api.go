@@ -0,0 +1,358 @@
+package promapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+
+	"github.com/slim-bean/leafbus/pkg/store"
+)
+
+const (
+	queryTimeout = 30 * time.Second
+	// maxSteps is the same limit of points per series as Prometheus.
+	maxSteps = 11000
+	// defaultSeriesRange is searched by /series and label values without a start, Prometheus searches everything
+	// but that reads the whole parquet archive.
+	defaultSeriesRange = 24 * time.Hour
+)
+
+type response struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+type queryData struct {
+	ResultType string      `json:"resultType"`
+	Result     interface{} `json:"result"`
+}
+
+type matrixSeries struct {
+	Metric map[string]string `json:"metric"`
+	Values [][2]interface{}  `json:"values"`
+}
+
+type vectorSample struct {
+	Metric map[string]string `json:"metric"`
+	Value  [2]interface{}    `json:"value"`
+}
+
+// Register adds the Prometheus HTTP API endpoints query, query_range, series and label values under /api/v1 and
+// under /api/prom/api/v1 where Cortex served them, so existing clients only need the leafbus address.
+func Register(mux *http.ServeMux, writer *store.Writer) {
+	if mux == nil {
+		mux = http.DefaultServeMux
+	}
+	a := &api{writer: writer}
+	for _, prefix := range []string{"/api/v1", "/api/prom/api/v1"} {
+		mux.HandleFunc(prefix+"/query", a.query)
+		mux.HandleFunc(prefix+"/query_range", a.queryRange)
+		mux.HandleFunc(prefix+"/series", a.series)
+		mux.HandleFunc(prefix+"/label/{name}/values", a.labelValues)
+	}
+}
+
+type api struct {
+	writer *store.Writer
+}
+
+func (a *api) query(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	ts := time.Now()
+	if raw := r.Form.Get("time"); raw != "" {
+		var err error
+		if ts, err = parseTime(raw); err != nil {
+			writeError(w, http.StatusBadRequest, "bad_data", fmt.Errorf("invalid time: %w", err))
+			return
+		}
+	}
+	series, scalar, err := a.eval(r.Context(), r.Form.Get("query"), ts, ts, time.Second)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	if scalar {
+		value := [2]interface{}{unixSeconds(ts), "NaN"}
+		if len(series) > 0 && len(series[0].Values) > 0 {
+			value = series[0].Values[0]
+		}
+		writeJSON(w, http.StatusOK, response{Status: "success", Data: queryData{ResultType: "scalar", Result: value}})
+		return
+	}
+	vector := make([]vectorSample, 0, len(series))
+	for _, s := range series {
+		vector = append(vector, vectorSample{Metric: s.Metric, Value: s.Values[len(s.Values)-1]})
+	}
+	writeJSON(w, http.StatusOK, response{Status: "success", Data: queryData{ResultType: "vector", Result: vector}})
+}
+
+func (a *api) queryRange(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	start, err := parseTime(r.Form.Get("start"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_data", fmt.Errorf("invalid start: %w", err))
+		return
+	}
+	end, err := parseTime(r.Form.Get("end"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_data", fmt.Errorf("invalid end: %w", err))
+		return
+	}
+	step, err := parseDuration(r.Form.Get("step"))
+	if err != nil || step <= 0 {
+		writeError(w, http.StatusBadRequest, "bad_data", fmt.Errorf("invalid step %q", r.Form.Get("step")))
+		return
+	}
+	if end.Before(start) {
+		writeError(w, http.StatusBadRequest, "bad_data", fmt.Errorf("end is before start"))
+		return
+	}
+	if end.Sub(start)/step > maxSteps {
+		writeError(w, http.StatusBadRequest, "bad_data", fmt.Errorf("exceeded maximum resolution of %d points per series, use a larger step", maxSteps))
+		return
+	}
+	series, _, err := a.eval(r.Context(), r.Form.Get("query"), start, end, step)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, response{Status: "success", Data: queryData{ResultType: "matrix", Result: series}})
+}
+
+// eval runs a PromQL query at every step between start and end.
+func (a *api) eval(ctx context.Context, query string, start time.Time, end time.Time, step time.Duration) ([]matrixSeries, bool, error) {
+	expr, err := promql.ParseExpr(query)
+	if err != nil {
+		return nil, false, err
+	}
+	sqlQuery, scalar, err := translate(expr, start, end, step)
+	if err != nil {
+		return nil, false, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	result, err := a.writer.Query(ctx, sqlQuery)
+	if err != nil {
+		return nil, false, err
+	}
+	series := []matrixSeries{}
+	var current *matrixSeries
+	var lastName, lastSeries string
+	for _, row := range result.Rows {
+		ms, ok1 := row[0].(int64)
+		name, ok2 := row[1].(string)
+		key, ok3 := row[2].(string)
+		value, ok4 := row[3].(float64)
+		if !ok1 || !ok2 || !ok3 || !ok4 {
+			continue
+		}
+		if current == nil || name != lastName || key != lastSeries {
+			metric, err := seriesLabels(name, key)
+			if err != nil {
+				return nil, false, err
+			}
+			series = append(series, matrixSeries{Metric: metric})
+			current = &series[len(series)-1]
+			lastName, lastSeries = name, key
+		}
+		current.Values = append(current.Values, [2]interface{}{float64(ms) / 1000, formatValue(value)})
+	}
+	return series, scalar, nil
+}
+
+func (a *api) series(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	matches := r.Form["match[]"]
+	if len(matches) == 0 {
+		writeError(w, http.StatusBadRequest, "bad_data", fmt.Errorf("no match[] parameter provided"))
+		return
+	}
+	start, end, err := seriesRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	c := &compiler{start: start, end: end}
+	var selects []string
+	for _, match := range matches {
+		matchers, err := promql.ParseMetricSelector(match)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "bad_data", err)
+			return
+		}
+		selects = append(selects, fmt.Sprintf("SELECT DISTINCT name, series FROM (%s)", c.samples(matchers, start, end)))
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+	result, err := a.writer.Query(ctx, strings.Join(selects, " UNION ")+" ORDER BY name, series")
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "execution", err)
+		return
+	}
+	data := make([]map[string]string, 0, len(result.Rows))
+	for _, row := range result.Rows {
+		name, _ := row[0].(string)
+		key, _ := row[1].(string)
+		metric, err := seriesLabels(name, key)
+		if err != nil {
+			writeError(w, http.StatusUnprocessableEntity, "execution", err)
+			return
+		}
+		data = append(data, metric)
+	}
+	writeJSON(w, http.StatusOK, response{Status: "success", Data: data})
+}
+
+func (a *api) labelValues(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	name := r.PathValue("name")
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+	if name == labels.MetricName {
+		names, err := a.writer.MetricNames(ctx)
+		if err != nil {
+			writeError(w, http.StatusUnprocessableEntity, "execution", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, response{Status: "success", Data: names})
+		return
+	}
+	if !labelName(name) {
+		writeError(w, http.StatusBadRequest, "bad_data", fmt.Errorf("invalid label name %q", name))
+		return
+	}
+	start, end, err := seriesRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	result, err := a.writer.Query(ctx, fmt.Sprintf(
+		"SELECT DISTINCT %[1]s AS value FROM runtime_metrics WHERE ts > %[2]s AND ts <= %[3]s AND %[1]s <> '' ORDER BY value",
+		labelValue("labels", name), sqlTime(start), sqlTime(end),
+	))
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "execution", err)
+		return
+	}
+	values := make([]string, 0, len(result.Rows))
+	for _, row := range result.Rows {
+		if value, ok := row[0].(string); ok {
+			values = append(values, value)
+		}
+	}
+	writeJSON(w, http.StatusOK, response{Status: "success", Data: values})
+}
+
+// seriesLabels returns the labels of a series, series is the labels column of runtime_metrics without __name__.
+func seriesLabels(name string, series string) (map[string]string, error) {
+	metric := make(map[string]string)
+	if series != "" && series != "{}" {
+		ls, err := promql.ParseMetric(series)
+		if err != nil {
+			return nil, fmt.Errorf("invalid labels %s: %w", series, err)
+		}
+		for _, l := range ls {
+			metric[l.Name] = l.Value
+		}
+	}
+	if name != "" {
+		metric[labels.MetricName] = name
+	}
+	return metric, nil
+}
+
+func seriesRange(r *http.Request) (time.Time, time.Time, error) {
+	end := time.Now()
+	if raw := r.Form.Get("end"); raw != "" {
+		var err error
+		if end, err = parseTime(raw); err != nil {
+			return end, end, fmt.Errorf("invalid end: %w", err)
+		}
+	}
+	start := end.Add(-defaultSeriesRange)
+	if raw := r.Form.Get("start"); raw != "" {
+		var err error
+		if start, err = parseTime(raw); err != nil {
+			return start, end, fmt.Errorf("invalid start: %w", err)
+		}
+	}
+	return start, end, nil
+}
+
+// parseTime accepts unix seconds with an optional fraction or RFC3339, like Prometheus.
+func parseTime(raw string) (time.Time, error) {
+	if seconds, err := strconv.ParseFloat(raw, 64); err == nil {
+		whole, frac := math.Modf(seconds)
+		return time.Unix(int64(whole), int64(math.Round(frac*1e9))).UTC(), nil
+	}
+	return time.Parse(time.RFC3339Nano, raw)
+}
+
+// parseDuration accepts seconds with an optional fraction or a duration such as 15s or 1m.
+func parseDuration(raw string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(raw, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	return time.ParseDuration(raw)
+}
+
+func labelName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, ch := range name {
+		if !(ch == '_' || ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || i > 0 && ch >= '0' && ch <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func unixSeconds(ts time.Time) float64 {
+	return float64(ts.UnixNano()) / 1e9
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func writeError(w http.ResponseWriter, status int, errorType string, err error) {
+	writeJSON(w, status, response{Status: "error", ErrorType: errorType, Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, payload interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(payload); err != nil {
+		log.Println("promapi: failed to write response:", err)
+	}
+}
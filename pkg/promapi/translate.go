@@ -0,0 +1,374 @@
+package promapi
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+)
+
+// lookback is how far back an instant selector looks for the latest sample, like Prometheus.
+const lookback = 5 * time.Minute
+
+// seriesExpr is the labels of a runtime metric row without __name__, which identifies the series of a metric.
+const seriesExpr = `regexp_replace(regexp_replace(coalesce(labels, '{}'), '__name__="(?:[^"\\]|\\.)*"(, )?', ''), ', }$', '}')`
+
+// compiler translates a PromQL expression into DuckDB SQL returning one row per step and series with the
+// columns t, name, series and value. name is empty once a function or operator dropped the metric name.
+type compiler struct {
+	start time.Time
+	end   time.Time
+	step  time.Duration
+	n     int
+}
+
+// compiled is either a scalar SQL expression or a query.
+type compiled struct {
+	scalar string
+	query  string
+}
+
+func (c compiled) isScalar() bool {
+	return c.query == ""
+}
+
+// translate returns the SQL of expr evaluated at every step between start and end, scalar reports whether the
+// expression is a number rather than a vector.
+func translate(expr promql.Expr, start time.Time, end time.Time, step time.Duration) (query string, scalar bool, err error) {
+	c := &compiler{start: start, end: end, step: step}
+	root, err := c.compile(expr)
+	if err != nil {
+		return "", false, err
+	}
+	scalar = root.isScalar()
+	if scalar {
+		root.query = fmt.Sprintf("SELECT t, '' AS name, '{}' AS series, %s AS value FROM %s", root.scalar, c.steps())
+	}
+	return fmt.Sprintf(
+		"SELECT epoch_ms(t) AS t, name, series, value FROM (%s) WHERE value IS NOT NULL AND NOT isnan(value) ORDER BY name, series, t",
+		root.query,
+	), scalar, nil
+}
+
+func (c *compiler) compile(expr promql.Expr) (compiled, error) {
+	switch e := expr.(type) {
+	case *promql.NumberLiteral:
+		return compiled{scalar: sqlFloat(e.Val)}, nil
+	case *promql.ParenExpr:
+		return c.compile(e.Expr)
+	case *promql.UnaryExpr:
+		inner, err := c.compile(e.Expr)
+		if err != nil || e.Op != promql.ItemSUB {
+			return inner, err
+		}
+		if inner.isScalar() {
+			return compiled{scalar: "(-" + inner.scalar + ")"}, nil
+		}
+		return compiled{query: fmt.Sprintf("SELECT t, '' AS name, series, -value AS value FROM (%s)", inner.query)}, nil
+	case *promql.VectorSelector:
+		return c.selector(e), nil
+	case *promql.Call:
+		return c.call(e)
+	case *promql.AggregateExpr:
+		return c.aggregate(e)
+	case *promql.BinaryExpr:
+		return c.binary(e)
+	case *promql.MatrixSelector:
+		return compiled{}, fmt.Errorf("range vector %s must be used in a function such as rate", e)
+	default:
+		return compiled{}, fmt.Errorf("unsupported expression %s", expr)
+	}
+}
+
+// samples selects the raw samples matching a selector between from and to.
+func (c *compiler) samples(matchers []*labels.Matcher, from time.Time, to time.Time) string {
+	conds := []string{
+		"value IS NOT NULL",
+		"ts > " + sqlTime(from),
+		"ts <= " + sqlTime(to),
+	}
+	for _, m := range matchers {
+		col := labelValue("labels", m.Name)
+		if m.Name == labels.MetricName {
+			col = "name"
+		}
+		switch m.Type {
+		case labels.MatchEqual:
+			conds = append(conds, fmt.Sprintf("%s = %s", col, sqlString(m.Value)))
+		case labels.MatchNotEqual:
+			conds = append(conds, fmt.Sprintf("%s <> %s", col, sqlString(m.Value)))
+		case labels.MatchRegexp:
+			conds = append(conds, fmt.Sprintf("regexp_full_match(%s, %s)", col, sqlString(m.Value)))
+		case labels.MatchNotRegexp:
+			conds = append(conds, fmt.Sprintf("NOT regexp_full_match(%s, %s)", col, sqlString(m.Value)))
+		}
+	}
+	return fmt.Sprintf("SELECT ts, name, %s AS series, value FROM runtime_metrics WHERE %s", seriesExpr, strings.Join(conds, " AND "))
+}
+
+// selector returns the latest sample of each series at every step, up to the lookback old.
+func (c *compiler) selector(e *promql.VectorSelector) compiled {
+	samples := c.alias("samples")
+	return compiled{query: fmt.Sprintf(`WITH %[1]s AS (%[2]s)
+SELECT k.t, m.name, m.series, m.value
+FROM (SELECT s.t, d.name, d.series FROM %[3]s s CROSS JOIN (SELECT DISTINCT name, series FROM %[1]s) d) k
+ASOF JOIN %[1]s m ON k.name = m.name AND k.series = m.series AND m.ts <= k.t - %[4]s
+WHERE m.ts > k.t - %[4]s - %[5]s`,
+		samples,
+		c.samples(e.LabelMatchers, c.start.Add(-e.Offset-lookback), c.end.Add(-e.Offset)),
+		c.steps(),
+		sqlInterval(e.Offset),
+		sqlInterval(lookback),
+	)}
+}
+
+var overTime = map[string]string{
+	"avg_over_time":    "avg(m.value)",
+	"min_over_time":    "min(m.value)",
+	"max_over_time":    "max(m.value)",
+	"sum_over_time":    "sum(m.value)",
+	"count_over_time":  "count(m.value)::DOUBLE",
+	"stddev_over_time": "stddev_pop(m.value)",
+	"stdvar_over_time": "var_pop(m.value)",
+}
+
+var mathFuncs = map[string]string{
+	"abs":   "abs",
+	"ceil":  "ceil",
+	"floor": "floor",
+	"round": "round",
+	"sqrt":  "sqrt",
+	"exp":   "exp",
+	"ln":    "ln",
+	"log2":  "log2",
+	"log10": "log10",
+}
+
+func (c *compiler) call(e *promql.Call) (compiled, error) {
+	name := e.Func.Name
+	if fn, ok := mathFuncs[name]; ok && len(e.Args) == 1 {
+		inner, err := c.compile(e.Args[0])
+		if err != nil {
+			return inner, err
+		}
+		return compiled{query: fmt.Sprintf("SELECT t, '' AS name, series, %s(value) AS value FROM (%s)", fn, inner.query)}, nil
+	}
+	switch name {
+	case "clamp_min", "clamp_max":
+		inner, err := c.compile(e.Args[0])
+		if err != nil {
+			return inner, err
+		}
+		limit, err := c.compile(e.Args[1])
+		if err != nil {
+			return limit, err
+		}
+		if !limit.isScalar() {
+			return compiled{}, fmt.Errorf("%s needs a number as its limit", name)
+		}
+		fn := "greatest"
+		if name == "clamp_max" {
+			fn = "least"
+		}
+		return compiled{query: fmt.Sprintf("SELECT t, '' AS name, series, %s(value, %s) AS value FROM (%s)", fn, limit.scalar, inner.query)}, nil
+	case "rate", "increase", "irate", "delta":
+		return c.rangeCall(e)
+	}
+	if _, ok := overTime[name]; ok {
+		return c.rangeCall(e)
+	}
+	return compiled{}, fmt.Errorf("unsupported function %s", name)
+}
+
+// rangeCall evaluates a function over the samples of a range selector ending at every step. rate and increase
+// handle counter resets but, unlike Prometheus, don't extrapolate to the edges of the range.
+func (c *compiler) rangeCall(e *promql.Call) (compiled, error) {
+	sel, ok := e.Args[0].(*promql.MatrixSelector)
+	if !ok {
+		return compiled{}, fmt.Errorf("%s needs a range selector such as metric[1m]", e.Func.Name)
+	}
+	samples := c.alias("samples")
+	query := c.samples(sel.LabelMatchers, c.start.Add(-sel.Offset-sel.Range), c.end.Add(-sel.Offset))
+	window := fmt.Sprintf("m.ts > s.t - %[1]s - %[2]s AND m.ts <= s.t - %[1]s", sqlInterval(sel.Offset), sqlInterval(sel.Range))
+	value := overTime[e.Func.Name]
+	having := ""
+	switch e.Func.Name {
+	case "rate", "increase", "irate":
+		query = fmt.Sprintf(`SELECT ts, name, series, value,
+	CASE WHEN value < lag(value) OVER w THEN value ELSE value - lag(value) OVER w END AS delta,
+	lag(ts) OVER w AS prev_ts
+FROM (%s)
+WINDOW w AS (PARTITION BY name, series ORDER BY ts)`, query)
+		window += fmt.Sprintf(" AND m.prev_ts > s.t - %s - %s", sqlInterval(sel.Offset), sqlInterval(sel.Range))
+		switch e.Func.Name {
+		case "rate":
+			value = fmt.Sprintf("sum(m.delta) / %s", sqlFloat(sel.Range.Seconds()))
+		case "increase":
+			value = "sum(m.delta)"
+		case "irate":
+			value = "arg_max(m.delta / (date_diff('microsecond', m.prev_ts, m.ts) / 1e6), m.ts)"
+		}
+	case "delta":
+		value = "arg_max(m.value, m.ts) - arg_min(m.value, m.ts)"
+		having = " HAVING count(*) >= 2"
+	}
+	return compiled{query: fmt.Sprintf(`WITH %[1]s AS (%[2]s)
+SELECT s.t, '' AS name, m.series, %[3]s AS value
+FROM %[4]s s JOIN %[1]s m ON %[5]s
+GROUP BY s.t, m.name, m.series%[6]s`,
+		samples, query, value, c.steps(), window, having,
+	)}, nil
+}
+
+var aggregates = map[promql.ItemType]string{
+	promql.ItemSum:    "sum(value)",
+	promql.ItemAvg:    "avg(value)",
+	promql.ItemMin:    "min(value)",
+	promql.ItemMax:    "max(value)",
+	promql.ItemCount:  "count(value)::DOUBLE",
+	promql.ItemStddev: "stddev_pop(value)",
+	promql.ItemStdvar: "var_pop(value)",
+}
+
+// aggregate combines the series at every step, grouped by the labels of a by clause.
+func (c *compiler) aggregate(e *promql.AggregateExpr) (compiled, error) {
+	agg, ok := aggregates[e.Op]
+	if !ok {
+		return compiled{}, fmt.Errorf("unsupported aggregation %s", e.Op)
+	}
+	if e.Without && len(e.Grouping) > 0 {
+		return compiled{}, fmt.Errorf("aggregation without labels is not supported, use by")
+	}
+	inner, err := c.compile(e.Expr)
+	if err != nil {
+		return inner, err
+	}
+	series := "'{}'"
+	if len(e.Grouping) > 0 {
+		parts := make([]string, 0, len(e.Grouping))
+		for _, name := range e.Grouping {
+			if name == labels.MetricName {
+				return compiled{}, fmt.Errorf("aggregation by %s is not supported", name)
+			}
+			value := labelValue("series", name)
+			parts = append(parts, fmt.Sprintf(`CASE WHEN %[2]s <> '' THEN '%[1]s="' || %[2]s || '"' END`, name, value))
+		}
+		series = fmt.Sprintf("'{' || concat_ws(', ', %s) || '}'", strings.Join(parts, ", "))
+	}
+	return compiled{query: fmt.Sprintf("SELECT t, '' AS name, %[1]s AS series, %[2]s AS value FROM (%[3]s) GROUP BY t, %[1]s", series, agg, inner.query)}, nil
+}
+
+var arithmetic = map[promql.ItemType]string{
+	promql.ItemADD: "(%s + %s)",
+	promql.ItemSUB: "(%s - %s)",
+	promql.ItemMUL: "(%s * %s)",
+	promql.ItemDIV: "(%s / %s)",
+	promql.ItemMOD: "fmod(%s, %s)",
+	promql.ItemPOW: "pow(%s, %s)",
+}
+
+var comparisons = map[promql.ItemType]string{
+	promql.ItemEQL: "(%s = %s)",
+	promql.ItemNEQ: "(%s <> %s)",
+	promql.ItemGTR: "(%s > %s)",
+	promql.ItemLSS: "(%s < %s)",
+	promql.ItemGTE: "(%s >= %s)",
+	promql.ItemLTE: "(%s <= %s)",
+}
+
+// binary applies an operator between scalars and vectors, vectors are matched one to one on all labels except
+// the metric name. Comparisons filter the left side unless bool is used.
+func (c *compiler) binary(e *promql.BinaryExpr) (compiled, error) {
+	if m := e.VectorMatching; m != nil && (len(m.MatchingLabels) > 0 || m.Card != promql.CardOneToOne && m.Card != promql.CardManyToMany) {
+		return compiled{}, fmt.Errorf("on, ignoring and group modifiers are not supported")
+	}
+	lhs, err := c.compile(e.LHS)
+	if err != nil {
+		return lhs, err
+	}
+	rhs, err := c.compile(e.RHS)
+	if err != nil {
+		return rhs, err
+	}
+	switch e.Op {
+	case promql.ItemLAND, promql.ItemLUnless:
+		exists := "EXISTS"
+		if e.Op == promql.ItemLUnless {
+			exists = "NOT EXISTS"
+		}
+		return compiled{query: fmt.Sprintf("SELECT * FROM (%s) l WHERE %s (SELECT 1 FROM (%s) r WHERE r.t = l.t AND r.series = l.series)", lhs.query, exists, rhs.query)}, nil
+	case promql.ItemLOR:
+		return compiled{query: fmt.Sprintf("SELECT * FROM (%[1]s) UNION ALL SELECT * FROM (%[2]s) r WHERE NOT EXISTS (SELECT 1 FROM (%[1]s) l WHERE l.t = r.t AND l.series = r.series)", lhs.query, rhs.query)}, nil
+	}
+	format, isArithmetic := arithmetic[e.Op]
+	if !isArithmetic {
+		if format, ok := comparisons[e.Op]; ok {
+			return c.compare(format, e.ReturnBool, lhs, rhs)
+		}
+		return compiled{}, fmt.Errorf("unsupported operator %s", e.Op)
+	}
+	switch {
+	case lhs.isScalar() && rhs.isScalar():
+		return compiled{scalar: fmt.Sprintf(format, lhs.scalar, rhs.scalar)}, nil
+	case rhs.isScalar():
+		return compiled{query: fmt.Sprintf("SELECT t, '' AS name, series, %s AS value FROM (%s)", fmt.Sprintf(format, "value", rhs.scalar), lhs.query)}, nil
+	case lhs.isScalar():
+		return compiled{query: fmt.Sprintf("SELECT t, '' AS name, series, %s AS value FROM (%s)", fmt.Sprintf(format, lhs.scalar, "value"), rhs.query)}, nil
+	}
+	return compiled{query: fmt.Sprintf("SELECT l.t, '' AS name, l.series, %s AS value FROM (%s) l JOIN (%s) r ON l.t = r.t AND l.series = r.series",
+		fmt.Sprintf(format, "l.value", "r.value"), lhs.query, rhs.query)}, nil
+}
+
+func (c *compiler) compare(format string, returnBool bool, lhs compiled, rhs compiled) (compiled, error) {
+	if lhs.isScalar() && rhs.isScalar() {
+		return compiled{scalar: fmt.Sprintf("CAST(%s AS DOUBLE)", fmt.Sprintf(format, lhs.scalar, rhs.scalar))}, nil
+	}
+	var from, cond, value string
+	switch {
+	case rhs.isScalar():
+		from, cond, value = "("+lhs.query+") l", fmt.Sprintf(format, "l.value", rhs.scalar), "l.value"
+	case lhs.isScalar():
+		from, cond, value = "("+rhs.query+") l", fmt.Sprintf(format, lhs.scalar, "l.value"), "l.value"
+	default:
+		from = fmt.Sprintf("(%s) l JOIN (%s) r ON l.t = r.t AND l.series = r.series", lhs.query, rhs.query)
+		cond, value = fmt.Sprintf(format, "l.value", "r.value"), "l.value"
+	}
+	if returnBool {
+		return compiled{query: fmt.Sprintf("SELECT l.t, '' AS name, l.series, CAST(%s AS DOUBLE) AS value FROM %s", cond, from)}, nil
+	}
+	return compiled{query: fmt.Sprintf("SELECT l.t, l.name, l.series, %s AS value FROM %s WHERE %s", value, from, cond)}, nil
+}
+
+// steps is a relation with a t column holding every evaluation time.
+func (c *compiler) steps() string {
+	return fmt.Sprintf("(SELECT unnest(generate_series(%s, %s, %s)) AS t)", sqlTime(c.start), sqlTime(c.end), sqlInterval(c.step))
+}
+
+func (c *compiler) alias(prefix string) string {
+	c.n++
+	return fmt.Sprintf("%s_%d", prefix, c.n)
+}
+
+// labelValue extracts a label from a labels column such as {__name__="speed", job="gps"}, ” if it is missing.
+func labelValue(column string, name string) string {
+	return fmt.Sprintf(`coalesce(regexp_extract(%s, '[{ ]%s="((?:[^"\\]|\\.)*)"', 1), '')`, column, name)
+}
+
+func sqlTime(ts time.Time) string {
+	return fmt.Sprintf("TIMESTAMP '%s'", ts.UTC().Format("2006-01-02 15:04:05.000000"))
+}
+
+func sqlInterval(d time.Duration) string {
+	return fmt.Sprintf("INTERVAL '%d microseconds'", d.Microseconds())
+}
+
+func sqlString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+func sqlFloat(v float64) string {
+	return "CAST(" + sqlString(strconv.FormatFloat(v, 'g', -1, 64)) + " AS DOUBLE)"
+}
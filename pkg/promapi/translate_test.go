@@ -0,0 +1,224 @@
+package promapi
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/duckdb/duckdb-go/v2"
+	"github.com/prometheus/prometheus/promql"
+)
+
+var t0 = time.Date(2024, time.March, 5, 12, 0, 0, 0, time.UTC)
+
+// testMetrics are the runtime_metrics rows the translated queries run against, as seconds after t0.
+var testMetrics = []struct {
+	offset int
+	name   string
+	labels string
+	value  float64
+}{
+	{0, "speed", `{__name__="speed", job="leaf"}`, 10},
+	{10, "speed", `{__name__="speed", job="leaf"}`, 20},
+	{20, "speed", `{__name__="speed", job="leaf"}`, 30},
+	{30, "speed", `{__name__="speed", job="leaf"}`, 40},
+	{0, "speed", `{__name__="speed", job="gps"}`, 5},
+	{20, "speed", `{__name__="speed", job="gps"}`, 7},
+	{0, "frames_total", `{__name__="frames_total", bus="can0"}`, 0},
+	{10, "frames_total", `{__name__="frames_total", bus="can0"}`, 10},
+	{20, "frames_total", `{__name__="frames_total", bus="can0"}`, 20},
+	{30, "frames_total", `{__name__="frames_total", bus="can0"}`, 5},
+	{40, "frames_total", `{__name__="frames_total", bus="can0"}`, 15},
+}
+
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec("CREATE TABLE runtime_metrics (ts TIMESTAMP, name VARCHAR, value DOUBLE, text VARCHAR, labels VARCHAR, kind VARCHAR)"); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range testMetrics {
+		if _, err := db.Exec("INSERT INTO runtime_metrics VALUES (?, ?, ?, NULL, ?, 'metric')", t0.Add(time.Duration(m.offset)*time.Second), m.name, m.value, m.labels); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+// point is a row of a translated query, a value of a series at seconds after t0.
+type point struct {
+	offset int
+	name   string
+	series string
+	value  float64
+}
+
+func (p point) String() string {
+	return fmt.Sprintf("%s%s@%d=%v", p.name, p.series, p.offset, p.value)
+}
+
+func TestTranslate(t *testing.T) {
+	db := openTestDB(t)
+	// Evaluated at t0+20s, t0+30s and t0+40s
+	start, end, step := t0.Add(20*time.Second), t0.Add(40*time.Second), 10*time.Second
+	leaf, gps := `{job="leaf"}`, `{job="gps"}`
+	tests := []struct {
+		query  string
+		scalar bool
+		want   []point
+	}{
+		{
+			query: `speed{job="leaf"}`,
+			want:  []point{{20, "speed", leaf, 30}, {30, "speed", leaf, 40}, {40, "speed", leaf, 40}},
+		},
+		{
+			query: `speed{job=~"le.*"}`,
+			want:  []point{{20, "speed", leaf, 30}, {30, "speed", leaf, 40}, {40, "speed", leaf, 40}},
+		},
+		{
+			query: `speed{job!="leaf"}`,
+			want:  []point{{20, "speed", gps, 7}, {30, "speed", gps, 7}, {40, "speed", gps, 7}},
+		},
+		{
+			query: `speed{job="leaf"} offset 10s`,
+			want:  []point{{20, "speed", leaf, 20}, {30, "speed", leaf, 30}, {40, "speed", leaf, 40}},
+		},
+		{
+			query: `sum(speed)`,
+			want:  []point{{20, "", "{}", 37}, {30, "", "{}", 47}, {40, "", "{}", 47}},
+		},
+		{
+			query: `max by (job) (speed)`,
+			want: []point{
+				{20, "", gps, 7}, {30, "", gps, 7}, {40, "", gps, 7},
+				{20, "", leaf, 30}, {30, "", leaf, 40}, {40, "", leaf, 40},
+			},
+		},
+		{
+			query: `increase(frames_total[20s])`,
+			want:  []point{{20, "", `{bus="can0"}`, 10}, {30, "", `{bus="can0"}`, 5}, {40, "", `{bus="can0"}`, 10}},
+		},
+		{
+			query: `rate(frames_total[20s])`,
+			want:  []point{{20, "", `{bus="can0"}`, 0.5}, {30, "", `{bus="can0"}`, 0.25}, {40, "", `{bus="can0"}`, 0.5}},
+		},
+		{
+			query: `avg_over_time(speed{job="leaf"}[20s])`,
+			want:  []point{{20, "", leaf, 25}, {30, "", leaf, 35}, {40, "", leaf, 40}},
+		},
+		{
+			query: `delta(speed{job="leaf"}[30s])`,
+			want:  []point{{20, "", leaf, 20}, {30, "", leaf, 20}, {40, "", leaf, 10}},
+		},
+		{
+			query: `speed{job="leaf"} * 2`,
+			want:  []point{{20, "", leaf, 60}, {30, "", leaf, 80}, {40, "", leaf, 80}},
+		},
+		{
+			query: `100 - speed{job="leaf"}`,
+			want:  []point{{20, "", leaf, 70}, {30, "", leaf, 60}, {40, "", leaf, 60}},
+		},
+		{
+			query: `speed{job="leaf"} - speed{job="leaf"} offset 10s`,
+			want:  []point{{20, "", leaf, 10}, {30, "", leaf, 10}, {40, "", leaf, 0}},
+		},
+		{
+			query: `speed > 35`,
+			want:  []point{{30, "speed", leaf, 40}, {40, "speed", leaf, 40}},
+		},
+		{
+			query: `speed{job="leaf"} > bool 35`,
+			want:  []point{{20, "", leaf, 0}, {30, "", leaf, 1}, {40, "", leaf, 1}},
+		},
+		{
+			query: `abs(-speed{job="gps"})`,
+			want:  []point{{20, "", gps, 7}, {30, "", gps, 7}, {40, "", gps, 7}},
+		},
+		{
+			query: `clamp_max(speed{job="leaf"}, 35)`,
+			want:  []point{{20, "", leaf, 30}, {30, "", leaf, 35}, {40, "", leaf, 35}},
+		},
+		{
+			query: `speed and speed{job="gps"}`,
+			want:  []point{{20, "speed", gps, 7}, {30, "speed", gps, 7}, {40, "speed", gps, 7}},
+		},
+		{
+			query: `speed{job="gps"} or speed{job="leaf"}`,
+			want: []point{
+				{20, "speed", gps, 7}, {30, "speed", gps, 7}, {40, "speed", gps, 7},
+				{20, "speed", leaf, 30}, {30, "speed", leaf, 40}, {40, "speed", leaf, 40},
+			},
+		},
+		{
+			query:  `1 + 2`,
+			scalar: true,
+			want:   []point{{20, "", "{}", 3}, {30, "", "{}", 3}, {40, "", "{}", 3}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			expr, err := promql.ParseExpr(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			query, scalar, err := translate(expr, start, end, step)
+			if err != nil {
+				t.Fatalf("translate() error = %v", err)
+			}
+			if scalar != tt.scalar {
+				t.Errorf("translate() scalar = %v, want %v", scalar, tt.scalar)
+			}
+			rows, err := db.Query(query)
+			if err != nil {
+				t.Fatalf("query failed: %v\n%s", err, query)
+			}
+			defer rows.Close()
+			var got []point
+			for rows.Next() {
+				var ms int64
+				var p point
+				if err := rows.Scan(&ms, &p.name, &p.series, &p.value); err != nil {
+					t.Fatal(err)
+				}
+				p.offset = int(time.UnixMilli(ms).Sub(t0) / time.Second)
+				got = append(got, p)
+			}
+			if err := rows.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v\nwant %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTranslateUnsupported(t *testing.T) {
+	tests := map[string]string{
+		`speed[1m]`:                                "range vector",
+		`topk(1, speed)`:                           "unsupported aggregation",
+		`sum without (job) (speed)`:                "without labels is not supported",
+		`sum by (__name__) (speed)`:                "aggregation by __name__",
+		`speed + on(job) speed`:                    "on, ignoring and group modifiers",
+		`label_replace(speed, "a", "b", "c", "d")`: "unsupported function",
+	}
+	for query, want := range tests {
+		t.Run(query, func(t *testing.T) {
+			expr, err := promql.ParseExpr(query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _, err = translate(expr, t0, t0.Add(time.Minute), time.Minute)
+			if err == nil || !strings.Contains(err.Error(), want) {
+				t.Errorf("translate() error = %v, want %q", err, want)
+			}
+		})
+	}
+}
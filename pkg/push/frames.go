@@ -0,0 +1,57 @@
+package push
+
+import (
+	"time"
+
+	"github.com/brutella/can"
+
+	"github.com/slim-bean/leafbus/pkg/store"
+)
+
+// FrameRecorder stores the raw frames received on a bus so drives can be re-decoded after fixing a decoder.
+type FrameRecorder struct {
+	bus   string
+	store *store.Writer
+	allow map[uint32]struct{}
+}
+
+// NewFrameRecorder records frames from the named bus, if allow is not empty only those frame IDs are stored.
+func NewFrameRecorder(writer *store.Writer, bus string, allow []uint32) *FrameRecorder {
+	r := &FrameRecorder{
+		bus:   bus,
+		store: writer,
+	}
+	if len(allow) > 0 {
+		r.allow = make(map[uint32]struct{}, len(allow))
+		for _, id := range allow {
+			r.allow[id] = struct{}{}
+		}
+	}
+	return r
+}
+
+func (r *FrameRecorder) Handle(frame can.Frame) {
+	r.HandleAt(frame, time.Now())
+}
+
+// HandleAt records a frame received at ts.
+func (r *FrameRecorder) HandleAt(frame can.Frame, ts time.Time) {
+	if r.allow != nil {
+		if _, ok := r.allow[frame.ID]; !ok {
+			return
+		}
+	}
+	length := frame.Length
+	if length > can.MaxFrameDataLength {
+		length = can.MaxFrameDataLength
+	}
+	data := make([]byte, length)
+	copy(data, frame.Data[:length])
+	r.store.EnqueueFrame(store.FrameRow{
+		Timestamp: ts,
+		Bus:       r.bus,
+		ID:        frame.ID,
+		DLC:       frame.Length,
+		Data:      data,
+	})
+}
@@ -1,7 +1,9 @@
 package push
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
 	"log"
 	"strconv"
 	"strings"
@@ -14,9 +16,12 @@ import (
 	"github.com/brutella/can"
 	"github.com/prometheus/prometheus/pkg/labels"
 
+	"github.com/slim-bean/leafbus/pkg/decode"
+	"github.com/slim-bean/leafbus/pkg/events"
 	"github.com/slim-bean/leafbus/pkg/model"
 	"github.com/slim-bean/leafbus/pkg/store"
 	"github.com/slim-bean/leafbus/pkg/stream"
+	"github.com/slim-bean/leafbus/pkg/trip"
 )
 
 const (
@@ -69,6 +74,13 @@ type Handler struct {
 	runtimeMin   time.Duration
 	runtimeMu    sync.Mutex
 	runtimeLast  map[string]int64
+	decoder      *decode.Decoder
+	valuesMu     sync.Mutex
+	lastValues   map[*decode.Signal]string
+	cellsMu      sync.Mutex
+	cells        store.CellRow
+	trips        *trip.Tracker
+	events       *events.Broker
 }
 
 func (h *Handler) Follow(name string, follower *stream.Follower) {
@@ -135,187 +147,183 @@ func NewHandler(writer *store.Writer) (*Handler, error) {
 		streamMap:    map[string][]*ratedFollower{},
 		runtimeMin:   10 * time.Millisecond,
 		runtimeLast:  map[string]int64{},
+		decoder:      decode.NewDecoder(decode.Leaf),
+		lastValues:   map[*decode.Signal]string{},
+		trips:        trip.NewTracker(),
 	}
+	h.events = events.NewBroker(h.statusSnapshot)
 	return h, nil
 }
 
+// Events returns the broker publishing status changes and log events, see events.Register.
+func (h *Handler) Events() *events.Broker {
+	return h.events
+}
+
+// statusSnapshot is the first event of a new events client, every status column that is set.
+func (h *Handler) statusSnapshot() []events.Event {
+	status, ok := h.LatestStatus()
+	if !ok {
+		return nil
+	}
+	return []events.Event{{Type: "status", Data: status.Changes(store.StatusRow{})}}
+}
+
 // TODO this is not thread safe
 func (h *Handler) RegisterRunListener(rl model.RunListener) {
 	h.runListeners = append(h.runListeners, rl)
 }
 
+// SetDecoder replaces the signal definitions used to decode frames, it must be called before any frames are handled.
+func (h *Handler) SetDecoder(d *decode.Decoder) {
+	h.decoder = d
+}
+
 func (h *Handler) Handle(frame can.Frame) {
+	h.HandleAt(frame, time.Now())
+}
+
+// HandleAt decodes a frame received at ts, used when replaying captured frames with their original timestamps.
+func (h *Handler) HandleAt(frame can.Frame, ts time.Time) {
 	canMessages.Inc()
-	switch frame.ID {
-
-	case 0x002:
-		// Steering Position
-		steering := int16(uint16(frame.Data[1])<<8 | uint16(frame.Data[0]))
-		ts := time.Now()
-		h.SendMetric("steering_position", nil, ts, float64(steering))
-	case 0x11A:
-		// Gear and Key/Off/On
-		keyOn := false
-		if frame.Data[1]&0b11100000 == 0b10000000 {
-			// Off
-			keyOn = false
-		} else if frame.Data[1]&0b11100000 == 0b01000000 {
-			// On
-			keyOn = true
-		}
+	h.decoder.Decode(frame, ts, h)
+}
+
+// SetRunning marks the key as on or off without notifying the run listeners, metrics are only stored while running.
+func (h *Handler) SetRunning(running bool) {
+	h.running = running
+}
+
+// HandleSignal implements decode.Sink, signals with side effects beyond storing a metric are handled here.
+func (h *Handler) HandleSignal(sig *decode.Signal, ts time.Time, val float64) {
+	switch sig.Name {
+	case "key_state":
+		keyOn := val == 0b010
 		if keyOn && !h.running {
 			// Key is on, but not running, start
 			for _, l := range h.runListeners {
 				l.Start()
 			}
 			h.running = true
-			h.SendLog(keyLabel, time.Now(), "Key Turned On")
+			h.SendLog(keyLabel, ts, "Key Turned On")
 			h.tripStartGid = h.lastGid
+			h.trips.Start(ts)
 		} else if !keyOn && h.running {
 			// Key is off, currently running, stop
 			for _, l := range h.runListeners {
 				l.Stop()
 			}
 			h.running = false
-			h.SendLog(keyLabel, time.Now(), "Key Turned Off")
-		}
-	case 0x180:
-		//Throttle Position and Motor Amps
-		motorAmps := (uint16(frame.Data[2]) << 4) | (uint16(frame.Data[3]) >> 4)
-		ts := time.Now()
-		h.SendMetric("motor_amps", nil, ts, float64(motorAmps))
-		throttle := float64((uint16(frame.Data[5]) << 2) | (uint16(frame.Data[6]) >> 6))
-		throttle = (throttle / 800) * 100
-		h.SendMetric("throttle_percent", nil, ts, throttle)
-	case 0x1CB:
-		// Target brake position
-		brake := (uint16(frame.Data[2]) << 2) | (uint16(frame.Data[3]) >> 6)
-		ts := time.Now()
-		h.SendMetric("target_brake", nil, ts, float64(brake))
-	case 0x1DA:
-		//Motor Torque and Speed
-		var effectiveTorque int16
-		if frame.Data[2]&0b00000100 == 0b00000100 {
-			effectiveTorque = int16(((uint16(frame.Data[2]&0b00000111) << 8) | 0b1111100000000000) | uint16(frame.Data[3]))
-		} else {
-			effectiveTorque = int16(((uint16(frame.Data[2]&0b00000111) << 8) & 0b0000011111111111) | uint16(frame.Data[3]))
-		}
-		motorSpeed := int16(uint16(frame.Data[4])<<8 | uint16(frame.Data[5]))
-		ts := time.Now()
-		h.SendMetric("effective_torque", nil, ts, float64(effectiveTorque))
-		h.SendMetric("motor_rpm", nil, ts, float64(motorSpeed))
-
-	case 0x1DB:
-		//Battery Current and Voltage
-		var battCurrent int16
-		if frame.Data[0]&0b10000000 == 0b10000000 {
-			battCurrent = int16((uint16(frame.Data[0]) << 3) | 0b1111100000000000 | uint16(frame.Data[1]>>6))
-		} else {
-			battCurrent = int16((uint16(frame.Data[0])<<3)&0b0000011111111111 | uint16(frame.Data[1]>>6))
-		}
-		currVoltage := float64((uint16(frame.Data[2]) << 2) | (uint16(frame.Data[3]&0b11000000) >> 6))
-		currVoltage = currVoltage * 0.5
-		ts := time.Now()
-		// Invert the battery current reading because I prefer it this way
-		h.SendMetric("battery_amps", nil, ts, float64(-battCurrent))
-		h.SendMetric("battery_volts", nil, ts, float64(currVoltage))
-		h.lastBatteryV = currVoltage
-	case 0x280:
-		// Speed
-		speed := float64(uint16(frame.Data[4])<<8 | uint16(frame.Data[5]))
-		speed = speed * 0.0062
-		ts := time.Now()
-		h.SendMetric("speed_mph", nil, ts, speed)
-
-	case 0x292:
-		// Friction Brake Pressure
-		brake := frame.Data[6]
-		ts := time.Now()
-		h.SendMetric("friction_brake_pressure", nil, ts, float64(brake))
-	case 0x358:
-		// Turn Signal
-		turnL := frame.Data[2]&0b00000010 == 0b00000010
-		if turnL && h.prevLights&0b00000001 != 0b000000001 {
-			ts := time.Now()
-			h.SendLog(turnLabel, ts, "Left Turn Signal On")
-			h.prevLights |= 0b00000001
-		} else if !turnL && h.prevLights&0b00000001 != 0b00000000 {
-			ts := time.Now()
-			h.SendLog(turnLabel, ts, "Left Turn Signal Off")
-			h.prevLights &= 0b11111110
-		}
-		turnR := frame.Data[2]&0b00000100 == 0b00000100
-		if turnR && h.prevLights&0b00000010 != 0b000000010 {
-			ts := time.Now()
-			h.SendLog(turnLabel, ts, "Right Turn Signal On")
-			h.prevLights |= 0b00000010
-		} else if !turnR && h.prevLights&0b00000010 != 0b00000000 {
-			ts := time.Now()
-			h.SendLog(turnLabel, ts, "Right Turn Signal Off")
-			h.prevLights &= 0b11111101
+			h.SendLog(keyLabel, ts, "Key Turned Off")
+			if t, ok := h.trips.Finish(ts); ok {
+				h.storeTrip(t)
+			}
 		}
-	case 0x510:
-		//Climate control power
-		ccPower := float64(frame.Data[3] >> 1 & 0b00111111)
-		ccPower = ccPower * 0.25
-		ts := time.Now()
-		h.SendMetric("climate_control_kw", nil, ts, ccPower)
-		h.SendMetric("climate_control_amps", nil, ts, ccPower/h.lastBatteryV)
-	case 0x55B:
-		//SOC
-		currCharge := (uint16(frame.Data[0]) << 2) | (uint16(frame.Data[1]) >> 6)
-		h.SendMetric("soc", nil, time.Now(), float64(currCharge)/10)
-		h.UpdateTractionSOC(time.Now(), float64(currCharge)/10)
-	case 0x5B3:
-		//GID
-		gid := uint16(frame.Data[4]&0b00000001)<<8 | uint16(frame.Data[5])
+	case "battery_volts":
+		h.SendMetric(sig.Metric, nil, ts, val)
+		h.lastBatteryV = val
+		h.trips.Observe(sig.Name, ts, val)
+	case "battery_amps":
+		h.SendMetric(sig.Metric, nil, ts, val)
+		h.trips.Observe(sig.Name, ts, val)
+	case "climate_control_kw":
+		h.SendMetric(sig.Metric, nil, ts, val)
+		h.SendMetric("climate_control_amps", nil, ts, val/h.lastBatteryV)
+		h.trips.Observe(sig.Name, ts, val)
+	case "soc":
+		h.SendMetric(sig.Metric, nil, ts, val)
+		h.UpdateTractionSOC(ts, val)
+		h.trips.Observe(sig.Name, ts, val)
+	case "odometer":
+		h.SendMetric(sig.Metric, nil, ts, val)
+		h.trips.Observe(sig.Name, ts, val)
+	case "gids":
+		gid := uint16(val)
 		// Sometimes we get a bogus gid value of 511 so just send the last value
 		if gid == 511 {
 			gid = h.lastGid
 		} else {
 			h.lastGid = gid
 		}
-		ts := time.Now()
-		h.SendMetric("gids", nil, ts, float64(gid))
+		h.SendMetric(sig.Metric, nil, ts, float64(gid))
 		h.SendMetric("trip_gids", nil, ts, float64(h.tripStartGid-gid))
-	case 0x5C5:
-		//Odometer
-		odo := uint32(frame.Data[1])<<16 | uint32(frame.Data[2])<<8 | uint32(frame.Data[3])
-		ts := time.Now()
-		h.SendMetric("odometer", nil, ts, float64(odo))
-	case 0x625:
-		// Headlights
-		parkL := frame.Data[1]&0b01000000 == 0b01000000
-		if parkL && h.prevLights&0b00000100 != 0b000000100 {
-			ts := time.Now()
-			h.SendLog(lightLabel, ts, "Parking Lights On")
-			h.prevLights |= 0b00000100
-		} else if !parkL && h.prevLights&0b00000100 != 0b00000000 {
-			ts := time.Now()
-			h.SendLog(lightLabel, ts, "Parking Lights Off")
-			h.prevLights &= 0b11111011
+		h.trips.Observe(sig.Name, ts, float64(gid))
+	default:
+		if t, ok := toggles[sig.Name]; ok {
+			h.sendToggle(t, ts, val != 0)
+			return
+		}
+		if sig.Metric != "" {
+			h.SendMetric(sig.Metric, nil, ts, val)
 		}
-		lowBeam := frame.Data[1]&0b00100000 == 0b00100000
-		if lowBeam && h.prevLights&0b00001000 != 0b000001000 {
-			ts := time.Now()
-			h.SendLog(lightLabel, ts, "Low Beams On")
-			h.prevLights |= 0b00001000
-		} else if !lowBeam && h.prevLights&0b00001000 != 0b00000000 {
-			ts := time.Now()
-			h.SendLog(lightLabel, ts, "Low Beams Off")
-			h.prevLights &= 0b11110111
+		if desc, ok := sig.Description(val); ok {
+			h.sendValueChange(sig, ts, desc)
 		}
-		highBeam := frame.Data[1]&0b00010000 == 0b00010000
-		if highBeam && h.prevLights&0b00010000 != 0b000010000 {
-			ts := time.Now()
-			h.SendLog(lightLabel, ts, "High Beams On")
-			h.prevLights |= 0b00010000
-		} else if !highBeam && h.prevLights&0b00010000 != 0b00000000 {
-			ts := time.Now()
-			h.SendLog(lightLabel, ts, "High Beams Off")
-			h.prevLights &= 0b11101111
+	}
+}
+
+// storeTrip saves a finished trip without blocking the CAN handler.
+func (h *Handler) storeTrip(t store.Trip) {
+	if h.store == nil {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		id, err := h.store.InsertTrip(ctx, t)
+		if err != nil {
+			log.Println("Failed to store trip:", err)
+			return
 		}
+		log.Printf("Stored trip %d from %s to %s\n", id, t.Start.Format(time.RFC3339), t.End.Format(time.RFC3339))
+	}()
+}
+
+// sendValueChange logs the value table description of a signal when it changes.
+func (h *Handler) sendValueChange(sig *decode.Signal, ts time.Time, desc string) {
+	h.valuesMu.Lock()
+	last, ok := h.lastValues[sig]
+	h.lastValues[sig] = desc
+	h.valuesMu.Unlock()
+	if ok && last == desc {
+		return
+	}
+	name := sig.Metric
+	if name == "" {
+		name = decode.MetricName(sig.Name)
+	}
+	ls := labels.Labels{
+		labels.Label{
+			Name:  "job",
+			Value: name,
+		},
+	}
+	h.SendLog(ls, ts, fmt.Sprintf("%s: %s", sig.Name, desc))
+}
+
+// toggle is an on/off signal which is logged when it changes, bit is its position in prevLights.
+type toggle struct {
+	bit    uint8
+	labels labels.Labels
+	on     string
+	off    string
+}
+
+var toggles = map[string]toggle{
+	"turn_left":      {bit: 0b00000001, labels: turnLabel, on: "Left Turn Signal On", off: "Left Turn Signal Off"},
+	"turn_right":     {bit: 0b00000010, labels: turnLabel, on: "Right Turn Signal On", off: "Right Turn Signal Off"},
+	"parking_lights": {bit: 0b00000100, labels: lightLabel, on: "Parking Lights On", off: "Parking Lights Off"},
+	"low_beams":      {bit: 0b00001000, labels: lightLabel, on: "Low Beams On", off: "Low Beams Off"},
+	"high_beams":     {bit: 0b00010000, labels: lightLabel, on: "High Beams On", off: "High Beams Off"},
+}
 
+func (h *Handler) sendToggle(t toggle, ts time.Time, on bool) {
+	if on && h.prevLights&t.bit == 0 {
+		h.SendLog(t.labels, ts, t.on)
+		h.prevLights |= t.bit
+	} else if !on && h.prevLights&t.bit != 0 {
+		h.SendLog(t.labels, ts, t.off)
+		h.prevLights &^= t.bit
 	}
 }
 
@@ -377,13 +385,18 @@ func (h *Handler) allowRuntimeMetric(name string, ts time.Time) bool {
 }
 
 func (h *Handler) SendLog(labels labels.Labels, timestamp time.Time, entry string) {
-	if h.store == nil {
-		return
-	}
 	name := labels.Get("job")
 	if name == "" {
 		name = "log"
 	}
+	h.events.Publish(events.Event{
+		Type: "log",
+		Job:  name,
+		Data: logEvent{Timestamp: timestamp.UTC(), Job: name, Labels: labels.Map(), Line: entry},
+	})
+	if h.store == nil {
+		return
+	}
 	var labelString sql.NullString
 	if len(labels) > 0 {
 		labelString = nullString(labels.String())
@@ -404,7 +417,14 @@ func (h *Handler) UpdateTractionSOC(ts time.Time, soc float64) {
 	})
 }
 
+func (h *Handler) UpdateTractionTemp(ts time.Time, tempC float64) {
+	h.updateStatus(ts, func(s *store.StatusRow) {
+		s.TractionTempC = nullFloat(tempC)
+	})
+}
+
 func (h *Handler) UpdateGPS(ts time.Time, lat float64, lon float64) {
+	h.trips.ObserveGPS(lat, lon)
 	h.updateStatus(ts, func(s *store.StatusRow) {
 		s.GPSLat = nullFloat(lat)
 		s.GPSLon = nullFloat(lon)
@@ -460,6 +480,45 @@ func (h *Handler) UpdateHydra(ts time.Time, v1Volts float64, v1Amps float64, v2V
 	})
 }
 
+func (h *Handler) UpdateBatteryHealth(ts time.Time, soh float64, hx float64, ah float64) {
+	h.updateStatus(ts, func(s *store.StatusRow) {
+		s.BatterySOH = nullFloat(soh)
+		s.BatteryHx = nullFloat(hx)
+		s.BatteryAh = nullFloat(ah)
+	})
+}
+
+func (h *Handler) UpdateChargeCounts(ts time.Time, qc int64, l1l2 int64) {
+	h.updateStatus(ts, func(s *store.StatusRow) {
+		s.QCCount = nullInt(qc)
+		s.L1L2Count = nullInt(l1l2)
+	})
+}
+
+// UpdateCells stores a snapshot of the cell voltages, shunts may be nil if they could not be read.
+func (h *Handler) UpdateCells(ts time.Time, voltages []float64, shunts []bool) {
+	row := store.CellRow{
+		Timestamp: ts.UTC(),
+		Voltages:  voltages,
+		Shunts:    shunts,
+	}
+	h.cellsMu.Lock()
+	h.cells = row
+	h.cellsMu.Unlock()
+	if h.store != nil {
+		h.store.EnqueueCells(row)
+	}
+}
+
+func (h *Handler) LatestCells() (store.CellRow, bool) {
+	h.cellsMu.Lock()
+	defer h.cellsMu.Unlock()
+	if h.cells.Timestamp.IsZero() {
+		return store.CellRow{}, false
+	}
+	return h.cells, true
+}
+
 func (h *Handler) LatestStatus() (store.StatusRow, bool) {
 	h.statusMu.Lock()
 	defer h.statusMu.Unlock()
@@ -480,8 +539,19 @@ func (h *Handler) updateStatus(ts time.Time, updater func(*store.StatusRow)) {
 	} else {
 		h.status.Timestamp = ts.UTC()
 	}
+	prev := h.status
 	updater(&h.status)
 	h.store.EnqueueStatus(h.status)
+	if changes := h.status.Changes(prev); len(changes) > 0 {
+		h.events.Publish(events.Event{Type: "status", Data: changes})
+	}
+}
+
+type logEvent struct {
+	Timestamp time.Time         `json:"ts"`
+	Job       string            `json:"job"`
+	Labels    map[string]string `json:"labels"`
+	Line      string            `json:"line"`
 }
 
 func (h *Handler) publishMetric(name string, timestamp time.Time, val float64) {
@@ -492,15 +562,14 @@ func (h *Handler) publishMetric(name string, timestamp time.Time, val float64) {
 		return
 	}
 	for _, f := range followers {
-		if len(f.Follower.Pub) >= 1 {
+		ts := timestamp.UnixNano() / int64(time.Millisecond)
+		if f.Follower.Rate > 0 && ts-f.lastSent < f.Follower.Rate {
 			continue
 		}
-		ts := timestamp.UnixNano() / int64(time.Millisecond)
-		if f.Follower.Rate > 0 {
-			if ts-f.lastSent < f.Follower.Rate {
-				continue
-			}
-			f.lastSent = ts
+		f.lastSent = ts
+		if len(f.Follower.Pub) == cap(f.Follower.Pub) {
+			f.Follower.Dropped.Add(1)
+			continue
 		}
 		d := stream.GetData()
 		d.Name = name
@@ -524,6 +593,13 @@ func nullString(val string) sql.NullString {
 	}
 }
 
+func nullInt(val int64) sql.NullInt64 {
+	return sql.NullInt64{
+		Int64: val,
+		Valid: true,
+	}
+}
+
 func nullBool(val bool) sql.NullBool {
 	return sql.NullBool{
 		Bool:  val,
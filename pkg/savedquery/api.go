@@ -0,0 +1,62 @@
+package savedquery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/slim-bean/leafbus/pkg/store"
+)
+
+const queryTimeout = 5 * time.Second
+
+// Register serves the saved queries as GET /query/{name}?from=&to=&interval=&metric=, returning the same JSON as
+// /query. Results are cached per query and parameters for the registry's CacheTTL.
+func Register(mux *http.ServeMux, writer *store.Writer, registry *Registry) {
+	if mux == nil {
+		mux = http.DefaultServeMux
+	}
+	mux.HandleFunc("GET /query/{name}", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		sqlQuery, ok := registry.Get(name)
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("no saved query %q", name))
+			return
+		}
+		now := time.Now().UTC()
+		values := r.URL.Query()
+		params, err := ParseParams(values, now)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		key := name + "|" + paramsKey(values)
+		result, ok := registry.cached(key, now)
+		if !ok {
+			ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+			defer cancel()
+			result, err = writer.Query(ctx, sqlQuery, params.Args()...)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("query %s failed: %v", name, err))
+				return
+			}
+			registry.put(key, result, now)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if ttl := registry.cfg.CacheTTL; ttl > 0 {
+			w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(ttl.Seconds())))
+		}
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			log.Println("failed to write saved query response:", err)
+		}
+	})
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
@@ -0,0 +1,97 @@
+package savedquery
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/duckdb/duckdb-go/v2"
+)
+
+const defaultRange = time.Hour
+
+// Params are the values bound to $from, $to, $interval and $metric. The query only sees the ones it uses.
+type Params struct {
+	From     time.Time
+	To       time.Time
+	Interval time.Duration
+	Metric   string
+}
+
+// ParseParams reads from and to, as RFC3339, unix milliseconds like Grafana's ${__from} or now-<duration>, the
+// interval as a duration or milliseconds and the metric name. to defaults to now, from to an hour before to and the
+// interval to a minute.
+func ParseParams(values url.Values, now time.Time) (Params, error) {
+	p := Params{To: now, Interval: time.Minute, Metric: values.Get("metric")}
+	var err error
+	if raw := values.Get("to"); raw != "" {
+		if p.To, err = parseTime(raw, now); err != nil {
+			return p, fmt.Errorf("invalid to: %w", err)
+		}
+	}
+	p.From = p.To.Add(-defaultRange)
+	if raw := values.Get("from"); raw != "" {
+		if p.From, err = parseTime(raw, now); err != nil {
+			return p, fmt.Errorf("invalid from: %w", err)
+		}
+	}
+	if p.From.After(p.To) {
+		return p, fmt.Errorf("from must not be after to")
+	}
+	if raw := values.Get("interval"); raw != "" {
+		if p.Interval, err = parseDuration(raw); err != nil {
+			return p, fmt.Errorf("invalid interval: %w", err)
+		}
+		if p.Interval <= 0 {
+			return p, fmt.Errorf("interval must be positive")
+		}
+	}
+	return p, nil
+}
+
+// Args returns the parameters as named arguments for store.Writer.Query. $metric is NULL if it wasn't given.
+func (p Params) Args() []interface{} {
+	var metric interface{}
+	if p.Metric != "" {
+		metric = p.Metric
+	}
+	return []interface{}{
+		sql.Named("from", p.From.UTC()),
+		sql.Named("to", p.To.UTC()),
+		sql.Named("interval", duckdb.Interval{Micros: p.Interval.Microseconds()}),
+		sql.Named("metric", metric),
+	}
+}
+
+// paramsKey identifies the parameters in the result cache. It uses the values as given rather than the resolved
+// times, so relative and default ranges like now-1h hit the cache for the TTL instead of changing on every request.
+func paramsKey(values url.Values) string {
+	return fmt.Sprintf("%q|%q|%q|%q", values.Get("from"), values.Get("to"), values.Get("interval"), values.Get("metric"))
+}
+
+func parseTime(raw string, now time.Time) (time.Time, error) {
+	if raw == "now" {
+		return now, nil
+	}
+	if strings.HasPrefix(raw, "now-") {
+		d, err := time.ParseDuration(strings.TrimPrefix(raw, "now-"))
+		if err != nil {
+			return time.Time{}, err
+		}
+		return now.Add(-d), nil
+	}
+	if ms, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return time.UnixMilli(ms).UTC(), nil
+	}
+	return time.Parse(time.RFC3339Nano, raw)
+}
+
+func parseDuration(raw string) (time.Duration, error) {
+	if ms, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return time.Duration(ms) * time.Millisecond, nil
+	}
+	return time.ParseDuration(raw)
+}
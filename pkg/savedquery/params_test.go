@@ -0,0 +1,83 @@
+package savedquery
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseParams(t *testing.T) {
+	now := time.Date(2024, time.March, 5, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		query   string
+		want    Params
+		wantErr bool
+	}{
+		{
+			name:  "defaults",
+			query: "",
+			want:  Params{From: now.Add(-time.Hour), To: now, Interval: time.Minute},
+		},
+		{
+			name:  "relative",
+			query: "from=now-6h&to=now&interval=5m&metric=speed_mph",
+			want:  Params{From: now.Add(-6 * time.Hour), To: now, Interval: 5 * time.Minute, Metric: "speed_mph"},
+		},
+		{
+			name:  "grafana milliseconds",
+			query: "from=1709636400000&to=1709640000000&interval=15000",
+			want:  Params{From: now.Add(-time.Hour), To: now, Interval: 15 * time.Second},
+		},
+		{
+			name:  "rfc3339",
+			query: "from=2024-03-05T10:00:00Z&to=2024-03-05T13:00:00.5%2B01:00",
+			want:  Params{From: now.Add(-2 * time.Hour), To: now.Add(500 * time.Millisecond), Interval: time.Minute},
+		},
+		{
+			name:  "from defaults to an hour before to",
+			query: "to=now-1h",
+			want:  Params{From: now.Add(-2 * time.Hour), To: now.Add(-time.Hour), Interval: time.Minute},
+		},
+		{
+			name:  "empty range",
+			query: "from=now&to=now",
+			want:  Params{From: now, To: now, Interval: time.Minute},
+		},
+		{name: "from after to", query: "from=now&to=now-1h", wantErr: true},
+		{name: "invalid from", query: "from=yesterday", wantErr: true},
+		{name: "invalid relative to", query: "to=now-1x", wantErr: true},
+		{name: "invalid interval", query: "interval=often", wantErr: true},
+		{name: "zero interval", query: "interval=0", wantErr: true},
+		{name: "negative interval", query: "interval=-1m", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ParseParams(values, now)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseParams(%q) = %+v, want an error", tt.query, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseParams(%q) error = %v", tt.query, err)
+			}
+			if !got.From.Equal(tt.want.From) || !got.To.Equal(tt.want.To) || got.Interval != tt.want.Interval || got.Metric != tt.want.Metric {
+				t.Errorf("ParseParams(%q) = %+v, want %+v", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParamsKey(t *testing.T) {
+	a := url.Values{"from": {"now-1h"}, "metric": {"soc"}}
+	b := url.Values{"metric": {"soc"}, "from": {"now-1h"}, "unused": {"x"}}
+	if paramsKey(a) != paramsKey(b) {
+		t.Errorf("paramsKey(%v) = %s, paramsKey(%v) = %s, want them equal", a, paramsKey(a), b, paramsKey(b))
+	}
+}
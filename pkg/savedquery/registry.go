@@ -0,0 +1,114 @@
+package savedquery
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/slim-bean/leafbus/pkg/store"
+)
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+type Config struct {
+	// Dir holds the saved queries, one <name>.sql file each.
+	Dir string
+	// CacheTTL is how long a result is reused for the same query and parameters, 0 disables the cache.
+	CacheTTL time.Duration
+	// CacheSize is the maximum number of cached results.
+	CacheSize int
+}
+
+// Registry holds the saved queries and a cache of their recent results.
+type Registry struct {
+	cfg     Config
+	queries map[string]string
+
+	mu    sync.Mutex
+	cache map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	result  *store.QueryResult
+	expires time.Time
+}
+
+// NewRegistry loads the .sql files in cfg.Dir. Files are read once, changes need a restart.
+func NewRegistry(cfg Config) (*Registry, error) {
+	if cfg.CacheSize <= 0 {
+		cfg.CacheSize = 256
+	}
+	paths, err := filepath.Glob(filepath.Join(cfg.Dir, "*.sql"))
+	if err != nil {
+		return nil, err
+	}
+	r := &Registry{
+		cfg:     cfg,
+		queries: make(map[string]string, len(paths)),
+		cache:   make(map[string]cacheEntry),
+	}
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".sql")
+		if !validName.MatchString(name) {
+			log.Printf("skipping saved query %s: names may only use letters, digits, _ and -", path)
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading saved query %s: %w", path, err)
+		}
+		r.queries[name] = strings.TrimSpace(string(data))
+	}
+	log.Printf("loaded %d saved queries from %s", len(r.queries), cfg.Dir)
+	return r, nil
+}
+
+// Get returns the SQL of a saved query.
+func (r *Registry) Get(name string) (string, bool) {
+	sqlQuery, ok := r.queries[name]
+	return sqlQuery, ok
+}
+
+func (r *Registry) cached(key string, now time.Time) (*store.QueryResult, bool) {
+	if r.cfg.CacheTTL <= 0 {
+		return nil, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.cache[key]
+	if !ok || now.After(entry.expires) {
+		return nil, false
+	}
+	return entry.result, true
+}
+
+// put caches a result, dropping expired entries first and then the ones closest to expiring if it is full.
+func (r *Registry) put(key string, result *store.QueryResult, now time.Time) {
+	if r.cfg.CacheTTL <= 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.cache) >= r.cfg.CacheSize {
+		for k, entry := range r.cache {
+			if now.After(entry.expires) {
+				delete(r.cache, k)
+			}
+		}
+	}
+	for len(r.cache) >= r.cfg.CacheSize {
+		var oldest string
+		for k, entry := range r.cache {
+			if oldest == "" || entry.expires.Before(r.cache[oldest].expires) {
+				oldest = k
+			}
+		}
+		delete(r.cache, oldest)
+	}
+	r.cache[key] = cacheEntry{result: result, expires: now.Add(r.cfg.CacheTTL)}
+}
@@ -0,0 +1,116 @@
+package statusui
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/slim-bean/leafbus/pkg/push"
+	"github.com/slim-bean/leafbus/pkg/store"
+)
+
+const (
+	defaultCellHours  = 24
+	maxCellHistoryPts = 1000
+)
+
+type cellsResponse struct {
+	Latest  *cellSnapshot       `json:"latest,omitempty"`
+	History []store.CellSummary `json:"history"`
+	Error   string              `json:"error,omitempty"`
+}
+
+type cellSnapshot struct {
+	store.CellSummary
+	Voltages []float64 `json:"voltages"`
+	Shunts   []bool    `json:"shunts,omitempty"`
+	MinCell  int       `json:"min_cell"`
+	MaxCell  int       `json:"max_cell"`
+}
+
+// RegisterCells adds /cells which returns the latest cell voltages and the imbalance history,
+// ?hours= selects how far back the history goes and ?step= (e.g. 5m) the bucket size.
+func RegisterCells(mux *http.ServeMux, handler *push.Handler, writer *store.Writer) {
+	if mux == nil {
+		mux = http.DefaultServeMux
+	}
+	mux.HandleFunc("/cells", func(response http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodGet {
+			log.Printf("status ui: invalid method %s for /cells", request.Method)
+			response.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		hours := defaultCellHours
+		if raw := request.URL.Query().Get("hours"); raw != "" {
+			parsed, err := strconv.Atoi(raw)
+			if err != nil || parsed <= 0 {
+				http.Error(response, "hours must be a positive integer", http.StatusBadRequest)
+				return
+			}
+			hours = parsed
+		}
+		end := time.Now().UTC()
+		start := end.Add(-time.Duration(hours) * time.Hour)
+		step := end.Sub(start) / maxCellHistoryPts
+		if raw := request.URL.Query().Get("step"); raw != "" {
+			parsed, err := time.ParseDuration(raw)
+			if err != nil || parsed <= 0 {
+				http.Error(response, "step must be a duration like 5m", http.StatusBadRequest)
+				return
+			}
+			if parsed > step {
+				step = parsed
+			}
+		}
+
+		resp := cellsResponse{
+			Latest:  buildCellSnapshot(handler),
+			History: []store.CellSummary{},
+		}
+		if writer != nil {
+			ctx, cancel := context.WithTimeout(request.Context(), 5*time.Second)
+			defer cancel()
+			history, err := writer.CellHistory(ctx, start, end, step)
+			if err != nil {
+				log.Println("status ui: failed to load cell history:", err)
+				resp.Error = "failed to load cell history"
+			} else {
+				resp.History = history
+			}
+		}
+		response.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(response).Encode(resp); err != nil {
+			log.Println("status ui: failed to write cells response:", err)
+		}
+	})
+}
+
+func buildCellSnapshot(handler *push.Handler) *cellSnapshot {
+	if handler == nil {
+		return nil
+	}
+	row, ok := handler.LatestCells()
+	if !ok || len(row.Voltages) == 0 {
+		return nil
+	}
+	snap := &cellSnapshot{
+		CellSummary: store.SummarizeCells(row),
+		Voltages:    row.Voltages,
+		Shunts:      row.Shunts,
+	}
+	for i, v := range row.Voltages {
+		if v < row.Voltages[snap.MinCell] {
+			snap.MinCell = i
+		}
+		if v > row.Voltages[snap.MaxCell] {
+			snap.MaxCell = i
+		}
+	}
+	// Cells are numbered from 1 like LeafSpy
+	snap.MinCell++
+	snap.MaxCell++
+	return snap
+}
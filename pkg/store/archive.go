@@ -0,0 +1,51 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+)
+
+// ReadFrames reads the raw frames archived under baseDir/frames between start and end in timestamp order.
+// It only reads parquet files so it can run while leafbus holds the DuckDB file.
+func ReadFrames(ctx context.Context, baseDir string, start, end time.Time, fn func(FrameRow) error) error {
+	sources := parquetSources(baseDir, "frames")
+	if sources == "" {
+		return fmt.Errorf("no raw frames found in %s", filepath.Join(baseDir, "frames"))
+	}
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := db.Close(); cerr != nil {
+			log.Println("failed to close archive duckdb:", cerr)
+		}
+	}()
+	query := fmt.Sprintf(
+		"select ts, bus, id, dlc, data from (%s) where ts >= ? and ts < ? order by ts, bus",
+		sources,
+	)
+	rows, err := db.QueryContext(ctx, query, start.UTC(), end.UTC())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := rows.Close(); cerr != nil {
+			log.Println("failed to close archive rows:", cerr)
+		}
+	}()
+	for rows.Next() {
+		var row FrameRow
+		if err := rows.Scan(&row.Timestamp, &row.Bus, &row.ID, &row.DLC, &row.Data); err != nil {
+			return err
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
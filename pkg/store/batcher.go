@@ -0,0 +1,132 @@
+package store
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// batcher queues the rows of one table and inserts them in batches from its own goroutine. When a row of a new hour
+// arrives the batch is inserted and the previous hour exported in the background.
+type batcher[T any] struct {
+	name string
+	ch   chan T
+	// syncCh takes a channel which is closed once every row queued before it is inserted.
+	syncCh    chan chan struct{}
+	batchSize int
+	interval  time.Duration
+	// timestamp returns the ts of a row, which is set to now if it is zero.
+	timestamp func(row *T) *time.Time
+	insert    func(rows []T) error
+	flushHour func(hour time.Time)
+
+	hour time.Time
+	// drops counts the rows dropped since dropLog, in unix nanoseconds, as enqueue is called from any goroutine.
+	drops   atomic.Int64
+	dropLog atomic.Int64
+}
+
+func newBatcher[T any](name string, buffer int, batchSize int, interval time.Duration, timestamp func(row *T) *time.Time, insert func(rows []T) error, flushHour func(hour time.Time)) *batcher[T] {
+	return &batcher[T]{
+		name:      name,
+		ch:        make(chan T, buffer),
+		syncCh:    make(chan chan struct{}),
+		batchSize: batchSize,
+		interval:  interval,
+		timestamp: timestamp,
+		insert:    insert,
+		flushHour: flushHour,
+	}
+}
+
+// enqueue queues a row, when the buffer is full it waits if blocking is set and drops the row otherwise.
+func (b *batcher[T]) enqueue(row T, blocking bool) {
+	if blocking {
+		b.ch <- row
+		return
+	}
+	select {
+	case b.ch <- row:
+	default:
+		b.drops.Add(1)
+		now := time.Now().UnixNano()
+		last := b.dropLog.Load()
+		// Only the producer which moves dropLog on reports the drops
+		if now-last > int64(10*time.Second) && b.dropLog.CompareAndSwap(last, now) {
+			log.Printf("%s buffer full, dropping rows (dropped=%d)\n", b.name, b.drops.Swap(0))
+		}
+	}
+}
+
+func (b *batcher[T]) run(w *Writer) {
+	defer w.wg.Done()
+	flushTicker := time.NewTicker(b.interval)
+	defer flushTicker.Stop()
+
+	batch := make([]T, 0, b.batchSize)
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := b.insert(batch); err != nil {
+			log.Printf("failed to insert %s batch: %v\n", b.name, err)
+		}
+		batch = batch[:0]
+	}
+
+	handleRow := func(row T) {
+		ts := b.timestamp(&row)
+		if ts.IsZero() {
+			*ts = time.Now().UTC()
+		} else {
+			*ts = ts.UTC()
+		}
+		rowHour := ts.Truncate(time.Hour)
+		if b.hour.IsZero() {
+			b.hour = rowHour
+		}
+		if rowHour.Before(b.hour) {
+			log.Printf("%s row hour moved backwards (row=%s current=%s ts=%s)", b.name, rowHour.Format(time.RFC3339), b.hour.Format(time.RFC3339), ts.Format(time.RFC3339))
+		}
+		if rowHour.After(b.hour) {
+			flush()
+			w.goFlush(b.flushHour, b.hour)
+			b.hour = rowHour
+		}
+		batch = append(batch, row)
+		if len(batch) >= b.batchSize {
+			flush()
+		}
+	}
+
+	drain := func() {
+		for {
+			select {
+			case row := <-b.ch:
+				handleRow(row)
+			default:
+				flush()
+				return
+			}
+		}
+	}
+
+	for {
+		select {
+		case row := <-b.ch:
+			handleRow(row)
+
+		case <-flushTicker.C:
+			flush()
+
+		case done := <-b.syncCh:
+			drain()
+			close(done)
+
+		case <-w.closeCh:
+			drain()
+			return
+		}
+	}
+}
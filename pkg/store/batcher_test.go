@@ -0,0 +1,81 @@
+package store
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testRow struct {
+	ts time.Time
+	n  int
+}
+
+func TestBatcher(t *testing.T) {
+	t0 := time.Date(2024, time.March, 5, 12, 58, 0, 0, time.UTC)
+	var mu sync.Mutex
+	var inserted [][]int
+	var flushed []time.Time
+	b := newBatcher("test", 10, 3, time.Hour,
+		func(row *testRow) *time.Time { return &row.ts },
+		func(rows []testRow) error {
+			mu.Lock()
+			defer mu.Unlock()
+			batch := make([]int, len(rows))
+			for i, row := range rows {
+				batch[i] = row.n
+			}
+			inserted = append(inserted, batch)
+			return nil
+		},
+		func(hour time.Time) {
+			mu.Lock()
+			defer mu.Unlock()
+			flushed = append(flushed, hour)
+		})
+	w := &Writer{closeCh: make(chan struct{})}
+	w.wg.Add(1)
+	go b.run(w)
+
+	// A full batch is inserted at once, a row of the next hour inserts the rest and flushes the hour before it
+	for i, offset := range []time.Duration{0, time.Second, 2 * time.Second, 3 * time.Second, 2 * time.Minute, 3 * time.Minute} {
+		b.enqueue(testRow{ts: t0.Add(offset), n: i}, true)
+	}
+	done := make(chan struct{})
+	b.syncCh <- done
+	<-done
+	close(w.closeCh)
+	w.wg.Wait()
+	w.flushWg.Wait()
+
+	if want := [][]int{{0, 1, 2}, {3}, {4, 5}}; !reflect.DeepEqual(inserted, want) {
+		t.Errorf("inserted %v, want %v", inserted, want)
+	}
+	if want := []time.Time{t0.Truncate(time.Hour)}; !reflect.DeepEqual(flushed, want) {
+		t.Errorf("flushed hours %v, want %v", flushed, want)
+	}
+}
+
+func TestBatcherDrops(t *testing.T) {
+	b := newBatcher("test", 1, 1, time.Hour,
+		func(row *testRow) *time.Time { return &row.ts },
+		func(rows []testRow) error { return nil },
+		func(hour time.Time) {})
+	b.dropLog.Store(time.Now().UnixNano())
+	// Nothing reads the queue, every row after the first is dropped
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 100; n++ {
+				b.enqueue(testRow{n: n}, false)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := b.drops.Load(); got != 799 {
+		t.Errorf("drops = %d, want 799", got)
+	}
+}
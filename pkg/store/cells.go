@@ -0,0 +1,94 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// CellSummary is the spread of the cell voltages at one point in time.
+type CellSummary struct {
+	Timestamp    time.Time `json:"timestamp"`
+	MinVolts     float64   `json:"min_volts"`
+	MaxVolts     float64   `json:"max_volts"`
+	AvgVolts     float64   `json:"avg_volts"`
+	DeltaMV      float64   `json:"delta_mv"`
+	ActiveShunts int       `json:"active_shunts"`
+}
+
+func SummarizeCells(row CellRow) CellSummary {
+	summary := CellSummary{Timestamp: row.Timestamp}
+	if len(row.Voltages) == 0 {
+		return summary
+	}
+	summary.MinVolts = row.Voltages[0]
+	summary.MaxVolts = row.Voltages[0]
+	sum := 0.0
+	for _, v := range row.Voltages {
+		if v < summary.MinVolts {
+			summary.MinVolts = v
+		}
+		if v > summary.MaxVolts {
+			summary.MaxVolts = v
+		}
+		sum += v
+	}
+	summary.AvgVolts = sum / float64(len(row.Voltages))
+	summary.DeltaMV = (summary.MaxVolts - summary.MinVolts) * 1000
+	for _, on := range row.Shunts {
+		if on {
+			summary.ActiveShunts++
+		}
+	}
+	return summary
+}
+
+// CellHistory returns the cell spread between start and end averaged over buckets of step,
+// the largest delta and shunt count of each bucket are kept so short imbalances are not hidden.
+func (w *Writer) CellHistory(ctx context.Context, start time.Time, end time.Time, step time.Duration) ([]CellSummary, error) {
+	if step < time.Second {
+		step = time.Second
+	}
+	w.archiveMu.RLock()
+	defer w.archiveMu.RUnlock()
+	conn, err := w.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if cerr := conn.Close(); cerr != nil {
+			log.Println("failed to close cell history connection:", cerr)
+		}
+	}()
+	if err := w.ensureQueryViews(ctx, conn); err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf(`SELECT time_bucket(INTERVAL '%d seconds', ts) AS bucket,
+	min(min_volts), max(max_volts), avg(avg_volts), max(delta_mv), max(active_shunts)
+FROM cell_voltages_all
+WHERE ts >= %s AND ts < %s
+GROUP BY bucket
+ORDER BY bucket`, int64(step/time.Second), timestampLiteral(start), timestampLiteral(end))
+	rows, err := conn.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	history := []CellSummary{}
+	for rows.Next() {
+		var (
+			summary CellSummary
+			shunts  *int
+		)
+		if err := rows.Scan(&summary.Timestamp, &summary.MinVolts, &summary.MaxVolts, &summary.AvgVolts, &summary.DeltaMV, &shunts); err != nil {
+			return nil, err
+		}
+		if shunts != nil {
+			summary.ActiveShunts = *shunts
+		}
+		summary.Timestamp = summary.Timestamp.UTC()
+		history = append(history, summary)
+	}
+	return history, rows.Err()
+}
@@ -0,0 +1,341 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Problem is an inconsistency found in the parquet archive or the DuckDB file.
+type Problem struct {
+	Table     string `json:"table"`
+	Partition string `json:"partition,omitempty"`
+	File      string `json:"file,omitempty"`
+	Kind      string `json:"kind"`
+	Detail    string `json:"detail"`
+}
+
+func (p Problem) String() string {
+	where := p.Table
+	if p.Partition != "" {
+		where = p.Partition
+	}
+	if p.File != "" {
+		where = filepath.Join(where, p.File)
+	}
+	return fmt.Sprintf("%-15s %s: %s", p.Kind, where, p.Detail)
+}
+
+const (
+	ProblemNoManifest    = "no-manifest"
+	ProblemUnlisted      = "unlisted-file"
+	ProblemMissingFile   = "missing-file"
+	ProblemChecksum      = "checksum"
+	ProblemRowCount      = "row-count"
+	ProblemMisplaced     = "misplaced-rows"
+	ProblemOverlap       = "overlap"
+	ProblemDuplicateRows = "duplicate-rows"
+	ProblemGap           = "gap"
+	ProblemOrphanRows    = "orphan-rows"
+)
+
+type CheckReport struct {
+	Partitions int
+	Files      int
+	Rows       int64
+	Problems   []Problem
+}
+
+// Archive reads the parquet archive under a base directory without the DuckDB file, so it can be checked while
+// leafbus is running. Repairs replace files the same crash-safe way as compactions and should not run concurrently
+// with leafbus.
+type Archive struct {
+	w *Writer
+}
+
+func OpenArchive(baseDir string) (*Archive, error) {
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		return nil, err
+	}
+	return &Archive{w: &Writer{db: db, baseDir: baseDir}}, nil
+}
+
+func (a *Archive) Close() error {
+	return a.w.db.Close()
+}
+
+// Check verifies the partitions of the archive directories (status, runtime, ...): every file matches its manifest
+// entry, rows are in the right partition, files of a partition don't overlap or repeat rows, and there are no gaps
+// longer than minGap between partitions.
+func (a *Archive) Check(ctx context.Context, dirNames []string, minGap time.Duration) (*CheckReport, error) {
+	report := &CheckReport{}
+	for _, dirName := range dirNames {
+		parts, err := a.partitions(dirName)
+		if err != nil {
+			return report, err
+		}
+		for _, part := range parts {
+			if err := ctx.Err(); err != nil {
+				return report, err
+			}
+			report.Partitions++
+			report.Files += len(part.files)
+			rows, problems, err := a.checkPartition(dirName, part)
+			if err != nil {
+				return report, err
+			}
+			report.Rows += rows
+			report.Problems = append(report.Problems, problems...)
+		}
+		report.Problems = append(report.Problems, findGaps(dirName, parts, minGap)...)
+	}
+	return report, nil
+}
+
+func (a *Archive) partitions(dirName string) ([]*partition, error) {
+	hours, err := listPartitions(filepath.Join(a.w.baseDir, dirName), false)
+	if err != nil {
+		return nil, err
+	}
+	days, err := listPartitions(filepath.Join(a.w.baseDir, dirName+dailySuffix), true)
+	if err != nil {
+		return nil, err
+	}
+	parts := append(days, hours...)
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].start.Before(parts[j].start)
+	})
+	return parts, nil
+}
+
+func (a *Archive) checkPartition(dirName string, part *partition) (int64, []Problem, error) {
+	rel, _ := filepath.Rel(a.w.baseDir, part.dir)
+	problem := func(file string, kind string, format string, args ...interface{}) Problem {
+		return Problem{Table: dirName, Partition: rel, File: file, Kind: kind, Detail: fmt.Sprintf(format, args...)}
+	}
+	var problems []Problem
+	manifest, err := ReadManifest(part.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		problems = append(problems, problem("", ProblemNoManifest, "partition has no %s", ManifestFile))
+	} else if err != nil {
+		return 0, nil, err
+	}
+	listed := make(map[string]ManifestEntry)
+	for _, entry := range manifest.Files {
+		listed[entry.File] = entry
+	}
+
+	var rows int64
+	var entries []ManifestEntry
+	for _, file := range part.files {
+		entry, err := describeFile(a.w.db, file)
+		if err != nil {
+			return rows, nil, fmt.Errorf("failed to read %s: %w", file, err)
+		}
+		rows += entry.Rows
+		entries = append(entries, entry)
+		if entry.Rows > 0 && (entry.MinTS.Before(part.start) || !entry.MaxTS.Before(part.end)) {
+			problems = append(problems, problem(entry.File, ProblemMisplaced, "rows from %s to %s are outside the partition",
+				entry.MinTS.Format(time.RFC3339), entry.MaxTS.Format(time.RFC3339)))
+		}
+		want, ok := listed[entry.File]
+		delete(listed, entry.File)
+		if !ok {
+			if len(manifest.Files) > 0 {
+				problems = append(problems, problem(entry.File, ProblemUnlisted, "file is not in the manifest"))
+			}
+			continue
+		}
+		if want.SHA256 != entry.SHA256 {
+			problems = append(problems, problem(entry.File, ProblemChecksum, "checksum %s does not match manifest %s", short(entry.SHA256), short(want.SHA256)))
+		}
+		if want.Rows != entry.Rows {
+			problems = append(problems, problem(entry.File, ProblemRowCount, "%d rows, manifest has %d", entry.Rows, want.Rows))
+		}
+	}
+	for name := range listed {
+		problems = append(problems, problem(name, ProblemMissingFile, "file in the manifest does not exist"))
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].MinTS.Before(entries[j].MinTS)
+	})
+	for i := 1; i < len(entries); i++ {
+		if entries[i].Rows > 0 && entries[i-1].Rows > 0 && !entries[i].MinTS.After(entries[i-1].MaxTS) {
+			problems = append(problems, problem(entries[i].File, ProblemOverlap, "rows from %s overlap %s which ends at %s",
+				entries[i].MinTS.Format(time.RFC3339), entries[i-1].File, entries[i-1].MaxTS.Format(time.RFC3339)))
+		}
+	}
+	if len(part.files) > 1 {
+		duplicates, err := a.duplicateRows(part.files)
+		if err != nil {
+			return rows, nil, err
+		}
+		if duplicates > 0 {
+			problems = append(problems, problem("", ProblemDuplicateRows, "%d rows are stored more than once", duplicates))
+		}
+	}
+	return rows, problems, nil
+}
+
+// duplicateRows counts the rows which are identical to another row of the files, only possible if an hour
+// was exported twice.
+func (a *Archive) duplicateRows(files []string) (int64, error) {
+	var duplicates sql.NullInt64
+	err := a.w.db.QueryRow(fmt.Sprintf(
+		"SELECT sum(dup_count - 1) FROM (SELECT *, count(*) AS dup_count FROM %s GROUP BY ALL HAVING count(*) > 1)",
+		readFiles(files),
+	)).Scan(&duplicates)
+	return duplicates.Int64, err
+}
+
+func findGaps(dirName string, parts []*partition, minGap time.Duration) []Problem {
+	var problems []Problem
+	if minGap <= 0 {
+		return problems
+	}
+	for i := 1; i < len(parts); i++ {
+		gap := parts[i].start.Sub(parts[i-1].end)
+		if gap >= minGap {
+			problems = append(problems, Problem{
+				Table:  dirName,
+				Kind:   ProblemGap,
+				Detail: fmt.Sprintf("no data from %s to %s (%s)", parts[i-1].end.Format(time.RFC3339), parts[i].start.Format(time.RFC3339), gap),
+			})
+		}
+	}
+	return problems
+}
+
+// RebuildManifests writes the manifest of every partition of the directories from the files on disk.
+func (a *Archive) RebuildManifests(dirNames []string) (int, error) {
+	rebuilt := 0
+	for _, dirName := range dirNames {
+		parts, err := a.partitions(dirName)
+		if err != nil {
+			return rebuilt, err
+		}
+		for _, part := range parts {
+			var m Manifest
+			for _, file := range part.files {
+				entry, err := describeFile(a.w.db, file)
+				if err != nil {
+					return rebuilt, err
+				}
+				m.Files = append(m.Files, entry)
+			}
+			if err := writeManifest(part.dir, m); err != nil {
+				return rebuilt, err
+			}
+			rebuilt++
+		}
+	}
+	return rebuilt, nil
+}
+
+// Dedupe merges the files of every partition with duplicate rows into one file with each row once.
+func (a *Archive) Dedupe(dirNames []string) (int64, error) {
+	var removed int64
+	for _, dirName := range dirNames {
+		parts, err := a.partitions(dirName)
+		if err != nil {
+			return removed, err
+		}
+		for _, part := range parts {
+			if len(part.files) < 2 {
+				continue
+			}
+			duplicates, err := a.duplicateRows(part.files)
+			if err != nil {
+				return removed, err
+			}
+			if duplicates == 0 {
+				continue
+			}
+			version, err := a.w.minVersion(dirName, part.files)
+			if err != nil {
+				return removed, err
+			}
+			target := filepath.Join(part.dir, fmt.Sprintf("%s-%d.parquet", dirName, time.Now().UTC().UnixNano()))
+			query := fmt.Sprintf("SELECT DISTINCT * FROM %s ORDER BY ts", readFiles(part.files))
+			if err := a.w.replaceFiles(query, version, part.files, target); err != nil {
+				return removed, fmt.Errorf("failed to dedupe %s: %w", part.dir, err)
+			}
+			log.Printf("removed %d duplicate rows from %s\n", duplicates, part.dir)
+			removed += duplicates
+		}
+	}
+	return removed, nil
+}
+
+// CheckOrphans reports completed hours which are still in the DuckDB file, they are exported the next time
+// leafbus starts. The DuckDB file can only be opened while leafbus is stopped.
+func CheckOrphans(ctx context.Context, dbPath string, dirNames []string) ([]Problem, error) {
+	db, err := sql.Open("duckdb", dbPath+"?access_mode=read_only")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	completed := time.Now().UTC().Truncate(time.Hour)
+	var problems []Problem
+	for _, dirName := range dirNames {
+		table := ""
+		for _, t := range exportTables {
+			if t.dirName == dirName {
+				table = t.table
+			}
+		}
+		if table == "" {
+			continue
+		}
+		rows, err := db.QueryContext(ctx, fmt.Sprintf(
+			"SELECT date_trunc('hour', ts) AS hour, count(*) FROM %s WHERE ts < ? GROUP BY hour ORDER BY hour",
+			table,
+		), completed)
+		if err != nil {
+			return problems, err
+		}
+		for rows.Next() {
+			var hour time.Time
+			var count int64
+			if err := rows.Scan(&hour, &count); err != nil {
+				rows.Close()
+				return problems, err
+			}
+			problems = append(problems, Problem{
+				Table:  dirName,
+				Kind:   ProblemOrphanRows,
+				Detail: fmt.Sprintf("%d rows of %s are still in %s", count, hour.UTC().Format("2006-01-02T15"), table),
+			})
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return problems, err
+		}
+	}
+	return problems, nil
+}
+
+func readFiles(files []string) string {
+	list := make([]string, len(files))
+	for i, file := range files {
+		list[i] = "'" + escapePath(filepath.ToSlash(file)) + "'"
+	}
+	return fmt.Sprintf("read_parquet([%s], hive_partitioning=false, union_by_name=true)", strings.Join(list, ", "))
+}
+
+func short(sum string) string {
+	if len(sum) > 12 {
+		return sum[:12]
+	}
+	return sum
+}
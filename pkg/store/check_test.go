@@ -0,0 +1,196 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestManifestRoundTrip(t *testing.T) {
+	t0 := time.Date(2024, time.March, 5, 12, 0, 0, 0, time.UTC)
+	w := newTestWriter(t, t0, 3, 4)
+	dir := partitionDir(w.baseDir, "runtime", t0)
+	files := parquetFiles(t, dir)
+
+	m, err := ReadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Manifest{}
+	for i, file := range files {
+		entry, err := describeFile(w.db, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantRows := []int64{3, 4}[i]
+		if entry.Rows != wantRows || entry.SchemaVersion != archiveVersion("runtime") || entry.SHA256 == "" {
+			t.Errorf("describeFile(%s) = %+v, want %d rows of schema version %d", file, entry, wantRows, archiveVersion("runtime"))
+		}
+		want.Files = append(want.Files, entry)
+	}
+	first := want.Files[0]
+	if !first.MinTS.Equal(t0) || !first.MaxTS.Equal(t0.Add(2*time.Second)) {
+		t.Errorf("first file from %s to %s, want %s to %s", first.MinTS, first.MaxTS, t0, t0.Add(2*time.Second))
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("manifest written by the export = %+v, want %+v", m, want)
+	}
+
+	// Entries are sorted by file when written and read back as they were
+	reversed := Manifest{Files: []ManifestEntry{want.Files[1], want.Files[0]}}
+	if err := writeManifest(dir, reversed); err != nil {
+		t.Fatal(err)
+	}
+	if m, err = ReadManifest(dir); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("ReadManifest() = %+v, want %+v", m, want)
+	}
+
+	// An empty manifest is removed
+	if err := writeManifest(dir, Manifest{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadManifest(dir); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("ReadManifest() of an empty manifest error = %v, want it not to exist", err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	t0 := time.Date(2024, time.March, 5, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		damage func(t *testing.T, w *Writer, dir string, files []string)
+		want   []string
+		// repaired is whether RebuildManifests and Dedupe leave the partition without problems
+		repaired bool
+	}{
+		{
+			name:     "intact",
+			damage:   func(t *testing.T, w *Writer, dir string, files []string) {},
+			repaired: true,
+		},
+		{
+			name: "no manifest",
+			damage: func(t *testing.T, w *Writer, dir string, files []string) {
+				if err := os.Remove(filepath.Join(dir, ManifestFile)); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want:     []string{ProblemNoManifest},
+			repaired: true,
+		},
+		{
+			name: "missing file",
+			damage: func(t *testing.T, w *Writer, dir string, files []string) {
+				if err := os.Remove(files[0]); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want:     []string{ProblemMissingFile},
+			repaired: true,
+		},
+		{
+			name: "rewritten file",
+			damage: func(t *testing.T, w *Writer, dir string, files []string) {
+				writeParquet(t, w, fmt.Sprintf("SELECT * FROM %s LIMIT 2", readFiles(files[:1])), files[0])
+			},
+			want:     []string{ProblemChecksum, ProblemRowCount},
+			repaired: true,
+		},
+		{
+			name: "exported twice",
+			damage: func(t *testing.T, w *Writer, dir string, files []string) {
+				writeParquet(t, w, "SELECT * FROM "+readFiles(files[1:]), filepath.Join(dir, "runtime-1.parquet"))
+			},
+			want:     []string{ProblemDuplicateRows, ProblemOverlap, ProblemUnlisted},
+			repaired: true,
+		},
+		{
+			name: "rows of another hour",
+			damage: func(t *testing.T, w *Writer, dir string, files []string) {
+				query := fmt.Sprintf("SELECT ts + INTERVAL 1 HOUR AS ts, * EXCLUDE (ts) FROM %s", readFiles(files[:1]))
+				writeParquet(t, w, query, filepath.Join(dir, "runtime-1.parquet"))
+			},
+			want: []string{ProblemMisplaced, ProblemUnlisted},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newTestWriter(t, t0, 3, 4)
+			dir := partitionDir(w.baseDir, "runtime", t0)
+			tt.damage(t, w, dir, parquetFiles(t, dir))
+			a := &Archive{w: w}
+			if got := checkKinds(t, a); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Check() found %v, want %v", got, tt.want)
+			}
+
+			if _, err := a.Dedupe([]string{"runtime"}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := a.RebuildManifests([]string{"runtime"}); err != nil {
+				t.Fatal(err)
+			}
+			if got := checkKinds(t, a); (len(got) == 0) != tt.repaired {
+				t.Errorf("Check() after the repairs found %v, want repaired = %v", got, tt.repaired)
+			}
+		})
+	}
+}
+
+func TestCheckGaps(t *testing.T) {
+	t0 := time.Date(2024, time.March, 5, 12, 0, 0, 0, time.UTC)
+	w := newTestWriter(t, t0, 1)
+	later := newTestWriter(t, t0.Add(3*time.Hour), 1)
+	// Move the later hour into the first archive
+	src := filepath.Dir(partitionDir(later.baseDir, "runtime", t0.Add(3*time.Hour)))
+	dst := filepath.Dir(partitionDir(w.baseDir, "runtime", t0.Add(3*time.Hour)))
+	if err := os.Rename(filepath.Join(src, "hour=15"), filepath.Join(dst, "hour=15")); err != nil {
+		t.Fatal(err)
+	}
+	report, err := (&Archive{w: w}).Check(context.Background(), []string{"runtime"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 1 || report.Problems[0].Kind != ProblemGap {
+		t.Fatalf("Check() found %v, want a gap", report.Problems)
+	}
+	if want := fmt.Sprintf("no data from %s to %s (2h0m0s)", t0.Add(time.Hour).Format(time.RFC3339), t0.Add(3*time.Hour).Format(time.RFC3339)); report.Problems[0].Detail != want {
+		t.Errorf("gap %q, want %q", report.Problems[0].Detail, want)
+	}
+	if report.Partitions != 2 || report.Rows != 2 {
+		t.Errorf("checked %d partitions with %d rows, want 2 with 2", report.Partitions, report.Rows)
+	}
+}
+
+func checkKinds(t *testing.T, a *Archive) []string {
+	t.Helper()
+	report, err := a.Check(context.Background(), []string{"runtime"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kinds []string
+	for _, p := range report.Problems {
+		kinds = append(kinds, p.Kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+func writeParquet(t *testing.T, w *Writer, query string, path string) {
+	t.Helper()
+	tmpPath := path + tmpSuffix
+	if _, err := w.db.Exec(fmt.Sprintf("copy (%s) to '%s' (%s)", query, escapePath(tmpPath), parquetOptions(archiveVersion("runtime")))); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,455 @@
+package store
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCompactInterval = time.Hour
+
+	// dailySuffix names the tree next to each table's hourly tree that holds the daily rollups
+	dailySuffix = "_daily"
+	// A compaction is written to a .compact file and the files it replaces are listed in a .sources journal,
+	// the journal is the commit point after which an interrupted compaction is finished instead of discarded.
+	compactSuffix = ".compact"
+	sourcesSuffix = ".sources"
+)
+
+// Retention limits how much of a table's parquet archive is kept.
+type Retention struct {
+	// MaxAge removes partitions which ended longer ago than this, 0 keeps everything.
+	MaxAge time.Duration
+	// MaxBytes removes the oldest partitions until the table is below this size, 0 has no limit.
+	MaxBytes int64
+}
+
+type CompactConfig struct {
+	// Interval between compaction runs, defaults to an hour.
+	Interval time.Duration
+	// DailyAfter rolls the hour partitions of a day into one daily file once the day is this old, 0 disables it.
+	DailyAfter time.Duration
+	// Retention is keyed by the parquet directory of the table: status, runtime, frames or cells,
+	// of a runtime rollup: runtime_1s, runtime_1m or runtime_1h, or trips.
+	Retention map[string]Retention
+}
+
+// Compactor merges the parquet files of each partition and applies the retention limits in the background.
+type Compactor struct {
+	w   *Writer
+	cfg CompactConfig
+
+	closeCh chan struct{}
+	wg      sync.WaitGroup
+}
+
+// partition is an hour or day directory of the archive.
+type partition struct {
+	dir   string
+	start time.Time
+	end   time.Time
+	daily bool
+	files []string
+	bytes int64
+}
+
+func NewCompactor(w *Writer, cfg CompactConfig) *Compactor {
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultCompactInterval
+	}
+	c := &Compactor{
+		w:       w,
+		cfg:     cfg,
+		closeCh: make(chan struct{}),
+	}
+	c.wg.Add(1)
+	go c.run()
+	return c
+}
+
+func (c *Compactor) Close() {
+	close(c.closeCh)
+	c.wg.Wait()
+}
+
+func (c *Compactor) run() {
+	defer c.wg.Done()
+	c.w.recoverReplacements()
+	ticker := time.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		c.Compact(time.Now().UTC())
+		select {
+		case <-ticker.C:
+		case <-c.closeCh:
+			return
+		}
+	}
+}
+
+// Compact merges and removes the partitions of every table as of now. Missing runtime rollups are written first so
+// hours are rolled into their day together with their rollups.
+func (c *Compactor) Compact(now time.Time) {
+	_, err := c.w.backfillRollups(false, func(r rollup, part *partition) bool {
+		// Retention would remove it again
+		retention := c.cfg.Retention[r.dirName]
+		return retention.MaxAge > 0 && !part.end.After(now.Add(-retention.MaxAge))
+	})
+	if err != nil {
+		log.Println("failed to backfill runtime rollups:", err)
+	}
+	for _, dirName := range archiveDirs() {
+		select {
+		case <-c.closeCh:
+			return
+		default:
+		}
+		c.compactTable(dirName, now)
+	}
+}
+
+func (c *Compactor) compactTable(dirName string, now time.Time) {
+	hours, err := listPartitions(filepath.Join(c.w.baseDir, dirName), false)
+	if err != nil {
+		log.Printf("failed to list %s partitions: %v\n", dirName, err)
+		return
+	}
+	days, err := listPartitions(filepath.Join(c.w.baseDir, dirName+dailySuffix), true)
+	if err != nil {
+		log.Printf("failed to list %s daily partitions: %v\n", dirName, err)
+		return
+	}
+	dayFiles := make(map[time.Time]*partition)
+	for _, day := range days {
+		dayFiles[day.start] = day
+	}
+
+	// Roll old hours into their day, days without new hours are only merged if they hold several files
+	byDay := make(map[time.Time][]*partition)
+	for _, hour := range hours {
+		day := hour.start.Truncate(24 * time.Hour)
+		if c.cfg.DailyAfter > 0 && !day.Add(24*time.Hour).After(now.Add(-c.cfg.DailyAfter)) {
+			byDay[day] = append(byDay[day], hour)
+			continue
+		}
+		if len(hour.files) > 1 && !hour.end.After(now) {
+			c.merge(dirName, hour.files, hour.dir)
+		}
+	}
+	for _, day := range days {
+		if len(day.files) > 1 && byDay[day.start] == nil {
+			c.merge(dirName, day.files, day.dir)
+		}
+	}
+	for day, parts := range byDay {
+		var sources []string
+		if existing, ok := dayFiles[day]; ok {
+			sources = append(sources, existing.files...)
+		}
+		for _, part := range parts {
+			sources = append(sources, part.files...)
+		}
+		dir := dailyDir(c.w.baseDir, dirName, day)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			log.Printf("failed to create %s daily dir: %v\n", dirName, err)
+			continue
+		}
+		if c.merge(dirName, sources, dir) {
+			for _, part := range parts {
+				removeEmptyDirs(part.dir, filepath.Join(c.w.baseDir, dirName))
+			}
+		}
+	}
+
+	if retention, ok := c.cfg.Retention[dirName]; ok {
+		c.applyRetention(dirName, retention, now)
+	}
+}
+
+// merge replaces files with a single file in dir, it returns false if the files were left in place.
+func (c *Compactor) merge(dirName string, files []string, dir string) bool {
+	target := filepath.Join(dir, fmt.Sprintf("%s-%d.parquet", dirName, time.Now().UTC().UnixNano()))
+	version, err := c.w.minVersion(dirName, files)
+	if err != nil {
+		log.Printf("failed to read %s schema versions in %s: %v\n", dirName, dir, err)
+		return false
+	}
+	query := fmt.Sprintf("select * from %s order by ts", readFiles(files))
+	if err := c.w.replaceFiles(query, version, files, target); err != nil {
+		log.Printf("failed to compact %s parquet in %s: %v\n", dirName, dir, err)
+		return false
+	}
+	return true
+}
+
+// replaceFiles writes the result of query to target and removes files, target is written to a .compact file and
+// swapped in once the files it replaces are journaled so a crash never loses or duplicates rows.
+func (w *Writer) replaceFiles(query string, version int, files []string, target string) error {
+	tmpPath := target + compactSuffix
+	copySQL := fmt.Sprintf("copy (%s) to '%s' (%s)", query, escapePath(tmpPath), parquetOptions(version))
+	if _, err := w.db.Exec(copySQL); err != nil {
+		removeTmp(tmpPath)
+		return err
+	}
+	if err := syncFile(tmpPath); err != nil {
+		removeTmp(tmpPath)
+		return err
+	}
+	if err := w.writeSources(target, files); err != nil {
+		removeTmp(tmpPath)
+		removeTmp(target + sourcesSuffix)
+		return err
+	}
+	return w.finishReplace(target, files)
+}
+
+func (w *Writer) writeSources(target string, files []string) error {
+	f, err := os.Create(target + sourcesSuffix)
+	if err != nil {
+		return err
+	}
+	buf := bufio.NewWriter(f)
+	for _, file := range files {
+		rel, err := filepath.Rel(w.baseDir, file)
+		if err != nil {
+			_ = f.Close()
+			return err
+		}
+		_, _ = buf.WriteString(filepath.ToSlash(rel) + "\n")
+	}
+	if err := buf.Flush(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(target))
+}
+
+// finishReplace swaps a journaled replacement into place while no queries are running, it can be repeated after a crash.
+func (w *Writer) finishReplace(target string, files []string) error {
+	w.archiveMu.Lock()
+	defer w.archiveMu.Unlock()
+	for _, file := range files {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if _, err := os.Stat(target + compactSuffix); err == nil {
+		if err := os.Rename(target+compactSuffix, target); err != nil {
+			return err
+		}
+	}
+	if err := syncDir(filepath.Dir(target)); err != nil {
+		return err
+	}
+	if err := w.updateManifest([]string{target}, files); err != nil {
+		log.Printf("failed to update manifest of %s: %v\n", target, err)
+	}
+	return os.Remove(target + sourcesSuffix)
+}
+
+// recoverReplacements finishes the compactions and rewrites which were journaled before a crash and removes the ones
+// which weren't.
+func (w *Writer) recoverReplacements() {
+	for _, dirName := range archiveDirs() {
+		for _, root := range []string{filepath.Join(w.baseDir, dirName), filepath.Join(w.baseDir, dirName+dailySuffix)} {
+			_ = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+				if err != nil || d == nil || d.IsDir() {
+					return nil
+				}
+				switch {
+				case strings.HasSuffix(path, sourcesSuffix):
+					target := strings.TrimSuffix(path, sourcesSuffix)
+					files, err := w.readSources(path)
+					if err != nil {
+						log.Println("failed to read compaction journal:", err)
+						return nil
+					}
+					if err := w.finishReplace(target, files); err != nil {
+						log.Println("failed to recover compaction:", err)
+						return nil
+					}
+					log.Println("recovered parquet compaction", target)
+				case strings.HasSuffix(path, compactSuffix):
+					if _, err := os.Stat(strings.TrimSuffix(path, compactSuffix) + sourcesSuffix); os.IsNotExist(err) {
+						log.Println("removing incomplete parquet compaction", path)
+						removeTmp(path)
+					}
+				}
+				return nil
+			})
+		}
+	}
+}
+
+func (w *Writer) readSources(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			files = append(files, filepath.Join(w.baseDir, filepath.FromSlash(line)))
+		}
+	}
+	return files, nil
+}
+
+func (c *Compactor) applyRetention(dirName string, retention Retention, now time.Time) {
+	if retention.MaxAge <= 0 && retention.MaxBytes <= 0 {
+		return
+	}
+	hours, err := listPartitions(filepath.Join(c.w.baseDir, dirName), false)
+	if err != nil {
+		log.Printf("failed to list %s partitions: %v\n", dirName, err)
+		return
+	}
+	days, err := listPartitions(filepath.Join(c.w.baseDir, dirName+dailySuffix), true)
+	if err != nil {
+		log.Printf("failed to list %s daily partitions: %v\n", dirName, err)
+		return
+	}
+	parts := append(days, hours...)
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].start.Before(parts[j].start)
+	})
+	var total int64
+	for _, part := range parts {
+		total += part.bytes
+	}
+	var remove []*partition
+	for i, part := range parts {
+		// The newest partition is kept even if it is over the size limit on its own
+		expired := retention.MaxAge > 0 && !part.end.After(now.Add(-retention.MaxAge))
+		oversize := retention.MaxBytes > 0 && total > retention.MaxBytes && i < len(parts)-1
+		if !expired && !oversize {
+			break
+		}
+		remove = append(remove, part)
+		total -= part.bytes
+	}
+	if len(remove) == 0 {
+		return
+	}
+	c.w.archiveMu.Lock()
+	defer c.w.archiveMu.Unlock()
+	for _, part := range remove {
+		for _, file := range part.files {
+			if err := os.Remove(file); err != nil {
+				log.Printf("failed to remove expired %s parquet: %v\n", dirName, err)
+			}
+		}
+		if err := os.Remove(filepath.Join(part.dir, ManifestFile)); err != nil && !os.IsNotExist(err) {
+			log.Printf("failed to remove expired %s manifest: %v\n", dirName, err)
+		}
+		root := filepath.Join(c.w.baseDir, dirName)
+		if part.daily {
+			root = filepath.Join(c.w.baseDir, dirName+dailySuffix)
+		}
+		removeEmptyDirs(part.dir, root)
+	}
+	log.Printf("removed %d expired %s partitions\n", len(remove), dirName)
+}
+
+// listPartitions returns the hour partitions under root, or the day partitions if daily is set.
+func listPartitions(root string, daily bool) ([]*partition, error) {
+	pattern := filepath.Join(root, "year=*", "month=*", "day=*", "hour=*")
+	if daily {
+		pattern = filepath.Join(root, "year=*", "month=*", "day=*")
+	}
+	dirs, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	var parts []*partition
+	for _, dir := range dirs {
+		start, ok := partitionTime(dir, daily)
+		if !ok {
+			continue
+		}
+		part := &partition{dir: dir, start: start, daily: daily}
+		if daily {
+			part.end = start.Add(24 * time.Hour)
+		} else {
+			part.end = start.Add(time.Hour)
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".parquet") {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			part.files = append(part.files, filepath.Join(dir, entry.Name()))
+			part.bytes += info.Size()
+		}
+		if len(part.files) > 0 {
+			parts = append(parts, part)
+		}
+	}
+	return parts, nil
+}
+
+// partitionTime parses the start of a Hive partition from its year=/month=/day=[/hour=] directories.
+func partitionTime(dir string, daily bool) (time.Time, bool) {
+	var year, month, day, hour int
+	rest := dir
+	if !daily {
+		if _, err := fmt.Sscanf(filepath.Base(rest), "hour=%d", &hour); err != nil {
+			return time.Time{}, false
+		}
+		rest = filepath.Dir(rest)
+	}
+	if _, err := fmt.Sscanf(filepath.Base(rest), "day=%d", &day); err != nil {
+		return time.Time{}, false
+	}
+	rest = filepath.Dir(rest)
+	if _, err := fmt.Sscanf(filepath.Base(rest), "month=%d", &month); err != nil {
+		return time.Time{}, false
+	}
+	rest = filepath.Dir(rest)
+	if _, err := fmt.Sscanf(filepath.Base(rest), "year=%d", &year); err != nil {
+		return time.Time{}, false
+	}
+	return time.Date(year, time.Month(month), day, hour, 0, 0, 0, time.UTC), true
+}
+
+func dailyDir(baseDir string, dirName string, day time.Time) string {
+	return filepath.Join(
+		baseDir,
+		dirName+dailySuffix,
+		fmt.Sprintf("year=%04d", day.Year()),
+		fmt.Sprintf("month=%02d", day.Month()),
+		fmt.Sprintf("day=%02d", day.Day()),
+	)
+}
+
+// removeEmptyDirs removes dir and its parents up to root as long as they are empty.
+func removeEmptyDirs(dir string, root string) {
+	for dir != root && strings.HasPrefix(dir, root) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
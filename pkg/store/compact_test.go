@@ -0,0 +1,189 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// newTestWriter returns a writer whose runtime archive holds a file per batch of rows written to the hour of t0.
+func newTestWriter(t *testing.T, t0 time.Time, batches ...int) *Writer {
+	t.Helper()
+	w, err := NewWriter(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(w.Close)
+	w.SetBlocking(true)
+	n := 0
+	for _, rows := range batches {
+		for i := 0; i < rows; i++ {
+			w.EnqueueRuntime(RuntimeRow{
+				Timestamp: t0.Add(time.Duration(n) * time.Second),
+				Name:      "speed",
+				Value:     sql.NullFloat64{Float64: float64(n), Valid: true},
+				Kind:      sql.NullString{String: "metric", Valid: true},
+			})
+			n++
+		}
+		w.Flush()
+	}
+	return w
+}
+
+func parquetFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*.parquet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func TestCompactRecovery(t *testing.T) {
+	t0 := time.Date(2024, time.March, 5, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		// interrupt leaves a compaction of files into target as a crash at some point of replaceFiles would
+		interrupt func(t *testing.T, w *Writer, files []string, target string)
+		// wantMerged is whether the files are replaced by target after recovery
+		wantMerged bool
+	}{
+		{
+			name: "copied",
+			interrupt: func(t *testing.T, w *Writer, files []string, target string) {
+				copyCompaction(t, w, files, target)
+			},
+		},
+		{
+			name: "journaled",
+			interrupt: func(t *testing.T, w *Writer, files []string, target string) {
+				copyCompaction(t, w, files, target)
+				if err := w.writeSources(target, files); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantMerged: true,
+		},
+		{
+			name: "partly swapped",
+			interrupt: func(t *testing.T, w *Writer, files []string, target string) {
+				copyCompaction(t, w, files, target)
+				if err := w.writeSources(target, files); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Remove(files[0]); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantMerged: true,
+		},
+		{
+			name: "swapped",
+			interrupt: func(t *testing.T, w *Writer, files []string, target string) {
+				copyCompaction(t, w, files, target)
+				if err := w.writeSources(target, files); err != nil {
+					t.Fatal(err)
+				}
+				for _, file := range files {
+					if err := os.Remove(file); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := os.Rename(target+compactSuffix, target); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantMerged: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newTestWriter(t, t0, 3, 4)
+			dir := partitionDir(w.baseDir, "runtime", t0)
+			files := parquetFiles(t, dir)
+			if len(files) != 2 {
+				t.Fatalf("got runtime files %v, want two", files)
+			}
+			target := filepath.Join(dir, fmt.Sprintf("runtime-%d.parquet", time.Now().UTC().UnixNano()))
+			tt.interrupt(t, w, files, target)
+
+			w.recoverReplacements()
+
+			want := files
+			if tt.wantMerged {
+				want = []string{target}
+			}
+			if got := parquetFiles(t, dir); !equalStrings(got, want) {
+				t.Errorf("files after recovery = %v, want %v", got, want)
+			}
+			for _, suffix := range []string{compactSuffix, sourcesSuffix} {
+				if left, _ := filepath.Glob(filepath.Join(dir, "*"+suffix)); len(left) > 0 {
+					t.Errorf("%v left after recovery", left)
+				}
+			}
+			// Every row is there once and the manifest describes the files which are
+			var rows, distinct int
+			if err := w.db.QueryRow(fmt.Sprintf("SELECT count(*), count(DISTINCT ts) FROM %s", readFiles(parquetFiles(t, dir)))).Scan(&rows, &distinct); err != nil {
+				t.Fatal(err)
+			}
+			if rows != 7 || distinct != 7 {
+				t.Errorf("got %d rows with %d timestamps, want 7", rows, distinct)
+			}
+			m, err := ReadManifest(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var listed []string
+			for _, entry := range m.Files {
+				listed = append(listed, filepath.Join(dir, entry.File))
+			}
+			if !equalStrings(listed, want) {
+				t.Errorf("manifest lists %v, want %v", listed, want)
+			}
+			report, err := (&Archive{w: w}).Check(context.Background(), []string{"runtime"}, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(report.Problems) > 0 {
+				t.Errorf("check found %v", report.Problems)
+			}
+
+			// The next run merges whatever the interrupted one left
+			(&Compactor{w: w}).Compact(t0.Add(24 * time.Hour))
+			merged := parquetFiles(t, dir)
+			if len(merged) != 1 {
+				t.Fatalf("files after compaction = %v, want one", merged)
+			}
+			if err := w.db.QueryRow(fmt.Sprintf("SELECT count(*) FROM %s", readFiles(merged))).Scan(&rows); err != nil {
+				t.Fatal(err)
+			}
+			if rows != 7 {
+				t.Errorf("got %d rows after compaction, want 7", rows)
+			}
+		})
+	}
+}
+
+// copyCompaction writes the .compact file of a compaction of files into target.
+func copyCompaction(t *testing.T, w *Writer, files []string, target string) {
+	t.Helper()
+	query := fmt.Sprintf("copy (select * from %s order by ts) to '%s' (%s)", readFiles(files), escapePath(target+compactSuffix), parquetOptions(archiveVersion("runtime")))
+	if _, err := w.db.Exec(query); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func equalStrings(a []string, b []string) bool {
+	a = append([]string{}, a...)
+	b = append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
@@ -0,0 +1,152 @@
+package store
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	tmpSuffix = ".tmp"
+
+	// exportPending rows have been deleted from DuckDB but the file may still have its temporary name
+	exportPending = "pending"
+	exportDone    = "done"
+	// exportLost means the rows were deleted but neither the file nor its temporary copy survived a crash
+	exportLost = "lost"
+)
+
+// exportTables maps the parquet directory of each table flushed hourly to the table.
+var exportTables = []struct {
+	dirName string
+	table   string
+}{
+	{"status", "status_hourly"},
+	{"runtime", "runtime_metrics"},
+	{"frames", "can_frames"},
+	{"cells", "cell_voltages"},
+}
+
+// archiveDirs returns the parquet directory of every table, rollup and of the trips.
+func archiveDirs() []string {
+	dirs := make([]string, 0, len(exportTables)+len(rollups)+1)
+	for _, t := range exportTables {
+		dirs = append(dirs, t.dirName)
+	}
+	for _, r := range rollups {
+		dirs = append(dirs, r.dirName)
+	}
+	dirs = append(dirs, tripsDir)
+	return dirs
+}
+
+// exportAll flushes every table to parquet, only hours before a non zero before are flushed.
+func (w *Writer) exportAll(before time.Time) {
+	for _, t := range exportTables {
+		w.exportHours(t.dirName, t.table, before)
+	}
+}
+
+// completeExport renames the temporary file of a committed export into place and marks it done.
+func (w *Writer) completeExport(relPath string) error {
+	filePath := filepath.Join(w.baseDir, filepath.FromSlash(relPath))
+	if _, err := os.Stat(filePath); err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Rename(filePath+tmpSuffix, filePath); err != nil {
+			return err
+		}
+		if err := syncDir(filepath.Dir(filePath)); err != nil {
+			return err
+		}
+	}
+	if err := w.updateManifest([]string{filePath}, nil); err != nil {
+		log.Printf("failed to update manifest of %s: %v\n", relPath, err)
+	}
+	_, err := w.db.Exec("update parquet_exports set state = ? where file_path = ?", exportDone, filepath.ToSlash(relPath))
+	return err
+}
+
+// recoverExports finishes the exports which were committed before a crash and removes the temporary files
+// of exports which weren't, their rows are still in DuckDB and are exported again.
+func (w *Writer) recoverExports() {
+	rows, err := w.db.Query("select file_path from parquet_exports where state = ?", exportPending)
+	if err != nil {
+		log.Println("failed to find pending exports:", err)
+		return
+	}
+	var pending []string
+	for rows.Next() {
+		var relPath string
+		if err := rows.Scan(&relPath); err != nil {
+			log.Println("failed to scan pending export:", err)
+			continue
+		}
+		pending = append(pending, relPath)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("failed to read pending exports:", err)
+	}
+	_ = rows.Close()
+	// Temporary files of exports which can't be completed yet are kept for the next start
+	keep := make(map[string]bool)
+	for _, relPath := range pending {
+		err := w.completeExport(relPath)
+		if err == nil {
+			log.Println("recovered parquet export", relPath)
+			continue
+		}
+		if !os.IsNotExist(err) {
+			log.Printf("failed to recover parquet export %s: %v\n", relPath, err)
+			keep[filepath.Join(w.baseDir, filepath.FromSlash(relPath))+tmpSuffix] = true
+			continue
+		}
+		log.Printf("parquet export %s was lost, its rows are no longer in duckdb\n", relPath)
+		if _, err := w.db.Exec("update parquet_exports set state = ? where file_path = ?", exportLost, relPath); err != nil {
+			log.Println("failed to mark export lost:", err)
+		}
+	}
+	for _, dirName := range archiveDirs() {
+		_ = filepath.WalkDir(filepath.Join(w.baseDir, dirName), func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d == nil || d.IsDir() {
+				return nil
+			}
+			if strings.HasSuffix(d.Name(), ".parquet"+tmpSuffix) && !keep[path] {
+				log.Println("removing incomplete parquet export", path)
+				removeTmp(path)
+			}
+			return nil
+		})
+	}
+}
+
+func removeTmp(path string) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Println("failed to remove temporary parquet file:", err)
+	}
+}
+
+func syncFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	if err := syncFile(dir); err != nil {
+		return fmt.Errorf("failed to sync %s: %w", dir, err)
+	}
+	return nil
+}
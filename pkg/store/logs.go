@@ -0,0 +1,67 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// LogEntry is a runtime_metrics row with kind 'log', such as a key or headlight event.
+type LogEntry struct {
+	Timestamp time.Time `json:"ts"`
+	Name      string    `json:"name"`
+	Text      string    `json:"text"`
+	Labels    string    `json:"labels,omitempty"`
+}
+
+// LogEntries returns the log rows between start and end in timestamp order, only the named ones if names is not
+// empty, at most limit rows if limit is positive.
+func (w *Writer) LogEntries(ctx context.Context, start time.Time, end time.Time, names []string, limit int) ([]LogEntry, error) {
+	w.archiveMu.RLock()
+	defer w.archiveMu.RUnlock()
+	conn, err := w.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if cerr := conn.Close(); cerr != nil {
+			log.Println("failed to close log entries connection:", cerr)
+		}
+	}()
+	if err := w.ensureQueryViews(ctx, conn); err != nil {
+		return nil, err
+	}
+	query := "SELECT ts, name, text, labels FROM runtime_metrics_all WHERE kind = 'log' AND ts >= ? AND ts < ?"
+	args := []interface{}{start.UTC(), end.UTC()}
+	if len(names) > 0 {
+		query += fmt.Sprintf(" AND name IN (%s)", strings.TrimSuffix(strings.Repeat("?, ", len(names)), ", "))
+		for _, name := range names {
+			args = append(args, name)
+		}
+	}
+	query += " ORDER BY ts"
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []LogEntry{}
+	for rows.Next() {
+		var entry LogEntry
+		var text, labels sql.NullString
+		if err := rows.Scan(&entry.Timestamp, &entry.Name, &text, &labels); err != nil {
+			return nil, err
+		}
+		entry.Timestamp = entry.Timestamp.UTC()
+		entry.Text = text.String
+		entry.Labels = labels.String
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,163 @@
+package store
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// ManifestFile is written to every partition directory and describes the parquet files in it.
+const ManifestFile = "_manifest.json"
+
+type Manifest struct {
+	Files []ManifestEntry `json:"files"`
+}
+
+type ManifestEntry struct {
+	File          string    `json:"file"`
+	Rows          int64     `json:"rows"`
+	MinTS         time.Time `json:"min_ts"`
+	MaxTS         time.Time `json:"max_ts"`
+	Bytes         int64     `json:"bytes"`
+	SHA256        string    `json:"sha256"`
+	SchemaVersion int       `json:"schema_version"`
+	WrittenAt     time.Time `json:"written_at"`
+}
+
+// ReadManifest reads the manifest of a partition directory, os.ErrNotExist is returned if it has none.
+func ReadManifest(dir string) (Manifest, error) {
+	var m Manifest
+	data, err := os.ReadFile(filepath.Join(dir, ManifestFile))
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("invalid manifest in %s: %w", dir, err)
+	}
+	return m, nil
+}
+
+// writeManifest replaces the manifest of dir atomically, an empty manifest is removed.
+func writeManifest(dir string, m Manifest) error {
+	path := filepath.Join(dir, ManifestFile)
+	if len(m.Files) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	sort.Slice(m.Files, func(i, j int) bool {
+		return m.Files[i].File < m.Files[j].File
+	})
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := path + tmpSuffix
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return err
+	}
+	if err := syncFile(tmpPath); err != nil {
+		removeTmp(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		removeTmp(tmpPath)
+		return err
+	}
+	return syncDir(dir)
+}
+
+// updateManifest adds the parquet files in added to the manifests of their partitions and drops the ones in removed.
+func (w *Writer) updateManifest(added []string, removed []string) error {
+	w.manifestMu.Lock()
+	defer w.manifestMu.Unlock()
+	changes := make(map[string]bool)
+	for _, file := range append(append([]string{}, added...), removed...) {
+		changes[filepath.Dir(file)] = true
+	}
+	for dir := range changes {
+		m, err := ReadManifest(dir)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		drop := make(map[string]bool)
+		for _, file := range append(append([]string{}, added...), removed...) {
+			if filepath.Dir(file) == dir {
+				drop[filepath.Base(file)] = true
+			}
+		}
+		kept := m.Files[:0]
+		for _, entry := range m.Files {
+			if !drop[entry.File] {
+				kept = append(kept, entry)
+			}
+		}
+		m.Files = kept
+		for _, file := range added {
+			if filepath.Dir(file) != dir {
+				continue
+			}
+			entry, err := describeFile(w.db, file)
+			if err != nil {
+				return err
+			}
+			m.Files = append(m.Files, entry)
+		}
+		if err := writeManifest(dir, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// describeFile reads the row count, time range, checksum and schema version of a parquet file.
+func describeFile(db *sql.DB, path string) (ManifestEntry, error) {
+	entry := ManifestEntry{File: filepath.Base(path)}
+	info, err := os.Stat(path)
+	if err != nil {
+		return entry, err
+	}
+	entry.Bytes = info.Size()
+	entry.WrittenAt = info.ModTime().UTC()
+	var minTS, maxTS sql.NullTime
+	err = db.QueryRow(fmt.Sprintf(
+		"SELECT count(*), min(ts), max(ts) FROM read_parquet('%s', hive_partitioning=false)",
+		escapePath(filepath.ToSlash(path)),
+	)).Scan(&entry.Rows, &minTS, &maxTS)
+	if err != nil {
+		return entry, err
+	}
+	entry.MinTS = minTS.Time.UTC()
+	entry.MaxTS = maxTS.Time.UTC()
+	versions, err := fileVersions(db, []string{path})
+	if err != nil {
+		return entry, err
+	}
+	entry.SchemaVersion = versions[path]
+	if entry.SHA256, err = fileChecksum(path); err != nil {
+		return entry, err
+	}
+	return entry, nil
+}
+
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,379 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const schemaVersionKey = "schema_version"
+
+// migration changes the DuckDB tables with stmts and, for columns which are renamed or retyped, rewrites the
+// parquet files written by earlier versions with a select list per archive directory, e.g.
+// {"status": "* RENAME (traction_soc AS soc)"} or {"runtime": "* REPLACE (CAST(value AS FLOAT) AS value)"}.
+type migration struct {
+	version int
+	name    string
+	stmts   []string
+	rewrite map[string]string
+}
+
+// migrations are applied in order and must never be changed once released, add a new one instead.
+// The statements of a new database already have every column so the later additions are no-ops there.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "create tables",
+		stmts: []string{
+			`CREATE TABLE IF NOT EXISTS status_hourly (
+				ts TIMESTAMP,
+				battery12v_soc DOUBLE,
+				battery12v_volts DOUBLE,
+				battery12v_amps DOUBLE,
+				battery12v_temp_c DOUBLE,
+				battery12v_temps VARCHAR,
+				battery12v_status VARCHAR,
+				heater_mode VARCHAR,
+				heater_on BOOLEAN,
+				heater_manual_on BOOLEAN,
+				heater_min_temp_c DOUBLE,
+				traction_soc DOUBLE,
+				traction_temp_c DOUBLE,
+				gps_lat DOUBLE,
+				gps_lon DOUBLE,
+				charger_state VARCHAR,
+				charger_soc DOUBLE,
+				hydra_v1_volts DOUBLE,
+				hydra_v1_amps DOUBLE,
+				hydra_v2_volts DOUBLE,
+				hydra_v2_amps DOUBLE,
+				hydra_v3_volts DOUBLE,
+				hydra_v3_amps DOUBLE,
+				hydra_vin_volts DOUBLE,
+				battery_soh DOUBLE,
+				battery_hx DOUBLE,
+				battery_ah DOUBLE,
+				qc_count BIGINT,
+				l1l2_count BIGINT
+			);`,
+			`CREATE TABLE IF NOT EXISTS runtime_metrics (
+				ts TIMESTAMP,
+				name VARCHAR,
+				value DOUBLE,
+				text VARCHAR,
+				labels VARCHAR,
+				kind VARCHAR
+			);`,
+			`CREATE TABLE IF NOT EXISTS can_frames (
+				ts TIMESTAMP,
+				bus VARCHAR,
+				id UINTEGER,
+				dlc UTINYINT,
+				data BLOB
+			);`,
+			`CREATE TABLE IF NOT EXISTS cell_voltages (
+				ts TIMESTAMP,
+				voltages DOUBLE[],
+				shunts BOOLEAN[],
+				min_volts DOUBLE,
+				max_volts DOUBLE,
+				avg_volts DOUBLE,
+				delta_mv DOUBLE,
+				active_shunts INTEGER
+			);`,
+			`CREATE TABLE IF NOT EXISTS parquet_exports (
+				file_path VARCHAR PRIMARY KEY,
+				table_name VARCHAR,
+				hour TIMESTAMP,
+				row_count BIGINT,
+				state VARCHAR,
+				exported_at TIMESTAMP
+			);`,
+			`CREATE SEQUENCE IF NOT EXISTS trip_id_seq;`,
+			`CREATE TABLE IF NOT EXISTS trips (
+				id BIGINT PRIMARY KEY DEFAULT nextval('trip_id_seq'),
+				start_ts TIMESTAMP UNIQUE,
+				end_ts TIMESTAMP,
+				start_odometer DOUBLE,
+				end_odometer DOUBLE,
+				distance_miles DOUBLE,
+				gps_distance_miles DOUBLE,
+				start_gids DOUBLE,
+				end_gids DOUBLE,
+				gids_used DOUBLE,
+				start_soc DOUBLE,
+				end_soc DOUBLE,
+				soc_delta DOUBLE,
+				start_lat DOUBLE,
+				start_lon DOUBLE,
+				end_lat DOUBLE,
+				end_lon DOUBLE,
+				kwh_used DOUBLE,
+				kwh_regen DOUBLE,
+				kwh_net DOUBLE,
+				climate_kwh DOUBLE,
+				miles_per_kwh DOUBLE
+			);`,
+		},
+	},
+	{
+		version: 2,
+		name:    "add hydra and heater status columns",
+		stmts: []string{
+			`ALTER TABLE status_hourly ADD COLUMN IF NOT EXISTS hydra_v1_volts DOUBLE`,
+			`ALTER TABLE status_hourly ADD COLUMN IF NOT EXISTS hydra_v1_amps DOUBLE`,
+			`ALTER TABLE status_hourly ADD COLUMN IF NOT EXISTS hydra_v2_volts DOUBLE`,
+			`ALTER TABLE status_hourly ADD COLUMN IF NOT EXISTS hydra_v2_amps DOUBLE`,
+			`ALTER TABLE status_hourly ADD COLUMN IF NOT EXISTS hydra_v3_volts DOUBLE`,
+			`ALTER TABLE status_hourly ADD COLUMN IF NOT EXISTS hydra_v3_amps DOUBLE`,
+			`ALTER TABLE status_hourly ADD COLUMN IF NOT EXISTS hydra_vin_volts DOUBLE`,
+			`ALTER TABLE status_hourly ADD COLUMN IF NOT EXISTS heater_mode VARCHAR`,
+			`ALTER TABLE status_hourly ADD COLUMN IF NOT EXISTS heater_on BOOLEAN`,
+			`ALTER TABLE status_hourly ADD COLUMN IF NOT EXISTS heater_manual_on BOOLEAN`,
+			`ALTER TABLE status_hourly ADD COLUMN IF NOT EXISTS heater_min_temp_c DOUBLE`,
+		},
+	},
+	{
+		version: 3,
+		name:    "add battery health and charge count status columns",
+		stmts: []string{
+			`ALTER TABLE status_hourly ADD COLUMN IF NOT EXISTS battery_soh DOUBLE`,
+			`ALTER TABLE status_hourly ADD COLUMN IF NOT EXISTS battery_hx DOUBLE`,
+			`ALTER TABLE status_hourly ADD COLUMN IF NOT EXISTS battery_ah DOUBLE`,
+			`ALTER TABLE status_hourly ADD COLUMN IF NOT EXISTS qc_count BIGINT`,
+			`ALTER TABLE status_hourly ADD COLUMN IF NOT EXISTS l1l2_count BIGINT`,
+		},
+	},
+	{
+		version: 4,
+		name:    "add trip energy summary columns",
+		stmts: []string{
+			`ALTER TABLE trips ADD COLUMN IF NOT EXISTS kwh_used DOUBLE`,
+			`ALTER TABLE trips ADD COLUMN IF NOT EXISTS kwh_regen DOUBLE`,
+			`ALTER TABLE trips ADD COLUMN IF NOT EXISTS kwh_net DOUBLE`,
+			`ALTER TABLE trips ADD COLUMN IF NOT EXISTS climate_kwh DOUBLE`,
+			`ALTER TABLE trips ADD COLUMN IF NOT EXISTS miles_per_kwh DOUBLE`,
+		},
+	},
+	{
+		version: 5,
+		name:    "track parquet uploads",
+		stmts: []string{
+			`CREATE TABLE IF NOT EXISTS parquet_uploads (
+				file_path VARCHAR PRIMARY KEY,
+				sha256 VARCHAR,
+				bytes BIGINT,
+				upload_id VARCHAR,
+				parts VARCHAR,
+				state VARCHAR,
+				updated_at TIMESTAMP
+			);`,
+		},
+	},
+}
+
+// SchemaVersion is the version of the newest migration, the version of the DuckDB tables.
+var SchemaVersion = migrations[len(migrations)-1].version
+
+// archiveVersion is the schema version of the parquet files of an archive directory, stamped on them as
+// schema_version. It is the version of the newest migration which rewrites the directory, so a migration which
+// only changes DuckDB doesn't make the archive out of date.
+func archiveVersion(dirName string) int {
+	version := 0
+	for _, m := range migrations {
+		if _, ok := m.rewrite[dirName]; ok {
+			version = m.version
+		}
+	}
+	return version
+}
+
+// initSchema applies the migrations which haven't been applied yet, each in its own transaction.
+func (w *Writer) initSchema() error {
+	if _, err := w.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name VARCHAR,
+		applied_at TIMESTAMP
+	)`); err != nil {
+		return err
+	}
+	current, err := w.appliedVersion()
+	if err != nil {
+		return err
+	}
+	rewrites := false
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := w.applyMigration(m); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", m.version, m.name, err)
+		}
+		log.Printf("applied schema migration %d: %s\n", m.version, m.name)
+		if len(m.rewrite) > 0 {
+			rewrites = true
+		}
+	}
+	if rewrites {
+		log.Println("parquet files written before this schema version can be rewritten with `leafbus migrate`")
+	}
+	return nil
+}
+
+func (w *Writer) appliedVersion() (int, error) {
+	var version sql.NullInt64
+	if err := w.db.QueryRow("SELECT max(version) FROM schema_migrations").Scan(&version); err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+func (w *Writer) applyMigration(m migration) error {
+	tx, err := w.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			log.Println("failed to roll back migration:", err)
+		}
+	}()
+	for _, stmt := range m.stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+		m.version, m.name, time.Now().UTC(),
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// parquetOptions are the COPY options of every parquet file, stamped with the schema version of its columns.
+func parquetOptions(version int) string {
+	return fmt.Sprintf("format parquet, kv_metadata {%s: '%d'}", schemaVersionKey, version)
+}
+
+// fileVersions reads the schema version of parquet files, files written before versions were stamped are version 0.
+func fileVersions(db *sql.DB, files []string) (map[string]int, error) {
+	versions := make(map[string]int, len(files))
+	if len(files) == 0 {
+		return versions, nil
+	}
+	list := make([]string, len(files))
+	for i, file := range files {
+		versions[filepath.ToSlash(file)] = 0
+		list[i] = "'" + escapePath(filepath.ToSlash(file)) + "'"
+	}
+	rows, err := db.Query(fmt.Sprintf(
+		"SELECT file_name, decode(value) FROM parquet_kv_metadata([%s]) WHERE decode(key) = '%s'",
+		strings.Join(list, ", "),
+		schemaVersionKey,
+	))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var file, raw string
+		if err := rows.Scan(&file, &raw); err != nil {
+			return nil, err
+		}
+		version, err := strconv.Atoi(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schema version %q in %s", raw, file)
+		}
+		versions[file] = version
+	}
+	result := make(map[string]int, len(files))
+	for _, file := range files {
+		result[file] = versions[filepath.ToSlash(file)]
+	}
+	return result, rows.Err()
+}
+
+// minVersion returns the oldest schema version of files of an archive directory, a file merged from them can't claim
+// a newer one.
+func (w *Writer) minVersion(dirName string, files []string) (int, error) {
+	versions, err := fileVersions(w.db, files)
+	if err != nil {
+		return 0, err
+	}
+	version := archiveVersion(dirName)
+	for _, v := range versions {
+		if v < version {
+			version = v
+		}
+	}
+	return version, nil
+}
+
+// rewriteSelect returns the select list which brings a file of an archive directory from version to its archiveVersion.
+func rewriteSelect(dirName string, version int, from string) string {
+	query := "SELECT * FROM " + from
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		if expr, ok := m.rewrite[dirName]; ok {
+			query = fmt.Sprintf("SELECT %s FROM (%s)", expr, query)
+		}
+	}
+	return query
+}
+
+// MigrateArchive rewrites every parquet file with an older schema version than the archiveVersion of its directory,
+// applying the column renames and type changes of the newer migrations. Files are swapped in the same way as compactions.
+// With dryRun the files are only counted, it returns the number of files which are or would be rewritten.
+func (w *Writer) MigrateArchive(dryRun bool) (int, error) {
+	w.recoverReplacements()
+	rewritten := 0
+	for _, dirName := range archiveDirs() {
+		for _, root := range []string{filepath.Join(w.baseDir, dirName), filepath.Join(w.baseDir, dirName+dailySuffix)} {
+			var files []string
+			err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+				if err != nil || d == nil || d.IsDir() {
+					return nil
+				}
+				if strings.HasSuffix(d.Name(), ".parquet") {
+					files = append(files, path)
+				}
+				return nil
+			})
+			if err != nil {
+				return rewritten, err
+			}
+			versions, err := fileVersions(w.db, files)
+			if err != nil {
+				return rewritten, err
+			}
+			for _, file := range files {
+				version := versions[file]
+				if version >= archiveVersion(dirName) {
+					continue
+				}
+				rewritten++
+				if dryRun {
+					log.Printf("%s has schema version %d\n", file, version)
+					continue
+				}
+				target := filepath.Join(filepath.Dir(file), fmt.Sprintf("%s-%d.parquet", dirName, time.Now().UTC().UnixNano()))
+				from := fmt.Sprintf("read_parquet('%s', hive_partitioning=false)", escapePath(filepath.ToSlash(file)))
+				if err := w.replaceFiles(rewriteSelect(dirName, version, from), archiveVersion(dirName), []string{file}, target); err != nil {
+					return rewritten, fmt.Errorf("failed to rewrite %s: %w", file, err)
+				}
+				log.Printf("rewrote %s from schema version %d\n", file, version)
+			}
+		}
+	}
+	return rewritten, nil
+}
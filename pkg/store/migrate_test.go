@@ -0,0 +1,65 @@
+package store
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMigrateArchive(t *testing.T) {
+	t0 := time.Date(2024, time.March, 5, 12, 0, 0, 0, time.UTC)
+	w := newTestWriter(t, t0, 3, 4)
+	dir := partitionDir(w.baseDir, "runtime", t0)
+
+	// The migrations so far only change DuckDB, the archive is up to date
+	for _, dirName := range archiveDirs() {
+		if version := archiveVersion(dirName); version != 0 {
+			t.Errorf("archiveVersion(%s) = %d, want 0", dirName, version)
+		}
+	}
+	if count, err := w.MigrateArchive(false); err != nil || count != 0 {
+		t.Fatalf("MigrateArchive() = %d, %v, want nothing to rewrite", count, err)
+	}
+
+	saved := migrations
+	defer func() { migrations = saved }()
+	migrations = append(migrations[:len(migrations):len(migrations)],
+		migration{version: SchemaVersion + 1, name: "store speed in km/h", rewrite: map[string]string{"runtime": "* REPLACE (value * 1.609 AS value)"}},
+		migration{version: SchemaVersion + 2, name: "track something in DuckDB"},
+	)
+	if version := archiveVersion("runtime"); version != SchemaVersion+1 {
+		t.Fatalf("archiveVersion(runtime) = %d, want %d", version, SchemaVersion+1)
+	}
+	if version := archiveVersion("runtime_1m"); version != 0 {
+		t.Fatalf("archiveVersion(runtime_1m) = %d, want 0", version)
+	}
+
+	if count, err := w.MigrateArchive(true); err != nil || count != 2 {
+		t.Fatalf("MigrateArchive(dry run) = %d, %v, want the 2 runtime files", count, err)
+	}
+	if count, err := w.MigrateArchive(false); err != nil || count != 2 {
+		t.Fatalf("MigrateArchive() = %d, %v, want the 2 runtime files", count, err)
+	}
+	files := parquetFiles(t, dir)
+	versions, err := fileVersions(w.db, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if versions[file] != SchemaVersion+1 {
+			t.Errorf("%s has schema version %d, want %d", filepath.Base(file), versions[file], SchemaVersion+1)
+		}
+	}
+	var sum float64
+	if err := w.db.QueryRow(fmt.Sprintf("SELECT sum(value) FROM %s", readFiles(files))).Scan(&sum); err != nil {
+		t.Fatal(err)
+	}
+	// The speeds 0 to 6 are converted once
+	if want := 21 * 1.609; sum < want-1e-9 || sum > want+1e-9 {
+		t.Errorf("sum of the rewritten values = %v, want %v", sum, want)
+	}
+	if count, err := w.MigrateArchive(false); err != nil || count != 0 {
+		t.Errorf("second MigrateArchive() = %d, %v, want nothing to rewrite", count, err)
+	}
+}
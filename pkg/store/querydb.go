@@ -0,0 +1,852 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/duckdb/duckdb-go/v2"
+)
+
+// QueryLimits bound the separate DuckDB instance which runs Query and QueryRows, so a runaway query can't take the
+// memory and cores the writers need. They are shared by the queries running at the same time.
+type QueryLimits struct {
+	Threads     int
+	MemoryLimit string
+	// MaxTempSize bounds the files sorts and joins larger than MemoryLimit spill to, a query which needs more fails.
+	MaxTempSize string
+}
+
+var defaultQueryLimits = QueryLimits{Threads: 2, MemoryLimit: "512MB", MaxTempSize: "2GB"}
+
+// SetQueryLimits sets the limits of the query database, it must be called before the first query.
+func (w *Writer) SetQueryLimits(limits QueryLimits) {
+	w.queryMu.Lock()
+	defer w.queryMu.Unlock()
+	w.queryLimits = limits
+}
+
+// openQueryDB opens the in-memory DuckDB instance queries run in on first use. It can only read files in the parquet
+// directory and reaches the tables of the writer's database through views of the writer_table function, its
+// configuration is locked so a query can't lift the limits.
+func (w *Writer) openQueryDB(ctx context.Context) (*sql.DB, error) {
+	w.queryMu.Lock()
+	defer w.queryMu.Unlock()
+	if w.queryDB != nil {
+		return w.queryDB, nil
+	}
+	limits := w.queryLimits
+	if limits.Threads <= 0 {
+		limits.Threads = defaultQueryLimits.Threads
+	}
+	if limits.MemoryLimit == "" {
+		limits.MemoryLimit = defaultQueryLimits.MemoryLimit
+	}
+	if limits.MaxTempSize == "" {
+		limits.MaxTempSize = defaultQueryLimits.MaxTempSize
+	}
+	allowed := []string{sqlString(filepath.ToSlash(filepath.Clean(w.baseDir)) + "/")}
+	if abs, err := filepath.Abs(w.baseDir); err == nil {
+		allowed = append(allowed, sqlString(filepath.ToSlash(abs)+"/"))
+	}
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		return nil, err
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	defer conn.Close()
+	if err := duckdb.RegisterTableUDF(conn, "writer_table", w.writerTableFunction()); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to register writer_table: %w", err)
+	}
+	// Views named after the writer's tables let the same queries run in both databases
+	tables, err := w.writerTables(ctx)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	var stmts []string
+	queryColumns := make(map[string][]writerColumn, len(tables))
+	for _, table := range tables {
+		columns, err := w.writerColumns(ctx, table)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		queryColumns[table] = columns
+		stmts = append(stmts, fmt.Sprintf("CREATE VIEW %s AS %s", quoteIdent(table), writerSelect(table, columns, "''", "''", "''")))
+	}
+	for _, stmt := range append(stmts,
+		fmt.Sprintf("SET threads = %d", limits.Threads),
+		fmt.Sprintf("SET memory_limit = %s", sqlString(limits.MemoryLimit)),
+		fmt.Sprintf("SET temp_directory = %s", sqlString(filepath.ToSlash(filepath.Join(w.baseDir, queryTempDir)))),
+		fmt.Sprintf("SET max_temp_directory_size = %s", sqlString(limits.MaxTempSize)),
+		fmt.Sprintf("SET allowed_directories = [%s]", strings.Join(allowed, ", ")),
+		"SET enable_external_access = false",
+		"SET lock_configuration = true",
+	) {
+		if _, err := conn.ExecContext(ctx, stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to configure query database: %s: %w", stmt, err)
+		}
+	}
+	log.Printf("opened query database with %d threads, a %s memory limit and %s of spill files", limits.Threads, limits.MemoryLimit, limits.MaxTempSize)
+	w.queryDB = db
+	w.queryColumns = queryColumns
+	return db, nil
+}
+
+// queryTempDir is where the query database spills to when it runs out of memory.
+const queryTempDir = ".query_tmp"
+
+// queryConn returns a connection of the query database with the history and rollup views in place.
+func (w *Writer) queryConn(ctx context.Context) (*sql.Conn, error) {
+	db, err := w.openQueryDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.ensureQueryViews(ctx, conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (w *Writer) writerTables(ctx context.Context) ([]string, error) {
+	rows, err := w.db.QueryContext(ctx, "SELECT table_name FROM duckdb_tables() WHERE database_name = current_database() AND schema_name = 'main' ORDER BY table_name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+	return tables, rows.Err()
+}
+
+// writerColumn is a column of a writer table, columns of types writer_table can't pass on are read as VARCHAR.
+type writerColumn struct {
+	name string
+	expr string
+	info duckdb.TypeInfo
+}
+
+var columnTypes = map[string]duckdb.Type{
+	"BOOLEAN":   duckdb.TYPE_BOOLEAN,
+	"TINYINT":   duckdb.TYPE_TINYINT,
+	"SMALLINT":  duckdb.TYPE_SMALLINT,
+	"INTEGER":   duckdb.TYPE_INTEGER,
+	"BIGINT":    duckdb.TYPE_BIGINT,
+	"UTINYINT":  duckdb.TYPE_UTINYINT,
+	"USMALLINT": duckdb.TYPE_USMALLINT,
+	"UINTEGER":  duckdb.TYPE_UINTEGER,
+	"UBIGINT":   duckdb.TYPE_UBIGINT,
+	"FLOAT":     duckdb.TYPE_FLOAT,
+	"DOUBLE":    duckdb.TYPE_DOUBLE,
+	"VARCHAR":   duckdb.TYPE_VARCHAR,
+	"BLOB":      duckdb.TYPE_BLOB,
+	"TIMESTAMP": duckdb.TYPE_TIMESTAMP,
+	"DATE":      duckdb.TYPE_DATE,
+}
+
+func columnTypeInfo(dataType string) (duckdb.TypeInfo, bool) {
+	if inner, ok := strings.CutSuffix(dataType, "[]"); ok {
+		child, ok := columnTypeInfo(inner)
+		if !ok {
+			return nil, false
+		}
+		info, err := duckdb.NewListInfo(child)
+		return info, err == nil
+	}
+	t, ok := columnTypes[dataType]
+	if !ok {
+		return nil, false
+	}
+	info, err := duckdb.NewTypeInfo(t)
+	return info, err == nil
+}
+
+func (w *Writer) writerColumns(ctx context.Context, table string) ([]writerColumn, error) {
+	rows, err := w.db.QueryContext(ctx, `SELECT column_name, data_type FROM duckdb_columns()
+WHERE database_name = current_database() AND schema_name = 'main' AND table_name = ?
+ORDER BY column_index`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var columns []writerColumn
+	for rows.Next() {
+		var name, dataType string
+		if err := rows.Scan(&name, &dataType); err != nil {
+			return nil, err
+		}
+		col := writerColumn{name: name, expr: quoteIdent(name)}
+		info, ok := columnTypeInfo(dataType)
+		if !ok {
+			col.expr = fmt.Sprintf("CAST(%s AS VARCHAR)", quoteIdent(name))
+			info, _ = duckdb.NewTypeInfo(duckdb.TYPE_VARCHAR)
+		}
+		col.info = info
+		columns = append(columns, col)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("no table %s", table)
+	}
+	return columns, nil
+}
+
+// writerTableFunction is writer_table(table, since := ts, until := ts, name := name), which streams the rows of a
+// table of the writer's database into the query database. Only the columns the query uses are read, since and until
+// bound ts and name picks the rows of one metric of tables with a name column.
+// Every column is a STRUCT(v) because a table function row can't be set to NULL while a struct field can, the
+// selects of writerSelect unwrap them.
+func (w *Writer) writerTableFunction() duckdb.RowTableFunction {
+	varchar, _ := duckdb.NewTypeInfo(duckdb.TYPE_VARCHAR)
+	return duckdb.RowTableFunction{
+		Config: duckdb.TableFunctionConfig{
+			Arguments: []duckdb.TypeInfo{varchar},
+			// Text rather than TIMESTAMP because the driver can't bind a missing or NULL named argument, '' leaves
+			// a side open
+			NamedArguments: map[string]duckdb.TypeInfo{"since": varchar, "until": varchar, "name": varchar},
+		},
+		BindArgumentsContext: func(ctx context.Context, named map[string]any, args ...any) (duckdb.RowTableSource, error) {
+			table, _ := args[0].(string)
+			columns, err := w.writerColumns(ctx, table)
+			if err != nil {
+				return nil, err
+			}
+			t := &writerTable{ctx: ctx, db: w.db, table: table, columns: columns}
+			t.since, _ = named["since"].(string)
+			t.until, _ = named["until"].(string)
+			t.name, _ = named["name"].(string)
+			return t, nil
+		},
+	}
+}
+
+// writerSelect returns the select of a writer table through writer_table with the columns unwrapped, since, until
+// and name are the expressions of its bounds.
+func writerSelect(table string, columns []writerColumn, since string, until string, name string) string {
+	list := make([]string, len(columns))
+	for i, col := range columns {
+		list[i] = fmt.Sprintf("%s.v AS %s", quoteIdent(col.name), quoteIdent(col.name))
+	}
+	return fmt.Sprintf("SELECT %s FROM writer_table(%s, since := %s, until := %s, name := %s)", strings.Join(list, ", "), sqlString(table), since, until, name)
+}
+
+type writerTable struct {
+	ctx       context.Context
+	db        *sql.DB
+	table     string
+	columns   []writerColumn
+	since     string
+	until     string
+	name      string
+	projected []int
+	tx        *sql.Tx
+	query     string
+	args      []interface{}
+	from      int64
+	last      int64
+	rows      *sql.Rows
+	values    []interface{}
+	targets   []interface{}
+	fields    []map[string]any
+}
+
+// writerPageRows is the number of rowids a writer_table scan reads at a time. The driver holds a whole result in
+// memory, outside of the limits of either database, so a scan is read in pages to bound it.
+const writerPageRows = 100000
+
+func (t *writerTable) ColumnInfos() []duckdb.ColumnInfo {
+	infos := make([]duckdb.ColumnInfo, len(t.columns))
+	for i, col := range t.columns {
+		entry, _ := duckdb.NewStructEntry(col.info, "v")
+		info, _ := duckdb.NewStructInfo(entry)
+		infos[i] = duckdb.ColumnInfo{Name: col.name, T: info}
+	}
+	return infos
+}
+
+func (t *writerTable) Cardinality() *duckdb.CardinalityInfo {
+	return nil
+}
+
+func (t *writerTable) Init() {}
+
+// FillRow starts the scan of the writer table on the first row, once the projected columns are known, and reads
+// the next page whenever one runs out. The scan is closed at the end of the table, or by the cancellation of the
+// query context if the query stops reading early.
+func (t *writerTable) FillRow(row duckdb.Row) (bool, error) {
+	if t.tx == nil {
+		if err := t.start(row); err != nil {
+			return false, err
+		}
+	}
+	for t.rows == nil || !t.rows.Next() {
+		if t.rows != nil {
+			err := t.rows.Err()
+			t.rows.Close()
+			t.rows = nil
+			if err != nil {
+				t.finish()
+				return false, err
+			}
+			t.from += writerPageRows
+		}
+		if t.from > t.last {
+			t.finish()
+			return false, nil
+		}
+		rows, err := t.tx.QueryContext(t.ctx, t.query, append([]interface{}{t.from, t.from + writerPageRows}, t.args...)...)
+		if err != nil {
+			t.finish()
+			return false, err
+		}
+		t.rows = rows
+	}
+	if err := t.rows.Scan(t.targets...); err != nil {
+		t.finish()
+		return false, err
+	}
+	for j, i := range t.projected {
+		t.fields[j]["v"] = t.values[j]
+		if err := row.SetRowValue(i, t.fields[j]); err != nil {
+			t.finish()
+			return false, fmt.Errorf("%s.%s: %w", t.table, t.columns[i].name, err)
+		}
+	}
+	return true, nil
+}
+
+// start prepares the scan of the projected columns between since and until. The pages are read in one transaction
+// so the rowids they are cut by don't change in between.
+func (t *writerTable) start(row duckdb.Row) error {
+	var exprs []string
+	hasName := false
+	for i, col := range t.columns {
+		if row.IsProjected(i) {
+			t.projected = append(t.projected, i)
+			exprs = append(exprs, col.expr)
+		}
+		hasName = hasName || col.name == "name"
+	}
+	if len(exprs) == 0 {
+		exprs = append(exprs, "NULL")
+	}
+	where := []string{"rowid >= ?", "rowid < ?"}
+	if t.since != "" {
+		where = append(where, "ts >= CAST(? AS TIMESTAMP)")
+		t.args = append(t.args, t.since)
+	}
+	if t.until != "" {
+		where = append(where, "ts <= CAST(? AS TIMESTAMP)")
+		t.args = append(t.args, t.until)
+	}
+	if t.name != "" && hasName {
+		where = append(where, "name = ?")
+		t.args = append(t.args, t.name)
+	}
+	t.query = fmt.Sprintf("SELECT %s FROM %s WHERE %s", strings.Join(exprs, ", "), quoteIdent(t.table), strings.Join(where, " AND "))
+	tx, err := t.db.BeginTx(t.ctx, nil)
+	if err != nil {
+		return err
+	}
+	var last sql.NullInt64
+	if err := tx.QueryRowContext(t.ctx, "SELECT max(rowid) FROM "+quoteIdent(t.table)).Scan(&last); err != nil {
+		tx.Rollback()
+		return err
+	}
+	t.tx = tx
+	t.last = -1
+	if last.Valid {
+		t.last = last.Int64
+	}
+	t.values = make([]interface{}, len(exprs))
+	t.targets = make([]interface{}, len(exprs))
+	for i := range t.values {
+		t.targets[i] = &t.values[i]
+	}
+	t.fields = make([]map[string]any, len(t.projected))
+	for j := range t.fields {
+		t.fields[j] = map[string]any{}
+	}
+	return nil
+}
+
+// finish closes the scan, the transaction is only read from so it is rolled back.
+func (t *writerTable) finish() {
+	if t.rows != nil {
+		t.rows.Close()
+		t.rows = nil
+	}
+	t.from = t.last + 1
+	t.tx.Rollback()
+}
+
+// historyViews maps each table exported to parquet to the view which adds its archive.
+func historyViews() map[string]string {
+	views := make(map[string]string, len(exportTables))
+	for _, t := range exportTables {
+		views[t.table] = t.table + "_all"
+	}
+	return views
+}
+
+// historyRange reads an exported table or a rollup like its view, with the rows of the writer's table limited to a
+// range of ts and to a name.
+type historyRange struct {
+	table   string
+	columns []writerColumn
+	sources string
+	// rollup is set when the range is the rollup of table, it aggregates the rows of table
+	rollup *rollup
+}
+
+// historyRanges returns the history range of each exported table which the query database has a view of, and of the
+// rollups of runtime_metrics.
+func (w *Writer) historyRanges() map[string]historyRange {
+	w.queryMu.Lock()
+	columns := w.queryColumns
+	w.queryMu.Unlock()
+	ranges := make(map[string]historyRange, len(exportTables))
+	for _, t := range exportTables {
+		if cols, ok := columns[t.table]; ok {
+			ranges[t.table] = historyRange{table: t.table, columns: cols, sources: parquetSources(w.baseDir, t.dirName)}
+		}
+	}
+	if cols, ok := columns["runtime_metrics"]; ok {
+		for i := range rollups {
+			r := &rollups[i]
+			ranges[r.view] = historyRange{table: "runtime_metrics", columns: cols, sources: parquetSources(w.baseDir, r.dirName), rollup: r}
+		}
+	}
+	return ranges
+}
+
+// sql returns the select of the range, with $__since, $__until and $__name as the bounds it has.
+func (r historyRange) sql(since bool, until bool, name bool) string {
+	sinceArg, untilArg, nameArg := "''", "''", "''"
+	if since {
+		sinceArg = boundText("$__since")
+	}
+	if until {
+		untilArg = boundText("$__until")
+		if r.rollup != nil {
+			// A bucket up to until holds the rows up to the end of its step
+			untilArg = boundText(fmt.Sprintf("TRY_CAST($__until AS TIMESTAMP) + to_microseconds(%d)", r.rollup.step.Microseconds()))
+		}
+	}
+	if name {
+		nameArg = "coalesce(CAST($__name AS VARCHAR), '')"
+	}
+	live := "(" + writerSelect(r.table, r.columns, sinceArg, untilArg, nameArg) + ")"
+	if r.rollup != nil {
+		return r.rollup.viewSelect(live, r.sources)
+	}
+	return historySelect(r.table, live, r.sources)
+}
+
+// hasName reports whether the range's table has a name column the rows can be picked by.
+func (r historyRange) hasName() bool {
+	for _, col := range r.columns {
+		if col.name == "name" {
+			return true
+		}
+	}
+	return false
+}
+
+// boundText converts a bound to the text writer_table takes, a bound which isn't a timestamp leaves the side open.
+func boundText(expr string) string {
+	return fmt.Sprintf("coalesce(CAST(TRY_CAST(%s AS TIMESTAMP) AS VARCHAR), '')", expr)
+}
+
+// rewriteQuery checks that sqlQuery is a single SELECT statement and points its references to the exported tables
+// at their history views, working on DuckDB's parsed query tree so string literals, column names and CTEs with the
+// same name are left alone. A renamed table keeps its old name as alias, for qualified column references. Where the
+// WHERE clause bounds ts the table is read from its history range instead, so writer_table only scans those rows.
+func rewriteQuery(ctx context.Context, conn *sql.Conn, sqlQuery string, ranges map[string]historyRange) (string, []string, error) {
+	stmt, err := parseStatement(ctx, conn, sqlQuery)
+	if err != nil {
+		return "", nil, err
+	}
+	params, err := queryParams(stmt)
+	if err != nil {
+		return "", nil, err
+	}
+	ctes := make(map[string]bool)
+	collectCTEs(stmt, ctes)
+	var bounded []boundedTable
+	findBoundedTables(stmt, ranges, ctes, &bounded)
+	for _, b := range bounded {
+		if err := b.replace(ctx, conn, ranges[b.table]); err != nil {
+			return "", nil, err
+		}
+	}
+	renameTables(stmt, historyViews(), ctes)
+	tree, err := json.Marshal(map[string]interface{}{"error": false, "statements": []interface{}{stmt}})
+	if err != nil {
+		return "", nil, err
+	}
+	var query string
+	if err := conn.QueryRowContext(ctx, "SELECT json_deserialize_sql(?::JSON)", string(tree)).Scan(&query); err != nil {
+		return "", nil, err
+	}
+	return query, params, nil
+}
+
+// parseStatement returns DuckDB's parsed query tree of sqlQuery, which must be a single SELECT statement.
+func parseStatement(ctx context.Context, conn *sql.Conn, sqlQuery string) (interface{}, error) {
+	var serialized string
+	if err := conn.QueryRowContext(ctx, "SELECT json_serialize_sql(?::VARCHAR)::VARCHAR", sqlQuery).Scan(&serialized); err != nil {
+		return nil, err
+	}
+	var parsed struct {
+		Error        bool              `json:"error"`
+		ErrorType    string            `json:"error_type"`
+		ErrorMessage string            `json:"error_message"`
+		Statements   []json.RawMessage `json:"statements"`
+	}
+	if err := json.Unmarshal([]byte(serialized), &parsed); err != nil {
+		return nil, err
+	}
+	if parsed.Error {
+		if parsed.ErrorType == "not implemented" {
+			return nil, fmt.Errorf("only SELECT queries are allowed")
+		}
+		return nil, fmt.Errorf("%s: %s", parsed.ErrorType, parsed.ErrorMessage)
+	}
+	if len(parsed.Statements) != 1 {
+		return nil, fmt.Errorf("only a single SELECT statement is allowed, got %d", len(parsed.Statements))
+	}
+	// UseNumber keeps large constants and query locations exact
+	dec := json.NewDecoder(bytes.NewReader(parsed.Statements[0]))
+	dec.UseNumber()
+	var stmt interface{}
+	if err := dec.Decode(&stmt); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// boundedTable is a select from an exported table or a rollup whose WHERE clause bounds ts or name, since, until
+// and name are the bound expressions or nil.
+type boundedTable struct {
+	node  map[string]interface{}
+	table string
+	since interface{}
+	until interface{}
+	name  interface{}
+}
+
+// findBoundedTables adds the selects in node reading an exported table or a rollup, not a CTE of the same name, with
+// ts or name bounds in their WHERE clause.
+func findBoundedTables(node interface{}, ranges map[string]historyRange, ctes map[string]bool, found *[]boundedTable) {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		if n["type"] == "SELECT_NODE" {
+			from, _ := n["from_table"].(map[string]interface{})
+			if from != nil && from["type"] == "BASE_TABLE" {
+				name, _ := from["table_name"].(string)
+				schema, _ := from["schema_name"].(string)
+				catalog, _ := from["catalog_name"].(string)
+				if r, ok := ranges[name]; ok && !ctes[name] && catalog == "" && (schema == "" || schema == "main") {
+					qualifier, _ := from["alias"].(string)
+					if qualifier == "" {
+						qualifier = name
+					}
+					b := boundedTable{node: n, table: name}
+					b.addBounds(n["where_clause"], qualifier)
+					if !r.hasName() {
+						b.name = nil
+					}
+					if b.since != nil || b.until != nil || b.name != nil {
+						*found = append(*found, b)
+					}
+				}
+			}
+		}
+		for _, child := range n {
+			findBoundedTables(child, ranges, ctes, found)
+		}
+	case []interface{}:
+		for _, child := range n {
+			findBoundedTables(child, ranges, ctes, found)
+		}
+	}
+}
+
+// addBounds picks the ts bounds and the name out of the conjunction expr. Any bound the rows must satisfy will do, they only
+// limit the rows read, the WHERE clause still filters them.
+func (b *boundedTable) addBounds(expr interface{}, qualifier string) {
+	e, _ := expr.(map[string]interface{})
+	if e == nil {
+		return
+	}
+	switch e["class"] {
+	case "CONJUNCTION":
+		if e["type"] == "CONJUNCTION_AND" {
+			children, _ := e["children"].([]interface{})
+			for _, child := range children {
+				b.addBounds(child, qualifier)
+			}
+		}
+	case "BETWEEN":
+		if isColumnRef(e["input"], qualifier, "ts") {
+			b.setBounds(e["lower"], e["upper"])
+		}
+	case "COMPARISON":
+		left, right := e["left"], e["right"]
+		op, _ := e["type"].(string)
+		if op == "COMPARE_EQUAL" && b.name == nil {
+			if isColumnRef(right, qualifier, "name") {
+				left, right = right, left
+			}
+			if isColumnRef(left, qualifier, "name") && isConstant(right) {
+				b.name = right
+				return
+			}
+		}
+		if !isColumnRef(left, qualifier, "ts") {
+			if !isColumnRef(right, qualifier, "ts") {
+				return
+			}
+			// The bound is on the left, ? < ts is ts > ?
+			left, right = right, left
+			op = strings.NewReplacer("GREATER", "LESS", "LESS", "GREATER").Replace(op)
+		}
+		switch op {
+		case "COMPARE_GREATERTHAN", "COMPARE_GREATERTHANOREQUALTO":
+			b.setBounds(right, nil)
+		case "COMPARE_LESSTHAN", "COMPARE_LESSTHANOREQUALTO":
+			b.setBounds(nil, right)
+		case "COMPARE_EQUAL":
+			b.setBounds(right, right)
+		}
+	}
+}
+
+// setBounds keeps the first constant lower and upper bound.
+func (b *boundedTable) setBounds(since interface{}, until interface{}) {
+	if b.since == nil && since != nil && isConstant(since) {
+		b.since = since
+	}
+	if b.until == nil && until != nil && isConstant(until) {
+		b.until = until
+	}
+}
+
+// replace points the select at the history range of its table, with the bounds passed to writer_table. The range
+// keeps the name the query knows the table by.
+func (b boundedTable) replace(ctx context.Context, conn *sql.Conn, r historyRange) error {
+	stmt, err := parseStatement(ctx, conn, fmt.Sprintf("SELECT * FROM (%s)", r.sql(b.since != nil, b.until != nil, b.name != nil)))
+	if err != nil {
+		return fmt.Errorf("failed to parse the history range of %s: %w", b.table, err)
+	}
+	root, _ := stmt.(map[string]interface{})
+	node, _ := root["node"].(map[string]interface{})
+	from, _ := node["from_table"].(map[string]interface{})
+	if from == nil {
+		return fmt.Errorf("unexpected history range of %s", b.table)
+	}
+	alias, _ := b.node["from_table"].(map[string]interface{})["alias"].(string)
+	if alias == "" {
+		alias = b.table
+	}
+	from["alias"] = alias
+	b.node["from_table"] = substituteParams(from, map[string]interface{}{"__since": b.since, "__until": b.until, "__name": b.name})
+	return nil
+}
+
+// substituteParams replaces the parameters of node named in values with their expressions.
+func substituteParams(node interface{}, values map[string]interface{}) interface{} {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		if n["class"] == "PARAMETER" {
+			if value, ok := values[fmt.Sprint(n["identifier"])]; ok {
+				return value
+			}
+		}
+		for key, child := range n {
+			n[key] = substituteParams(child, values)
+		}
+	case []interface{}:
+		for i, child := range n {
+			n[i] = substituteParams(child, values)
+		}
+	}
+	return node
+}
+
+// isColumnRef reports whether expr is the column of the table known as qualifier.
+func isColumnRef(expr interface{}, qualifier string, column string) bool {
+	e, _ := expr.(map[string]interface{})
+	if e == nil || e["class"] != "COLUMN_REF" {
+		return false
+	}
+	names, _ := e["column_names"].([]interface{})
+	switch len(names) {
+	case 1:
+		name, _ := names[0].(string)
+		return strings.EqualFold(name, column)
+	case 2:
+		table, _ := names[0].(string)
+		name, _ := names[1].(string)
+		return strings.EqualFold(table, qualifier) && strings.EqualFold(name, column)
+	}
+	return false
+}
+
+// volatileFunctions return a different value on every call, a bound using them isn't the same in the WHERE clause.
+var volatileFunctions = map[string]bool{
+	"random":          true,
+	"uuid":            true,
+	"gen_random_uuid": true,
+	"nextval":         true,
+	"currval":         true,
+	"setseed":         true,
+}
+
+// isConstant reports whether expr has the same value for every row: constants, parameters and functions and casts
+// of them.
+func isConstant(expr interface{}) bool {
+	e, _ := expr.(map[string]interface{})
+	if e == nil {
+		return false
+	}
+	switch e["class"] {
+	case "CONSTANT", "PARAMETER":
+		return true
+	case "CAST":
+		return isConstant(e["child"])
+	case "FUNCTION":
+		name, _ := e["function_name"].(string)
+		if volatileFunctions[strings.ToLower(name)] || e["filter"] != nil {
+			return false
+		}
+		children, _ := e["children"].([]interface{})
+		for _, child := range children {
+			if !isConstant(child) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// queryParams returns the names of the parameters of a parsed statement in the order they are bound, numbers for
+// positional ones.
+func queryParams(stmt interface{}) ([]string, error) {
+	root, _ := stmt.(map[string]interface{})
+	entries, _ := root["named_param_map"].([]interface{})
+	params := make([]string, len(entries))
+	for _, entry := range entries {
+		e, _ := entry.(map[string]interface{})
+		name, _ := e["key"].(string)
+		index, _ := e["value"].(json.Number)
+		i, err := index.Int64()
+		if err != nil || i < 1 || int(i) > len(params) {
+			return nil, fmt.Errorf("unexpected parameter %s at %s", name, index)
+		}
+		params[i-1] = name
+	}
+	return params, nil
+}
+
+// bindArgs picks the named arguments for params in order. The driver falls back to binding by position, so a
+// parameter without an argument of its name would get an unrelated value.
+func bindArgs(params []string, args []interface{}) ([]interface{}, error) {
+	bound := make([]interface{}, len(params))
+	for i, name := range params {
+		for _, arg := range args {
+			if named, ok := arg.(sql.NamedArg); ok && named.Name == name {
+				bound[i] = named
+			}
+		}
+		if bound[i] == nil {
+			return nil, fmt.Errorf("no value for parameter $%s", name)
+		}
+	}
+	return bound, nil
+}
+
+// collectCTEs adds the names of the common table expressions anywhere in node to ctes.
+func collectCTEs(node interface{}, ctes map[string]bool) {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		if cteMap, ok := n["cte_map"].(map[string]interface{}); ok {
+			entries, _ := cteMap["map"].([]interface{})
+			for _, entry := range entries {
+				if e, ok := entry.(map[string]interface{}); ok {
+					if key, ok := e["key"].(string); ok {
+						ctes[key] = true
+					}
+				}
+			}
+		}
+		for _, child := range n {
+			collectCTEs(child, ctes)
+		}
+	case []interface{}:
+		for _, child := range n {
+			collectCTEs(child, ctes)
+		}
+	}
+}
+
+func renameTables(node interface{}, views map[string]string, ctes map[string]bool) {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		if n["type"] == "BASE_TABLE" {
+			name, _ := n["table_name"].(string)
+			schema, _ := n["schema_name"].(string)
+			catalog, _ := n["catalog_name"].(string)
+			if view, ok := views[name]; ok && !ctes[name] && catalog == "" && (schema == "" || schema == "main") {
+				n["table_name"] = view
+				n["schema_name"] = ""
+				if alias, _ := n["alias"].(string); alias == "" {
+					n["alias"] = name
+				}
+			}
+			return
+		}
+		for _, child := range n {
+			renameTables(child, views, ctes)
+		}
+	case []interface{}:
+		for _, child := range n {
+			renameTables(child, views, ctes)
+		}
+	}
+}
+
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func sqlString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -0,0 +1,176 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	_ "github.com/duckdb/duckdb-go/v2"
+)
+
+func TestRewriteQuery(t *testing.T) {
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ranges := map[string]historyRange{
+		"runtime_metrics": {table: "runtime_metrics", columns: []writerColumn{{name: "ts"}, {name: "value"}}},
+	}
+	// writerTable is the history range of runtime_metrics with the bounds since and until
+	writerTable := func(since string, until string) string {
+		return `(SELECT ts, "name", "value", "text", labels, kind FROM (SELECT ts.v AS ts, "value".v AS "value" ` +
+			`FROM writer_table('runtime_metrics', since := ` + since + `, "until" := ` + until + `, "name" := '')))`
+	}
+	bound := func(expr string) string {
+		return "COALESCE(CAST(TRY_CAST(" + expr + " AS TIMESTAMP) AS VARCHAR), '')"
+	}
+	tests := []struct {
+		name       string
+		query      string
+		want       string
+		wantParams []string
+		wantErr    string
+	}{
+		{
+			name:  "table renamed, string left alone",
+			query: "SELECT * FROM runtime_metrics WHERE name = 'runtime_metrics'",
+			want:  `SELECT * FROM runtime_metrics_all AS runtime_metrics WHERE ("name" = 'runtime_metrics')`,
+		},
+		{
+			name:  "alias and schema kept",
+			query: "SELECT * FROM main.status_hourly s JOIN can_frames USING (ts)",
+			want:  "SELECT * FROM status_hourly_all AS s INNER JOIN can_frames_all AS can_frames USING (ts)",
+		},
+		{
+			name:  "cte shadows the table",
+			query: "WITH runtime_metrics AS (SELECT 1 AS x) SELECT * FROM runtime_metrics",
+			want:  "WITH runtime_metrics AS (SELECT 1 AS x)SELECT * FROM runtime_metrics",
+		},
+		{
+			name:       "ts bounds pushed down",
+			query:      "SELECT r.value FROM runtime_metrics r WHERE r.ts >= $from AND $to > ts",
+			want:       `SELECT r."value" FROM ` + writerTable(bound("$from"), bound("$to")) + ` AS r WHERE ((r.ts >= $from) AND ($to > ts))`,
+			wantParams: []string{"from", "to"},
+		},
+		{
+			name:       "between bounds pushed down",
+			query:      "SELECT * FROM runtime_metrics WHERE ts BETWEEN ? AND now()",
+			want:       "SELECT * FROM " + writerTable(bound("$1"), bound("now()")) + " AS runtime_metrics WHERE (ts BETWEEN $1 AND now())",
+			wantParams: []string{"1"},
+		},
+		{
+			name:       "lower bound only",
+			query:      "SELECT * FROM runtime_metrics WHERE ts > $since AND value > 1",
+			want:       "SELECT * FROM " + writerTable(bound("$since"), "''") + ` AS runtime_metrics WHERE ((ts > $since) AND ("value" > 1))`,
+			wantParams: []string{"since"},
+		},
+		{
+			name:  "volatile bound not pushed down",
+			query: "SELECT * FROM runtime_metrics WHERE ts > random()",
+			want:  "SELECT * FROM runtime_metrics_all AS runtime_metrics WHERE (ts > random())",
+		},
+		{
+			name:       "bound of another table not pushed down",
+			query:      "SELECT * FROM runtime_metrics r WHERE x.ts > $from",
+			want:       "SELECT * FROM runtime_metrics_all AS r WHERE (x.ts > $from)",
+			wantParams: []string{"from"},
+		},
+		{name: "insert", query: "INSERT INTO runtime_metrics VALUES (1)", wantErr: "only SELECT queries are allowed"},
+		{name: "drop", query: "DROP TABLE runtime_metrics", wantErr: "only SELECT queries are allowed"},
+		{name: "two statements", query: "SELECT 1; SELECT 2", wantErr: "only a single SELECT statement is allowed"},
+		{name: "syntax error", query: "SELEC 1", wantErr: "syntax error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, params, err := rewriteQuery(ctx, conn, tt.query, ranges)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("rewriteQuery() = %q, %v, want error %q", got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("rewriteQuery() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("rewriteQuery() =\n%s\nwant\n%s", got, tt.want)
+			}
+			if len(params) != len(tt.wantParams) || (len(params) > 0 && !reflect.DeepEqual(params, tt.wantParams)) {
+				t.Errorf("params = %q, want %q", params, tt.wantParams)
+			}
+		})
+	}
+}
+
+func TestQueryRowsPages(t *testing.T) {
+	w, err := NewWriter(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	rows := 2*queryPageRows + 5
+	query := fmt.Sprintf("SELECT i, md5(i::VARCHAR) AS s FROM range(%d) t(i) ORDER BY s", rows)
+	want, err := w.Query(context.Background(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls int
+	var got [][]interface{}
+	err = w.QueryRows(context.Background(), query,
+		func(cols []*sql.ColumnType) error {
+			calls++
+			if len(cols) != 2 || cols[1].Name() != "s" {
+				t.Errorf("columns %v, want i and s", cols)
+			}
+			return nil
+		},
+		func(values []interface{}) error {
+			got = append(got, append([]interface{}(nil), values...))
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Errorf("columns called %d times, want once", calls)
+	}
+	if len(got) != rows || !reflect.DeepEqual(got, want.Rows) {
+		t.Errorf("QueryRows() read %d rows, want the %d rows of Query in the same order", len(got), rows)
+	}
+
+	errStop := errors.New("stop")
+	got = nil
+	err = w.QueryRows(context.Background(), query, func([]*sql.ColumnType) error { return nil }, func([]interface{}) error {
+		if got = append(got, nil); len(got) == queryPageRows+1 {
+			return errStop
+		}
+		return nil
+	})
+	if !errors.Is(err, errStop) || len(got) != queryPageRows+1 {
+		t.Errorf("QueryRows() stopped after %d rows with %v, want %d rows and the callback's error", len(got), err, queryPageRows+1)
+	}
+}
+
+func TestQueryTempSize(t *testing.T) {
+	w, err := NewWriter(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	w.SetQueryLimits(QueryLimits{Threads: 1, MemoryLimit: "32MB", MaxTempSize: "1MB"})
+	_, err = w.Query(context.Background(), "SELECT i, md5(i::VARCHAR) AS s FROM range(3000000) t(i) ORDER BY s")
+	if err == nil || !strings.Contains(err.Error(), "max_temp_directory_size") {
+		t.Fatalf("Query() of a sort larger than the spill limit error = %v, want max_temp_directory_size exceeded", err)
+	}
+}
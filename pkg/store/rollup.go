@@ -0,0 +1,272 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// rawInterval is roughly the period of the fastest broadcast signals, raw metrics are only read when
+// a range needs points closer together than the finest rollup.
+const rawInterval = 10 * time.Millisecond
+
+// rollup is a downsampled copy of runtime_metrics, written next to each exported hour.
+type rollup struct {
+	dirName string
+	view    string
+	unit    string
+	step    time.Duration
+}
+
+var rollups = []rollup{
+	{dirName: "runtime_1s", view: "runtime_metrics_1s", unit: "second", step: time.Second},
+	{dirName: "runtime_1m", view: "runtime_metrics_1m", unit: "minute", step: time.Minute},
+	{dirName: "runtime_1h", view: "runtime_metrics_1h", unit: "hour", step: time.Hour},
+}
+
+// query aggregates the runtime metrics of a time range read from a table or read_parquet into buckets, sum and last_ts
+// are kept so buckets split across files can be combined again.
+func (r rollup) query(from string, start time.Time, end time.Time) string {
+	return fmt.Sprintf(`select date_trunc('%s', ts) as ts, name,
+	min(value) as min, max(value) as max, avg(value) as avg, arg_max(value, ts) as last, count(value) as count,
+	sum(value) as sum, max(ts) as last_ts
+from %s
+where ts >= %s and ts < %s and value is not null
+group by all
+order by ts, name`, r.unit, from, timestampLiteral(start), timestampLiteral(end))
+}
+
+// covers reports whether the rollup has been written for a partition of the runtime archive. An hour counts as
+// covered by the daily rollup file of its day and a day by any rollup hour of it, the compactor rolls both up
+// at the same age.
+func (r rollup) covers(baseDir string, part *partition) bool {
+	day := part.start.Truncate(24 * time.Hour)
+	if hasParquet(dailyDir(baseDir, r.dirName, day)) {
+		return true
+	}
+	if part.daily {
+		return hasParquet(filepath.Dir(partitionDir(baseDir, r.dirName, day)))
+	}
+	return hasParquet(partitionDir(baseDir, r.dirName, part.start))
+}
+
+// BackfillRollups writes the missing rollups of the runtime archive, e.g. of hours exported before the rollups
+// existed or whose rollups failed to write. With dryRun the partitions are only counted, it returns the number of
+// rollup files which are or would be written.
+func (w *Writer) BackfillRollups(dryRun bool) (int, error) {
+	return w.backfillRollups(dryRun, nil)
+}
+
+// backfillRollups is BackfillRollups, skip leaves out rollups of partitions which shouldn't be written.
+func (w *Writer) backfillRollups(dryRun bool, skip func(r rollup, part *partition) bool) (int, error) {
+	type missing struct {
+		r    rollup
+		part *partition
+	}
+	var todo []missing
+	// The runtime files and their rollups appear together under archiveMu when an hour is exported
+	w.archiveMu.RLock()
+	for _, daily := range []bool{false, true} {
+		root := filepath.Join(w.baseDir, "runtime")
+		if daily {
+			root += dailySuffix
+		}
+		parts, err := listPartitions(root, daily)
+		if err != nil {
+			w.archiveMu.RUnlock()
+			return 0, err
+		}
+		for _, part := range parts {
+			for _, r := range rollups {
+				if !r.covers(w.baseDir, part) && (skip == nil || !skip(r, part)) {
+					todo = append(todo, missing{r: r, part: part})
+				}
+			}
+		}
+	}
+	w.archiveMu.RUnlock()
+
+	written := 0
+	// Partitions whose runtime columns are rewritten by a newer migration are rolled up after leafbus migrate
+	outdated := make(map[string]bool)
+	for _, m := range todo {
+		if dryRun {
+			log.Printf("%s has no %s rollup\n", m.part.dir, m.r.dirName)
+			written++
+			continue
+		}
+		version, err := w.minVersion("runtime", m.part.files)
+		if err != nil {
+			return written, err
+		}
+		if version < archiveVersion("runtime") {
+			outdated[m.part.dir] = true
+			continue
+		}
+		dir := partitionDir(w.baseDir, m.r.dirName, m.part.start)
+		if m.part.daily {
+			dir = dailyDir(w.baseDir, m.r.dirName, m.part.start)
+		}
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return written, err
+		}
+		target := filepath.Join(dir, fmt.Sprintf("%s-%d.parquet", m.r.dirName, time.Now().UTC().UnixNano()))
+		// Written like a compaction without sources so a crash leaves no partial file
+		if err := w.replaceFiles(m.r.query(readFiles(m.part.files), m.part.start, m.part.end), archiveVersion(m.r.dirName), nil, target); err != nil {
+			return written, fmt.Errorf("failed to write the %s rollup of %s: %w", m.r.dirName, m.part.dir, err)
+		}
+		written++
+	}
+	if written > 0 && !dryRun {
+		log.Printf("backfilled %d runtime rollups\n", written)
+	}
+	if len(outdated) > 0 {
+		log.Printf("not writing the rollups of %d runtime partitions until leafbus migrate rewrites them\n", len(outdated))
+	}
+	return written, nil
+}
+
+// createView combines the rollup files with the rows still in DuckDB.
+func (r rollup) createView(ctx context.Context, conn *sql.Conn, baseDir string) error {
+	_, err := conn.ExecContext(ctx, fmt.Sprintf("CREATE OR REPLACE TEMP VIEW %s AS\n%s", r.view, r.viewSelect("runtime_metrics", parquetSources(baseDir, r.dirName))))
+	return err
+}
+
+// viewSelect returns the select of the view, with the rows still in DuckDB read from live and the rollup files
+// from sources.
+func (r rollup) viewSelect(live string, sources string) string {
+	current := fmt.Sprintf(`SELECT date_trunc('%s', ts) AS ts, name,
+	min(value) AS min, max(value) AS max, arg_max(value, ts) AS last, count(value) AS count, sum(value) AS sum, max(ts) AS last_ts
+FROM %s
+WHERE value IS NOT NULL
+GROUP BY ALL`, r.unit, live)
+	if sources != "" {
+		current += "\nUNION ALL BY NAME " + sources
+	}
+	return fmt.Sprintf(`SELECT ts, name, min(min) AS min, max(max) AS max, sum(sum) / sum(count) AS avg,
+	arg_max(last, last_ts) AS last, sum(count)::BIGINT AS count, max(last_ts) AS last_ts
+FROM (%s)
+GROUP BY ts, name`, current)
+}
+
+// Resolution is a source of runtime metrics, either the raw rows or one of the rollups.
+type Resolution struct {
+	// View is the view to query, runtime_metrics_all for raw rows or runtime_metrics_1s, _1m or _1h.
+	View string
+	// Step is the bucket size of the rollup, 0 for raw rows.
+	Step time.Duration
+}
+
+// Raw reports whether the resolution reads the raw rows, which have a value column instead of min/max/avg/last/count.
+func (r Resolution) Raw() bool {
+	return r.Step == 0
+}
+
+// ResolutionFor returns the finest resolution which returns at most maxPoints points per metric between start and end.
+func ResolutionFor(start time.Time, end time.Time, maxPoints int) Resolution {
+	if maxPoints <= 0 {
+		maxPoints = 1
+	}
+	needed := end.Sub(start) / time.Duration(maxPoints)
+	if needed <= rawInterval {
+		return Resolution{View: "runtime_metrics_all"}
+	}
+	for _, r := range rollups {
+		if r.step >= needed {
+			return Resolution{View: r.view, Step: r.step}
+		}
+	}
+	last := rollups[len(rollups)-1]
+	return Resolution{View: last.view, Step: last.step}
+}
+
+// MetricPoint is a bucket of a metric, raw rows have the same value in every field and a count of 1.
+type MetricPoint struct {
+	Timestamp time.Time `json:"ts"`
+	Min       float64   `json:"min"`
+	Max       float64   `json:"max"`
+	Avg       float64   `json:"avg"`
+	Last      float64   `json:"last"`
+	Count     int64     `json:"count"`
+}
+
+// MetricRange returns a metric between start and end at the resolution picked by ResolutionFor.
+func (w *Writer) MetricRange(ctx context.Context, name string, start time.Time, end time.Time, maxPoints int) (Resolution, []MetricPoint, error) {
+	res := ResolutionFor(start, end, maxPoints)
+	w.archiveMu.RLock()
+	defer w.archiveMu.RUnlock()
+	conn, err := w.db.Conn(ctx)
+	if err != nil {
+		return res, nil, err
+	}
+	defer func() {
+		if cerr := conn.Close(); cerr != nil {
+			log.Println("failed to close metric range connection:", cerr)
+		}
+	}()
+	if err := w.ensureQueryViews(ctx, conn); err != nil {
+		return res, nil, err
+	}
+	columns := "min, max, avg, last, count"
+	if res.Raw() {
+		columns = "value, value, value, value, 1"
+	}
+	rows, err := conn.QueryContext(ctx, fmt.Sprintf(
+		"SELECT ts, %s FROM %s WHERE name = ? AND ts >= ? AND ts < ? AND %s IS NOT NULL ORDER BY ts",
+		columns,
+		res.View,
+		strings.SplitN(columns, ",", 2)[0],
+	), name, start.UTC(), end.UTC())
+	if err != nil {
+		return res, nil, err
+	}
+	defer rows.Close()
+	points := []MetricPoint{}
+	for rows.Next() {
+		var p MetricPoint
+		if err := rows.Scan(&p.Timestamp, &p.Min, &p.Max, &p.Avg, &p.Last, &p.Count); err != nil {
+			return res, nil, err
+		}
+		p.Timestamp = p.Timestamp.UTC()
+		points = append(points, p)
+	}
+	return res, points, rows.Err()
+}
+
+// MetricNames returns the names of every numeric runtime metric, read from the hourly rollup so it stays fast.
+func (w *Writer) MetricNames(ctx context.Context) ([]string, error) {
+	w.archiveMu.RLock()
+	defer w.archiveMu.RUnlock()
+	conn, err := w.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if cerr := conn.Close(); cerr != nil {
+			log.Println("failed to close metric names connection:", cerr)
+		}
+	}()
+	if err := w.ensureQueryViews(ctx, conn); err != nil {
+		return nil, err
+	}
+	last := rollups[len(rollups)-1]
+	rows, err := conn.QueryContext(ctx, fmt.Sprintf("SELECT DISTINCT name FROM %s ORDER BY name", last.view))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
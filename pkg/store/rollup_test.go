@@ -0,0 +1,133 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackfillRollups(t *testing.T) {
+	t0 := time.Date(2024, time.March, 5, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		// rewrite is a pending migration of the runtime columns
+		rewrite     string
+		wantWritten int
+	}{
+		{name: "legacy archive", wantWritten: 3},
+		{name: "rewrite pending", rewrite: "* REPLACE (value * 2 AS value)", wantWritten: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := NewWriter(t.TempDir(), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Close()
+			// Written before schema versions were stamped and before the rollups existed
+			dir := partitionDir(w.baseDir, "runtime", t0)
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.db.Exec(fmt.Sprintf(`copy (SELECT TIMESTAMP '2024-03-05 12:00:00' + to_seconds(i) AS ts, 'speed' AS name,
+				i::DOUBLE AS value, NULL::VARCHAR AS text, NULL::VARCHAR AS labels, 'metric' AS kind FROM range(120) t(i))
+				to '%s' (format parquet)`, escapePath(filepath.Join(dir, "runtime-1.parquet")))); err != nil {
+				t.Fatal(err)
+			}
+			if tt.rewrite != "" {
+				saved := migrations
+				defer func() { migrations = saved }()
+				migrations = append(migrations[:len(migrations):len(migrations)],
+					migration{version: SchemaVersion + 1, name: "rewrite runtime", rewrite: map[string]string{"runtime": tt.rewrite}})
+			}
+
+			if count, err := w.BackfillRollups(true); err != nil || count != 3 {
+				t.Fatalf("BackfillRollups(dry run) = %d, %v, want 3 missing rollups", count, err)
+			}
+			written, err := w.BackfillRollups(false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if written != tt.wantWritten {
+				t.Fatalf("BackfillRollups() = %d, want %d", written, tt.wantWritten)
+			}
+			if tt.rewrite != "" {
+				if _, err := w.MigrateArchive(false); err != nil {
+					t.Fatal(err)
+				}
+				if written, err = w.BackfillRollups(false); err != nil || written != 3 {
+					t.Fatalf("BackfillRollups() after migrate = %d, %v, want 3", written, err)
+				}
+			}
+			if count, err := w.BackfillRollups(true); err != nil || count != 0 {
+				t.Errorf("BackfillRollups(dry run) after the backfill = %d, %v, want none missing", count, err)
+			}
+
+			files := parquetFiles(t, partitionDir(w.baseDir, "runtime_1m", t0))
+			if len(files) != 1 {
+				t.Fatalf("got runtime_1m files %v, want one", files)
+			}
+			var buckets, count int
+			var max float64
+			if err := w.db.QueryRow("SELECT count(*), sum(count), max(max) FROM "+readFiles(files)).Scan(&buckets, &count, &max); err != nil {
+				t.Fatal(err)
+			}
+			wantMax := 119.0
+			if tt.rewrite != "" {
+				wantMax *= 2
+			}
+			if buckets != 2 || count != 120 || max != wantMax {
+				t.Errorf("runtime_1m has %d buckets of %d values up to %v, want 2 of 120 up to %v", buckets, count, max, wantMax)
+			}
+		})
+	}
+}
+
+func TestRollupViewBounds(t *testing.T) {
+	t0 := time.Date(2024, time.March, 5, 12, 0, 0, 0, time.UTC)
+	w := newTestWriter(t, t0, 120)
+	// The next hour is still in DuckDB, in more rows than a page of writer_table
+	if _, err := w.db.Exec(fmt.Sprintf(`INSERT INTO runtime_metrics (ts, name, value, kind)
+		SELECT TIMESTAMP '2024-03-05 13:00:00' + to_milliseconds(i * 10), CASE WHEN i %% 2 = 0 THEN 'speed' ELSE 'rpm' END, i, 'metric'
+		FROM range(%d) t(i)`, writerPageRows+writerPageRows/2)); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	from, to := t0.Add(30*time.Second), t0.Add(80*time.Minute)
+	for _, r := range rollups {
+		t.Run(r.view, func(t *testing.T) {
+			query := fmt.Sprintf("SELECT * FROM %s WHERE name = 'speed' AND ts BETWEEN $from AND $to ORDER BY ts", r.view)
+			conn, err := w.queryConn(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rewritten, _, err := rewriteQuery(ctx, conn, query, w.historyRanges())
+			conn.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(rewritten, "writer_table('runtime_metrics', since := ") || strings.Contains(rewritten, "\"name\" := ''") {
+				t.Errorf("rewriteQuery() = %s, want the ts and name bounds passed to writer_table", rewritten)
+			}
+			got, err := w.Query(ctx, query, sql.Named("from", from), sql.Named("to", to))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The same bounds as expressions, which aren't pushed down
+			want, err := w.Query(ctx, fmt.Sprintf("SELECT * FROM %s WHERE lower(name) = 'speed' AND ts + INTERVAL 0 SECOND BETWEEN $from AND $to ORDER BY ts", r.view),
+				sql.Named("from", from), sql.Named("to", to))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got.Rows) == 0 || !reflect.DeepEqual(got.Rows, want.Rows) {
+				t.Errorf("bounded %s has %d buckets %v, want %d %v", r.view, len(got.Rows), got.Rows, len(want.Rows), want.Rows)
+			}
+		})
+	}
+}
@@ -3,13 +3,14 @@ package store
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
 	"io/fs"
 	"log"
 	"math"
 	"os"
 	"path/filepath"
-	"regexp"
 	"strings"
 	"sync"
 	"time"
@@ -46,6 +47,67 @@ type StatusRow struct {
 	HydraV3Volts     sql.NullFloat64
 	HydraV3Amps      sql.NullFloat64
 	HydraVinVolts    sql.NullFloat64
+	BatterySOH       sql.NullFloat64
+	BatteryHx        sql.NullFloat64
+	BatteryAh        sql.NullFloat64
+	QCCount          sql.NullInt64
+	L1L2Count        sql.NullInt64
+}
+
+// values returns the fields in the order of statusColumns.
+func (r StatusRow) values() []interface{} {
+	return []interface{}{
+		r.Timestamp,
+		r.Battery12VSOC,
+		r.Battery12VVolts,
+		r.Battery12VAmps,
+		r.Battery12VTempC,
+		r.Battery12VTemps,
+		r.Battery12VStatus,
+		r.HeaterMode,
+		r.HeaterOn,
+		r.HeaterManualOn,
+		r.HeaterMinTempC,
+		r.TractionSOC,
+		r.TractionTempC,
+		r.GPSLat,
+		r.GPSLon,
+		r.ChargerState,
+		r.ChargerSOC,
+		r.HydraV1Volts,
+		r.HydraV1Amps,
+		r.HydraV2Volts,
+		r.HydraV2Amps,
+		r.HydraV3Volts,
+		r.HydraV3Amps,
+		r.HydraVinVolts,
+		r.BatterySOH,
+		r.BatteryHx,
+		r.BatteryAh,
+		r.QCCount,
+		r.L1L2Count,
+	}
+}
+
+// Changes returns the columns of status_hourly that differ from prev, by name, with nil for NULL. The timestamp is
+// only included as ts if something else changed. Compared to an empty row it returns every column that is set.
+func (r StatusRow) Changes(prev StatusRow) map[string]interface{} {
+	changes := make(map[string]interface{})
+	cur, old := r.values(), prev.values()
+	for i := 1; i < len(cur); i++ {
+		if cur[i] == old[i] {
+			continue
+		}
+		value, err := cur[i].(driver.Valuer).Value()
+		if err != nil {
+			value = nil
+		}
+		changes[statusColumns[i]] = value
+	}
+	if len(changes) > 0 {
+		changes[statusColumns[0]] = r.Timestamp
+	}
+	return changes
 }
 
 type RuntimeRow struct {
@@ -57,19 +119,40 @@ type RuntimeRow struct {
 	Kind      sql.NullString
 }
 
+// FrameRow is a raw CAN frame as it was received on a bus.
+type FrameRow struct {
+	Timestamp time.Time
+	Bus       string
+	ID        uint32
+	DLC       uint8
+	Data      []byte
+}
+
+// CellRow is a snapshot of the traction battery cell pair voltages and balancing shunts.
+type CellRow struct {
+	Timestamp time.Time
+	Voltages  []float64
+	Shunts    []bool
+}
+
 type Writer struct {
-	db             *sql.DB
-	baseDir        string
-	statusCh       chan StatusRow
-	runtimeCh      chan RuntimeRow
-	closeCh        chan struct{}
-	wg             sync.WaitGroup
-	statusHourUTC  time.Time
-	runtimeHourUTC time.Time
-	statusDrops    int
-	runtimeDrops   int
-	statusDropLog  time.Time
-	runtimeDropLog time.Time
+	db           *sql.DB
+	baseDir      string
+	status       *batcher[StatusRow]
+	runtime      *batcher[RuntimeRow]
+	frames       *batcher[FrameRow]
+	cells        *batcher[CellRow]
+	closeCh      chan struct{}
+	wg           sync.WaitGroup
+	flushWg      sync.WaitGroup
+	exportMu     sync.Mutex
+	manifestMu   sync.Mutex
+	archiveMu    sync.RWMutex
+	queryMu      sync.Mutex
+	queryDB      *sql.DB
+	queryColumns map[string][]writerColumn
+	queryLimits  QueryLimits
+	blocking     bool
 }
 
 type QueryResult struct {
@@ -92,277 +175,307 @@ func NewWriter(baseDir string, dbPath string) (*Writer, error) {
 		return nil, err
 	}
 	w := &Writer{
-		db:        db,
-		baseDir:   baseDir,
-		statusCh:  make(chan StatusRow, 20000),
-		runtimeCh: make(chan RuntimeRow, 200000),
-		closeCh:   make(chan struct{}),
-	}
+		db:      db,
+		baseDir: baseDir,
+		closeCh: make(chan struct{}),
+	}
+	w.status = newBatcher("status", 20000, 200, 2*time.Second, func(row *StatusRow) *time.Time { return &row.Timestamp }, w.insertStatusBatch, w.flushStatusHour)
+	w.runtime = newBatcher("runtime", 200000, 20000, 100*time.Millisecond, func(row *RuntimeRow) *time.Time { return &row.Timestamp }, w.insertRuntimeBatch, w.flushRuntimeHour)
+	w.frames = newBatcher("frames", 200000, 20000, 100*time.Millisecond, func(row *FrameRow) *time.Time { return &row.Timestamp }, w.insertFramesBatch, w.flushFramesHour)
+	w.cells = newBatcher("cells", 1000, 100, 2*time.Second, func(row *CellRow) *time.Time { return &row.Timestamp }, w.insertCellsBatch, w.flushCellsHour)
 	if err := w.initSchema(); err != nil {
 		return nil, err
 	}
-	w.wg.Add(2)
-	go w.runStatus()
-	go w.runRuntime()
+	w.recoverExports()
+	w.wg.Add(4)
+	go w.status.run(w)
+	go w.runtime.run(w)
+	go w.frames.run(w)
+	go w.cells.run(w)
+	// Hours left in DuckDB by a previous run which lost power are exported in the background
+	completed := time.Now().UTC().Truncate(time.Hour)
+	w.flushWg.Add(1)
+	go func() {
+		defer w.flushWg.Done()
+		w.exportAll(completed)
+		if err := w.exportPendingTrips(); err != nil {
+			log.Println("failed to export trips:", err)
+		}
+	}()
 	return w, nil
 }
 
-func (w *Writer) Query(ctx context.Context, sqlQuery string) (*QueryResult, error) {
-	conn, err := w.db.Conn(ctx)
+// Query runs sqlQuery and collects its result. args are sql.Named values for the query's $name parameters, the ones
+// the query doesn't use are ignored.
+func (w *Writer) Query(ctx context.Context, sqlQuery string, args ...interface{}) (*QueryResult, error) {
+	result := &QueryResult{
+		Rows: make([][]interface{}, 0),
+	}
+	err := w.QueryRows(ctx, sqlQuery, func(cols []*sql.ColumnType) error {
+		for _, col := range cols {
+			result.Columns = append(result.Columns, col.Name())
+		}
+		return nil
+	}, func(values []interface{}) error {
+		row := make([]interface{}, len(values))
+		for i, v := range values {
+			row[i] = normalizeValue(v)
+		}
+		result.Rows = append(result.Rows, row)
+		return nil
+	}, args...)
 	if err != nil {
-		log.Printf("query error: failed to get database connection: %v (query=%q)", err, sqlQuery)
 		return nil, err
 	}
-	defer func() {
-		if cerr := conn.Close(); cerr != nil {
-			log.Println("failed to close query connection:", cerr)
-		}
-	}()
-	if err := w.ensureQueryViews(ctx, conn); err != nil {
-		log.Printf("query error: failed to ensure query views: %v (query=%q)", err, sqlQuery)
+	return result, nil
+}
+
+// HistoryPoint is a stored value of a runtime metric.
+type HistoryPoint struct {
+	Timestamp time.Time
+	Value     float64
+}
+
+// MetricHistory returns the values of a runtime metric from since on, oldest first, including the rows still queued
+// for insertion. With a step the last value of each step long bucket is returned instead of every value, steps of a
+// second or more are read from the rollups.
+func (w *Writer) MetricHistory(ctx context.Context, name string, since time.Time, step time.Duration) ([]HistoryPoint, error) {
+	if err := w.syncRuntime(ctx); err != nil {
 		return nil, err
 	}
-	query := rewriteQueryForHistory(sqlQuery)
-	rows, err := conn.QueryContext(ctx, query)
+	view, ts, value := "runtime_metrics_all", "ts", "value"
+	for _, r := range rollups {
+		if r.step <= step {
+			// A rollup's ts is the start of its bucket, last_ts keeps the live values after it from being repeated
+			view, ts, value = r.view, "last_ts", "last"
+		}
+	}
+	query := fmt.Sprintf("SELECT %s, %s FROM %s WHERE name = ? AND ts >= ? AND %s IS NOT NULL ORDER BY ts", ts, value, view, value)
+	if step > 0 {
+		query = fmt.Sprintf(`SELECT max(%s) AS ts, arg_max(%s, %s) FROM %s WHERE name = ? AND ts >= ? AND %s IS NOT NULL
+			GROUP BY time_bucket(to_microseconds(%d), ts) ORDER BY ts`, ts, value, ts, view, value, step.Microseconds())
+	}
+	w.archiveMu.RLock()
+	defer w.archiveMu.RUnlock()
+	conn, err := w.db.Conn(ctx)
 	if err != nil {
-		log.Printf("query error: failed to execute query: %v (original=%q, rewritten=%q)", err, sqlQuery, query)
 		return nil, err
 	}
 	defer func() {
-		if cerr := rows.Close(); cerr != nil {
-			log.Println("failed to close query rows:", cerr)
+		if cerr := conn.Close(); cerr != nil {
+			log.Println("failed to close metric history connection:", cerr)
 		}
 	}()
-	cols, err := rows.Columns()
-	if err != nil {
-		log.Printf("query error: failed to get columns: %v (query=%q)", err, sqlQuery)
+	if err := w.ensureQueryViews(ctx, conn); err != nil {
 		return nil, err
 	}
-	result := &QueryResult{
-		Columns: cols,
-		Rows:    make([][]interface{}, 0),
+	rows, err := conn.QueryContext(ctx, query, name, since.UTC())
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
+	points := []HistoryPoint{}
 	for rows.Next() {
-		values := make([]interface{}, len(cols))
-		scanTargets := make([]interface{}, len(cols))
-		for i := range values {
-			scanTargets[i] = &values[i]
-		}
-		if err := rows.Scan(scanTargets...); err != nil {
-			log.Printf("query error: failed to scan row: %v (query=%q)", err, sqlQuery)
+		var p HistoryPoint
+		if err := rows.Scan(&p.Timestamp, &p.Value); err != nil {
 			return nil, err
 		}
-		for i, v := range values {
-			values[i] = normalizeValue(v)
-		}
-		result.Rows = append(result.Rows, values)
+		points = append(points, p)
 	}
-	if err := rows.Err(); err != nil {
-		log.Printf("query error: rows error: %v (query=%q)", err, sqlQuery)
-		return nil, err
-	}
-	return result, nil
+	return points, rows.Err()
 }
 
-func (w *Writer) Close() {
-	close(w.closeCh)
-	w.wg.Wait()
-	if err := w.db.Close(); err != nil {
-		log.Println("failed to close duckdb:", err)
+// syncRuntime waits until the queued runtime rows are inserted.
+func (w *Writer) syncRuntime(ctx context.Context) error {
+	done := make(chan struct{})
+	select {
+	case w.runtime.syncCh <- done:
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-}
-
-func (w *Writer) EnqueueStatus(row StatusRow) {
 	select {
-	case w.statusCh <- row:
-	default:
-		w.statusDrops++
-		if time.Since(w.statusDropLog) > 10*time.Second {
-			log.Printf("status buffer full, dropping rows (dropped=%d)\n", w.statusDrops)
-			w.statusDrops = 0
-			w.statusDropLog = time.Now()
-		}
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
-func (w *Writer) EnqueueRuntime(row RuntimeRow) {
-	select {
-	case w.runtimeCh <- row:
-	default:
-		w.runtimeDrops++
-		if time.Since(w.runtimeDropLog) > 10*time.Second {
-			log.Printf("runtime buffer full, dropping rows (dropped=%d)\n", w.runtimeDrops)
-			w.runtimeDrops = 0
-			w.runtimeDropLog = time.Now()
-		}
-	}
-}
-
-func (w *Writer) initSchema() error {
-	stmts := []string{
-		`CREATE TABLE IF NOT EXISTS status_hourly (
-			ts TIMESTAMP,
-			battery12v_soc DOUBLE,
-			battery12v_volts DOUBLE,
-			battery12v_amps DOUBLE,
-			battery12v_temp_c DOUBLE,
-			battery12v_temps VARCHAR,
-			battery12v_status VARCHAR,
-			heater_mode VARCHAR,
-			heater_on BOOLEAN,
-			heater_manual_on BOOLEAN,
-			heater_min_temp_c DOUBLE,
-			traction_soc DOUBLE,
-			traction_temp_c DOUBLE,
-			gps_lat DOUBLE,
-			gps_lon DOUBLE,
-			charger_state VARCHAR,
-			charger_soc DOUBLE,
-			hydra_v1_volts DOUBLE,
-			hydra_v1_amps DOUBLE,
-			hydra_v2_volts DOUBLE,
-			hydra_v2_amps DOUBLE,
-			hydra_v3_volts DOUBLE,
-			hydra_v3_amps DOUBLE,
-			hydra_vin_volts DOUBLE
-		);`,
-		`CREATE TABLE IF NOT EXISTS runtime_metrics (
-			ts TIMESTAMP,
-			name VARCHAR,
-			value DOUBLE,
-			text VARCHAR,
-			labels VARCHAR,
-			kind VARCHAR
-		);`,
-	}
-	for _, stmt := range stmts {
-		if _, err := w.db.Exec(stmt); err != nil {
-			return err
+// QueryRows runs a query like Query but hands each row to row as it is read instead of collecting them, so large
+// exports don't have to fit in memory. columns is called once before the first row. The values passed to row are
+// as scanned from DuckDB, except []byte which becomes a string, and the slice is reused for the next row.
+// The query runs in the separate query database, see openQueryDB, and must be a single SELECT statement. Its result
+// is materialized in a temporary table while compaction is held off, the rows are then read from that table so a
+// slow client doesn't hold up compaction and exports. The table is read queryPageRows at a time since the driver
+// holds a whole result in memory, outside of the query database's memory limit.
+func (w *Writer) QueryRows(ctx context.Context, sqlQuery string, columns func([]*sql.ColumnType) error, row func([]interface{}) error, args ...interface{}) error {
+	conn, err := w.queryConn(ctx)
+	if err != nil {
+		log.Printf("query error: failed to get query database connection: %v (query=%q)", err, sqlQuery)
+		return err
+	}
+	defer func() {
+		if cerr := conn.Close(); cerr != nil {
+			log.Println("failed to close query connection:", cerr)
 		}
+	}()
+	if err := w.materializeQuery(ctx, conn, sqlQuery, args); err != nil {
+		return err
 	}
-	alterStmts := []string{
-		`ALTER TABLE status_hourly ADD COLUMN IF NOT EXISTS hydra_v1_volts DOUBLE`,
-		`ALTER TABLE status_hourly ADD COLUMN IF NOT EXISTS hydra_v1_amps DOUBLE`,
-		`ALTER TABLE status_hourly ADD COLUMN IF NOT EXISTS hydra_v2_volts DOUBLE`,
-		`ALTER TABLE status_hourly ADD COLUMN IF NOT EXISTS hydra_v2_amps DOUBLE`,
-		`ALTER TABLE status_hourly ADD COLUMN IF NOT EXISTS hydra_v3_volts DOUBLE`,
-		`ALTER TABLE status_hourly ADD COLUMN IF NOT EXISTS hydra_v3_amps DOUBLE`,
-		`ALTER TABLE status_hourly ADD COLUMN IF NOT EXISTS hydra_vin_volts DOUBLE`,
-		`ALTER TABLE status_hourly ADD COLUMN IF NOT EXISTS heater_mode VARCHAR`,
-		`ALTER TABLE status_hourly ADD COLUMN IF NOT EXISTS heater_on BOOLEAN`,
-		`ALTER TABLE status_hourly ADD COLUMN IF NOT EXISTS heater_manual_on BOOLEAN`,
-		`ALTER TABLE status_hourly ADD COLUMN IF NOT EXISTS heater_min_temp_c DOUBLE`,
-	}
-	for _, stmt := range alterStmts {
-		if _, err := w.db.Exec(stmt); err != nil {
+	defer func() {
+		// The connection goes back to the pool, the table would otherwise keep its memory and spill files
+		if _, err := conn.ExecContext(context.Background(), "DROP TABLE IF EXISTS "+queryResultTable); err != nil {
+			log.Println("failed to drop query result:", err)
+		}
+	}()
+	var values, scanTargets []interface{}
+	for from := int64(0); ; from += queryPageRows {
+		n, err := readQueryPage(ctx, conn, from, func(cols []*sql.ColumnType) error {
+			if values != nil {
+				return nil
+			}
+			values = make([]interface{}, len(cols))
+			scanTargets = make([]interface{}, len(cols))
+			for i := range values {
+				scanTargets[i] = &values[i]
+			}
+			return columns(cols)
+		}, func(rows *sql.Rows) error {
+			if err := rows.Scan(scanTargets...); err != nil {
+				log.Printf("query error: failed to scan row: %v (query=%q)", err, sqlQuery)
+				return err
+			}
+			for i, v := range values {
+				if b, ok := v.([]byte); ok {
+					values[i] = string(b)
+				}
+			}
+			return row(values)
+		})
+		if err != nil {
 			return err
 		}
+		if n < queryPageRows {
+			return nil
+		}
 	}
-	return nil
 }
 
-func (w *Writer) runStatus() {
-	defer w.wg.Done()
-	flushTicker := time.NewTicker(2 * time.Second)
-	defer flushTicker.Stop()
-
-	statusBatch := make([]StatusRow, 0, 200)
+// queryPageRows is the number of rows QueryRows reads from queryResultTable at a time.
+const queryPageRows = 10000
 
-	flushStatus := func() {
-		if len(statusBatch) == 0 {
-			return
+// readQueryPage passes the columns of queryResultTable and then its rows from rowid from, at most queryPageRows
+// of them, to columns and row. It returns the number of rows read.
+func readQueryPage(ctx context.Context, conn *sql.Conn, from int64, columns func([]*sql.ColumnType) error, row func(*sql.Rows) error) (int, error) {
+	rows, err := conn.QueryContext(ctx, fmt.Sprintf("SELECT * FROM %s WHERE rowid >= %d AND rowid < %d ORDER BY rowid",
+		queryResultTable, from, from+queryPageRows))
+	if err != nil {
+		log.Printf("query error: failed to read query result: %v", err)
+		return 0, err
+	}
+	defer func() {
+		if cerr := rows.Close(); cerr != nil {
+			log.Println("failed to close query rows:", cerr)
 		}
-		if err := w.insertStatusBatch(statusBatch); err != nil {
-			log.Println("failed to insert status batch:", err)
+	}()
+	cols, err := rows.ColumnTypes()
+	if err != nil {
+		log.Printf("query error: failed to get columns: %v", err)
+		return 0, err
+	}
+	if err := columns(cols); err != nil {
+		return 0, err
+	}
+	n := 0
+	for ; rows.Next(); n++ {
+		if err := row(rows); err != nil {
+			return n, err
 		}
-		statusBatch = statusBatch[:0]
 	}
+	if err := rows.Err(); err != nil {
+		log.Printf("query error: rows error: %v", err)
+		return n, err
+	}
+	return n, nil
+}
 
-	for {
-		select {
-		case row := <-w.statusCh:
-			if row.Timestamp.IsZero() {
-				row.Timestamp = time.Now().UTC()
-			} else {
-				row.Timestamp = row.Timestamp.UTC()
-			}
-			rowHour := row.Timestamp.Truncate(time.Hour)
-			if w.statusHourUTC.IsZero() {
-				w.statusHourUTC = rowHour
-			}
-			if rowHour.Before(w.statusHourUTC) {
-				log.Printf("status row hour moved backwards (row=%s current=%s ts=%s)", rowHour.Format(time.RFC3339), w.statusHourUTC.Format(time.RFC3339), row.Timestamp.Format(time.RFC3339))
-			}
-			if rowHour.After(w.statusHourUTC) {
-				flushStatus()
-				go w.flushStatusHour(w.statusHourUTC)
-				w.statusHourUTC = rowHour
-			}
-			statusBatch = append(statusBatch, row)
-			if len(statusBatch) >= 200 {
-				flushStatus()
-			}
-
-		case <-flushTicker.C:
-			flushStatus()
+// queryResultTable holds the result of the query running on a query connection, its rowids follow the order of
+// the query's rows.
+const queryResultTable = "query_result"
 
-		case <-w.closeCh:
-			flushStatus()
-			return
-		}
+// materializeQuery rewrites sqlQuery and stores its result in queryResultTable. The parquet files and writer tables
+// are read under archiveMu so rows aren't missed or seen twice while an hour is exported or files are compacted.
+func (w *Writer) materializeQuery(ctx context.Context, conn *sql.Conn, sqlQuery string, args []interface{}) error {
+	w.archiveMu.RLock()
+	defer w.archiveMu.RUnlock()
+	query, params, err := rewriteQuery(ctx, conn, sqlQuery, w.historyRanges())
+	if err == nil {
+		args, err = bindArgs(params, args)
+	}
+	if err != nil {
+		log.Printf("query error: rejected query: %v (query=%q)", err, sqlQuery)
+		return err
+	}
+	// Cancelled on return to close writer_table scans of a failed query
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if _, err := conn.ExecContext(ctx, "CREATE OR REPLACE TEMP TABLE "+queryResultTable+" AS "+query, args...); err != nil {
+		log.Printf("query error: failed to execute query: %v (original=%q, rewritten=%q)", err, sqlQuery, query)
+		return err
 	}
+	return nil
 }
 
-func (w *Writer) runRuntime() {
-	defer w.wg.Done()
-	flushTicker := time.NewTicker(100 * time.Millisecond)
-	defer flushTicker.Stop()
+// SetBlocking makes the Enqueue methods wait for room in the buffers instead of dropping rows,
+// batch tools which produce rows faster than they can be inserted should enable it before enqueueing.
+func (w *Writer) SetBlocking(blocking bool) {
+	w.blocking = blocking
+}
 
-	runtimeBatch := make([]RuntimeRow, 0, 20000)
+// Flush inserts every queued row and exports all hours still held in DuckDB, including the current hour, to parquet.
+// Rows must not be enqueued while Flush is running.
+func (w *Writer) Flush() {
+	for _, syncCh := range []chan chan struct{}{w.status.syncCh, w.runtime.syncCh, w.frames.syncCh, w.cells.syncCh} {
+		done := make(chan struct{})
+		syncCh <- done
+		<-done
+	}
+	w.flushWg.Wait()
+	w.exportAll(time.Time{})
+}
 
-	flushRuntime := func() {
-		if len(runtimeBatch) == 0 {
-			return
-		}
-		if err := w.insertRuntimeBatch(runtimeBatch); err != nil {
-			log.Println("failed to insert runtime batch:", err)
+// Close inserts every queued row and exports everything held in DuckDB, including the current hour, before closing it.
+func (w *Writer) Close() {
+	close(w.closeCh)
+	w.wg.Wait()
+	w.flushWg.Wait()
+	w.exportAll(time.Time{})
+	w.queryMu.Lock()
+	if w.queryDB != nil {
+		if err := w.queryDB.Close(); err != nil {
+			log.Println("failed to close query database:", err)
 		}
-		runtimeBatch = runtimeBatch[:0]
 	}
+	w.queryMu.Unlock()
+	if err := w.db.Close(); err != nil {
+		log.Println("failed to close duckdb:", err)
+	}
+}
 
-	for {
-		select {
-		case row := <-w.runtimeCh:
-			if row.Timestamp.IsZero() {
-				row.Timestamp = time.Now().UTC()
-			} else {
-				row.Timestamp = row.Timestamp.UTC()
-			}
-			rowHour := row.Timestamp.Truncate(time.Hour)
-			if w.runtimeHourUTC.IsZero() {
-				w.runtimeHourUTC = rowHour
-			}
-			if rowHour.Before(w.runtimeHourUTC) {
-				log.Printf("runtime row hour moved backwards (row=%s current=%s ts=%s)", rowHour.Format(time.RFC3339), w.runtimeHourUTC.Format(time.RFC3339), row.Timestamp.Format(time.RFC3339))
-			}
-			if rowHour.After(w.runtimeHourUTC) {
-				flushRuntime()
-				go w.flushRuntimeHour(w.runtimeHourUTC)
-				w.runtimeHourUTC = rowHour
-			}
-			runtimeBatch = append(runtimeBatch, row)
-			if len(runtimeBatch) >= 20000 {
-				flushRuntime()
-			}
+func (w *Writer) EnqueueStatus(row StatusRow) {
+	w.status.enqueue(row, w.blocking)
+}
 
-		case <-flushTicker.C:
-			flushRuntime()
+func (w *Writer) EnqueueRuntime(row RuntimeRow) {
+	w.runtime.enqueue(row, w.blocking)
+}
 
-		case <-w.closeCh:
-			flushRuntime()
-			return
-		}
-	}
+func (w *Writer) EnqueueFrame(row FrameRow) {
+	w.frames.enqueue(row, w.blocking)
+}
+
+func (w *Writer) EnqueueCells(row CellRow) {
+	w.cells.enqueue(row, w.blocking)
 }
 
 func (w *Writer) insertStatusBatch(rows []StatusRow) error {
@@ -375,8 +488,9 @@ func (w *Writer) insertStatusBatch(rows []StatusRow) error {
 		battery12v_temps, battery12v_status, heater_mode, heater_on, heater_manual_on, heater_min_temp_c,
 		traction_soc, traction_temp_c, gps_lat, gps_lon, charger_state, charger_soc,
 		hydra_v1_volts, hydra_v1_amps, hydra_v2_volts, hydra_v2_amps,
-		hydra_v3_volts, hydra_v3_amps, hydra_vin_volts
-	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+		hydra_v3_volts, hydra_v3_amps, hydra_vin_volts,
+		battery_soh, battery_hx, battery_ah, qc_count, l1l2_count
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
 	if err != nil {
 		_ = tx.Rollback()
 		return err
@@ -387,32 +501,7 @@ func (w *Writer) insertStatusBatch(rows []StatusRow) error {
 		}
 	}()
 	for _, row := range rows {
-		_, err = stmt.Exec(
-			row.Timestamp,
-			row.Battery12VSOC,
-			row.Battery12VVolts,
-			row.Battery12VAmps,
-			row.Battery12VTempC,
-			row.Battery12VTemps,
-			row.Battery12VStatus,
-			row.HeaterMode,
-			row.HeaterOn,
-			row.HeaterManualOn,
-			row.HeaterMinTempC,
-			row.TractionSOC,
-			row.TractionTempC,
-			row.GPSLat,
-			row.GPSLon,
-			row.ChargerState,
-			row.ChargerSOC,
-			row.HydraV1Volts,
-			row.HydraV1Amps,
-			row.HydraV2Volts,
-			row.HydraV2Amps,
-			row.HydraV3Volts,
-			row.HydraV3Amps,
-			row.HydraVinVolts,
-		)
+		_, err = stmt.Exec(row.values()...)
 		if err != nil {
 			_ = tx.Rollback()
 			return err
@@ -455,87 +544,286 @@ func (w *Writer) insertRuntimeBatch(rows []RuntimeRow) error {
 	return tx.Commit()
 }
 
-func (w *Writer) flushStatusHour(hour time.Time) {
-	if hour.IsZero() {
-		return
+func (w *Writer) insertFramesBatch(rows []FrameRow) error {
+	tx, err := w.db.Begin()
+	if err != nil {
+		return err
 	}
-	start := hour.UTC()
-	end := start.Add(time.Hour)
-	dir := filepath.Join(
-		w.baseDir,
-		"status",
-		fmt.Sprintf("year=%04d", start.Year()),
-		fmt.Sprintf("month=%02d", start.Month()),
-		fmt.Sprintf("day=%02d", start.Day()),
-		fmt.Sprintf("hour=%02d", start.Hour()),
-	)
-	if err := os.MkdirAll(dir, 0o755); err != nil {
-		log.Println("failed to create status parquet dir:", err)
+	stmt, err := tx.Prepare(`INSERT INTO can_frames (
+		ts, bus, id, dlc, data
+	) VALUES (?, ?, ?, ?, ?)`)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	defer func() {
+		if cerr := stmt.Close(); cerr != nil {
+			log.Println("failed to close frames stmt:", cerr)
+		}
+	}()
+	for _, row := range rows {
+		_, err = stmt.Exec(
+			row.Timestamp,
+			row.Bus,
+			row.ID,
+			row.DLC,
+			row.Data,
+		)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (w *Writer) insertCellsBatch(rows []CellRow) error {
+	tx, err := w.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`INSERT INTO cell_voltages (
+		ts, voltages, shunts, min_volts, max_volts, avg_volts, delta_mv, active_shunts
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	defer func() {
+		if cerr := stmt.Close(); cerr != nil {
+			log.Println("failed to close cells stmt:", cerr)
+		}
+	}()
+	for _, row := range rows {
+		summary := SummarizeCells(row)
+		var shunts interface{}
+		if row.Shunts != nil {
+			shunts = row.Shunts
+		}
+		_, err = stmt.Exec(
+			row.Timestamp,
+			row.Voltages,
+			shunts,
+			summary.MinVolts,
+			summary.MaxVolts,
+			summary.AvgVolts,
+			summary.DeltaMV,
+			summary.ActiveShunts,
+		)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (w *Writer) goFlush(flush func(time.Time), hour time.Time) {
+	w.flushWg.Add(1)
+	go func() {
+		defer w.flushWg.Done()
+		flush(hour)
+	}()
+}
+
+// exportHours flushes every hour found in a table to parquet, only hours before a non zero before are flushed.
+func (w *Writer) exportHours(dirName string, table string, before time.Time) {
+	query := fmt.Sprintf("select distinct date_trunc('hour', ts) as hour from %s order by hour", table)
+	if !before.IsZero() {
+		query = fmt.Sprintf("select distinct date_trunc('hour', ts) as hour from %s where ts < %s order by hour", table, timestampLiteral(before))
+	}
+	rows, err := w.db.Query(query)
+	if err != nil {
+		log.Printf("failed to find %s hours to export: %v\n", table, err)
 		return
 	}
-	flushUnix := time.Now().UTC().UnixNano()
-	filePath := filepath.Join(dir, fmt.Sprintf("status-%d.parquet", flushUnix))
-	w.copyAndDelete(
-		"status_hourly",
-		start,
-		end,
-		filePath,
-	)
+	var hours []time.Time
+	for rows.Next() {
+		var hour time.Time
+		if err := rows.Scan(&hour); err != nil {
+			log.Printf("failed to scan %s hour: %v\n", table, err)
+			continue
+		}
+		hours = append(hours, hour)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("failed to read %s hours: %v\n", table, err)
+	}
+	_ = rows.Close()
+	for _, hour := range hours {
+		w.flushHour(dirName, table, hour)
+	}
+}
+
+func (w *Writer) flushStatusHour(hour time.Time) {
+	w.flushHour("status", "status_hourly", hour)
 }
 
 func (w *Writer) flushRuntimeHour(hour time.Time) {
+	w.flushHour("runtime", "runtime_metrics", hour)
+}
+
+func (w *Writer) flushFramesHour(hour time.Time) {
+	w.flushHour("frames", "can_frames", hour)
+}
+
+func (w *Writer) flushCellsHour(hour time.Time) {
+	w.flushHour("cells", "cell_voltages", hour)
+}
+
+// flushHour copies one hour of a table into a new parquet file in the Hive partition for that hour
+// and deletes the copied rows, the file is named after the partition directory.
+// Exports are serialized so concurrent flushes never delete the same rows.
+func (w *Writer) flushHour(dirName string, table string, hour time.Time) {
 	if hour.IsZero() {
 		return
 	}
+	w.exportMu.Lock()
+	defer w.exportMu.Unlock()
 	start := hour.UTC()
 	end := start.Add(time.Hour)
-	dir := filepath.Join(
-		w.baseDir,
-		"runtime",
-		fmt.Sprintf("year=%04d", start.Year()),
-		fmt.Sprintf("month=%02d", start.Month()),
-		fmt.Sprintf("day=%02d", start.Day()),
-		fmt.Sprintf("hour=%02d", start.Hour()),
-	)
+	dir := partitionDir(w.baseDir, dirName, start)
 	if err := os.MkdirAll(dir, 0o755); err != nil {
-		log.Println("failed to create runtime parquet dir:", err)
+		log.Printf("failed to create %s parquet dir: %v\n", dirName, err)
 		return
 	}
 	flushUnix := time.Now().UTC().UnixNano()
-	filePath := filepath.Join(dir, fmt.Sprintf("runtime-%d.parquet", flushUnix))
+	filePath := filepath.Join(dir, fmt.Sprintf("%s-%d.parquet", dirName, flushUnix))
 	w.copyAndDelete(
-		"runtime_metrics",
+		dirName,
+		table,
 		start,
 		end,
 		filePath,
 	)
 }
 
-func (w *Writer) copyAndDelete(table string, start, end time.Time, filePath string) {
+func partitionDir(baseDir string, dirName string, hour time.Time) string {
+	return filepath.Join(
+		baseDir,
+		dirName,
+		fmt.Sprintf("year=%04d", hour.Year()),
+		fmt.Sprintf("month=%02d", hour.Month()),
+		fmt.Sprintf("day=%02d", hour.Day()),
+		fmt.Sprintf("hour=%02d", hour.Hour()),
+	)
+}
+
+// copyAndDelete writes the rows of a time range to a temporary file and, in the same transaction, deletes them and
+// records the export in parquet_exports, the file is only renamed into place once that has been committed.
+// Runtime metrics also write their rollups in the same transaction.
+// recoverExports completes or discards exports which were interrupted by a crash.
+func (w *Writer) copyAndDelete(dirName string, table string, start, end time.Time, filePath string) {
 	startLiteral := timestampLiteral(start)
 	endLiteral := timestampLiteral(end)
-	copySQL := fmt.Sprintf(
-		"copy (select * from %s where ts >= %s and ts < %s) to '%s' (format parquet, overwrite false)",
+	tx, err := w.db.Begin()
+	if err != nil {
+		log.Println("failed to begin export:", err)
+		return
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			log.Println("failed to roll back export:", err)
+		}
+	}()
+	var exported []string
+	discard := func() {
+		for _, relPath := range exported {
+			removeTmp(filepath.Join(w.baseDir, filepath.FromSlash(relPath)) + tmpSuffix)
+		}
+	}
+	relPath, err := w.exportQuery(tx, fmt.Sprintf(
+		"select * from %s where ts >= %s and ts < %s",
 		table,
 		startLiteral,
 		endLiteral,
-		escapePath(filePath),
-	)
-	if _, err := w.db.Exec(copySQL); err != nil {
+	), filePath, table, start, archiveVersion(dirName))
+	if err != nil {
 		log.Println("failed to copy parquet:", err)
 		return
 	}
+	if relPath == "" {
+		return
+	}
+	exported = append(exported, relPath)
+	if table == "runtime_metrics" {
+		for _, r := range rollups {
+			rollupPath := filepath.Join(partitionDir(w.baseDir, r.dirName, start), fmt.Sprintf("%s-%d.parquet", r.dirName, time.Now().UTC().UnixNano()))
+			if err := os.MkdirAll(filepath.Dir(rollupPath), 0o755); err != nil {
+				log.Printf("failed to create %s parquet dir: %v\n", r.dirName, err)
+				discard()
+				return
+			}
+			relPath, err := w.exportQuery(tx, r.query("runtime_metrics", start, end), rollupPath, r.view, start, archiveVersion(r.dirName))
+			if err != nil {
+				log.Printf("failed to copy %s parquet: %v\n", r.dirName, err)
+				discard()
+				return
+			}
+			if relPath != "" {
+				exported = append(exported, relPath)
+			}
+		}
+	}
 	deleteSQL := fmt.Sprintf(
 		"delete from %s where ts >= %s and ts < %s",
 		table,
 		startLiteral,
 		endLiteral,
 	)
-	if _, err := w.db.Exec(deleteSQL); err != nil {
+	if _, err := tx.Exec(deleteSQL); err != nil {
 		log.Println("failed to delete after copy:", err)
+		discard()
+		return
+	}
+	// Queries must not run between the rows being deleted and the files appearing
+	w.archiveMu.Lock()
+	defer w.archiveMu.Unlock()
+	if err := tx.Commit(); err != nil {
+		log.Println("failed to commit export:", err)
+		discard()
+		return
+	}
+	for _, relPath := range exported {
+		if err := w.completeExport(relPath); err != nil {
+			log.Println("failed to complete export:", err)
+		}
 	}
 }
 
+// exportQuery copies the result of query to the temporary file of filePath, stamped with the schema version of its
+// archive directory, and records it as a pending export. It returns the path relative to the base dir or "" if the
+// query returned no rows.
+func (w *Writer) exportQuery(tx *sql.Tx, query string, filePath string, table string, hour time.Time, version int) (string, error) {
+	relPath, err := filepath.Rel(w.baseDir, filePath)
+	if err != nil {
+		return "", err
+	}
+	tmpPath := filePath + tmpSuffix
+	res, err := tx.Exec(fmt.Sprintf("copy (%s) to '%s' (%s, overwrite false)", query, escapePath(tmpPath), parquetOptions(version)))
+	if err != nil {
+		removeTmp(tmpPath)
+		return "", err
+	}
+	count, err := res.RowsAffected()
+	if err != nil || count == 0 {
+		removeTmp(tmpPath)
+		return "", err
+	}
+	if err := syncFile(tmpPath); err != nil {
+		removeTmp(tmpPath)
+		return "", err
+	}
+	if _, err := tx.Exec(
+		"insert into parquet_exports (file_path, table_name, hour, row_count, state, exported_at) values (?, ?, ?, ?, ?, ?)",
+		filepath.ToSlash(relPath), table, hour, count, exportPending, time.Now().UTC(),
+	); err != nil {
+		removeTmp(tmpPath)
+		return "", err
+	}
+	return filepath.ToSlash(relPath), nil
+}
+
 func timestampLiteral(ts time.Time) string {
 	return fmt.Sprintf("TIMESTAMP '%s'", ts.UTC().Format("2006-01-02 15:04:05"))
 }
@@ -569,38 +857,51 @@ func normalizeValue(val interface{}) interface{} {
 }
 
 func (w *Writer) ensureQueryViews(ctx context.Context, conn *sql.Conn) error {
-	runtimeParquet := filepath.Join(w.baseDir, "runtime")
-	statusParquet := filepath.Join(w.baseDir, "status")
-	hasRuntimeParquet := hasParquet(runtimeParquet)
-	hasStatusParquet := hasParquet(statusParquet)
-
-	if err := w.createHistoryView(ctx, conn, "runtime_metrics_all", "runtime_metrics", runtimeParquet, hasRuntimeParquet, "*.parquet"); err != nil {
-		return err
+	for _, t := range exportTables {
+		if err := w.createHistoryView(ctx, conn, t.table+"_all", t.table, parquetSources(w.baseDir, t.dirName)); err != nil {
+			return err
+		}
 	}
-	if err := w.createHistoryView(ctx, conn, "status_hourly_all", "status_hourly", statusParquet, hasStatusParquet, "*.parquet"); err != nil {
-		return err
+	for _, r := range rollups {
+		if err := r.createView(ctx, conn, w.baseDir); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func (w *Writer) createHistoryView(ctx context.Context, conn *sql.Conn, viewName string, tableName string, baseDir string, hasParquet bool, fileName string) error {
-	if !hasParquet {
-		_, err := conn.ExecContext(ctx, fmt.Sprintf("CREATE OR REPLACE TEMP VIEW %s AS SELECT %s FROM %s", viewName, columnListForTable(tableName), tableName))
-		return err
-	}
-	hiveGlob := filepath.ToSlash(filepath.Join(baseDir, "year=*", "month=*", "day=*", "hour=*", fileName))
-	stmt := fmt.Sprintf(
-		`CREATE OR REPLACE TEMP VIEW %s AS
-SELECT * FROM %s
-UNION ALL BY NAME SELECT * FROM read_parquet('%s', hive_partitioning=1, union_by_name=true)`,
-		viewName,
-		tableName,
-		escapePath(hiveGlob),
-	)
-	_, err := conn.ExecContext(ctx, stmt)
+func (w *Writer) createHistoryView(ctx context.Context, conn *sql.Conn, viewName string, tableName string, sources string) error {
+	_, err := conn.ExecContext(ctx, fmt.Sprintf("CREATE OR REPLACE TEMP VIEW %s AS\n%s", viewName, historySelect(tableName, tableName, sources)))
 	return err
 }
 
+// historySelect returns the rows of a table read from from, e.g. the table itself, together with its parquet sources.
+func historySelect(tableName string, from string, sources string) string {
+	if sources == "" {
+		return fmt.Sprintf("SELECT %s FROM %s", columnListForTable(tableName), from)
+	}
+	return fmt.Sprintf("SELECT * FROM %s\nUNION ALL BY NAME %s", from, sources)
+}
+
+// parquetSources returns a select of the hourly and daily parquet files of a table, or "" if there are none.
+// The two trees are read separately because read_parquet refuses to mix Hive partitions of different depths.
+func parquetSources(baseDir string, dirName string) string {
+	var selects []string
+	hourly := filepath.Join(baseDir, dirName)
+	if hasParquet(hourly) {
+		selects = append(selects, readParquet(filepath.Join(hourly, "year=*", "month=*", "day=*", "hour=*", "*.parquet")))
+	}
+	daily := filepath.Join(baseDir, dirName+dailySuffix)
+	if hasParquet(daily) {
+		selects = append(selects, readParquet(filepath.Join(daily, "year=*", "month=*", "day=*", "*.parquet")))
+	}
+	return strings.Join(selects, "\nUNION ALL BY NAME ")
+}
+
+func readParquet(glob string) string {
+	return fmt.Sprintf("SELECT * FROM read_parquet('%s', hive_partitioning=1, union_by_name=true)", escapePath(filepath.ToSlash(glob)))
+}
+
 func hasParquet(dir string) bool {
 	found := false
 	_ = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
@@ -619,25 +920,16 @@ func hasParquet(dir string) bool {
 	return found
 }
 
-func rewriteQueryForHistory(sqlQuery string) string {
-	replacements := map[string]string{
-		"runtime_metrics": "runtime_metrics_all",
-		"status_hourly":   "status_hourly_all",
-	}
-	out := sqlQuery
-	for src, dst := range replacements {
-		re := regexp.MustCompile(`\b` + regexp.QuoteMeta(src) + `\b`)
-		out = re.ReplaceAllString(out, dst)
-	}
-	return out
-}
-
 func columnListForTable(tableName string) string {
 	switch tableName {
 	case "status_hourly":
 		return strings.Join(statusColumns, ", ")
 	case "runtime_metrics":
 		return strings.Join(runtimeColumns, ", ")
+	case "can_frames":
+		return strings.Join(frameColumns, ", ")
+	case "cell_voltages":
+		return strings.Join(cellColumns, ", ")
 	default:
 		return "*"
 	}
@@ -668,6 +960,11 @@ var statusColumns = []string{
 	"hydra_v3_volts",
 	"hydra_v3_amps",
 	"hydra_vin_volts",
+	"battery_soh",
+	"battery_hx",
+	"battery_ah",
+	"qc_count",
+	"l1l2_count",
 }
 
 var runtimeColumns = []string{
@@ -678,3 +975,22 @@ var runtimeColumns = []string{
 	"labels",
 	"kind",
 }
+
+var frameColumns = []string{
+	"ts",
+	"bus",
+	"id",
+	"dlc",
+	"data",
+}
+
+var cellColumns = []string{
+	"ts",
+	"voltages",
+	"shunts",
+	"min_volts",
+	"max_volts",
+	"avg_volts",
+	"delta_mv",
+	"active_shunts",
+}
@@ -0,0 +1,62 @@
+package store
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStatusRowChanges(t *testing.T) {
+	ts := time.Date(2024, time.March, 5, 12, 0, 0, 0, time.UTC)
+	prev := StatusRow{
+		Timestamp:     ts.Add(-time.Minute),
+		Battery12VSOC: sql.NullFloat64{Float64: 80, Valid: true},
+		HeaterMode:    sql.NullString{String: "auto", Valid: true},
+		HeaterOn:      sql.NullBool{Bool: false, Valid: true},
+		QCCount:       sql.NullInt64{Int64: 12, Valid: true},
+	}
+	tests := []struct {
+		name string
+		row  StatusRow
+		prev StatusRow
+		want map[string]interface{}
+	}{
+		{
+			name: "unchanged",
+			row:  StatusRow{Timestamp: ts, Battery12VSOC: prev.Battery12VSOC, HeaterMode: prev.HeaterMode, HeaterOn: prev.HeaterOn, QCCount: prev.QCCount},
+			prev: prev,
+			want: map[string]interface{}{},
+		},
+		{
+			name: "changed values",
+			row: StatusRow{
+				Timestamp:     ts,
+				Battery12VSOC: sql.NullFloat64{Float64: 79.5, Valid: true},
+				HeaterMode:    prev.HeaterMode,
+				HeaterOn:      sql.NullBool{Bool: true, Valid: true},
+				QCCount:       sql.NullInt64{Int64: 13, Valid: true},
+			},
+			prev: prev,
+			want: map[string]interface{}{"ts": ts, "battery12v_soc": 79.5, "heater_on": true, "qc_count": int64(13)},
+		},
+		{
+			name: "value cleared",
+			row:  StatusRow{Timestamp: ts, Battery12VSOC: prev.Battery12VSOC, HeaterOn: prev.HeaterOn, QCCount: prev.QCCount},
+			prev: prev,
+			want: map[string]interface{}{"ts": ts, "heater_mode": nil},
+		},
+		{
+			name: "compared to an empty row",
+			row:  prev,
+			want: map[string]interface{}{"ts": prev.Timestamp, "battery12v_soc": 80.0, "heater_mode": "auto", "heater_on": false, "qc_count": int64(12)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.row.Changes(tt.prev); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Changes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,395 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// tripsDir is the parquet directory of the trips, each day's trips are written to a single file of its daily
+// partition which is replaced whenever a trip of the day is stored.
+const tripsDir = "trips"
+
+// Trip is a drive from key on to key off, values which were not seen during the trip are nil.
+type Trip struct {
+	ID               int64     `json:"id"`
+	Start            time.Time `json:"start"`
+	End              time.Time `json:"end"`
+	StartOdometer    *float64  `json:"start_odometer,omitempty"`
+	EndOdometer      *float64  `json:"end_odometer,omitempty"`
+	DistanceMiles    *float64  `json:"distance_miles,omitempty"`
+	GPSDistanceMiles *float64  `json:"gps_distance_miles,omitempty"`
+	StartGids        *float64  `json:"start_gids,omitempty"`
+	EndGids          *float64  `json:"end_gids,omitempty"`
+	// GidsUsed and SOCDelta are start minus end, positive when energy was used.
+	GidsUsed *float64 `json:"gids_used,omitempty"`
+	StartSOC *float64 `json:"start_soc,omitempty"`
+	EndSOC   *float64 `json:"end_soc,omitempty"`
+	SOCDelta *float64 `json:"soc_delta,omitempty"`
+	StartLat *float64 `json:"start_lat,omitempty"`
+	StartLon *float64 `json:"start_lon,omitempty"`
+	EndLat   *float64 `json:"end_lat,omitempty"`
+	EndLon   *float64 `json:"end_lon,omitempty"`
+	// KWhUsed is the energy drawn from the traction battery, KWhRegen the energy put back and KWhNet the difference.
+	KWhUsed     *float64 `json:"kwh_used,omitempty"`
+	KWhRegen    *float64 `json:"kwh_regen,omitempty"`
+	KWhNet      *float64 `json:"kwh_net,omitempty"`
+	ClimateKWh  *float64 `json:"climate_kwh,omitempty"`
+	MilesPerKWh *float64 `json:"miles_per_kwh,omitempty"`
+}
+
+var tripColumns = []string{
+	"id",
+	"start_ts",
+	"end_ts",
+	"start_odometer",
+	"end_odometer",
+	"distance_miles",
+	"gps_distance_miles",
+	"start_gids",
+	"end_gids",
+	"gids_used",
+	"start_soc",
+	"end_soc",
+	"soc_delta",
+	"start_lat",
+	"start_lon",
+	"end_lat",
+	"end_lon",
+	"kwh_used",
+	"kwh_regen",
+	"kwh_net",
+	"climate_kwh",
+	"miles_per_kwh",
+}
+
+func (t *Trip) scanTargets() []interface{} {
+	return []interface{}{
+		&t.ID,
+		&t.Start,
+		&t.End,
+		&t.StartOdometer,
+		&t.EndOdometer,
+		&t.DistanceMiles,
+		&t.GPSDistanceMiles,
+		&t.StartGids,
+		&t.EndGids,
+		&t.GidsUsed,
+		&t.StartSOC,
+		&t.EndSOC,
+		&t.SOCDelta,
+		&t.StartLat,
+		&t.StartLon,
+		&t.EndLat,
+		&t.EndLon,
+		&t.KWhUsed,
+		&t.KWhRegen,
+		&t.KWhNet,
+		&t.ClimateKWh,
+		&t.MilesPerKWh,
+	}
+}
+
+// InsertTrip stores a finished trip and returns its id. Trips are kept in DuckDB, the day of the trip is also
+// written to the trips archive.
+func (w *Writer) InsertTrip(ctx context.Context, trip Trip) (int64, error) {
+	var id int64
+	err := w.db.QueryRowContext(ctx, `INSERT INTO trips (
+		start_ts, end_ts, start_odometer, end_odometer, distance_miles, gps_distance_miles,
+		start_gids, end_gids, gids_used, start_soc, end_soc, soc_delta,
+		start_lat, start_lon, end_lat, end_lon,
+		kwh_used, kwh_regen, kwh_net, climate_kwh, miles_per_kwh
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT (start_ts) DO NOTHING
+	RETURNING id`,
+		trip.Start.UTC(),
+		trip.End.UTC(),
+		trip.StartOdometer,
+		trip.EndOdometer,
+		trip.DistanceMiles,
+		trip.GPSDistanceMiles,
+		trip.StartGids,
+		trip.EndGids,
+		trip.GidsUsed,
+		trip.StartSOC,
+		trip.EndSOC,
+		trip.SOCDelta,
+		trip.StartLat,
+		trip.StartLon,
+		trip.EndLat,
+		trip.EndLon,
+		trip.KWhUsed,
+		trip.KWhRegen,
+		trip.KWhNet,
+		trip.ClimateKWh,
+		trip.MilesPerKWh,
+	).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("trip starting at %s already exists", trip.Start.UTC().Format(time.RFC3339))
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := w.exportTrips([]time.Time{trip.Start}); err != nil {
+		log.Println("failed to export trips:", err)
+	}
+	return id, nil
+}
+
+// ListTrips returns the trips which started between start and end, oldest first.
+func (w *Writer) ListTrips(ctx context.Context, start time.Time, end time.Time) ([]Trip, error) {
+	rows, err := w.db.QueryContext(ctx, fmt.Sprintf(
+		"SELECT %s FROM trips WHERE start_ts >= ? AND start_ts < ? ORDER BY start_ts",
+		strings.Join(tripColumns, ", "),
+	), start.UTC(), end.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	trips := []Trip{}
+	for rows.Next() {
+		var trip Trip
+		if err := rows.Scan(trip.scanTargets()...); err != nil {
+			return nil, err
+		}
+		trip.Start = trip.Start.UTC()
+		trip.End = trip.End.UTC()
+		trips = append(trips, trip)
+	}
+	return trips, rows.Err()
+}
+
+// GetTrip returns a single trip, ok is false if there is no trip with the id.
+func (w *Writer) GetTrip(ctx context.Context, id int64) (Trip, bool, error) {
+	var trip Trip
+	err := w.db.QueryRowContext(ctx, fmt.Sprintf(
+		"SELECT %s FROM trips WHERE id = ?",
+		strings.Join(tripColumns, ", "),
+	), id).Scan(trip.scanTargets()...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Trip{}, false, nil
+	}
+	if err != nil {
+		return Trip{}, false, err
+	}
+	trip.Start = trip.Start.UTC()
+	trip.End = trip.End.UTC()
+	return trip, true, nil
+}
+
+// BackfillTrips rebuilds trips from the key on/off log rows in runtime_metrics, trips which already exist are skipped.
+func (w *Writer) BackfillTrips(ctx context.Context) (int64, error) {
+	count, err := w.backfillTrips(ctx)
+	// The days are exported once archiveMu is released as the files are swapped under it
+	if eerr := w.exportPendingTrips(); eerr != nil {
+		log.Println("failed to export trips:", eerr)
+	}
+	return count, err
+}
+
+func (w *Writer) backfillTrips(ctx context.Context) (int64, error) {
+	w.archiveMu.RLock()
+	defer w.archiveMu.RUnlock()
+	conn, err := w.db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if cerr := conn.Close(); cerr != nil {
+			log.Println("failed to close backfill connection:", cerr)
+		}
+	}()
+	if err := w.ensureQueryViews(ctx, conn); err != nil {
+		return 0, err
+	}
+	// The GPS path distance can't be rebuilt from the sparse status rows so only the odometer distance is filled in.
+	res, err := conn.ExecContext(ctx, `INSERT INTO trips (
+		start_ts, end_ts, start_odometer, end_odometer, distance_miles,
+		start_gids, end_gids, gids_used, start_soc, end_soc, soc_delta,
+		start_lat, start_lon, end_lat, end_lon
+	)
+	WITH keys AS (
+		SELECT ts, text,
+			lead(ts) OVER (ORDER BY ts) AS next_ts,
+			lead(text) OVER (ORDER BY ts) AS next_text
+		FROM runtime_metrics_all
+		WHERE kind = 'log' AND name = 'key'
+	), spans AS (
+		SELECT ts AS start_ts, next_ts AS end_ts
+		FROM keys
+		WHERE text = 'Key Turned On' AND next_text = 'Key Turned Off'
+	), metrics AS (
+		SELECT s.start_ts,
+			arg_min(m.value, m.ts) FILTER (WHERE m.name = 'odometer') AS start_odometer,
+			arg_max(m.value, m.ts) FILTER (WHERE m.name = 'odometer') AS end_odometer,
+			arg_min(m.value, m.ts) FILTER (WHERE m.name = 'gids') AS start_gids,
+			arg_max(m.value, m.ts) FILTER (WHERE m.name = 'gids') AS end_gids,
+			arg_min(m.value, m.ts) FILTER (WHERE m.name = 'soc') AS start_soc,
+			arg_max(m.value, m.ts) FILTER (WHERE m.name = 'soc') AS end_soc
+		FROM spans s
+		LEFT JOIN runtime_metrics_all m
+			ON m.ts >= s.start_ts AND m.ts <= s.end_ts
+			AND m.kind = 'metric' AND m.name IN ('odometer', 'gids', 'soc') AND m.value IS NOT NULL
+		GROUP BY s.start_ts
+	), gps AS (
+		SELECT s.start_ts,
+			arg_min(g.gps_lat, g.ts) AS start_lat,
+			arg_min(g.gps_lon, g.ts) AS start_lon,
+			arg_max(g.gps_lat, g.ts) AS end_lat,
+			arg_max(g.gps_lon, g.ts) AS end_lon
+		FROM spans s
+		LEFT JOIN status_hourly_all g
+			ON g.ts >= s.start_ts AND g.ts <= s.end_ts
+			AND g.gps_lat IS NOT NULL AND g.gps_lon IS NOT NULL
+		GROUP BY s.start_ts
+	)
+	SELECT s.start_ts, s.end_ts,
+		m.start_odometer, m.end_odometer, m.end_odometer - m.start_odometer,
+		m.start_gids, m.end_gids, m.start_gids - m.end_gids,
+		m.start_soc, m.end_soc, m.start_soc - m.end_soc,
+		g.start_lat, g.start_lon, g.end_lat, g.end_lon
+	FROM spans s
+	JOIN metrics m USING (start_ts)
+	JOIN gps g USING (start_ts)
+	ORDER BY s.start_ts
+	ON CONFLICT (start_ts) DO NOTHING`)
+	if err != nil {
+		return 0, err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	// Days whose trips change are written to the archive again
+	if _, err := conn.ExecContext(ctx, `DELETE FROM parquet_exports
+		WHERE table_name = 'trips' AND hour IN (SELECT DISTINCT date_trunc('day', start_ts) FROM trips WHERE kwh_used IS NULL)`); err != nil {
+		return count, err
+	}
+	if err := summarizeTrips(ctx, conn); err != nil {
+		return count, fmt.Errorf("failed to summarize backfilled trips: %w", err)
+	}
+	return count, nil
+}
+
+// summarizeTrips fills in the energy summary of trips which don't have one from the battery and climate metrics,
+// integrating the same way as the live trip tracker: each sample holds until the next one for at most 5 seconds.
+func summarizeTrips(ctx context.Context, conn *sql.Conn) error {
+	_, err := conn.ExecContext(ctx, `UPDATE trips SET
+		kwh_used = s.kwh_used,
+		kwh_regen = s.kwh_regen,
+		kwh_net = s.kwh_used - s.kwh_regen,
+		climate_kwh = s.climate_kwh,
+		miles_per_kwh = CASE WHEN s.kwh_used - s.kwh_regen > 0
+			THEN coalesce(trips.distance_miles, trips.gps_distance_miles) / (s.kwh_used - s.kwh_regen) END
+	FROM (
+		WITH pending AS (
+			SELECT id, start_ts, end_ts FROM trips WHERE kwh_used IS NULL
+		), metrics AS (
+			SELECT p.id, m.ts, m.name, m.value
+			FROM pending p
+			JOIN runtime_metrics_all m
+				ON m.ts >= p.start_ts AND m.ts <= p.end_ts
+				AND m.kind = 'metric' AND m.value IS NOT NULL
+				AND m.name IN ('battery_volts', 'battery_amps', 'climate_control_kw')
+		), amps AS (
+			SELECT id, ts, value AS amps FROM metrics WHERE name = 'battery_amps'
+		), volts AS (
+			SELECT id, ts, value AS volts FROM metrics WHERE name = 'battery_volts'
+		), power AS (
+			SELECT a.id, a.ts, a.amps * v.volts / 1000 AS kw, 'battery' AS kind
+			FROM amps a ASOF JOIN volts v ON a.id = v.id AND a.ts >= v.ts
+			UNION ALL
+			SELECT id, ts, value AS kw, 'climate' AS kind FROM metrics WHERE name = 'climate_control_kw'
+		), samples AS (
+			SELECT id, kind, kw,
+				epoch(lead(ts) OVER (PARTITION BY id, kind ORDER BY ts) - ts) AS dt
+			FROM power
+		)
+		SELECT p.id,
+			coalesce(sum(kw * dt / 3600) FILTER (WHERE kind = 'battery' AND kw > 0 AND dt <= 5), 0) AS kwh_used,
+			coalesce(sum(-kw * dt / 3600) FILTER (WHERE kind = 'battery' AND kw < 0 AND dt <= 5), 0) AS kwh_regen,
+			coalesce(sum(kw * dt / 3600) FILTER (WHERE kind = 'climate' AND dt <= 5), 0) AS climate_kwh
+		FROM pending p
+		LEFT JOIN samples s ON s.id = p.id
+		GROUP BY p.id
+	) s
+	WHERE trips.id = s.id`)
+	return err
+}
+
+// exportPendingTrips exports the days with trips which haven't been written to the trips archive, e.g. because
+// trips were stored before the archive existed or an export failed.
+func (w *Writer) exportPendingTrips() error {
+	rows, err := w.db.Query(`SELECT DISTINCT date_trunc('day', start_ts) AS day FROM trips
+		WHERE date_trunc('day', start_ts) NOT IN (SELECT hour FROM parquet_exports WHERE table_name = 'trips')
+		ORDER BY day`)
+	if err != nil {
+		return err
+	}
+	var days []time.Time
+	for rows.Next() {
+		var day time.Time
+		if err := rows.Scan(&day); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		days = append(days, day)
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	return w.exportTrips(days)
+}
+
+// exportTrips writes the trips of each day in days to the daily partition of the trips archive, replacing the file
+// written before. The export is recorded in parquet_exports once the file is in place, a day without a record is
+// exported again by exportPendingTrips.
+func (w *Writer) exportTrips(days []time.Time) error {
+	w.exportMu.Lock()
+	defer w.exportMu.Unlock()
+	for _, day := range days {
+		day = day.UTC().Truncate(24 * time.Hour)
+		if _, err := w.db.Exec("DELETE FROM parquet_exports WHERE table_name = 'trips' AND hour = ?", day); err != nil {
+			return err
+		}
+		where := fmt.Sprintf("start_ts >= %s AND start_ts < %s", timestampLiteral(day), timestampLiteral(day.Add(24*time.Hour)))
+		var count int64
+		if err := w.db.QueryRow("SELECT count(*) FROM trips WHERE " + where).Scan(&count); err != nil {
+			return err
+		}
+		if count == 0 {
+			continue
+		}
+		dir := dailyDir(w.baseDir, tripsDir, day)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+		files, err := filepath.Glob(filepath.Join(dir, "*.parquet"))
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dir, fmt.Sprintf("%s-%d.parquet", tripsDir, time.Now().UTC().UnixNano()))
+		// ts is the start of the trip so the file can be checked and compacted like the other tables
+		query := fmt.Sprintf("SELECT start_ts AS ts, * FROM trips WHERE %s ORDER BY start_ts", where)
+		if err := w.replaceFiles(query, archiveVersion(tripsDir), files, target); err != nil {
+			return fmt.Errorf("failed to write the trips of %s: %w", day.Format("2006-01-02"), err)
+		}
+		relPath, err := filepath.Rel(w.baseDir, target)
+		if err != nil {
+			return err
+		}
+		if _, err := w.db.Exec(
+			"INSERT INTO parquet_exports (file_path, table_name, hour, row_count, state, exported_at) VALUES (?, ?, ?, ?, ?, ?)",
+			filepath.ToSlash(relPath), "trips", day, count, exportDone, time.Now().UTC(),
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackfillTrips(t *testing.T) {
+	baseDir := t.TempDir()
+	w, err := NewWriter(baseDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	w.SetBlocking(true)
+
+	t0 := time.Date(2024, time.March, 5, 12, 50, 0, 0, time.UTC)
+	at := func(seconds int) time.Time {
+		return t0.Add(time.Duration(seconds) * time.Second)
+	}
+	key := func(seconds int, text string) {
+		w.EnqueueRuntime(RuntimeRow{Timestamp: at(seconds), Name: "key", Text: sql.NullString{String: text, Valid: true}, Kind: sql.NullString{String: "log", Valid: true}})
+	}
+	metric := func(seconds int, name string, value float64) {
+		w.EnqueueRuntime(RuntimeRow{Timestamp: at(seconds), Name: name, Value: sql.NullFloat64{Float64: value, Valid: true}, Kind: sql.NullString{String: "metric", Valid: true}})
+	}
+	gps := func(seconds int, lat float64, lon float64) {
+		w.EnqueueStatus(StatusRow{Timestamp: at(seconds), GPSLat: sql.NullFloat64{Float64: lat, Valid: true}, GPSLon: sql.NullFloat64{Float64: lon, Valid: true}})
+	}
+
+	// The first trip spans the hour boundary, 40 kW for 3 seconds and 20 kW of regen for 2 seconds
+	key(0, "Key Turned On")
+	metric(0, "odometer", 1000)
+	metric(0, "gids", 200)
+	metric(0, "soc", 80)
+	metric(0, "battery_volts", 400)
+	gps(0, 45, -122)
+	metric(1, "battery_amps", 100)
+	metric(4, "battery_amps", -50)
+	metric(6, "battery_amps", 0)
+	metric(6, "climate_control_kw", 1.8)
+	metric(8, "climate_control_kw", 0)
+	// A gap longer than 5 seconds is not integrated
+	metric(20, "battery_amps", 100)
+	metric(900, "battery_amps", 0)
+	metric(900, "odometer", 1010)
+	metric(900, "gids", 180)
+	metric(900, "soc", 75)
+	gps(900, 45.1, -122.1)
+	key(901, "Key Turned Off")
+	// Rows outside the trip are left out
+	metric(1000, "odometer", 1011)
+	// The second trip has no metrics, the last key on has no key off
+	key(2000, "Key Turned On")
+	key(2100, "Key Turned Off")
+	key(3000, "Key Turned On")
+	w.Flush()
+
+	var live int
+	if err := w.db.QueryRow("SELECT count(*) FROM runtime_metrics").Scan(&live); err != nil {
+		t.Fatal(err)
+	}
+	if live != 0 {
+		t.Fatalf("%d runtime rows left in DuckDB, want every hour archived", live)
+	}
+
+	ctx := context.Background()
+	count, err := w.BackfillTrips(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("BackfillTrips() = %d, want 2", count)
+	}
+	if count, err := w.BackfillTrips(ctx); err != nil || count != 0 {
+		t.Fatalf("second BackfillTrips() = %d, %v, want 0", count, err)
+	}
+
+	trips, err := w.ListTrips(ctx, t0.Add(-time.Hour), t0.Add(24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trips) != 2 {
+		t.Fatalf("got %d trips, want 2", len(trips))
+	}
+	first := trips[0]
+	if !first.Start.Equal(at(0)) || !first.End.Equal(at(901)) {
+		t.Errorf("first trip from %s to %s, want %s to %s", first.Start, first.End, at(0), at(901))
+	}
+	checks := []struct {
+		name string
+		got  *float64
+		want float64
+	}{
+		{"distance_miles", first.DistanceMiles, 10},
+		{"gids_used", first.GidsUsed, 20},
+		{"soc_delta", first.SOCDelta, 5},
+		{"start_lat", first.StartLat, 45},
+		{"end_lon", first.EndLon, -122.1},
+		{"kwh_used", first.KWhUsed, 40 * 3.0 / 3600},
+		{"kwh_regen", first.KWhRegen, 20 * 2.0 / 3600},
+		{"kwh_net", first.KWhNet, (40*3.0 - 20*2.0) / 3600},
+		{"climate_kwh", first.ClimateKWh, 1.8 * 2 / 3600},
+		{"miles_per_kwh", first.MilesPerKWh, 10 / ((40*3.0 - 20*2.0) / 3600)},
+	}
+	for _, c := range checks {
+		if c.got == nil {
+			t.Errorf("%s is nil, want %v", c.name, c.want)
+			continue
+		}
+		if math.Abs(*c.got-c.want) > 1e-9 {
+			t.Errorf("%s = %v, want %v", c.name, *c.got, c.want)
+		}
+	}
+	second := trips[1]
+	if !second.Start.Equal(at(2000)) || second.DistanceMiles != nil || second.KWhUsed == nil || *second.KWhUsed != 0 || second.MilesPerKWh != nil {
+		t.Errorf("second trip = %+v, want no distance and no energy used", second)
+	}
+
+	// Both trips are in the day's file of the trips archive
+	files, err := filepath.Glob(filepath.Join(dailyDir(baseDir, tripsDir, t0), "*.parquet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("got trips files %v, want one", files)
+	}
+	var archived int
+	var kwhUsed float64
+	if err := w.db.QueryRow(fmt.Sprintf("SELECT count(*), sum(kwh_used) FROM read_parquet('%s') WHERE ts = start_ts", escapePath(files[0]))).Scan(&archived, &kwhUsed); err != nil {
+		t.Fatal(err)
+	}
+	if archived != 2 || math.Abs(kwhUsed-40*3.0/3600) > 1e-9 {
+		t.Errorf("archived %d trips using %v kWh, want 2 using %v", archived, kwhUsed, 40*3.0/3600)
+	}
+}
@@ -0,0 +1,401 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/slim-bean/leafbus/pkg/s3"
+)
+
+const (
+	defaultUploadInterval = 15 * time.Minute
+	// defaultPartSize splits files into multipart uploads so an upload interrupted by leaving the Wi-Fi resumes
+	// from the last finished part, S3 requires at least 5MB per part.
+	defaultPartSize = 16 << 20
+	minPartSize     = 5 << 20
+
+	uploadPending = "uploading"
+	uploadDone    = "uploaded"
+	// uploadRemoved files were removed locally after their upload, their objects are always kept
+	uploadRemoved = "removed"
+)
+
+type UploadConfig struct {
+	// Interval between upload runs, defaults to 15 minutes.
+	Interval time.Duration
+	// Prefix is prepended to the archive path of every object key.
+	Prefix string
+	// SSID only uploads while the Wi-Fi network reported by iwgetid is this one, e.g. the home network.
+	// Uploads are always skipped while the bucket is unreachable.
+	SSID string
+	// PartSize of multipart uploads, files up to this size are sent in one request. Defaults to 16MB.
+	PartSize int64
+	// DeleteAfter is keyed by the parquet directory like the compaction retention, uploaded partitions which
+	// ended longer ago than the duration are removed locally.
+	DeleteAfter map[string]time.Duration
+}
+
+// Uploader mirrors the finished partitions of the parquet archive to an S3-compatible bucket in the background.
+type Uploader struct {
+	w      *Writer
+	client *s3.Client
+	cfg    UploadConfig
+
+	online bool
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// uploadRecord is the row of parquet_uploads tracking the upload of a file.
+type uploadRecord struct {
+	sha256   string
+	bytes    int64
+	uploadID string
+	parts    []s3.Part
+	state    string
+}
+
+func NewUploader(w *Writer, client *s3.Client, cfg UploadConfig) *Uploader {
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultUploadInterval
+	}
+	if cfg.PartSize <= 0 {
+		cfg.PartSize = defaultPartSize
+	}
+	if cfg.PartSize < minPartSize {
+		cfg.PartSize = minPartSize
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	u := &Uploader{
+		w:      w,
+		client: client,
+		cfg:    cfg,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	u.wg.Add(1)
+	go u.run()
+	return u
+}
+
+// Close stops the uploader, an upload in progress is resumed from its last part the next time.
+func (u *Uploader) Close() {
+	u.cancel()
+	u.wg.Wait()
+}
+
+func (u *Uploader) run() {
+	defer u.wg.Done()
+	ticker := time.NewTicker(u.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		if err := u.Upload(u.ctx, time.Now().UTC()); err != nil && u.ctx.Err() == nil {
+			log.Println("parquet upload failed:", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-u.ctx.Done():
+			return
+		}
+	}
+}
+
+// Upload sends every partition which ended before now and isn't uploaded yet, objects of files which were
+// compacted away are removed from the bucket once their replacement is uploaded.
+func (u *Uploader) Upload(ctx context.Context, now time.Time) error {
+	if !u.reachable(ctx) {
+		return nil
+	}
+	for _, dirName := range archiveDirs() {
+		hours, err := listPartitions(filepath.Join(u.w.baseDir, dirName), false)
+		if err != nil {
+			return err
+		}
+		days, err := listPartitions(filepath.Join(u.w.baseDir, dirName+dailySuffix), true)
+		if err != nil {
+			return err
+		}
+		for _, part := range append(hours, days...) {
+			if part.end.After(now) {
+				continue
+			}
+			if err := u.syncPartition(ctx, dirName, part, now); err != nil {
+				return fmt.Errorf("failed to upload %s: %w", part.dir, err)
+			}
+		}
+	}
+	return nil
+}
+
+// reachable reports whether uploads can run, it logs when the bucket becomes reachable or unreachable.
+func (u *Uploader) reachable(ctx context.Context) bool {
+	online := true
+	if u.cfg.SSID != "" {
+		out, err := exec.CommandContext(ctx, "iwgetid", "-r").Output()
+		online = err == nil && strings.TrimSpace(string(out)) == u.cfg.SSID
+	}
+	if online {
+		headCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		err := u.client.HeadBucket(headCtx)
+		cancel()
+		online = err == nil
+		if err != nil && u.online {
+			log.Println("parquet upload bucket is unreachable:", err)
+		}
+	}
+	if online && !u.online {
+		log.Println("parquet upload bucket is reachable, uploading archive")
+	}
+	u.online = online
+	return online
+}
+
+func (u *Uploader) syncPartition(ctx context.Context, dirName string, part *partition, now time.Time) error {
+	rel, err := filepath.Rel(u.w.baseDir, part.dir)
+	if err != nil {
+		return err
+	}
+	manifest, err := ReadManifest(part.dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	listed := make(map[string]ManifestEntry)
+	for _, entry := range manifest.Files {
+		listed[entry.File] = entry
+	}
+
+	// A daily partition replaces the hours of its day, their objects are cleaned up with it
+	prefixes := []string{filepath.ToSlash(rel) + "/"}
+	if part.daily {
+		hours := filepath.Join(dirName, strings.TrimPrefix(rel, dirName+dailySuffix))
+		prefixes = append(prefixes, filepath.ToSlash(hours)+"/")
+	}
+	records, err := u.records(prefixes)
+	if err != nil {
+		return err
+	}
+
+	complete := true
+	for _, file := range part.files {
+		entry, ok := listed[filepath.Base(file)]
+		if !ok {
+			if entry, err = describeFile(u.w.db, file); err != nil {
+				if os.IsNotExist(err) {
+					complete = false
+					continue
+				}
+				return err
+			}
+		}
+		fileRel := filepath.ToSlash(filepath.Join(rel, entry.File))
+		rec := records[fileRel]
+		if rec.state == uploadDone && rec.sha256 == entry.SHA256 {
+			continue
+		}
+		if err := u.uploadFile(ctx, fileRel, file, entry, rec); err != nil {
+			if os.IsNotExist(err) {
+				complete = false
+				continue
+			}
+			return err
+		}
+		log.Printf("uploaded %s (%d bytes)\n", fileRel, entry.Bytes)
+	}
+	if !complete {
+		// The partition was compacted while uploading, it is cleaned up in the next run
+		return nil
+	}
+
+	for fileRel, rec := range records {
+		if rec.state == uploadRemoved {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(u.w.baseDir, filepath.FromSlash(fileRel))); !os.IsNotExist(err) {
+			continue
+		}
+		if rec.state == uploadPending && rec.uploadID != "" {
+			if err := u.client.AbortMultipartUpload(ctx, u.key(fileRel), rec.uploadID); err != nil && !s3.IsNoSuchUpload(err) {
+				return err
+			}
+		}
+		if err := u.client.DeleteObject(ctx, u.key(fileRel)); err != nil {
+			return err
+		}
+		if _, err := u.w.db.Exec("DELETE FROM parquet_uploads WHERE file_path = ?", fileRel); err != nil {
+			return err
+		}
+		log.Printf("removed uploaded %s which was compacted\n", fileRel)
+	}
+
+	if after, ok := u.cfg.DeleteAfter[dirName]; ok && after > 0 && !part.end.After(now.Add(-after)) {
+		u.removeLocal(dirName, part)
+	}
+	return nil
+}
+
+// uploadFile uploads a file as one object, large files are uploaded in parts and resumed from rec if it is the
+// same file.
+func (u *Uploader) uploadFile(ctx context.Context, fileRel string, file string, entry ManifestEntry, rec uploadRecord) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	key := u.key(fileRel)
+	if size <= u.cfg.PartSize {
+		if err := u.client.PutObject(ctx, key, io.NewSectionReader(f, 0, size), size); err != nil {
+			return err
+		}
+		return u.saveRecord(fileRel, uploadRecord{sha256: entry.SHA256, bytes: size, state: uploadDone})
+	}
+
+	if rec.state != uploadPending || rec.sha256 != entry.SHA256 || rec.uploadID == "" {
+		uploadID, err := u.client.CreateMultipartUpload(ctx, key)
+		if err != nil {
+			return err
+		}
+		rec = uploadRecord{sha256: entry.SHA256, bytes: size, uploadID: uploadID, state: uploadPending}
+		if err := u.saveRecord(fileRel, rec); err != nil {
+			return err
+		}
+	} else if len(rec.parts) > 0 {
+		log.Printf("resuming upload of %s at part %d\n", fileRel, len(rec.parts)+1)
+	}
+	for offset := int64(len(rec.parts)) * u.cfg.PartSize; offset < size; offset += u.cfg.PartSize {
+		n := u.cfg.PartSize
+		if size-offset < n {
+			n = size - offset
+		}
+		number := len(rec.parts) + 1
+		etag, err := u.client.UploadPart(ctx, key, rec.uploadID, number, io.NewSectionReader(f, offset, n), n)
+		if s3.IsNoSuchUpload(err) {
+			// The bucket dropped the unfinished upload, start over
+			return u.uploadFile(ctx, fileRel, file, entry, uploadRecord{})
+		}
+		if err != nil {
+			return err
+		}
+		rec.parts = append(rec.parts, s3.Part{Number: number, ETag: etag})
+		if err := u.saveRecord(fileRel, rec); err != nil {
+			return err
+		}
+	}
+	err = u.client.CompleteMultipartUpload(ctx, key, rec.uploadID, rec.parts)
+	if s3.IsNoSuchUpload(err) {
+		return u.uploadFile(ctx, fileRel, file, entry, uploadRecord{})
+	}
+	if err != nil {
+		return err
+	}
+	return u.saveRecord(fileRel, uploadRecord{sha256: entry.SHA256, bytes: size, state: uploadDone})
+}
+
+// removeLocal removes an uploaded partition from the archive unless it is being compacted.
+func (u *Uploader) removeLocal(dirName string, part *partition) {
+	u.w.archiveMu.Lock()
+	defer u.w.archiveMu.Unlock()
+	entries, err := os.ReadDir(part.dir)
+	if err != nil {
+		log.Printf("failed to read uploaded %s partition: %v\n", dirName, err)
+		return
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), compactSuffix) || strings.HasSuffix(entry.Name(), sourcesSuffix) {
+			return
+		}
+	}
+	for _, file := range part.files {
+		rel, _ := filepath.Rel(u.w.baseDir, file)
+		if _, err := u.w.db.Exec(
+			"UPDATE parquet_uploads SET state = ?, updated_at = ? WHERE file_path = ?",
+			uploadRemoved, time.Now().UTC(), filepath.ToSlash(rel),
+		); err != nil {
+			log.Printf("failed to mark %s removed: %v\n", rel, err)
+			return
+		}
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			log.Printf("failed to remove uploaded %s parquet: %v\n", dirName, err)
+		}
+	}
+	if err := os.Remove(filepath.Join(part.dir, ManifestFile)); err != nil && !os.IsNotExist(err) {
+		log.Printf("failed to remove uploaded %s manifest: %v\n", dirName, err)
+	}
+	root := filepath.Join(u.w.baseDir, dirName)
+	if part.daily {
+		root = filepath.Join(u.w.baseDir, dirName+dailySuffix)
+	}
+	removeEmptyDirs(part.dir, root)
+	log.Printf("removed uploaded %s partition %s\n", dirName, part.dir)
+}
+
+func (u *Uploader) key(fileRel string) string {
+	return path.Join(u.cfg.Prefix, fileRel)
+}
+
+// records returns the uploads of the files under the archive path prefixes.
+func (u *Uploader) records(prefixes []string) (map[string]uploadRecord, error) {
+	records := make(map[string]uploadRecord)
+	for _, prefix := range prefixes {
+		rows, err := u.w.db.Query(
+			"SELECT file_path, sha256, bytes, upload_id, parts, state FROM parquet_uploads WHERE starts_with(file_path, ?)",
+			prefix,
+		)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var fileRel string
+			var uploadID, parts sql.NullString
+			var rec uploadRecord
+			if err := rows.Scan(&fileRel, &rec.sha256, &rec.bytes, &uploadID, &parts, &rec.state); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			rec.uploadID = uploadID.String
+			if parts.String != "" {
+				if err := json.Unmarshal([]byte(parts.String), &rec.parts); err != nil {
+					log.Printf("ignoring invalid upload parts of %s: %v\n", fileRel, err)
+					rec.parts = nil
+					rec.uploadID = ""
+				}
+			}
+			records[fileRel] = rec
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+func (u *Uploader) saveRecord(fileRel string, rec uploadRecord) error {
+	parts, err := json.Marshal(rec.parts)
+	if err != nil {
+		return err
+	}
+	_, err = u.w.db.Exec(
+		"INSERT OR REPLACE INTO parquet_uploads (file_path, sha256, bytes, upload_id, parts, state, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		fileRel, rec.sha256, rec.bytes, rec.uploadID, string(parts), rec.state, time.Now().UTC(),
+	)
+	return err
+}
@@ -0,0 +1,229 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/slim-bean/leafbus/pkg/s3"
+)
+
+// fakeS3 is an in-memory bucket with the calls used by the uploader, failPart fails the upload of a part number
+// once and expire drops the unfinished multipart uploads.
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	uploads  map[string]map[int][]byte
+	created  int
+	parts    []int
+	failPart int
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: make(map[string][]byte), uploads: make(map[string]map[int][]byte)}
+}
+
+func (f *fakeS3) expire() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.uploads = make(map[string]map[int][]byte)
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=test/") {
+		http.Error(w, "unsigned request", http.StatusForbidden)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	query := r.URL.Query()
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	noSuchUpload := func() {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "<Error><Code>NoSuchUpload</Code><Message>The specified upload does not exist.</Message></Error>")
+	}
+	switch {
+	case r.Method == http.MethodHead:
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.created++
+		id := fmt.Sprintf("upload-%d", f.created)
+		f.uploads[id] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			noSuchUpload()
+			return
+		}
+		if number == f.failPart {
+			f.failPart = 0
+			http.Error(w, "connection lost", http.StatusInternalServerError)
+			return
+		}
+		f.parts = append(f.parts, number)
+		parts[number] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"etag-%d"`, number))
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			noSuchUpload()
+			return
+		}
+		var complete struct {
+			Parts []s3.Part `xml:"Part"`
+		}
+		if err := xml.Unmarshal(body, &complete); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var object []byte
+		for i, part := range complete.Parts {
+			if part.Number != i+1 || part.ETag != fmt.Sprintf(`"etag-%d"`, i+1) {
+				http.Error(w, "invalid part", http.StatusBadRequest)
+				return
+			}
+			object = append(object, parts[part.Number]...)
+		}
+		f.objects[key] = object
+		delete(f.uploads, query.Get("uploadId"))
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	case r.Method == http.MethodPut:
+		f.objects[key] = body
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+	default:
+		http.Error(w, "unexpected request", http.StatusMethodNotAllowed)
+	}
+}
+
+func TestUploadResume(t *testing.T) {
+	t0 := time.Date(2024, time.March, 5, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		// interrupt happens between the failed and the next run
+		interrupt   func(f *fakeS3)
+		wantCreated int
+		wantParts   []int
+	}{
+		{
+			name:        "resumes after the last uploaded part",
+			interrupt:   func(f *fakeS3) {},
+			wantCreated: 1,
+			wantParts:   []int{1, 2, 3},
+		},
+		{
+			name:        "starts over when the upload expired",
+			interrupt:   (*fakeS3).expire,
+			wantCreated: 2,
+			wantParts:   []int{1, 1, 2, 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := NewWriter(t.TempDir(), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Close()
+			dir := partitionDir(w.baseDir, "runtime", t0)
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			// Hashes don't compress, the file is split into three parts
+			file := filepath.Join(dir, "runtime-1.parquet")
+			writeParquet(t, w, `SELECT TIMESTAMP '2024-03-05 12:00:00' + to_milliseconds(i) AS ts, 'speed' AS name, i::DOUBLE AS value,
+				sha256(i::VARCHAR) AS text, NULL::VARCHAR AS labels, 'metric' AS kind FROM range(160000) t(i)`, file)
+			data, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(data) <= 2*minPartSize || len(data) > 3*minPartSize {
+				t.Fatalf("test file has %d bytes, want three parts of %d", len(data), minPartSize)
+			}
+
+			f := newFakeS3()
+			f.failPart = 2
+			server := httptest.NewServer(f)
+			defer server.Close()
+			client, err := s3.NewClient(s3.Config{Endpoint: server.URL, Bucket: "bucket", AccessKey: "test", SecretKey: "secret"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			u := &Uploader{w: w, client: client, cfg: UploadConfig{Prefix: "car", PartSize: minPartSize}}
+			ctx := context.Background()
+			now := t0.Add(24 * time.Hour)
+
+			if err := u.Upload(ctx, now); err == nil {
+				t.Fatal("Upload() with a failing part succeeded")
+			}
+			fileRel := "runtime/year=2024/month=03/day=05/hour=12/runtime-1.parquet"
+			records, err := u.records([]string{"runtime/"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec := records[fileRel]; rec.state != uploadPending || len(rec.parts) != 1 {
+				t.Fatalf("record after the failed part = %+v, want pending with one part", rec)
+			}
+
+			tt.interrupt(f)
+			if err := u.Upload(ctx, now); err != nil {
+				t.Fatal(err)
+			}
+			if f.created != tt.wantCreated || fmt.Sprint(f.parts) != fmt.Sprint(tt.wantParts) {
+				t.Errorf("created %d uploads of parts %v, want %d of %v", f.created, f.parts, tt.wantCreated, tt.wantParts)
+			}
+			if got := f.objects["car/"+fileRel]; !bytes.Equal(got, data) {
+				t.Errorf("uploaded object has %d bytes, want the %d bytes of the file", len(got), len(data))
+			}
+			if records, err = u.records([]string{"runtime/"}); err != nil {
+				t.Fatal(err)
+			}
+			if rec := records[fileRel]; rec.state != uploadDone || rec.bytes != int64(len(data)) {
+				t.Errorf("record after the upload = %+v, want uploaded", rec)
+			}
+
+			// Nothing is sent again, a compacted file replaces the object of the one it was merged from
+			f.parts = nil
+			if err := u.Upload(ctx, now); err != nil {
+				t.Fatal(err)
+			}
+			if len(f.parts) != 0 {
+				t.Errorf("uploaded parts %v again", f.parts)
+			}
+			compacted := filepath.Join(dir, "runtime-2.parquet")
+			writeParquet(t, w, "SELECT * FROM "+readFiles([]string{file})+" LIMIT 10", compacted)
+			if err := os.Remove(file); err != nil {
+				t.Fatal(err)
+			}
+			if err := u.Upload(ctx, now); err != nil {
+				t.Fatal(err)
+			}
+			var keys []string
+			for key := range f.objects {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			if want := "[car/runtime/year=2024/month=03/day=05/hour=12/runtime-2.parquet]"; fmt.Sprint(keys) != want {
+				t.Errorf("objects %v, want %s", keys, want)
+			}
+		})
+	}
+}
@@ -1,12 +1,17 @@
 package stream
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/slim-bean/leafbus/pkg/store"
 )
 
 var (
@@ -29,6 +34,8 @@ type FollowStream interface {
 type Follower struct {
 	Pub  chan *Data
 	Rate int64
+	// Dropped counts the values not published because Pub was full.
+	Dropped atomic.Uint64
 }
 
 func GetData() *Data {
@@ -57,14 +64,47 @@ func (d *Data) String() string {
 //	return b
 //}
 
+// History replays stored values of a metric, see store.Writer.MetricHistory.
+type History interface {
+	MetricHistory(ctx context.Context, name string, since time.Time, step time.Duration) ([]store.HistoryPoint, error)
+}
+
+const (
+	// maxSince is how far back a stream can be backfilled.
+	maxSince = 24 * time.Hour
+	// maxBackfill is the most values replayed, longer histories are downsampled to fit.
+	maxBackfill = 5000
+	// backfillBuffer holds the live values published while the history is replayed.
+	backfillBuffer = 1024
+	historyTimeout = 30 * time.Second
+)
+
+// backfillNotice tells the client how the replayed history differs from the live stream. Unlike values it has a
+// type instead of a ts.
+type backfillNotice struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+	// Step is the spacing in milliseconds the history was downsampled to when it is coarser than the rate.
+	Step int64 `json:"step,omitempty"`
+	// Dropped is the number of live values lost while the history was sent.
+	Dropped uint64 `json:"dropped,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
 type Streamer struct {
 	handler FollowStream
+	history History
 }
 
 func NewStreamer(handler FollowStream) *Streamer {
 	return &Streamer{handler: handler}
 }
 
+// SetHistory enables the since parameter of Handler, it must be called before the server starts.
+func (s *Streamer) SetHistory(history History) {
+	s.history = history
+}
+
 func setupResponse(w *http.ResponseWriter, req *http.Request) {
 	(*w).Header().Set("Access-Control-Allow-Origin", "*")
 	(*w).Header().Set("Access-Control-Allow-Methods", "GET")
@@ -105,21 +145,55 @@ func (s *Streamer) Handler(w http.ResponseWriter, r *http.Request) {
 		rate = rt
 	}
 
+	var since time.Time
+	if sinceQuery := query.Get("since"); sinceQuery != "" {
+		if s.history == nil {
+			http.Error(w, "since is not supported without a store", http.StatusBadRequest)
+			return
+		}
+		st, err := parseSince(sinceQuery, time.Now())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Unable to parse since: %v", err), http.StatusBadRequest)
+			return
+		}
+		since = st
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	enc := json.NewEncoder(w)
+	pubSize := 1
+	if !since.IsZero() {
+		pubSize = backfillBuffer
+	}
 	f := &Follower{
-		Pub:  make(chan *Data, 1),
+		Pub:  make(chan *Data, pubSize),
 		Rate: rate,
 	}
+	// Following before the history is read means nothing published in between is missed, the live values
+	// already replayed from the history are skipped below.
 	s.handler.Follow(name, f)
 	defer func() {
 		log.Println("Unfollowing")
 		s.handler.Unfollow(name, f)
 		close(f.Pub)
 	}()
+	var replayed int64
+	if !since.IsZero() {
+		replayed = s.backfill(r.Context(), enc, name, since, rate)
+		if dropped := f.Dropped.Load(); dropped > 0 {
+			if err := enc.Encode(backfillNotice{Type: "backfill", Name: name, Dropped: dropped}); err != nil {
+				log.Println("Failed to marshal backfill notice to json stream:", err)
+			}
+		}
+		flusher.Flush()
+	}
 	for {
 		select {
 		case d := <-f.Pub:
+			if d.Timestamp <= replayed {
+				reuseData(d)
+				continue
+			}
 			err := enc.Encode(d)
 			if err != nil {
 				log.Println("Failed to marshal data object to json stream:", err)
@@ -133,6 +207,58 @@ func (s *Streamer) Handler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// backfill writes the stored values of name from since on, at most one per rate milliseconds like the live values,
+// and returns the timestamp of the last one. A long history is downsampled further and failures are logged, both are
+// reported to the client with a backfillNotice before the stream goes on with the live values.
+func (s *Streamer) backfill(ctx context.Context, enc *json.Encoder, name string, since time.Time, rate int64) int64 {
+	step := time.Duration(rate) * time.Millisecond
+	if minStep := time.Since(since) / maxBackfill; minStep > step {
+		step = minStep.Truncate(time.Millisecond)
+		if err := enc.Encode(backfillNotice{Type: "backfill", Name: name, Step: step.Milliseconds()}); err != nil {
+			return 0
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, historyTimeout)
+	defer cancel()
+	points, err := s.history.MetricHistory(ctx, name, since, step)
+	if err != nil {
+		log.Printf("Failed to replay history of %v: %v", name, err)
+		if err := enc.Encode(backfillNotice{Type: "backfill", Name: name, Error: err.Error()}); err != nil {
+			log.Println("Failed to marshal backfill notice to json stream:", err)
+		}
+		return 0
+	}
+	var last int64
+	d := &Data{Name: name}
+	for _, p := range points {
+		d.Timestamp = p.Timestamp.UnixNano() / int64(time.Millisecond)
+		d.Val = p.Value
+		if err := enc.Encode(d); err != nil {
+			break
+		}
+		last = d.Timestamp
+	}
+	return last
+}
+
+// parseSince accepts a duration before now such as 10m, unix milliseconds or RFC3339.
+func parseSince(raw string, now time.Time) (time.Time, error) {
+	var since time.Time
+	if d, err := time.ParseDuration(raw); err == nil {
+		since = now.Add(-d)
+	} else if ms, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		since = time.UnixMilli(ms)
+	} else if t, err := time.Parse(time.RFC3339Nano, raw); err == nil {
+		since = t
+	} else {
+		return time.Time{}, fmt.Errorf("use a duration, unix milliseconds or RFC3339")
+	}
+	if now.Sub(since) > maxSince {
+		return time.Time{}, fmt.Errorf("at most %v can be replayed", maxSince)
+	}
+	return since, nil
+}
+
 func reuseData(data *Data) {
 	dataPool.Put(data)
 }
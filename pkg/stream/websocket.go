@@ -0,0 +1,340 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Policy decides what happens to values of a metric while the client is behind.
+type Policy string
+
+const (
+	// Drop sends every value in order and drops new ones while the connection's queue is full.
+	Drop Policy = "drop"
+	// Coalesce only keeps the latest unsent value of the metric.
+	Coalesce Policy = "coalesce"
+)
+
+const (
+	// pubSize is the capacity of the channel the followers of one connection publish to.
+	pubSize = 256
+	// queueSize is the number of values of drop metrics a connection holds before dropping.
+	queueSize = 1024
+	// maxSubscriptions limits the metrics followed over one connection.
+	maxSubscriptions = 256
+
+	writeTimeout  = 10 * time.Second
+	pongTimeout   = 60 * time.Second
+	pingInterval  = 30 * time.Second
+	statsInterval = time.Second
+)
+
+var upgrader = websocket.Upgrader{
+	// The HTTP streams allow any origin as well
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// wsRequest is a message from the client: {"op":"subscribe","name":"speed","rate":100,"policy":"coalesce"} or
+// {"op":"unsubscribe","name":"speed"}. rate is the minimum number of milliseconds between values, as for Handler.
+type wsRequest struct {
+	Op     string `json:"op"`
+	Name   string `json:"name"`
+	Rate   int64  `json:"rate"`
+	Policy Policy `json:"policy"`
+}
+
+// wsMessage is a message to the client. Data messages carry the values sent since the last one, dropped messages
+// the total number of values not sent for each metric whose count changed, and error messages a rejected request.
+type wsMessage struct {
+	Type    string            `json:"type"`
+	Values  []*Data           `json:"values,omitempty"`
+	Dropped map[string]uint64 `json:"dropped,omitempty"`
+	Error   string            `json:"error,omitempty"`
+	Name    string            `json:"name,omitempty"`
+}
+
+type subscription struct {
+	follower *Follower
+	policy   Policy
+	// pending is the latest unsent value of a coalesce metric.
+	pending *Data
+	// dropped counts the values dropped or replaced here, the follower counts the ones it couldn't publish.
+	dropped  uint64
+	reported uint64
+}
+
+func (s *subscription) totalDropped() uint64 {
+	return s.dropped + s.follower.Dropped.Load()
+}
+
+type wsConn struct {
+	handler FollowStream
+	conn    *websocket.Conn
+	pub     chan *Data
+	wake    chan struct{}
+
+	mu     sync.Mutex
+	subs   map[string]*subscription
+	queue  []*Data
+	errors []wsMessage
+}
+
+// WebSocketHandler serves many metrics over one WebSocket. The client subscribes and unsubscribes with wsRequest
+// messages and receives batches of values, the dropped counts once a second while they change and errors.
+func (s *Streamer) WebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("Failed to upgrade stream websocket:", err)
+		return
+	}
+	c := &wsConn{
+		handler: s.handler,
+		conn:    conn,
+		pub:     make(chan *Data, pubSize),
+		wake:    make(chan struct{}, 1),
+		subs:    make(map[string]*subscription),
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		defer cancel()
+		c.readLoop()
+	}()
+	go c.pump(ctx)
+	if err := c.writeLoop(ctx); err != nil {
+		log.Println("Stream websocket closed:", err)
+	}
+	// readLoop can subscribe until the connection is closed, the followers are removed once it has returned
+	conn.Close()
+	<-readDone
+	c.unfollowAll()
+}
+
+func (c *wsConn) readLoop() {
+	c.conn.SetReadLimit(4096)
+	c.conn.SetReadDeadline(time.Now().Add(pongTimeout))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongTimeout))
+	})
+	for {
+		var req wsRequest
+		if err := c.conn.ReadJSON(&req); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Println("Failed to read stream websocket request:", err)
+			}
+			return
+		}
+		if err := c.handle(req); err != nil {
+			c.mu.Lock()
+			c.errors = append(c.errors, wsMessage{Type: "error", Error: err.Error(), Name: req.Name})
+			c.mu.Unlock()
+			c.notify()
+		}
+	}
+}
+
+func (c *wsConn) handle(req wsRequest) error {
+	if req.Name == "" {
+		return fmt.Errorf("missing name")
+	}
+	switch req.Op {
+	case "subscribe":
+		if req.Policy == "" {
+			req.Policy = Drop
+		}
+		if req.Policy != Drop && req.Policy != Coalesce {
+			return fmt.Errorf("unknown policy %q, use %q or %q", req.Policy, Drop, Coalesce)
+		}
+		if req.Rate < 0 {
+			return fmt.Errorf("rate must be >= 0")
+		}
+		c.mu.Lock()
+		_, exists := c.subs[req.Name]
+		count := len(c.subs)
+		c.mu.Unlock()
+		if !exists && count >= maxSubscriptions {
+			return fmt.Errorf("at most %d metrics can be followed", maxSubscriptions)
+		}
+		// Subscribing again replaces the rate and policy
+		c.unfollow(req.Name)
+		sub := &subscription{
+			follower: &Follower{Pub: c.pub, Rate: req.Rate},
+			policy:   req.Policy,
+		}
+		c.mu.Lock()
+		c.subs[req.Name] = sub
+		c.mu.Unlock()
+		c.handler.Follow(req.Name, sub.follower)
+	case "unsubscribe":
+		c.unfollow(req.Name)
+	default:
+		return fmt.Errorf("unknown op %q, use subscribe or unsubscribe", req.Op)
+	}
+	return nil
+}
+
+func (c *wsConn) unfollow(name string) {
+	c.mu.Lock()
+	sub, ok := c.subs[name]
+	delete(c.subs, name)
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+	c.handler.Unfollow(name, sub.follower)
+	if sub.pending != nil {
+		reuseData(sub.pending)
+	}
+}
+
+func (c *wsConn) unfollowAll() {
+	c.mu.Lock()
+	names := make([]string, 0, len(c.subs))
+	for name := range c.subs {
+		names = append(names, name)
+	}
+	c.mu.Unlock()
+	for _, name := range names {
+		c.unfollow(name)
+	}
+}
+
+// pump moves published values to the queue or the pending value of their metric, so publishing isn't held up by
+// a slow client.
+func (c *wsConn) pump(ctx context.Context) {
+	for {
+		select {
+		case d := <-c.pub:
+			c.add(d)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *wsConn) add(d *Data) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sub, ok := c.subs[d.Name]
+	switch {
+	case !ok:
+		// Published just before it was unsubscribed
+		reuseData(d)
+		return
+	case sub.policy == Coalesce:
+		if sub.pending != nil {
+			reuseData(sub.pending)
+			sub.dropped++
+		}
+		sub.pending = d
+	case len(c.queue) >= queueSize:
+		reuseData(d)
+		sub.dropped++
+		return
+	default:
+		c.queue = append(c.queue, d)
+	}
+	c.notify()
+}
+
+func (c *wsConn) notify() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (c *wsConn) writeLoop(ctx context.Context) error {
+	ping := time.NewTicker(pingInterval)
+	defer ping.Stop()
+	stats := time.NewTicker(statsInterval)
+	defer stats.Stop()
+	for {
+		select {
+		case <-c.wake:
+			if err := c.writePending(); err != nil {
+				return err
+			}
+		case <-stats.C:
+			if dropped := c.droppedChanges(); len(dropped) > 0 {
+				if err := c.write(wsMessage{Type: "dropped", Dropped: dropped}); err != nil {
+					return err
+				}
+			}
+		case <-ping.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout)); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// writePending sends the errors and then the queued and coalesced values as one data message.
+func (c *wsConn) writePending() error {
+	c.mu.Lock()
+	errs := c.errors
+	c.errors = nil
+	values := make([]*Data, 0, len(c.queue))
+	for _, d := range c.queue {
+		if _, ok := c.subs[d.Name]; ok {
+			values = append(values, d)
+		} else {
+			reuseData(d)
+		}
+	}
+	c.queue = c.queue[:0]
+	for _, sub := range c.subs {
+		if sub.pending != nil {
+			values = append(values, sub.pending)
+			sub.pending = nil
+		}
+	}
+	c.mu.Unlock()
+	defer func() {
+		for _, d := range values {
+			reuseData(d)
+		}
+	}()
+	for _, msg := range errs {
+		if err := c.write(msg); err != nil {
+			return err
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	return c.write(wsMessage{Type: "data", Values: values})
+}
+
+func (c *wsConn) droppedChanges() map[string]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var changed map[string]uint64
+	for name, sub := range c.subs {
+		total := sub.totalDropped()
+		if total == sub.reported {
+			continue
+		}
+		if changed == nil {
+			changed = make(map[string]uint64)
+		}
+		changed[name] = total
+		sub.reported = total
+	}
+	return changed
+}
+
+func (c *wsConn) write(msg wsMessage) error {
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return c.conn.WriteJSON(msg)
+}
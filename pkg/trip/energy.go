@@ -0,0 +1,39 @@
+package trip
+
+import (
+	"time"
+)
+
+// maxSampleGap limits how long a power sample is assumed to last, longer gaps mean frames were missed.
+const maxSampleGap = 5 * time.Second
+
+// integrator sums power samples in kW into kWh, each sample holds until the next one.
+type integrator struct {
+	last    time.Time
+	lastKW  float64
+	hasLast bool
+
+	positive float64
+	negative float64
+}
+
+func (i *integrator) add(ts time.Time, kw float64) {
+	if i.hasLast {
+		dt := ts.Sub(i.last)
+		if dt > 0 && dt <= maxSampleGap {
+			kwh := i.lastKW * dt.Hours()
+			if kwh >= 0 {
+				i.positive += kwh
+			} else {
+				i.negative -= kwh
+			}
+		}
+	}
+	i.last = ts
+	i.lastKW = kw
+	i.hasLast = true
+}
+
+func (i *integrator) reset() {
+	*i = integrator{}
+}
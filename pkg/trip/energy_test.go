@@ -0,0 +1,79 @@
+package trip
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestIntegrator(t *testing.T) {
+	t0 := time.Date(2024, time.March, 5, 12, 0, 0, 0, time.UTC)
+	type sample struct {
+		offset time.Duration
+		kw     float64
+	}
+	tests := []struct {
+		name         string
+		samples      []sample
+		wantPositive float64
+		wantNegative float64
+		wantHasLast  bool
+	}{
+		{
+			name: "no samples",
+		},
+		{
+			name:        "a single sample has no duration",
+			samples:     []sample{{0, 50}},
+			wantHasLast: true,
+		},
+		{
+			name:         "each sample holds until the next one",
+			samples:      []sample{{0, 36}, {time.Second, 72}, {3 * time.Second, 0}},
+			wantPositive: (36*1 + 72*2) / 3600.0,
+			wantHasLast:  true,
+		},
+		{
+			name:         "negative power is counted separately",
+			samples:      []sample{{0, 36}, {2 * time.Second, -18}, {4 * time.Second, 36}, {5 * time.Second, 0}},
+			wantPositive: (36*2 + 36*1) / 3600.0,
+			wantNegative: 18 * 2 / 3600.0,
+			wantHasLast:  true,
+		},
+		{
+			name:         "a gap of exactly maxSampleGap is integrated",
+			samples:      []sample{{0, 36}, {maxSampleGap, 0}},
+			wantPositive: 36 * maxSampleGap.Hours(),
+			wantHasLast:  true,
+		},
+		{
+			name:         "a longer gap is skipped",
+			samples:      []sample{{0, 36}, {maxSampleGap + time.Millisecond, 36}, {maxSampleGap + time.Second + time.Millisecond, 0}},
+			wantPositive: 36 / 3600.0,
+			wantHasLast:  true,
+		},
+		{
+			name:        "samples out of order are skipped",
+			samples:     []sample{{time.Second, 36}, {0, 36}, {0, 0}},
+			wantHasLast: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var i integrator
+			for _, s := range tt.samples {
+				i.add(t0.Add(s.offset), s.kw)
+			}
+			if math.Abs(i.positive-tt.wantPositive) > 1e-12 || math.Abs(i.negative-tt.wantNegative) > 1e-12 {
+				t.Errorf("positive = %v, negative = %v, want %v and %v", i.positive, i.negative, tt.wantPositive, tt.wantNegative)
+			}
+			if i.hasLast != tt.wantHasLast {
+				t.Errorf("hasLast = %v, want %v", i.hasLast, tt.wantHasLast)
+			}
+			i.reset()
+			if i.positive != 0 || i.negative != 0 || i.hasLast {
+				t.Errorf("after reset = %+v, want zero", i)
+			}
+		})
+	}
+}
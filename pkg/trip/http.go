@@ -0,0 +1,106 @@
+package trip
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/slim-bean/leafbus/pkg/store"
+)
+
+const defaultTripDays = 30
+
+type tripsResponse struct {
+	Trips []store.Trip `json:"trips"`
+	Error string       `json:"error,omitempty"`
+}
+
+type tripResponse struct {
+	Trip  *store.Trip `json:"trip,omitempty"`
+	Error string      `json:"error,omitempty"`
+}
+
+// Register adds /trips which lists the trips that started in a time range, either ?date=2026-01-20 for a single
+// local day or ?from= and ?to= as RFC3339 timestamps, by default the last 30 days, and /trips/{id} for a single trip.
+func Register(mux *http.ServeMux, writer *store.Writer) {
+	if mux == nil {
+		mux = http.DefaultServeMux
+	}
+	mux.HandleFunc("/trips", func(response http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodGet {
+			log.Printf("trips: invalid method %s for /trips", request.Method)
+			response.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		start, end, err := parseRange(request)
+		if err != nil {
+			writeJSON(response, http.StatusBadRequest, tripsResponse{Trips: []store.Trip{}, Error: err.Error()})
+			return
+		}
+		ctx, cancel := context.WithTimeout(request.Context(), 5*time.Second)
+		defer cancel()
+		trips, err := writer.ListTrips(ctx, start, end)
+		if err != nil {
+			log.Println("trips: failed to list trips:", err)
+			writeJSON(response, http.StatusInternalServerError, tripsResponse{Trips: []store.Trip{}, Error: "failed to list trips"})
+			return
+		}
+		writeJSON(response, http.StatusOK, tripsResponse{Trips: trips})
+	})
+	mux.HandleFunc("GET /trips/{id}", func(response http.ResponseWriter, request *http.Request) {
+		id, err := strconv.ParseInt(request.PathValue("id"), 10, 64)
+		if err != nil {
+			writeJSON(response, http.StatusBadRequest, tripResponse{Error: "invalid trip id"})
+			return
+		}
+		ctx, cancel := context.WithTimeout(request.Context(), 5*time.Second)
+		defer cancel()
+		trip, ok, err := writer.GetTrip(ctx, id)
+		if err != nil {
+			log.Println("trips: failed to get trip:", err)
+			writeJSON(response, http.StatusInternalServerError, tripResponse{Error: "failed to get trip"})
+			return
+		}
+		if !ok {
+			writeJSON(response, http.StatusNotFound, tripResponse{Error: "trip not found"})
+			return
+		}
+		writeJSON(response, http.StatusOK, tripResponse{Trip: &trip})
+	})
+}
+
+func parseRange(request *http.Request) (time.Time, time.Time, error) {
+	query := request.URL.Query()
+	if date := query.Get("date"); date != "" {
+		day, err := time.ParseInLocation("2006-01-02", date, time.Local)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		return day, day.AddDate(0, 0, 1), nil
+	}
+	end := time.Now()
+	start := end.AddDate(0, 0, -defaultTripDays)
+	var err error
+	if raw := query.Get("from"); raw != "" {
+		if start, err = time.Parse(time.RFC3339, raw); err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+	}
+	if raw := query.Get("to"); raw != "" {
+		if end, err = time.Parse(time.RFC3339, raw); err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+	}
+	return start, end, nil
+}
+
+func writeJSON(response http.ResponseWriter, status int, body interface{}) {
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(status)
+	if err := json.NewEncoder(response).Encode(body); err != nil {
+		log.Println("trips: failed to write response:", err)
+	}
+}
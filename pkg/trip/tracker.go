@@ -0,0 +1,181 @@
+package trip
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/slim-bean/leafbus/pkg/store"
+)
+
+const (
+	earthRadiusMiles = 3958.8
+	// GPS fixes closer than this to the previous point are jitter rather than movement
+	minGPSStepMiles = 0.01
+)
+
+// Tracker follows the values needed to describe a trip, values are observed whether or not a trip is active
+// so a trip starts with the last value seen before the key was turned on.
+type Tracker struct {
+	mu sync.Mutex
+
+	active bool
+	trip   store.Trip
+
+	odometer *float64
+	gids     *float64
+	soc      *float64
+	lat      *float64
+	lon      *float64
+
+	gpsDistance float64
+	gpsLat      *float64
+	gpsLon      *float64
+
+	volts   *float64
+	battery integrator
+	climate integrator
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{}
+}
+
+// Observe records the value of a signal at ts, odometer, gids and soc describe the ends of a trip and
+// battery_volts, battery_amps and climate_control_kw are integrated into the energy used during it.
+func (t *Tracker) Observe(name string, ts time.Time, val float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch name {
+	case "odometer":
+		t.odometer = ptr(val)
+		if t.active && t.trip.StartOdometer == nil {
+			t.trip.StartOdometer = ptr(val)
+		}
+	case "gids":
+		t.gids = ptr(val)
+		if t.active && t.trip.StartGids == nil {
+			t.trip.StartGids = ptr(val)
+		}
+	case "soc":
+		t.soc = ptr(val)
+		if t.active && t.trip.StartSOC == nil {
+			t.trip.StartSOC = ptr(val)
+		}
+	case "battery_volts":
+		t.volts = ptr(val)
+	case "battery_amps":
+		// Positive current is discharge, negative is regen or charging
+		if t.active && t.volts != nil {
+			t.battery.add(ts, *t.volts*val/1000)
+		}
+	case "climate_control_kw":
+		if t.active {
+			t.climate.add(ts, val)
+		}
+	}
+}
+
+// ObserveGPS records the position and adds the distance travelled to an active trip.
+func (t *Tracker) ObserveGPS(lat float64, lon float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lat = ptr(lat)
+	t.lon = ptr(lon)
+	if !t.active {
+		return
+	}
+	if t.trip.StartLat == nil {
+		t.trip.StartLat = ptr(lat)
+		t.trip.StartLon = ptr(lon)
+	}
+	if t.gpsLat == nil {
+		t.gpsLat = ptr(lat)
+		t.gpsLon = ptr(lon)
+		return
+	}
+	if step := Haversine(*t.gpsLat, *t.gpsLon, lat, lon); step >= minGPSStepMiles {
+		t.gpsDistance += step
+		t.gpsLat = ptr(lat)
+		t.gpsLon = ptr(lon)
+	}
+}
+
+// Start begins a trip at ts, an active trip is discarded.
+func (t *Tracker) Start(ts time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.active = true
+	t.trip = store.Trip{
+		Start:         ts.UTC(),
+		StartOdometer: t.odometer,
+		StartGids:     t.gids,
+		StartSOC:      t.soc,
+		StartLat:      t.lat,
+		StartLon:      t.lon,
+	}
+	t.gpsDistance = 0
+	t.gpsLat = t.lat
+	t.gpsLon = t.lon
+	t.battery.reset()
+	t.climate.reset()
+}
+
+// Finish ends the active trip at ts, it returns false if no trip was started.
+func (t *Tracker) Finish(ts time.Time) (store.Trip, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.active {
+		return store.Trip{}, false
+	}
+	t.active = false
+	trip := t.trip
+	trip.End = ts.UTC()
+	trip.EndOdometer = t.odometer
+	trip.EndGids = t.gids
+	trip.EndSOC = t.soc
+	trip.EndLat = t.lat
+	trip.EndLon = t.lon
+	if trip.StartOdometer != nil && trip.EndOdometer != nil {
+		trip.DistanceMiles = ptr(*trip.EndOdometer - *trip.StartOdometer)
+	}
+	if trip.StartLat != nil {
+		trip.GPSDistanceMiles = ptr(t.gpsDistance)
+	}
+	if trip.StartGids != nil && trip.EndGids != nil {
+		trip.GidsUsed = ptr(*trip.StartGids - *trip.EndGids)
+	}
+	if trip.StartSOC != nil && trip.EndSOC != nil {
+		trip.SOCDelta = ptr(*trip.StartSOC - *trip.EndSOC)
+	}
+	if t.battery.hasLast {
+		trip.KWhUsed = ptr(t.battery.positive)
+		trip.KWhRegen = ptr(t.battery.negative)
+		trip.KWhNet = ptr(t.battery.positive - t.battery.negative)
+		distance := trip.DistanceMiles
+		if distance == nil {
+			distance = trip.GPSDistanceMiles
+		}
+		if distance != nil && *trip.KWhNet > 0 {
+			trip.MilesPerKWh = ptr(*distance / *trip.KWhNet)
+		}
+	}
+	if t.climate.hasLast {
+		trip.ClimateKWh = ptr(t.climate.positive)
+	}
+	return trip, true
+}
+
+// Haversine returns the great circle distance between two points in miles.
+func Haversine(lat1 float64, lon1 float64, lat2 float64, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusMiles * math.Asin(math.Sqrt(a))
+}
+
+func ptr(val float64) *float64 {
+	return &val
+}
@@ -0,0 +1,241 @@
+package trip
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/slim-bean/leafbus/pkg/store"
+)
+
+func TestTracker(t *testing.T) {
+	t0 := time.Date(2024, time.March, 5, 12, 0, 0, 0, time.UTC)
+	at := func(seconds int) time.Time {
+		return t0.Add(time.Duration(seconds) * time.Second)
+	}
+	// 0.001 degrees of latitude is about 0.069 miles, 0.0001 is below minGPSStepMiles
+	step := Haversine(45, -122, 45.001, -122)
+	tests := []struct {
+		name   string
+		run    func(tr *Tracker)
+		finish time.Time
+		want   store.Trip
+		wantOK bool
+	}{
+		{
+			name:   "no trip started",
+			run:    func(tr *Tracker) { tr.Observe("odometer", at(0), 1000) },
+			finish: at(10),
+		},
+		{
+			name: "values seen before the key was turned on start the trip",
+			run: func(tr *Tracker) {
+				tr.Observe("odometer", at(0), 1000)
+				tr.Observe("gids", at(0), 200)
+				tr.Observe("soc", at(0), 80.5)
+				tr.Start(at(1))
+				tr.Observe("odometer", at(60), 1012)
+				tr.Observe("gids", at(60), 180)
+				tr.Observe("soc", at(60), 75.25)
+			},
+			finish: at(61),
+			want: store.Trip{
+				Start:         at(1),
+				End:           at(61),
+				StartOdometer: ptr(1000),
+				EndOdometer:   ptr(1012),
+				DistanceMiles: ptr(12),
+				StartGids:     ptr(200),
+				EndGids:       ptr(180),
+				GidsUsed:      ptr(20),
+				StartSOC:      ptr(80.5),
+				EndSOC:        ptr(75.25),
+				SOCDelta:      ptr(5.25),
+			},
+			wantOK: true,
+		},
+		{
+			name: "values first seen during the trip start it",
+			run: func(tr *Tracker) {
+				tr.Start(at(0))
+				tr.Observe("odometer", at(5), 1000)
+				tr.Observe("odometer", at(60), 1003)
+				tr.Observe("soc", at(60), 70)
+			},
+			finish: at(61),
+			want: store.Trip{
+				Start:         at(0),
+				End:           at(61),
+				StartOdometer: ptr(1000),
+				EndOdometer:   ptr(1003),
+				DistanceMiles: ptr(3),
+				StartSOC:      ptr(70),
+				EndSOC:        ptr(70),
+				SOCDelta:      ptr(0),
+			},
+			wantOK: true,
+		},
+		{
+			name: "a second start discards the active trip",
+			run: func(tr *Tracker) {
+				tr.Observe("odometer", at(0), 1000)
+				tr.Start(at(0))
+				tr.Observe("odometer", at(30), 1005)
+				tr.Start(at(40))
+				tr.Observe("odometer", at(60), 1007)
+			},
+			finish: at(61),
+			want: store.Trip{
+				Start:         at(40),
+				End:           at(61),
+				StartOdometer: ptr(1005),
+				EndOdometer:   ptr(1007),
+				DistanceMiles: ptr(2),
+			},
+			wantOK: true,
+		},
+		{
+			name: "gps jitter is not counted as distance",
+			run: func(tr *Tracker) {
+				tr.ObserveGPS(45, -122)
+				tr.Start(at(0))
+				tr.ObserveGPS(45.0001, -122)
+				tr.ObserveGPS(45.001, -122)
+				tr.ObserveGPS(45.0011, -122)
+			},
+			finish: at(60),
+			want: store.Trip{
+				Start:            at(0),
+				End:              at(60),
+				GPSDistanceMiles: ptr(step),
+				StartLat:         ptr(45),
+				StartLon:         ptr(-122),
+				EndLat:           ptr(45.0011),
+				EndLon:           ptr(-122),
+			},
+			wantOK: true,
+		},
+		{
+			name: "gps first seen during the trip starts it",
+			run: func(tr *Tracker) {
+				tr.Start(at(0))
+				tr.ObserveGPS(45, -122)
+				tr.ObserveGPS(45.001, -122)
+			},
+			finish: at(60),
+			want: store.Trip{
+				Start:            at(0),
+				End:              at(60),
+				GPSDistanceMiles: ptr(step),
+				StartLat:         ptr(45),
+				StartLon:         ptr(-122),
+				EndLat:           ptr(45.001),
+				EndLon:           ptr(-122),
+			},
+			wantOK: true,
+		},
+		{
+			name: "energy is only integrated during the trip once the voltage is known",
+			run: func(tr *Tracker) {
+				tr.Observe("odometer", at(0), 1000)
+				tr.Observe("battery_volts", at(0), 400)
+				tr.Observe("battery_amps", at(0), 100)
+				tr.Start(at(1))
+				// 40 kW for 3 seconds, then 20 kW of regen for 2 seconds
+				tr.Observe("battery_amps", at(1), 100)
+				tr.Observe("battery_amps", at(4), -50)
+				tr.Observe("climate_control_kw", at(4), 1.8)
+				tr.Observe("battery_amps", at(6), 0)
+				tr.Observe("climate_control_kw", at(6), 0)
+				tr.Observe("odometer", at(6), 1000.5)
+			},
+			finish: at(7),
+			want: store.Trip{
+				Start:         at(1),
+				End:           at(7),
+				StartOdometer: ptr(1000),
+				EndOdometer:   ptr(1000.5),
+				DistanceMiles: ptr(0.5),
+				KWhUsed:       ptr(40 * 3.0 / 3600),
+				KWhRegen:      ptr(20 * 2.0 / 3600),
+				KWhNet:        ptr((40*3.0 - 20*2.0) / 3600),
+				ClimateKWh:    ptr(1.8 * 2 / 3600),
+				MilesPerKWh:   ptr(0.5 / ((40*3.0 - 20*2.0) / 3600)),
+			},
+			wantOK: true,
+		},
+		{
+			name: "no miles per kWh when more energy was regenerated than used",
+			run: func(tr *Tracker) {
+				tr.Observe("odometer", at(0), 1000)
+				tr.Observe("battery_volts", at(0), 400)
+				tr.Start(at(0))
+				tr.Observe("battery_amps", at(1), -50)
+				tr.Observe("battery_amps", at(2), 0)
+			},
+			finish: at(3),
+			want: store.Trip{
+				Start:         at(0),
+				End:           at(3),
+				StartOdometer: ptr(1000),
+				EndOdometer:   ptr(1000),
+				DistanceMiles: ptr(0),
+				KWhUsed:       ptr(0),
+				KWhRegen:      ptr(20.0 / 3600),
+				KWhNet:        ptr(-20.0 / 3600),
+			},
+			wantOK: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := NewTracker()
+			tt.run(tr)
+			got, ok := tr.Finish(tt.finish)
+			if ok != tt.wantOK {
+				t.Fatalf("Finish() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if err := compareTrips(got, tt.want); err != nil {
+				t.Error(err)
+			}
+			// A trip is only finished once
+			if _, ok := tr.Finish(tt.finish); ok {
+				t.Error("second Finish() ok = true, want false")
+			}
+		})
+	}
+}
+
+// compareTrips compares the fields of two trips, allowing for rounding in the distances and energy.
+func compareTrips(got store.Trip, want store.Trip) error {
+	gv, wv := reflect.ValueOf(got), reflect.ValueOf(want)
+	for i := 0; i < gv.NumField(); i++ {
+		name := gv.Type().Field(i).Name
+		g, w := gv.Field(i).Interface(), wv.Field(i).Interface()
+		gp, ok := g.(*float64)
+		if !ok {
+			if !reflect.DeepEqual(g, w) {
+				return fmt.Errorf("%s = %v, want %v", name, g, w)
+			}
+			continue
+		}
+		wp := w.(*float64)
+		switch {
+		case gp == nil && wp == nil:
+		case gp == nil || wp == nil:
+			return fmt.Errorf("%s = %s, want %s", name, format(gp), format(wp))
+		case math.Abs(*gp-*wp) > 1e-9:
+			return fmt.Errorf("%s = %v, want %v", name, *gp, *wp)
+		}
+	}
+	return nil
+}
+
+func format(val *float64) string {
+	if val == nil {
+		return "nil"
+	}
+	return fmt.Sprint(*val)
+}
@@ -0,0 +1,110 @@
+package uds
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/slim-bean/leafbus/pkg/isotp"
+)
+
+const (
+	ServiceDiagnosticSession         = 0x10
+	ServiceReadDataByLocalIdentifier = 0x21
+	ServiceReadDataByIdentifier      = 0x22
+	ServiceTesterPresent             = 0x3E
+	negativeResponse                 = 0x7F
+	positiveResponseOffset           = 0x40
+	nrcResponsePending               = 0x78
+	defaultPendingTimeout            = 5 * time.Second
+)
+
+// Transport sends a request and receives the responses of an ECU, isotp.Conn satisfies it.
+type Transport interface {
+	Send(payload []byte) error
+	Receive() ([]byte, error)
+}
+
+// NegativeResponseError is returned when the ECU rejects a request.
+type NegativeResponseError struct {
+	Service byte
+	Code    byte
+}
+
+func (e *NegativeResponseError) Error() string {
+	return fmt.Sprintf("uds: service %#02x negative response %#02x", e.Service, e.Code)
+}
+
+// Client sends diagnostic requests to a single ECU.
+type Client struct {
+	transport Transport
+	// PendingTimeout bounds how long the ECU may keep answering with response pending (0x78).
+	PendingTimeout time.Duration
+}
+
+func NewClient(transport Transport) *Client {
+	return &Client{
+		transport:      transport,
+		PendingTimeout: defaultPendingTimeout,
+	}
+}
+
+// Request sends service with data and returns the positive response without the service byte.
+func (c *Client) Request(service byte, data ...byte) ([]byte, error) {
+	if err := c.transport.Send(append([]byte{service}, data...)); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(c.PendingTimeout)
+	pending := false
+	for {
+		resp, err := c.transport.Receive()
+		if errors.Is(err, isotp.ErrTimeout) && pending && time.Now().Before(deadline) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(resp) == 0 {
+			return nil, fmt.Errorf("uds: empty response to service %#02x", service)
+		}
+		switch {
+		case resp[0] == negativeResponse && len(resp) >= 3 && resp[1] == service:
+			if resp[2] == nrcResponsePending && time.Now().Before(deadline) {
+				pending = true
+				continue
+			}
+			return nil, &NegativeResponseError{Service: service, Code: resp[2]}
+		case resp[0] == service+positiveResponseOffset:
+			return resp[1:], nil
+		default:
+			// Response to a different request, e.g. one which timed out earlier
+			if time.Now().After(deadline) {
+				return nil, fmt.Errorf("uds: no response to service %#02x", service)
+			}
+		}
+	}
+}
+
+// ReadDataByLocalIdentifier requests a KWP2000 style record (0x21), the response excludes the identifier.
+func (c *Client) ReadDataByLocalIdentifier(id byte) ([]byte, error) {
+	resp, err := c.Request(ServiceReadDataByLocalIdentifier, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 1 || resp[0] != id {
+		return nil, fmt.Errorf("uds: response for local identifier %#02x does not match", id)
+	}
+	return resp[1:], nil
+}
+
+// ReadDataByIdentifier requests a data identifier (0x22), the response excludes the identifier.
+func (c *Client) ReadDataByIdentifier(did uint16) ([]byte, error) {
+	resp, err := c.Request(ServiceReadDataByIdentifier, byte(did>>8), byte(did))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 2 || uint16(resp[0])<<8|uint16(resp[1]) != did {
+		return nil, fmt.Errorf("uds: response for identifier %#04x does not match", did)
+	}
+	return resp[2:], nil
+}